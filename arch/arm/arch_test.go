@@ -4,13 +4,14 @@ import (
 	"testing"
 )
 
-var testAsm = `
-mov r1, 100
-l1: subs r1, 1
-    bge l1
-`
+// testCode is a countdown loop.
+var testCode = []byte{
+	0x64, 0x10, 0xa0, 0xe3, // mov r1, 100
+	0x01, 0x10, 0x51, 0xe2, // l1: subs r1, 1
+	0xfd, 0xff, 0xff, 0xaa, // bge l1
+}
 
 func TestArm(t *testing.T)          { Arch.SmokeTest(t) }
-func TestArmExec(t *testing.T)      { Arch.TestExec(t, testAsm) }
+func TestArmExec(t *testing.T)      { Arch.TestExec(t, testCode) }
 func BenchmarkArmRegs(b *testing.B) { Arch.BenchRegs(b) }
-func BenchmarkArmExec(b *testing.B) { Arch.BenchExec(b, testAsm) }
+func BenchmarkArmExec(b *testing.B) { Arch.BenchExec(b, testCode) }
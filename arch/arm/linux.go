@@ -0,0 +1,206 @@
+package arm
+
+import (
+	"io"
+
+	"github.com/felberj/binemu/cpu"
+	"github.com/felberj/binemu/kernel/common"
+	"github.com/felberj/binemu/kernel/linux"
+	"github.com/felberj/binemu/models"
+	"github.com/pkg/errors"
+
+	uc "github.com/felberj/binemu/cpu/unicorn"
+	sysnum "github.com/lunixbochs/ghostrace/ghost/sys/num"
+)
+
+var LinuxRegs = []int{uc.ARM_REG_R0, uc.ARM_REG_R1, uc.ARM_REG_R2, uc.ARM_REG_R3, uc.ARM_REG_R4, uc.ARM_REG_R5, uc.ARM_REG_R6}
+
+// ARM private syscalls live above __ARM_NR_BASE and are not part of the generic table.
+const armNrBase = 0x0f0000
+
+var armPrivateSyscalls = map[int]string{
+	armNrBase + 1: "breakpoint",
+	armNrBase + 2: "cacheflush",
+	armNrBase + 5: "set_tls",
+	armNrBase + 6: "get_tls",
+}
+
+// kuser helpers, see Documentation/arm/kernel_user_helpers.txt
+const (
+	kuserBase          = 0xffff0000
+	kuserVersion       = 0xffff0ffc
+	kuserGetTls        = 0xffff0fe0
+	kuserCmpxchg       = 0xffff0fc0
+	kuserMemoryBarrier = 0xffff0fa0
+	kuserCmpxchg64     = 0xffff0f60
+
+	cpsrCarry = 1 << 29
+)
+
+// ArmLinuxKernel implements the ARM private syscalls.
+type ArmLinuxKernel struct {
+	*linux.LinuxKernel
+}
+
+// SetTls syscall
+func (k *ArmLinuxKernel) SetTls(addr uint64) uint64 {
+	if err := k.U.RegWrite(uc.ARM_REG_C13_C0_3, addr); err != nil {
+		return linux.MinusOne
+	}
+	return 0
+}
+
+// GetTls syscall
+func (k *ArmLinuxKernel) GetTls() uint64 {
+	tls, _ := k.U.RegRead(uc.ARM_REG_C13_C0_3)
+	return tls
+}
+
+// Cacheflush syscall (unicorn invalidates translated blocks on write)
+func (k *ArmLinuxKernel) Cacheflush(start, end, flags uint64) uint64 {
+	return 0
+}
+
+// Breakpoint syscall
+func (k *ArmLinuxKernel) Breakpoint() {
+	k.U.Exit(errors.New("breakpoint trap"))
+}
+
+func kuserCmpxchgOp(u models.Usercorn, oldval, newval []byte, ptr uint64) (bool, error) {
+	cur := make([]byte, len(oldval))
+	mem := u.Mem()
+	mem.Seek(int64(ptr), io.SeekStart)
+	if _, err := mem.Read(cur); err != nil {
+		return false, err
+	}
+	if string(cur) != string(oldval) {
+		return false, nil
+	}
+	mem.Seek(int64(ptr), io.SeekStart)
+	_, err := mem.Write(newval)
+	return err == nil, err
+}
+
+func readRegs(u models.Usercorn, enums ...int) []uint64 {
+	vals := make([]uint64, len(enums))
+	for i, enum := range enums {
+		vals[i], _ = u.RegRead(enum)
+	}
+	return vals
+}
+
+func setCarry(u models.Usercorn, set bool) {
+	cpsr, _ := u.RegRead(uc.ARM_REG_CPSR)
+	if set {
+		cpsr |= cpsrCarry
+	} else {
+		cpsr &^= cpsrCarry
+	}
+	u.RegWrite(uc.ARM_REG_CPSR, cpsr)
+}
+
+// setupKuser maps the kuser helper page. Every helper is a `bx lr` that is
+// trapped by a code hook so the operation itself happens in Go.
+func setupKuser(u models.Usercorn) error {
+	if err := u.MemMap(kuserBase, 0x1000, cpu.PROT_READ|cpu.PROT_EXEC); err != nil {
+		return err
+	}
+	var tmp [4]byte
+	bxlr := make([]byte, 4)
+	u.ByteOrder().PutUint32(bxlr, 0xe12fff1e)
+	mem := u.Mem()
+	for _, addr := range []uint64{kuserGetTls, kuserCmpxchg, kuserMemoryBarrier, kuserCmpxchg64} {
+		mem.Seek(int64(addr), io.SeekStart)
+		if _, err := mem.Write(bxlr); err != nil {
+			return err
+		}
+	}
+	u.ByteOrder().PutUint32(tmp[:], 5)
+	mem.Seek(kuserVersion, io.SeekStart)
+	if _, err := mem.Write(tmp[:]); err != nil {
+		return err
+	}
+	_, err := u.GetCPU().HookCode(func(addr uint64, size uint32) {
+		switch addr {
+		case kuserGetTls:
+			tls, _ := u.RegRead(uc.ARM_REG_C13_C0_3)
+			u.RegWrite(uc.ARM_REG_R0, tls)
+		case kuserCmpxchg:
+			regs := readRegs(u, uc.ARM_REG_R0, uc.ARM_REG_R1, uc.ARM_REG_R2)
+			var oldval, newval [4]byte
+			u.ByteOrder().PutUint32(oldval[:], uint32(regs[0]))
+			u.ByteOrder().PutUint32(newval[:], uint32(regs[1]))
+			ok, _ := kuserCmpxchgOp(u, oldval[:], newval[:], regs[2])
+			if ok {
+				u.RegWrite(uc.ARM_REG_R0, 0)
+			} else {
+				u.RegWrite(uc.ARM_REG_R0, 1)
+			}
+			setCarry(u, ok)
+		case kuserCmpxchg64:
+			regs := readRegs(u, uc.ARM_REG_R0, uc.ARM_REG_R1, uc.ARM_REG_R2)
+			oldval, newval := make([]byte, 8), make([]byte, 8)
+			mem := u.Mem()
+			mem.Seek(int64(regs[0]), io.SeekStart)
+			mem.Read(oldval)
+			mem.Seek(int64(regs[1]), io.SeekStart)
+			mem.Read(newval)
+			ok, _ := kuserCmpxchgOp(u, oldval, newval, regs[2])
+			if ok {
+				u.RegWrite(uc.ARM_REG_R0, 0)
+			} else {
+				u.RegWrite(uc.ARM_REG_R0, 1)
+			}
+			setCarry(u, ok)
+		case kuserMemoryBarrier:
+		}
+	}, kuserBase, kuserBase+0x1000)
+	return errors.Wrap(err, "u.HookAdd() failed")
+}
+
+func LinuxKernels(u models.Usercorn) []interface{} {
+	kernel := &ArmLinuxKernel{LinuxKernel: linux.NewKernel(u.Fs())}
+	return []interface{}{kernel}
+}
+
+func LinuxInit(u models.Usercorn, args, env []string) error {
+	if err := EnableFPU(u); err != nil {
+		return err
+	}
+	if err := setupKuser(u); err != nil {
+		return err
+	}
+	return linux.StackInit(u, args, env)
+}
+
+func LinuxSyscall(u models.Usercorn) {
+	// EABI passes the syscall number in r7 and always uses `svc #0`
+	num, _ := u.RegRead(uc.ARM_REG_R7)
+	name, ok := armPrivateSyscalls[int(num)]
+	if !ok {
+		name, _ = sysnum.Linux_arm[int(num)]
+	}
+	ret, _ := u.Syscall(int(num), name, common.RegArgs(u, LinuxRegs))
+	u.RegWrite(uc.ARM_REG_R0, ret)
+}
+
+func LinuxInterrupt(u models.Usercorn, intno uint32) {
+	switch intno {
+	case 2: // EXCP_SWI
+		LinuxSyscall(u)
+	case 7: // EXCP_BKPT
+		u.Exit(models.Signal(linux.SIGTRAP))
+	default:
+		// undefined instructions and anything else the kernel doesn't route
+		u.Exit(models.Signal(linux.SIGILL))
+	}
+}
+
+func init() {
+	Arch.RegisterOS(&models.OS{
+		Name:      "linux",
+		Kernels:   LinuxKernels,
+		Init:      LinuxInit,
+		Interrupt: LinuxInterrupt,
+	})
+}
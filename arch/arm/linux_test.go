@@ -0,0 +1,119 @@
+package arm
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/felberj/binemu/cpu"
+	"github.com/felberj/binemu/models"
+
+	uc "github.com/felberj/binemu/cpu/unicorn"
+)
+
+// armUsercorn runs the kuser helpers on a bare CPU and records why the
+// guest was stopped.
+type armUsercorn struct {
+	models.Usercorn
+	c   *cpu.Cpu
+	err error
+}
+
+func (u *armUsercorn) RegRead(reg int) (uint64, error)          { return u.c.RegRead(reg) }
+func (u *armUsercorn) RegWrite(reg int, val uint64) error       { return u.c.RegWrite(reg, val) }
+func (u *armUsercorn) MemMap(addr, size uint64, prot int) error { return u.c.MemMap(addr, size, prot) }
+func (u *armUsercorn) Mem() io.ReadWriteSeeker                  { return u.c.Mem() }
+func (u *armUsercorn) ByteOrder() binary.ByteOrder              { return binary.LittleEndian }
+func (u *armUsercorn) GetCPU() *cpu.Cpu                         { return u.c }
+func (u *armUsercorn) Exit(err error)                           { u.err = err }
+
+func TestArmKuser(t *testing.T) {
+	c, err := Arch.Cpu.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &armUsercorn{c: c}
+	if err := setupKuser(u); err != nil {
+		t.Fatal(err)
+	}
+	blx := func(rm uint32) uint32 { return 0xe12fff30 | rm }              // blx rm
+	mov := func(rd, rm uint32) uint32 { return 0xe1a00000 | rd<<12 | rm } // mov rd, rm
+	cmpxchg := []uint32{mov(0, 6), mov(1, 7), mov(2, 8), blx(9)}
+	code := []uint32{blx(4), mov(5, 0)}
+	// the first exchange succeeds and sets the carry, the second one sees
+	// the new value and fails
+	code = append(code, cmpxchg...)
+	code = append(code, mov(10, 0), 0x23a0b001) // movcs r11, #1
+	code = append(code, cmpxchg...)
+	code = append(code, mov(12, 0))
+
+	const base, data = 0x10000, 0x20000
+	if err := c.MemMap(base, 0x1000, cpu.PROT_READ|cpu.PROT_EXEC); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.MemMap(data, 0x1000, cpu.PROT_READ|cpu.PROT_WRITE); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(code)*4)
+	for i, insn := range code {
+		binary.LittleEndian.PutUint32(buf[i*4:], insn)
+	}
+	if err := c.MemWrite(base, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.MemWrite(data, []byte{1, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	for reg, val := range map[int]uint64{
+		uc.ARM_REG_C13_C0_3: 0x1234,
+		uc.ARM_REG_R4:       kuserGetTls,
+		uc.ARM_REG_R6:       1,
+		uc.ARM_REG_R7:       2,
+		uc.ARM_REG_R8:       data,
+		uc.ARM_REG_R9:       kuserCmpxchg,
+		uc.ARM_REG_R12:      0xff,
+	} {
+		c.RegWrite(reg, val)
+	}
+	if err := c.Start(base, base+uint64(len(buf))); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []struct {
+		name string
+		reg  int
+		want uint64
+	}{
+		{"__kuser_get_tls", uc.ARM_REG_R5, 0x1234},
+		{"successful __kuser_cmpxchg", uc.ARM_REG_R10, 0},
+		{"carry after success", uc.ARM_REG_R11, 1},
+		{"failed __kuser_cmpxchg", uc.ARM_REG_R12, 1},
+	} {
+		if got, _ := c.RegRead(r.reg); got != r.want {
+			t.Errorf("%s is %#x, want %#x", r.name, got, r.want)
+		}
+	}
+	if cpsr, _ := c.RegRead(uc.ARM_REG_CPSR); cpsr&cpsrCarry != 0 {
+		t.Errorf("carry is set after a failed __kuser_cmpxchg")
+	}
+	val, err := c.MemRead(data, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := binary.LittleEndian.Uint32(val); got != 2 {
+		t.Errorf("*ptr is %d after the exchange, want 2", got)
+	}
+}
+
+func TestArmUnhandledInterrupt(t *testing.T) {
+	for _, c := range []struct {
+		intno uint32
+		sig   models.Signal
+	}{{7, 5}, {1, 4}, {5, 4}} {
+		u := &armUsercorn{}
+		LinuxInterrupt(u, c.intno)
+		if u.err != c.sig {
+			t.Errorf("interrupt %d stopped with %v, want %v", c.intno, u.err, c.sig)
+		}
+	}
+}
@@ -49,6 +49,42 @@ var Arch = &models.Arch{
 		"lr":  uc.ARM64_REG_LR,
 		"sp":  uc.ARM64_REG_SP,
 		"pc":  uc.ARM64_REG_PC,
+
+		"nzcv":      uc.ARM64_REG_NZCV,
+		"tpidr_el0": uc.ARM64_REG_TPIDR_EL0,
+
+		"d0":  uc.ARM64_REG_D0,
+		"d1":  uc.ARM64_REG_D1,
+		"d2":  uc.ARM64_REG_D2,
+		"d3":  uc.ARM64_REG_D3,
+		"d4":  uc.ARM64_REG_D4,
+		"d5":  uc.ARM64_REG_D5,
+		"d6":  uc.ARM64_REG_D6,
+		"d7":  uc.ARM64_REG_D7,
+		"d8":  uc.ARM64_REG_D8,
+		"d9":  uc.ARM64_REG_D9,
+		"d10": uc.ARM64_REG_D10,
+		"d11": uc.ARM64_REG_D11,
+		"d12": uc.ARM64_REG_D12,
+		"d13": uc.ARM64_REG_D13,
+		"d14": uc.ARM64_REG_D14,
+		"d15": uc.ARM64_REG_D15,
+		"d16": uc.ARM64_REG_D16,
+		"d17": uc.ARM64_REG_D17,
+		"d18": uc.ARM64_REG_D18,
+		"d19": uc.ARM64_REG_D19,
+		"d20": uc.ARM64_REG_D20,
+		"d21": uc.ARM64_REG_D21,
+		"d22": uc.ARM64_REG_D22,
+		"d23": uc.ARM64_REG_D23,
+		"d24": uc.ARM64_REG_D24,
+		"d25": uc.ARM64_REG_D25,
+		"d26": uc.ARM64_REG_D26,
+		"d27": uc.ARM64_REG_D27,
+		"d28": uc.ARM64_REG_D28,
+		"d29": uc.ARM64_REG_D29,
+		"d30": uc.ARM64_REG_D30,
+		"d31": uc.ARM64_REG_D31,
 	},
 	DefaultRegs: []string{
 		"x0", "x1", "x2", "x3", "x4", "x5", "x6", "x7", "x8",
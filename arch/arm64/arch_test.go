@@ -4,14 +4,14 @@ import (
 	"testing"
 )
 
-var testAsm = `
-mov x1, 100
-l1:
-subs x1, x1, 1
-bge l1
-`
+// testCode is a countdown loop.
+var testCode = []byte{
+	0x81, 0x0c, 0x80, 0xd2, // mov x1, 100
+	0x21, 0x04, 0x00, 0xf1, // l1: subs x1, x1, 1
+	0xea, 0xff, 0xff, 0x54, // bge l1
+}
 
 func TestArm64(t *testing.T)          { Arch.SmokeTest(t) }
-func TestArm64Exec(t *testing.T)      { Arch.TestExec(t, testAsm) }
+func TestArm64Exec(t *testing.T)      { Arch.TestExec(t, testCode) }
 func BenchmarkArm64Regs(b *testing.B) { Arch.BenchRegs(b) }
-func BenchmarkArm64Exec(b *testing.B) { Arch.BenchExec(b, testAsm) }
+func BenchmarkArm64Exec(b *testing.B) { Arch.BenchExec(b, testCode) }
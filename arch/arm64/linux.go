@@ -1,8 +1,6 @@
 package arm64
 
 import (
-	"fmt"
-
 	uc "github.com/felberj/binemu/cpu/unicorn"
 	sysnum "github.com/lunixbochs/ghostrace/ghost/sys/num"
 
@@ -15,11 +13,14 @@ var LinuxRegs = []int{uc.ARM64_REG_X0, uc.ARM64_REG_X1, uc.ARM64_REG_X2, uc.ARM6
 
 type Arm64LinuxKernel struct {
 	*linux.LinuxKernel
-	tls uint64
 }
 
-func (k *Arm64LinuxKernel) SetTls(addr uint64) {
-	k.tls = addr
+// SetTls stores the thread pointer in TPIDR_EL0, where `mrs x0, tpidr_el0` reads it.
+func (k *Arm64LinuxKernel) SetTls(addr uint64) uint64 {
+	if err := k.U.RegWrite(uc.ARM64_REG_TPIDR_EL0, addr); err != nil {
+		return linux.MinusOne
+	}
+	return 0
 }
 
 func LinuxKernels(u models.Usercorn) []interface{} {
@@ -40,13 +41,20 @@ func LinuxSyscall(u models.Usercorn, num int) {
 	u.RegWrite(uc.ARM64_REG_X0, ret)
 }
 
+// LinuxInterrupt handles the exceptions Unicorn raises for aarch64.
+// The numbers are QEMU's EXCP_* values: `svc #0` raises EXCP_SWI with
+// PC already pointing past the instruction.
 func LinuxInterrupt(u models.Usercorn, intno uint32) {
-	if intno == 2 {
+	switch intno {
+	case 2: // EXCP_SWI
 		num, _ := u.RegRead(uc.ARM64_REG_X8)
 		LinuxSyscall(u, int(num))
-		return
+	case 7: // EXCP_BKPT
+		u.Exit(models.Signal(linux.SIGTRAP))
+	default:
+		// undefined instructions and anything else the kernel doesn't route
+		u.Exit(models.Signal(linux.SIGILL))
 	}
-	panic(fmt.Sprintf("unhandled ARM interrupt: %d", intno))
 }
 
 func init() {
@@ -0,0 +1,76 @@
+package arm64
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/felberj/binemu/cpu"
+	"github.com/felberj/binemu/kernel/linux"
+	"github.com/felberj/binemu/models"
+
+	uc "github.com/felberj/binemu/cpu/unicorn"
+)
+
+// exitUsercorn records why the guest was stopped.
+type exitUsercorn struct {
+	models.Usercorn
+	err error
+}
+
+func (u *exitUsercorn) Exit(err error) { u.err = err }
+
+func TestArm64UnhandledInterrupt(t *testing.T) {
+	for _, c := range []struct {
+		intno uint32
+		sig   models.Signal
+	}{{7, 5}, {1, 4}, {5, 4}} {
+		u := &exitUsercorn{}
+		LinuxInterrupt(u, c.intno)
+		if u.err != c.sig {
+			t.Errorf("interrupt %d stopped with %v, want %v", c.intno, u.err, c.sig)
+		}
+	}
+}
+
+// regUsercorn runs on a bare CPU.
+type regUsercorn struct {
+	models.Usercorn
+	c *cpu.Cpu
+}
+
+func (u *regUsercorn) RegRead(reg int) (uint64, error)    { return u.c.RegRead(reg) }
+func (u *regUsercorn) RegWrite(reg int, val uint64) error { return u.c.RegWrite(reg, val) }
+func (u *regUsercorn) GetCPU() *cpu.Cpu                   { return u.c }
+func (u *regUsercorn) ByteOrder() binary.ByteOrder        { return binary.LittleEndian }
+
+func TestArm64Sigcontext(t *testing.T) {
+	c, err := Arch.Cpu.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &regUsercorn{c: c}
+	if err := EnableFPU(u); err != nil {
+		t.Fatal(err)
+	}
+	c.RegWrite(uc.ARM64_REG_X3, 0x33)
+	c.RegWrite(uc.ARM64_REG_LR, 0x1234)
+	if err := c.RegWrite128(uc.ARM64_REG_Q31, 0x1111, 0x2222); err != nil {
+		t.Fatal(err)
+	}
+	sc, err := Sigcontext(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.Regs[3] != 0x33 || sc.Regs[30] != 0x1234 {
+		t.Errorf("wrong registers: x3 %#x, lr %#x", sc.Regs[3], sc.Regs[30])
+	}
+	le := binary.LittleEndian
+	if magic, size := le.Uint32(sc.Reserved[:]), le.Uint32(sc.Reserved[4:]); magic != linux.FPSIMD_MAGIC || size != 528 {
+		t.Fatalf("fpsimd_context has magic %#x and size %d", magic, size)
+	}
+	// the high half of q31 ends the record
+	q31 := sc.Reserved[16+31*16:]
+	if lo, hi := le.Uint64(q31), le.Uint64(q31[8:]); lo != 0x1111 || hi != 0x2222 {
+		t.Errorf("q31 is %#x:%#x, want 0x2222:0x1111", hi, lo)
+	}
+}
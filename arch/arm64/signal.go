@@ -0,0 +1,47 @@
+package arm64
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/felberj/binemu/kernel/linux"
+	"github.com/felberj/binemu/models"
+
+	uc "github.com/felberj/binemu/cpu/unicorn"
+)
+
+// Sigcontext saves the registers of u the way the kernel does in a signal
+// frame. The reserved area gets an fpsimd_context with the full 128-bit
+// q0-q31 followed by the null record ending the list. Unicorn has no FPSR
+// and FPCR, they are saved as zero.
+func Sigcontext(u models.Usercorn) (*linux.Sigcontext_arm64, error) {
+	c := u.GetCPU()
+	sc := &linux.Sigcontext_arm64{}
+	regs := make([]int, 0, 34)
+	for r := uc.ARM64_REG_X0; r <= uc.ARM64_REG_X28; r++ {
+		regs = append(regs, r)
+	}
+	regs = append(regs, uc.ARM64_REG_FP, uc.ARM64_REG_LR, uc.ARM64_REG_SP, uc.ARM64_REG_PC, uc.ARM64_REG_NZCV)
+	vals, err := c.RegReadBatch(regs)
+	if err != nil {
+		return nil, err
+	}
+	copy(sc.Regs[:], vals)
+	sc.Sp, sc.Pc, sc.Pstate = vals[31], vals[32], vals[33]
+
+	fp := linux.FpsimdContext_arm64{Magic: linux.FPSIMD_MAGIC}
+	fp.Size = uint32(binary.Size(fp))
+	for i := range fp.Vregs {
+		lo, hi, err := c.RegRead128(uc.ARM64_REG_Q0 + i)
+		if err != nil {
+			return nil, err
+		}
+		fp.Vregs[i] = [2]uint64{lo, hi}
+	}
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, u.ByteOrder(), &fp); err != nil {
+		return nil, err
+	}
+	copy(sc.Reserved[:], buf.Bytes())
+	return sc, nil
+}
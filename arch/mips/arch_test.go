@@ -4,14 +4,15 @@ import (
 	"testing"
 )
 
-var testAsm = `
-li $t0, 100
-l1:
-addi $t0, $t0, -1
-bgt $t0, 0, l1
-`
+// testCode is a countdown loop.
+var testCode = []byte{
+	0x64, 0x00, 0x08, 0x24, // li $t0, 100
+	0xff, 0xff, 0x08, 0x21, // l1: addi $t0, $t0, -1
+	0xfe, 0xff, 0x00, 0x1d, // bgtz $t0, l1
+	0x00, 0x00, 0x00, 0x00, // nop
+}
 
 func TestMips(t *testing.T)          { Arch.SmokeTest(t) }
-func TestMipsExec(t *testing.T)      { Arch.TestExec(t, testAsm) }
+func TestMipsExec(t *testing.T)      { Arch.TestExec(t, testCode) }
 func BenchmarkMipsRegs(b *testing.B) { Arch.BenchRegs(b) }
-func BenchmarkMipsExec(b *testing.B) { Arch.BenchExec(b, testAsm) }
+func BenchmarkMipsExec(b *testing.B) { Arch.BenchExec(b, testCode) }
@@ -2,27 +2,118 @@ package mips
 
 import (
 	"fmt"
+	"io"
 
 	uc "github.com/felberj/binemu/cpu/unicorn"
 	sysnum "github.com/lunixbochs/ghostrace/ghost/sys/num"
 
+	"github.com/felberj/binemu/cpu"
 	"github.com/felberj/binemu/kernel/common"
 	"github.com/felberj/binemu/kernel/linux"
 	"github.com/felberj/binemu/models"
+	"github.com/felberj/binemu/native/enum"
 )
 
-var LinuxRegs = []int{uc.MIPS_REG_A0, uc.MIPS_REG_A1, uc.MIPS_REG_A2, uc.MIPS_REG_A3, 0, 0}
+var LinuxRegs = []int{uc.MIPS_REG_A0, uc.MIPS_REG_A1, uc.MIPS_REG_A2, uc.MIPS_REG_A3}
+
+// rdhwr $rt, $29 (UserLocal) with the rt field masked out
+const (
+	rdhwrMask = 0xffe0ffff
+	rdhwrTls  = 0x7c00e83b
+)
 
 type MipsLinuxKernel struct {
 	*linux.LinuxKernel
+	tls    uint64
+	tlsSet bool
+	rdhwr  map[uint64]bool
+}
+
+// SetThreadArea syscall. Unicorn has no UserLocal register, so every
+// `rdhwr $rt, $29` in executable memory is trapped and emulated instead.
+func (k *MipsLinuxKernel) SetThreadArea(addr uint64) uint64 {
+	k.tls = addr
+	if !k.tlsSet {
+		k.tlsSet = true
+		regions, err := k.U.MemRegions()
+		if err != nil {
+			return linux.MinusOne
+		}
+		for _, r := range regions {
+			if r.Prot&cpu.PROT_EXEC != 0 {
+				k.hookRdhwr(r.Begin, r.End-r.Begin+1)
+			}
+		}
+	}
+	return 0
+}
+
+// Mmap syscall
+func (k *MipsLinuxKernel) Mmap(addrHint, size uint64, prot enum.MmapProt, flags enum.MmapFlag, fd common.Fd, off common.Off) uint64 {
+	addr := k.LinuxKernel.Mmap(addrHint, size, prot, flags, fd, off)
+	if addr != linux.MinusOne && prot&cpu.PROT_EXEC != 0 {
+		k.hookRdhwr(addr, size)
+	}
+	return addr
 }
 
-func (k *MipsLinuxKernel) SetThreadArea(addr uint64) error {
-	panic("not implemented")
+// Mprotect syscall
+func (k *MipsLinuxKernel) Mprotect(addr, size uint64, prot uint64) uint64 {
+	ret := k.LinuxKernel.Mprotect(addr, size, prot)
+	if ret == 0 && prot&cpu.PROT_EXEC != 0 {
+		k.hookRdhwr(addr, size)
+	}
+	return ret
+}
+
+// hookRdhwr installs a code hook on every TLS rdhwr in [addr, addr+size).
+func (k *MipsLinuxKernel) hookRdhwr(addr, size uint64) {
+	if !k.tlsSet {
+		return
+	}
+	data, err := k.U.GetCPU().MemRead(addr, size)
+	if err != nil {
+		return
+	}
+	order := k.U.ByteOrder()
+	for off := uint64(0); off+4 <= uint64(len(data)); off += 4 {
+		if order.Uint32(data[off:])&rdhwrMask != rdhwrTls {
+			continue
+		}
+		pc := addr + off
+		if k.rdhwr[pc] {
+			continue
+		}
+		k.rdhwr[pc] = true
+		k.U.GetCPU().HookCode(func(addr uint64, size uint32) {
+			k.emulateRdhwr(addr)
+		}, pc, pc)
+	}
+}
+
+// emulateRdhwr loads the thread pointer into rt and skips the instruction.
+// The code at addr may have been replaced since the hook was installed.
+func (k *MipsLinuxKernel) emulateRdhwr(addr uint64) {
+	var tmp [4]byte
+	mem := k.U.Mem()
+	mem.Seek(int64(addr), io.SeekStart)
+	if _, err := mem.Read(tmp[:]); err != nil {
+		return
+	}
+	insn := k.U.ByteOrder().Uint32(tmp[:])
+	if insn&rdhwrMask != rdhwrTls {
+		return
+	}
+	rt := int((insn >> 16) & 31)
+	k.U.RegWrite(uc.MIPS_REG_0+rt, k.tls)
+	k.U.RegWrite(uc.MIPS_REG_PC, addr+4)
 }
 
 func LinuxKernels(u models.Usercorn) []interface{} {
-	kernel := &MipsLinuxKernel{LinuxKernel: linux.NewKernel(u.Fs())}
+	kernel := &MipsLinuxKernel{
+		LinuxKernel: linux.NewKernel(u.Fs()),
+		rdhwr:       make(map[uint64]bool),
+	}
 	return []interface{}{kernel}
 }
 
@@ -30,12 +121,44 @@ func LinuxInit(u models.Usercorn, args, env []string) error {
 	return linux.StackInit(u, args, env)
 }
 
+// LinuxArgs fetches o32 syscall arguments: the first four are passed in
+// a0-a3, the rest in the caller's argument slots starting at sp+16.
+func LinuxArgs(u models.Usercorn) func(n int) ([]uint64, error) {
+	return func(n int) ([]uint64, error) {
+		nregs := n
+		if nregs > len(LinuxRegs) {
+			nregs = len(LinuxRegs)
+		}
+		args, err := common.RegArgs(u, LinuxRegs)(nregs)
+		if err != nil {
+			return nil, err
+		}
+		sp, _ := u.RegRead(uc.MIPS_REG_SP)
+		s := u.StrucAt(sp + 16)
+		for i := nregs; i < n; i++ {
+			var arg uint32
+			if err := s.Unpack(&arg); err != nil {
+				return nil, err
+			}
+			args = append(args, uint64(arg))
+		}
+		return args, nil
+	}
+}
+
 func LinuxSyscall(u models.Usercorn) {
 	// TODO: handle errors or something
 	num, _ := u.RegRead(uc.MIPS_REG_V0)
 	name, _ := sysnum.Linux_mips[int(num)]
-	ret, _ := u.Syscall(int(num), name, common.RegArgs(u, LinuxRegs))
-	u.RegWrite(uc.MIPS_REG_V0, ret)
+	ret, _ := u.Syscall(int(num), name, LinuxArgs(u))
+	// errors are flagged in a3 with a positive errno in v0
+	if errno := int64(ret); errno < 0 && errno > -4096 {
+		u.RegWrite(uc.MIPS_REG_V0, uint64(-errno))
+		u.RegWrite(uc.MIPS_REG_A3, 1)
+	} else {
+		u.RegWrite(uc.MIPS_REG_V0, ret)
+		u.RegWrite(uc.MIPS_REG_A3, 0)
+	}
 }
 
 func LinuxInterrupt(u models.Usercorn, cause uint32) {
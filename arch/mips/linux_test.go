@@ -0,0 +1,135 @@
+package mips
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/lunixbochs/struc"
+
+	"github.com/felberj/binemu/cpu"
+	"github.com/felberj/binemu/kernel/linux"
+	"github.com/felberj/binemu/models"
+	"github.com/felberj/binemu/vfs"
+
+	uc "github.com/felberj/binemu/cpu/unicorn"
+)
+
+// mipsUsercorn runs the syscall and rdhwr handlers on a bare CPU. Syscall
+// 4006 records its arguments and fails with EBADF, every other one
+// returns 7.
+type mipsUsercorn struct {
+	models.Usercorn
+	c    *cpu.Cpu
+	args []uint64
+}
+
+func (u *mipsUsercorn) RegRead(reg int) (uint64, error)      { return u.c.RegRead(reg) }
+func (u *mipsUsercorn) RegWrite(reg int, val uint64) error   { return u.c.RegWrite(reg, val) }
+func (u *mipsUsercorn) Mem() io.ReadWriteSeeker              { return u.c.Mem() }
+func (u *mipsUsercorn) MemRegions() ([]*uc.MemRegion, error) { return u.c.MemRegions() }
+func (u *mipsUsercorn) ByteOrder() binary.ByteOrder          { return binary.LittleEndian }
+func (u *mipsUsercorn) GetCPU() *cpu.Cpu                     { return u.c }
+
+func (u *mipsUsercorn) StrucAt(addr uint64) *models.StrucStream {
+	mem := u.c.Mem()
+	mem.Seek(int64(addr), io.SeekStart)
+	return models.NewStrucStream(mem, &struc.Options{Order: binary.LittleEndian, PtrSize: 32})
+}
+
+func (u *mipsUsercorn) Syscall(num int, name string, getArgs models.SysGetArgs) (uint64, error) {
+	if num == 4006 {
+		u.args, _ = getArgs(6)
+		ebadf := int64(-9)
+		return uint64(ebadf), nil
+	}
+	return 7, nil
+}
+
+// register numbers of the test program
+const (
+	v0 = 2
+	v1 = 3
+	a3 = 7
+	s0 = 16
+)
+
+func TestMipsLinux(t *testing.T) {
+	c, err := Arch.Cpu.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &mipsUsercorn{c: c}
+	if _, err := c.HookInterrupt(func(intno uint32) { LinuxInterrupt(u, intno) }, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	li := func(rt, imm uint32) uint32 { return 0x24000000 | rt<<16 | imm } // addiu rt, $zero, imm
+	move := func(rd, rs uint32) uint32 { return 0x25 | rs<<21 | rd<<11 }   // or rd, rs, $zero
+	const syscall = 0x0000000c
+	code := []uint32{
+		0x7c03e83b, // rdhwr $3, $29
+		move(s0, v1),
+		// a failing syscall sets a3 and returns a positive errno
+		li(v0, 4006), syscall, move(s0+1, v0), move(s0+2, a3),
+		li(v0, 4007), syscall, move(s0+3, v0), move(s0+4, a3),
+	}
+	const base, stack = 0x10000, 0x20000
+	if err := c.MemMap(base, 0x1000, cpu.PROT_READ|cpu.PROT_EXEC); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.MemMap(stack, 0x1000, cpu.PROT_READ|cpu.PROT_WRITE); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(code)*4)
+	for i, insn := range code {
+		binary.LittleEndian.PutUint32(buf[i*4:], insn)
+	}
+	if err := c.MemWrite(base, buf); err != nil {
+		t.Fatal(err)
+	}
+	// arguments 5 and 6 are in the caller's argument slots
+	if err := c.MemWrite(stack+16, []byte{5, 0, 0, 0, 6, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	k := &MipsLinuxKernel{LinuxKernel: linux.NewKernel(vfs.New()), rdhwr: make(map[uint64]bool)}
+	k.U = u
+	if ret := k.SetThreadArea(0x7000); ret != 0 {
+		t.Fatalf("set_thread_area returned %#x", ret)
+	}
+	if !k.rdhwr[base] {
+		t.Fatalf("rdhwr at %#x is not hooked", base)
+	}
+	for i, reg := range LinuxRegs {
+		c.RegWrite(reg, uint64(i+1))
+	}
+	c.RegWrite(uc.MIPS_REG_SP, stack)
+	if err := c.Start(base, base+uint64(len(buf))); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []uint64{1, 2, 3, 4, 5, 6}
+	if len(u.args) != len(want) {
+		t.Fatalf("syscall args %v, want %v", u.args, want)
+	}
+	for i := range want {
+		if u.args[i] != want[i] {
+			t.Errorf("syscall arg %d is %d, want %d", i, u.args[i], want[i])
+		}
+	}
+	for _, r := range []struct {
+		name string
+		reg  int
+		want uint64
+	}{
+		{"rdhwr $3, $29", uc.MIPS_REG_S0, 0x7000},
+		{"errno", uc.MIPS_REG_S1, 9},
+		{"a3 after an error", uc.MIPS_REG_S2, 1},
+		{"return value", uc.MIPS_REG_S3, 7},
+		{"a3 after success", uc.MIPS_REG_S4, 0},
+	} {
+		if got, _ := c.RegRead(r.reg); got != r.want {
+			t.Errorf("%s is %#x, want %#x", r.name, got, r.want)
+		}
+	}
+}
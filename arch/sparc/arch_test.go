@@ -4,15 +4,30 @@ import (
 	"testing"
 )
 
-var testAsm = `
-set 100, %l0
-loop: sub %l0, 1, %l0
-      cmp %l0, 0
-      bg loop
-      nop
-`
+// testCode is a countdown loop.
+var testCode = []byte{
+	0xa0, 0x10, 0x20, 0x64, // set 100, %l0
+	0xa0, 0x24, 0x20, 0x01, // loop: sub %l0, 1, %l0
+	0x80, 0xa4, 0x20, 0x00, // cmp %l0, 0
+	0x14, 0xbf, 0xff, 0xfe, // bg loop
+	0x01, 0x00, 0x00, 0x00, // nop
+}
 
 func TestSparc(t *testing.T)          { Arch.SmokeTest(t) }
-func TestSparcExec(t *testing.T)      { Arch.TestExec(t, testAsm) }
+func TestSparcExec(t *testing.T)      { Arch.TestExec(t, testCode) }
 func BenchmarkSparcRegs(b *testing.B) { Arch.BenchRegs(b) }
-func BenchmarkSparcExec(b *testing.B) { Arch.BenchExec(b, testAsm) }
+func BenchmarkSparcExec(b *testing.B) { Arch.BenchExec(b, testCode) }
+
+func TestSparcStubEncoding(t *testing.T) {
+	for _, c := range []struct{ got, want uint32 }{
+		{taLinux, 0x91d02010},           // ta 0x10
+		{save, 0x81e00000},              // save %g0, %g0, %g0
+		{restore, 0x81e80000},           // restore %g0, %g0, %g0
+		{taDone, 0x91d0207f},            // ta 0x7f
+		{windowInitCode[0], 0x81902002}, // wr %g0, 2, %wim
+	} {
+		if c.got != c.want {
+			t.Errorf("got %#x, want %#x", c.got, c.want)
+		}
+	}
+}
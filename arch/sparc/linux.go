@@ -2,9 +2,9 @@ package sparc
 
 import (
 	"fmt"
+	"io"
 
-	"github.com/lunixbochs/ghostrace/ghost/sys/num"
-
+	"github.com/felberj/binemu/cpu"
 	"github.com/felberj/binemu/kernel/linux"
 	"github.com/felberj/binemu/models"
 
@@ -12,8 +12,212 @@ import (
 	co "github.com/felberj/binemu/kernel/common"
 )
 
-// TODO: sparc linux syscall abi regs
-var LinuxRegs = []int{}
+var LinuxRegs = []int{uc.SPARC_REG_O0, uc.SPARC_REG_O1, uc.SPARC_REG_O2, uc.SPARC_REG_O3, uc.SPARC_REG_O4, uc.SPARC_REG_O5}
+
+// trap numbers as reported by Unicorn (tt field of the trap base register)
+const (
+	ttWindowOverflow  = 0x05
+	ttWindowUnderflow = 0x06
+	ttTrapInstruction = 0x80
+	ttFlushWindows    = ttTrapInstruction + 0x03
+	ttLinuxSyscall    = ttTrapInstruction + 0x10
+	ttFlushDone       = ttTrapInstruction + 0x7e
+	ttStubDone        = ttTrapInstruction + 0x7f
+)
+
+// Unicorn neither exposes %psr nor %wim, so window spills and the carry
+// flag are handled by small supervisor mode stubs in the read-only trap
+// page. The registers they clobber and the address to return to are kept
+// in the scratch page when a stub starts, and put back by the trap each
+// stub ends with. The flush stub keeps its own in flushScratch, as the
+// window traps it causes run stubs of their own.
+const (
+	nwindows     = 8
+	trapPage     = 0xfffff000
+	scratchPage  = trapPage - 0x1000
+	flushScratch = scratchPage + 0x100
+
+	overflowHandler  = trapPage + 0x100
+	underflowHandler = trapPage + 0x200
+	carrySetStub     = trapPage + 0x300
+	carryClearStub   = trapPage + 0x340
+	flushStub        = trapPage + 0x380
+	windowInit       = trapPage + 0x3c0
+
+	// the initial frame reserves room for one register window spill
+	windowSaveArea = 16 * 4
+)
+
+// scratchRegs are saved to the scratch page in this order, followed by
+// the return address.
+var scratchRegs = []int{uc.SPARC_REG_G2, uc.SPARC_REG_G3, uc.SPARC_REG_G4}
+
+// sparc register numbers used by the stubs
+const (
+	g0 = 0
+	g2 = 2
+	g3 = 3
+	g4 = 4
+	sp = 14
+	l0 = 16
+)
+
+func fmt3i(op, rd, op3, rs1 uint32, simm int32) uint32 {
+	return op<<30 | rd<<25 | op3<<19 | rs1<<14 | 1<<13 | uint32(simm)&0x1fff
+}
+
+func fmt3r(op, rd, op3, rs1, rs2 uint32) uint32 {
+	return op<<30 | rd<<25 | op3<<19 | rs1<<14 | rs2
+}
+
+var (
+	nop         = uint32(0x01000000)
+	taFlush     = fmt3i(2, 8, 0x3a, g0, 0x03)
+	taLinux     = fmt3i(2, 8, 0x3a, g0, 0x10)
+	taFlushDone = fmt3i(2, 8, 0x3a, g0, 0x7e)
+	taDone      = fmt3i(2, 8, 0x3a, g0, 0x7f)
+	save        = fmt3r(2, g0, 0x3c, g0, g0)
+	restore     = fmt3r(2, g0, 0x3d, g0, g0)
+	rdWim       = func(rd uint32) uint32 { return fmt3r(2, rd, 0x2a, g0, g0) }
+	wrWim       = func(rs1 uint32) uint32 { return fmt3i(2, 0, 0x32, rs1, 0) }
+	std         = func(rd uint32, off int32) uint32 { return fmt3i(3, rd, 0x07, sp, off) }
+	ldd         = func(rd uint32, off int32) uint32 { return fmt3i(3, rd, 0x03, sp, off) }
+)
+
+// windowHandler builds a stub that rotates %wim by one window and moves
+// a single window between the register file and its stack save area.
+func windowHandler(overflow bool) []uint32 {
+	code := []uint32{rdWim(g2)}
+	if overflow {
+		code = append(code,
+			fmt3i(2, g3, 0x26, g2, 1),          // srl %g2, 1, %g3
+			fmt3i(2, g4, 0x25, g2, nwindows-1), // sll %g2, nwindows-1, %g4
+		)
+	} else {
+		code = append(code,
+			fmt3i(2, g3, 0x25, g2, 1),          // sll %g2, 1, %g3
+			fmt3i(2, g4, 0x26, g2, nwindows-1), // srl %g2, nwindows-1, %g4
+		)
+	}
+	code = append(code,
+		fmt3r(2, g3, 0x02, g3, g4),              // or %g3, %g4, %g3
+		fmt3i(2, g3, 0x01, g3, (1<<nwindows)-1), // and %g3, mask, %g3
+		wrWim(g0), nop, nop, nop,
+	)
+	if overflow {
+		// spill the oldest window, two below the current one
+		code = append(code, save, save)
+		for i := uint32(0); i < 8; i++ {
+			code = append(code, std(l0+i*2, int32(i*8)))
+		}
+		code = append(code, restore, restore)
+	} else {
+		// fill the caller's window from its stack
+		code = append(code, restore)
+		for i := uint32(0); i < 8; i++ {
+			code = append(code, ldd(l0+i*2, int32(i*8)))
+		}
+		code = append(code, save)
+	}
+	return append(code, wrWim(g3), nop, nop, nop, taDone)
+}
+
+func carryStub(set bool) []uint32 {
+	code := []uint32{fmt3r(2, g0, 0x10, g0, g0)} // addcc %g0, %g0, %g0
+	if set {
+		code[0] = fmt3i(2, g0, 0x14, g0, 1) // subcc %g0, 1, %g0
+	}
+	return append(code, taDone)
+}
+
+// flushWindows builds the stub of ST_FLUSH_WINDOWS. Going nwindows-1
+// frames deeper spills every window but the new ones through the overflow
+// handler, the current one included. Coming back fills just the current
+// window, the callers' are left on the stack.
+func flushWindows() []uint32 {
+	var code []uint32
+	for i := 0; i < nwindows-1; i++ {
+		code = append(code, save)
+	}
+	for i := 0; i < nwindows-1; i++ {
+		code = append(code, restore)
+	}
+	return append(code, taFlushDone)
+}
+
+// windowInitCode marks the window above the initial one invalid, as %cwp
+// starts at 0.
+var windowInitCode = []uint32{fmt3i(2, 0, 0x32, g0, 1<<1), nop, nop, nop} // wr %g0, 2, %wim
+
+func writeCode(u models.Usercorn, addr uint64, code []uint32) error {
+	buf := make([]byte, len(code)*4)
+	for i, insn := range code {
+		u.ByteOrder().PutUint32(buf[i*4:], insn)
+	}
+	mem := u.Mem()
+	mem.Seek(int64(addr), io.SeekStart)
+	_, err := mem.Write(buf)
+	return err
+}
+
+func setupTrapPage(u models.Usercorn) error {
+	if err := u.MemMap(scratchPage, 0x1000, cpu.PROT_READ|cpu.PROT_WRITE); err != nil {
+		return err
+	}
+	if err := u.MemMap(trapPage, 0x1000, cpu.PROT_READ|cpu.PROT_EXEC); err != nil {
+		return err
+	}
+	stubs := map[uint64][]uint32{
+		overflowHandler:  windowHandler(true),
+		underflowHandler: windowHandler(false),
+		carrySetStub:     carryStub(true),
+		carryClearStub:   carryStub(false),
+		flushStub:        flushWindows(),
+		windowInit:       windowInitCode,
+	}
+	for addr, code := range stubs {
+		if err := writeCode(u, addr, code); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// initWindows leaves the first frame the only valid window, like a new
+// process gets it from the kernel. It fails if Unicorn left the CPU in user
+// mode, which it does unless it resets its sparc CPUs. Windows then wrap
+// around without ever trapping.
+func initWindows(u models.Usercorn) error {
+	return u.GetCPU().Start(windowInit, windowInit+uint64(len(windowInitCode)*4))
+}
+
+// trapReturn runs one of the trap page stubs, which returns to ret when
+// done. What it clobbers is saved to scratch.
+func trapReturn(u models.Usercorn, stub, ret, scratch uint64) {
+	buf := make([]byte, 4*(len(scratchRegs)+1))
+	for i, reg := range scratchRegs {
+		val, _ := u.RegRead(reg)
+		u.ByteOrder().PutUint32(buf[i*4:], uint32(val))
+	}
+	u.ByteOrder().PutUint32(buf[len(buf)-4:], uint32(ret))
+	mem := u.Mem()
+	mem.Seek(int64(scratch), io.SeekStart)
+	mem.Write(buf)
+	u.RegWrite(uc.SPARC_REG_PC, stub)
+}
+
+// stubDone puts back what trapReturn saved to scratch and continues the
+// guest.
+func stubDone(u models.Usercorn, scratch uint64) {
+	buf := make([]byte, 4*(len(scratchRegs)+1))
+	mem := u.Mem()
+	mem.Seek(int64(scratch), io.SeekStart)
+	mem.Read(buf)
+	for i, reg := range scratchRegs {
+		u.RegWrite(reg, uint64(u.ByteOrder().Uint32(buf[i*4:])))
+	}
+	u.RegWrite(uc.SPARC_REG_PC, uint64(u.ByteOrder().Uint32(buf[len(buf)-4:])))
+}
 
 type LinuxKernel struct {
 	*linux.LinuxKernel
@@ -24,25 +228,123 @@ func LinuxKernels(u models.Usercorn) []interface{} {
 	return []interface{}{kernel}
 }
 
-func LinuxSyscall(u models.Usercorn) {
-	// TODO: handle errors or something
+func LinuxInit(u models.Usercorn, args, env []string) error {
+	if err := setupTrapPage(u); err != nil {
+		return err
+	}
+	// without window traps only call chains deeper than nwindows break
+	initWindows(u)
+	if err := linux.StackInit(u, args, env); err != nil {
+		return err
+	}
+	// argc lives right above the register window save area of the first frame
+	sp, _ := u.RegRead(uc.SPARC_REG_SP)
+	if err := u.RegWrite(uc.SPARC_REG_SP, sp-windowSaveArea); err != nil {
+		return err
+	}
+	return u.RegWrite(uc.SPARC_REG_FP, 0)
+}
+
+// LinuxSyscall dispatches a syscall and reports whether it failed.
+func LinuxSyscall(u models.Usercorn) bool {
 	g1, _ := u.RegRead(uc.SPARC_REG_G1)
-	// TODO: add sparc x86 syscall numbers to ghostrace
-	name, _ := num.Linux_x86[int(g1)]
+	name, _ := linuxSyscalls[int(g1)]
 	ret, _ := u.Syscall(int(g1), name, co.RegArgs(u, LinuxRegs))
+	// errors set the carry flag and return a positive errno
+	if errno := int64(ret); errno < 0 && errno > -4096 {
+		u.RegWrite(uc.SPARC_REG_O0, uint64(-errno))
+		return true
+	}
 	u.RegWrite(uc.SPARC_REG_O0, ret)
+	return false
+}
+
+// windowTrapEnd returns where to retry the save or restore at pc. Unicorn
+// keeps nPC to itself, so a window trap in a delay slot, as in `ret;
+// restore`, resumes at the control transfer before it. That runs the
+// trapping instruction again in its delay slot and jumps to where nPC
+// pointed, unless re-running the transfer would change what it does.
+func windowTrapEnd(u models.Usercorn, pc uint64) uint64 {
+	if pc < 4 {
+		return pc
+	}
+	var tmp [4]byte
+	mem := u.Mem()
+	mem.Seek(int64(pc-4), io.SeekStart)
+	if _, err := mem.Read(tmp[:]); err != nil {
+		return pc
+	}
+	insn := u.ByteOrder().Uint32(tmp[:])
+	op, op2, op3 := insn>>30, (insn>>22)&7, (insn>>19)&0x3f
+	rd, rs1, rs2 := (insn>>25)&31, (insn>>14)&31, insn&31
+	switch {
+	case op == 1: // call
+	case op == 0 && (op2 == 2 || op2 == 6 || op2 == 7): // Bicc, FBfcc, CBccc
+		// ba,a and bn,a never run their delay slot
+		if insn&(1<<29) != 0 && (insn>>25)&7 == 0 {
+			return pc
+		}
+	case op == 2 && op3 == 0x38: // jmpl
+		// jmpl may overwrite the register its target came from
+		if rd != g0 && (rd == rs1 || insn&(1<<13) == 0 && rd == rs2) {
+			return pc
+		}
+	default:
+		return pc
+	}
+	return pc - 4
+}
+
+// trapEnd returns the address after the trap instruction ta at pc.
+func trapEnd(u models.Usercorn, pc uint64, ta uint32) uint64 {
+	var tmp [4]byte
+	mem := u.Mem()
+	mem.Seek(int64(pc), io.SeekStart)
+	mem.Read(tmp[:])
+	if u.ByteOrder().Uint32(tmp[:]) == ta {
+		return pc + 4
+	}
+	return pc
 }
 
-// TODO: add sparc syscall convention support
 func LinuxInterrupt(u models.Usercorn, intno uint32) {
-	panic(fmt.Sprintf("unknown interrupt: %d", intno))
+	// Unicorn reports traps with PC still pointing at the trapping instruction
+	pc, _ := u.RegRead(uc.SPARC_REG_PC)
+	switch intno {
+	case ttLinuxSyscall:
+		ret := trapEnd(u, pc, taLinux)
+		if LinuxSyscall(u) {
+			trapReturn(u, carrySetStub, ret, scratchPage)
+		} else {
+			trapReturn(u, carryClearStub, ret, scratchPage)
+		}
+	case ttFlushWindows:
+		trapReturn(u, flushStub, trapEnd(u, pc, taFlush), flushScratch)
+	case ttWindowOverflow:
+		trapReturn(u, overflowHandler, windowTrapEnd(u, pc), scratchPage)
+	case ttWindowUnderflow:
+		trapReturn(u, underflowHandler, windowTrapEnd(u, pc), scratchPage)
+	case ttStubDone, ttFlushDone:
+		// the guest's own traps aren't ours to handle
+		if pc >= trapPage {
+			if intno == ttFlushDone {
+				stubDone(u, flushScratch)
+			} else {
+				stubDone(u, scratchPage)
+			}
+			break
+		}
+		fallthrough
+	default:
+		u.Exit(fmt.Errorf("unhandled sparc trap %#x at %#x", intno, pc))
+	}
 }
 
 func init() {
 	Arch.RegisterOS(&models.OS{
 		Name:      "linux",
 		Kernels:   LinuxKernels,
-		Init:      linux.StackInit,
+		Init:      LinuxInit,
 		Interrupt: LinuxInterrupt,
 	})
 }
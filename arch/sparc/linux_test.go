@@ -0,0 +1,239 @@
+package sparc
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/felberj/binemu/cpu"
+	"github.com/felberj/binemu/models"
+
+	uc "github.com/felberj/binemu/cpu/unicorn"
+)
+
+// trapUsercorn runs the trap handlers on a bare CPU. Syscall 20 fails
+// with EBADF, every other one returns 7.
+type trapUsercorn struct {
+	models.Usercorn
+	c *cpu.Cpu
+}
+
+func (u *trapUsercorn) RegRead(reg int) (uint64, error)          { return u.c.RegRead(reg) }
+func (u *trapUsercorn) RegWrite(reg int, val uint64) error       { return u.c.RegWrite(reg, val) }
+func (u *trapUsercorn) MemMap(addr, size uint64, prot int) error { return u.c.MemMap(addr, size, prot) }
+func (u *trapUsercorn) Mem() io.ReadWriteSeeker                  { return u.c.Mem() }
+func (u *trapUsercorn) ByteOrder() binary.ByteOrder              { return binary.BigEndian }
+func (u *trapUsercorn) GetCPU() *cpu.Cpu                         { return u.c }
+
+func (u *trapUsercorn) Syscall(num int, name string, getArgs models.SysGetArgs) (uint64, error) {
+	if num == 20 {
+		ebadf := int64(-9)
+		return uint64(ebadf), nil
+	}
+	return 7, nil
+}
+
+// more register numbers of the test program
+const (
+	g1 = 1
+	g5 = 5
+	o0 = 8
+	l1 = 17
+	l2 = 18
+	l3 = 19
+	l4 = 20
+)
+
+func TestSparcTraps(t *testing.T) {
+	c, err := Arch.Cpu.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &trapUsercorn{c: c}
+	if err := setupTrapPage(u); err != nil {
+		t.Fatal(err)
+	}
+	if err := initWindows(u); err != nil {
+		t.Skip("no window traps:", err)
+	}
+	if _, err := c.HookInterrupt(func(intno uint32) { LinuxInterrupt(u, intno) }, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	mov := func(rd uint32, imm int32) uint32 { return fmt3i(2, rd, 0x02, g0, imm) } // or %g0, imm, rd
+	addx := func(rd uint32) uint32 { return fmt3r(2, rd, 0x08, g0, g0) }            // addx %g0, %g0, rd
+	add := func(rd, rs1, rs2 uint32) uint32 { return fmt3r(2, rd, 0x00, rs1, rs2) } // add rs1, rs2, rd
+	frame := fmt3i(2, sp, 0x3c, sp, -96)                                            // save %sp, -96, %sp
+	code := []uint32{
+		// a failing syscall sets the carry and returns a positive errno
+		mov(g1, 20), taLinux, addx(l1), add(l2, o0, g0),
+		mov(g1, 21), taLinux, addx(l3), add(l4, o0, g0),
+		mov(l0, 0x100),
+	}
+	// go deeper than the register file to spill and fill windows
+	const depth = 2 * nwindows
+	for i := int32(1); i < depth; i++ {
+		code = append(code, frame, mov(l0, i))
+	}
+	for i := 1; i < depth; i++ {
+		code = append(code, restore, add(g5, g5, l0))
+	}
+	const base, stack = 0x10000, 0x20000
+	if err := c.MemMap(base, 0x1000, cpu.PROT_READ|cpu.PROT_EXEC); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.MemMap(stack, 0x10000, cpu.PROT_READ|cpu.PROT_WRITE); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeCode(u, base, code); err != nil {
+		t.Fatal(err)
+	}
+	c.RegWrite(uc.SPARC_REG_SP, stack+0x10000-windowSaveArea)
+	c.RegWrite(uc.SPARC_REG_G2, 0x22)
+	c.RegWrite(uc.SPARC_REG_G3, 0x33)
+	c.RegWrite(uc.SPARC_REG_G4, 0x44)
+	if err := c.Start(base, base+uint64(len(code)*4)); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := uint64(0x100)
+	for i := uint64(1); i < depth-1; i++ {
+		sum += i
+	}
+	for _, r := range []struct {
+		name string
+		reg  int
+		want uint64
+	}{
+		{"carry after an error", uc.SPARC_REG_L1, 1},
+		{"errno", uc.SPARC_REG_L2, 9},
+		{"carry after success", uc.SPARC_REG_L3, 0},
+		{"return value", uc.SPARC_REG_L4, 7},
+		{"locals of the unwound frames", uc.SPARC_REG_G5, sum},
+		{"%l0 of the first frame", uc.SPARC_REG_L0, 0x100},
+		{"%g2", uc.SPARC_REG_G2, 0x22},
+		{"%g3", uc.SPARC_REG_G3, 0x33},
+		{"%g4", uc.SPARC_REG_G4, 0x44},
+	} {
+		if got, _ := c.RegRead(r.reg); got != r.want {
+			t.Errorf("%s is %#x, want %#x", r.name, got, r.want)
+		}
+	}
+}
+
+func TestSparcFlushWindows(t *testing.T) {
+	c, err := Arch.Cpu.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &trapUsercorn{c: c}
+	if err := setupTrapPage(u); err != nil {
+		t.Fatal(err)
+	}
+	if err := initWindows(u); err != nil {
+		t.Skip("no window traps:", err)
+	}
+	if _, err := c.HookInterrupt(func(intno uint32) { LinuxInterrupt(u, intno) }, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	mov := func(rd uint32, imm int32) uint32 { return fmt3i(2, rd, 0x02, g0, imm) }
+	frame := fmt3i(2, sp, 0x3c, sp, -96)
+	flush := []uint32{
+		mov(l0, 0x100), frame, mov(l0, 0x101), frame, mov(l0, 0x102), taFlush,
+	}
+	unwind := []uint32{restore, restore}
+	const base, stack = 0x10000, 0x20000
+	if err := c.MemMap(base, 0x1000, cpu.PROT_READ|cpu.PROT_EXEC); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.MemMap(stack, 0x10000, cpu.PROT_READ|cpu.PROT_WRITE); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeCode(u, base, append(flush, unwind...)); err != nil {
+		t.Fatal(err)
+	}
+	const top = stack + 0x10000 - windowSaveArea
+	c.RegWrite(uc.SPARC_REG_SP, top)
+	mid := base + uint64(len(flush)*4)
+	if err := c.Start(base, mid); err != nil {
+		t.Fatal(err)
+	}
+	// the callers' windows are on their stacks, %l0 first
+	for _, f := range []struct {
+		sp, l0 uint64
+	}{{top, 0x100}, {top - 96, 0x101}} {
+		data, err := c.MemRead(f.sp, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := binary.BigEndian.Uint32(data); uint64(got) != f.l0 {
+			t.Errorf("saved %%l0 at %#x is %#x, want %#x", f.sp, got, f.l0)
+		}
+	}
+	if l0, _ := c.RegRead(uc.SPARC_REG_L0); l0 != 0x102 {
+		t.Errorf("%%l0 is %#x after the flush, want 0x102", l0)
+	}
+	if err := c.Start(mid, mid+uint64(len(unwind)*4)); err != nil {
+		t.Fatal(err)
+	}
+	if l0, _ := c.RegRead(uc.SPARC_REG_L0); l0 != 0x100 {
+		t.Errorf("%%l0 of the first frame is %#x, want 0x100", l0)
+	}
+}
+
+// TestSparcDelaySlot returns from 2*nwindows nested calls with `ret;
+// restore` after flushing the windows, so every restore underflows in a
+// delay slot.
+func TestSparcDelaySlot(t *testing.T) {
+	c, err := Arch.Cpu.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &trapUsercorn{c: c}
+	if err := setupTrapPage(u); err != nil {
+		t.Fatal(err)
+	}
+	if err := initWindows(u); err != nil {
+		t.Skip("no window traps:", err)
+	}
+	if _, err := c.HookInterrupt(func(intno uint32) { LinuxInterrupt(u, intno) }, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	const i0, i7 = 24, 31
+	call := func(from, to int) uint32 { return 1<<30 | uint32(to-from)&0x3fffffff }
+	ret := fmt3i(2, g0, 0x38, i7, 8) // jmpl %i7+8, %g0
+	// sum(n) adds n to sum(n-1) in the restore that returns it
+	sum := []uint32{
+		fmt3i(2, sp, 0x3c, sp, -96), // save %sp, -96, %sp
+		fmt3i(2, g0, 0x14, i0, 0),   // subcc %i0, 0, %g0
+		0x02800007,                  // be 1f
+		nop,                         // delay slot
+		fmt3i(2, o0, 0x04, i0, 1),   // sub %i0, 1, %o0
+		call(5, 0),                  // call sum
+		nop,                         // delay slot
+		ret,                         // ret
+		fmt3r(2, o0, 0x3d, o0, i0),  // restore %o0, %i0, %o0
+		taFlush,                     // 1: ta 3
+		ret,                         // ret
+		fmt3i(2, o0, 0x3d, g0, 0),   // restore %g0, 0, %o0
+	}
+	const depth = 2 * nwindows
+	main := []uint32{fmt3i(2, o0, 0x02, g0, depth), call(len(sum)+1, 0), nop}
+	const base, stack = 0x10000, 0x20000
+	if err := c.MemMap(base, 0x1000, cpu.PROT_READ|cpu.PROT_EXEC); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.MemMap(stack, 0x10000, cpu.PROT_READ|cpu.PROT_WRITE); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeCode(u, base, append(sum, main...)); err != nil {
+		t.Fatal(err)
+	}
+	c.RegWrite(uc.SPARC_REG_SP, stack+0x10000-windowSaveArea)
+	start := base + uint64(len(sum)*4)
+	if err := c.Start(start, start+uint64(len(main)*4)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.RegRead(uc.SPARC_REG_O0); got != depth*(depth+1)/2 {
+		t.Errorf("sum(%d) is %d, want %d", depth, got, depth*(depth+1)/2)
+	}
+}
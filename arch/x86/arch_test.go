@@ -4,15 +4,15 @@ import (
 	"testing"
 )
 
-var testAsm = `
-mov eax, 100
-l1:
-dec eax
-cmp eax, 0
-jg l1
-`
+// testCode is a countdown loop.
+var testCode = []byte{
+	0xb8, 0x64, 0x00, 0x00, 0x00, // mov eax, 100
+	0x48,             // l1: dec eax
+	0x83, 0xf8, 0x00, // cmp eax, 0
+	0x7f, 0xfa, // jg l1
+}
 
 func TestX86(t *testing.T)          { Arch.SmokeTest(t) }
-func TestX86Exec(t *testing.T)      { Arch.TestExec(t, testAsm) }
+func TestX86Exec(t *testing.T)      { Arch.TestExec(t, testCode) }
 func BenchmarkX86Regs(b *testing.B) { Arch.BenchRegs(b) }
-func BenchmarkX86Exec(b *testing.B) { Arch.BenchExec(b, testAsm) }
+func BenchmarkX86Exec(b *testing.B) { Arch.BenchExec(b, testCode) }
@@ -0,0 +1,89 @@
+package x86
+
+import (
+	"github.com/felberj/binemu/kernel/cgc"
+	"github.com/felberj/binemu/kernel/linux"
+	"github.com/felberj/binemu/models"
+
+	uc "github.com/felberj/binemu/cpu/unicorn"
+	co "github.com/felberj/binemu/kernel/common"
+)
+
+var cgcSyscalls = map[int]string{
+	1: "terminate",
+	2: "transmit",
+	3: "receive",
+	4: "fdwait",
+	5: "allocate",
+	6: "deallocate",
+	7: "random",
+}
+
+const (
+	cgcStackTop  = 0xbaaab000
+	cgcStackSize = 0x800000
+)
+
+func CgcKernels(u models.Usercorn) []interface{} {
+	return []interface{}{cgc.NewKernel(u.Rand())}
+}
+
+// CgcInit sets up the DECREE initial state: no arguments or environment,
+// every register cleared except ecx pointing at the magic page.
+func CgcInit(u models.Usercorn, args, env []string) error {
+	// the magic page is the first thing taken from the random stream
+	if err := cgc.MapMagicPage(u, u.Rand()); err != nil {
+		return err
+	}
+	if err := u.MapStack(cgcStackTop-cgcStackSize, cgcStackSize, false); err != nil {
+		return err
+	}
+	regs := map[int]uint64{
+		uc.X86_REG_EAX:    0,
+		uc.X86_REG_EBX:    0,
+		uc.X86_REG_ECX:    cgc.MagicPage,
+		uc.X86_REG_EDX:    0,
+		uc.X86_REG_ESI:    0,
+		uc.X86_REG_EDI:    0,
+		uc.X86_REG_EBP:    0,
+		uc.X86_REG_ESP:    cgcStackTop - 4,
+		uc.X86_REG_EFLAGS: 0x202,
+	}
+	for reg, val := range regs {
+		if err := u.RegWrite(reg, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func CgcSyscall(u models.Usercorn) {
+	eax, _ := u.RegRead(uc.X86_REG_EAX)
+	name, ok := cgcSyscalls[int(eax)]
+	if !ok {
+		u.RegWrite(uc.X86_REG_EAX, cgc.ENOSYS)
+		return
+	}
+	ret, _ := u.Syscall(int(eax), name, co.RegArgs(u, LinuxRegs))
+	u.RegWrite(uc.X86_REG_EAX, ret)
+}
+
+func CgcInterrupt(u models.Usercorn, intno uint32) {
+	switch intno {
+	case 0x80:
+		CgcSyscall(u)
+	case 1, 3: // debug exception, int3
+		u.Exit(models.Signal(linux.SIGTRAP))
+	default:
+		u.Exit(models.Signal(linux.SIGILL))
+	}
+}
+
+func init() {
+	Arch.RegisterOS(&models.OS{
+		Name:      "cgc",
+		Kernels:   CgcKernels,
+		Init:      CgcInit,
+		Interrupt: CgcInterrupt,
+	})
+}
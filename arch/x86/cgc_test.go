@@ -0,0 +1,28 @@
+package x86
+
+import (
+	"testing"
+
+	"github.com/felberj/binemu/models"
+)
+
+// exitUsercorn records why the guest was stopped.
+type exitUsercorn struct {
+	models.Usercorn
+	err error
+}
+
+func (u *exitUsercorn) Exit(err error) { u.err = err }
+
+func TestCgcUnhandledInterrupt(t *testing.T) {
+	for _, c := range []struct {
+		intno uint32
+		sig   models.Signal
+	}{{3, 5}, {0x81, 4}} {
+		u := &exitUsercorn{}
+		CgcInterrupt(u, c.intno)
+		if u.err != c.sig {
+			t.Errorf("interrupt %#x stopped with %v, want %v", c.intno, u.err, c.sig)
+		}
+	}
+}
@@ -60,8 +60,12 @@ func createSelector(idx uint32, flags uint32) uint64 {
 	return uint64(ret)
 }
 
-// TODO: move this to arch.go or something
 func (k *LinuxKernel) gdtWrite(sel, base, limit, access, flags uint32) error {
+	return gdtWrite(k.U, &k.gdt, sel, base, limit, access, flags)
+}
+
+// gdtWrite writes a segment descriptor, allocating the GDT on first use.
+func gdtWrite(u models.Usercorn, gdtAddr *uint64, sel, base, limit, access, flags uint32) error {
 	var entry uint64
 	// set default access bits
 	access |= 1 << 7
@@ -77,16 +81,16 @@ func (k *LinuxKernel) gdtWrite(sel, base, limit, access, flags uint32) error {
 	entry |= (uint64(access) & 0xFF) << 40
 	entry |= (uint64(flags) & 0xFF) << 52
 
-	if k.gdt == 0 {
-		k.gdt, _ = k.U.Malloc(0x1000, "gdt")
+	if *gdtAddr == 0 {
+		*gdtAddr, _ = u.Malloc(0x1000, "gdt")
 		gdt := uc.X86Mmr{
-			Base:  k.gdt,
+			Base:  *gdtAddr,
 			Limit: 31*8 - 1,
 		}
-		k.U.Backend().(*uc.Unicorn).RegWriteMmr(uc.X86_REG_GDTR, &gdt)
+		u.Backend().(*uc.Unicorn).RegWriteMmr(uc.X86_REG_GDTR, &gdt)
 	}
 	// this is fragile but we only call it once below in SetThreadArea
-	s := k.U.StrucAt(k.gdt + uint64(sel)*8)
+	s := u.StrucAt(*gdtAddr + uint64(sel)*8)
 	s.Pack(entry)
 	return s.Error
 }
@@ -130,12 +134,17 @@ func (k *LinuxKernel) SetThreadArea(addr uint64) int {
 }
 
 func (k *LinuxKernel) setupGdt() {
-	k.gdtWrite(1, 0, 0xffffff00, (A_PRESENT | A_DATA | A_DATA_WRITABLE | A_PRIV_0 | A_DIR_CON_BIT), F_PROT_32) // code
-	k.gdtWrite(2, 0, 0xffffff00, (A_PRESENT | A_DATA | A_DATA_WRITABLE | A_PRIV_0 | A_DIR_CON_BIT), F_PROT_32) // data
-	k.gdtWrite(3, 0, 0xffffff00, (A_PRESENT | A_DATA | A_DATA_WRITABLE | A_PRIV_0), F_PROT_32)                 // stack
-	k.U.RegWrite(uc.X86_REG_CS, createSelector(1, (S_GDT|S_PRIV_0)))
-	k.U.RegWrite(uc.X86_REG_DS, createSelector(2, (S_GDT|S_PRIV_0)))
-	k.U.RegWrite(uc.X86_REG_SS, createSelector(3, (S_GDT|S_PRIV_0)))
+	setupGdt(k.U, &k.gdt)
+}
+
+// setupGdt loads flat code, data and stack segments.
+func setupGdt(u models.Usercorn, gdt *uint64) {
+	gdtWrite(u, gdt, 1, 0, 0xffffff00, (A_PRESENT | A_DATA | A_DATA_WRITABLE | A_PRIV_0 | A_DIR_CON_BIT), F_PROT_32) // code
+	gdtWrite(u, gdt, 2, 0, 0xffffff00, (A_PRESENT | A_DATA | A_DATA_WRITABLE | A_PRIV_0 | A_DIR_CON_BIT), F_PROT_32) // data
+	gdtWrite(u, gdt, 3, 0, 0xffffff00, (A_PRESENT | A_DATA | A_DATA_WRITABLE | A_PRIV_0), F_PROT_32)                 // stack
+	u.RegWrite(uc.X86_REG_CS, createSelector(1, (S_GDT|S_PRIV_0)))
+	u.RegWrite(uc.X86_REG_DS, createSelector(2, (S_GDT|S_PRIV_0)))
+	u.RegWrite(uc.X86_REG_SS, createSelector(3, (S_GDT|S_PRIV_0)))
 }
 
 func LinuxKernels(u models.Usercorn) []interface{} {
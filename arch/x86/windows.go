@@ -0,0 +1,35 @@
+package x86
+
+import (
+	"github.com/felberj/binemu/kernel/windows"
+	"github.com/felberj/binemu/models"
+
+	uc "github.com/felberj/binemu/cpu/unicorn"
+)
+
+func WindowsKernels(u models.Usercorn) []interface{} {
+	return []interface{}{windows.NewKernel(u.Fs())}
+}
+
+// WindowsInit points fs at the TEB through its own GDT entry.
+func WindowsInit(u models.Usercorn, args, env []string) error {
+	teb, err := windows.Init(u, args, env)
+	if err != nil {
+		return err
+	}
+	var gdt uint64
+	setupGdt(u, &gdt)
+	if err := gdtWrite(u, &gdt, 5, uint32(teb), 0xfff, (A_PRESENT | A_DATA | A_DATA_WRITABLE | A_PRIV_3 | A_DIR_CON_BIT), F_PROT_32); err != nil {
+		return err
+	}
+	return u.RegWrite(uc.X86_REG_FS, createSelector(5, (S_GDT|S_PRIV_3)))
+}
+
+func init() {
+	Arch.RegisterOS(&models.OS{
+		Name:      "windows",
+		Kernels:   WindowsKernels,
+		Init:      WindowsInit,
+		Interrupt: windows.Interrupt,
+	})
+}
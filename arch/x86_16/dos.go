@@ -0,0 +1,182 @@
+package x86_16
+
+import (
+	"io"
+	"strings"
+
+	"github.com/felberj/binemu/cpu"
+	"github.com/felberj/binemu/kernel/common"
+	"github.com/felberj/binemu/kernel/dos"
+	"github.com/felberj/binemu/loader"
+	"github.com/felberj/binemu/models"
+
+	uc "github.com/felberj/binemu/cpu/unicorn"
+)
+
+var dosServices = map[int]string{
+	0x00: "terminate",
+	0x01: "read_char_echo",
+	0x02: "write_char",
+	0x06: "direct_console_io",
+	0x07: "read_char",
+	0x08: "read_char",
+	0x09: "print_string",
+	0x0a: "buffered_input",
+	0x19: "get_drive",
+	0x25: "set_vector",
+	0x30: "get_version",
+	0x35: "get_vector",
+	0x3c: "create_file",
+	0x3d: "open_file",
+	0x3e: "close_file",
+	0x3f: "read_file",
+	0x40: "write_file",
+	0x41: "delete_file",
+	0x42: "seek_file",
+	0x4c: "exit",
+}
+
+var videoServices = map[int]string{
+	0x00: "video_set_mode",
+	0x02: "video_set_cursor",
+	0x03: "video_get_cursor",
+	0x09: "video_write_char",
+	0x0a: "video_write_char",
+	0x0e: "video_teletype",
+	0x0f: "video_get_mode",
+	0x13: "video_write_string",
+}
+
+const pspBase = loader.ComSegment << 4
+
+// dosPorts latches port writes so reads return the last value written.
+// Nothing is attached to the ports, which is enough for programs poking
+// at the PIT, the keyboard controller or the speaker.
+type dosPorts map[uint32]uint32
+
+func (p dosPorts) in(port, size uint32) uint32 {
+	return p[port] & (1<<(size*8) - 1)
+}
+
+func (p dosPorts) out(port, size, value uint32) {
+	p[port] = value
+}
+
+func DosKernels(u models.Usercorn) []interface{} {
+	return []interface{}{dos.NewKernel(u.Fs())}
+}
+
+// setupPsp builds the program segment prefix at the start of the segment.
+func setupPsp(u models.Usercorn, args []string) error {
+	psp := make([]byte, 0x100)
+	// int 20h, so a near ret to offset 0 terminates
+	psp[0], psp[1] = 0xcd, 0x20
+	// first segment beyond the program's memory
+	u.ByteOrder().PutUint16(psp[2:], 0xa000)
+	tail := ""
+	if len(args) > 1 {
+		tail = " " + strings.Join(args[1:], " ")
+	}
+	if len(tail) > 126 {
+		tail = tail[:126]
+	}
+	psp[0x80] = byte(len(tail))
+	copy(psp[0x81:], tail+"\r")
+	mem := u.Mem()
+	mem.Seek(pspBase, io.SeekStart)
+	_, err := mem.Write(psp)
+	return err
+}
+
+func DosInit(u models.Usercorn, args, env []string) error {
+	// interrupt vector table and BIOS data area
+	if err := u.MemMap(0, 0x1000, cpu.PROT_READ|cpu.PROT_WRITE); err != nil {
+		return err
+	}
+	if err := setupPsp(u, args); err != nil {
+		return err
+	}
+	for _, seg := range []int{uc.X86_REG_CS, uc.X86_REG_DS, uc.X86_REG_ES, uc.X86_REG_SS} {
+		if err := u.RegWrite(seg, loader.ComSegment); err != nil {
+			return err
+		}
+	}
+	// the stack starts with a zero word, returning to the int 20h in the PSP
+	if err := u.RegWrite(uc.X86_REG_SP, 0xfffe); err != nil {
+		return err
+	}
+	ports := make(dosPorts)
+	if _, err := u.GetCPU().HookX86In(ports.in, 1, 0); err != nil {
+		return err
+	}
+	_, err := u.GetCPU().HookX86Out(ports.out, 1, 0)
+	return err
+}
+
+// dosCall runs the service AH of an interrupt. An unknown one stops the
+// guest as an unsupported syscall numbered vector<<8|AH.
+func dosCall(u models.Usercorn, services map[int]string, vector uint32) {
+	ah, _ := u.RegRead(uc.X86_REG_AH)
+	// the services read and write registers themselves
+	u.Syscall(int(vector<<8|uint32(ah)), services[int(ah)], common.RegArgs(u, nil))
+}
+
+// guestVector enters the handler the guest set for intno, the way the CPU
+// does: FLAGS, CS and IP are pushed, and interrupts and tracing are
+// disabled. It returns false if the vector is not set.
+func guestVector(u models.Usercorn, intno uint32) bool {
+	var tmp [4]byte
+	mem := u.Mem()
+	mem.Seek(int64(intno*4), io.SeekStart)
+	if _, err := mem.Read(tmp[:]); err != nil {
+		return false
+	}
+	vec := u.ByteOrder().Uint32(tmp[:])
+	if vec == 0 {
+		return false
+	}
+	reg := func(r int) uint16 {
+		v, _ := u.RegRead(r)
+		return uint16(v)
+	}
+	flags, cs, ip := reg(uc.X86_REG_EFLAGS), reg(uc.X86_REG_CS), reg(uc.X86_REG_IP)
+	ss, sp := reg(uc.X86_REG_SS), reg(uc.X86_REG_SP)
+	for _, v := range []uint16{flags, cs, ip} {
+		sp -= 2
+		u.ByteOrder().PutUint16(tmp[:], v)
+		mem.Seek(int64(ss)<<4+int64(sp), io.SeekStart)
+		mem.Write(tmp[:2])
+	}
+	u.RegWrite(uc.X86_REG_SP, uint64(sp))
+	u.RegWrite(uc.X86_REG_EFLAGS, uint64(flags&^0x300))
+	u.RegWrite(uc.X86_REG_CS, uint64(vec>>16))
+	u.RegWrite(uc.X86_REG_IP, uint64(vec&0xffff))
+	return true
+}
+
+// DosInterrupt runs the emulated DOS and BIOS services, and for other
+// interrupts the handler the guest installed. Interrupts without either
+// stop the guest as unsupported syscalls numbered intno<<8.
+func DosInterrupt(u models.Usercorn, intno uint32) {
+	switch intno {
+	case 0x10:
+		dosCall(u, videoServices, intno)
+	case 0x20:
+		u.Syscall(0, "terminate", common.RegArgs(u, nil))
+	case 0x21:
+		dosCall(u, dosServices, intno)
+	default:
+		if !guestVector(u, intno) {
+			u.Syscall(int(intno<<8), "", common.RegArgs(u, nil))
+		}
+	}
+}
+
+func init() {
+	Arch.RegisterOS(&models.OS{
+		Name:      "dos",
+		Kernels:   DosKernels,
+		Init:      DosInit,
+		Interrupt: DosInterrupt,
+	})
+}
@@ -0,0 +1,90 @@
+package x86_16
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/felberj/binemu/cpu"
+	"github.com/felberj/binemu/models"
+
+	uc "github.com/felberj/binemu/cpu/unicorn"
+)
+
+type dosSyscall struct {
+	num  int
+	name string
+}
+
+// intUsercorn runs the interrupt handlers on a bare CPU and records the
+// syscalls they make.
+type intUsercorn struct {
+	models.Usercorn
+	c        *cpu.Cpu
+	syscalls []dosSyscall
+}
+
+func (u *intUsercorn) RegRead(reg int) (uint64, error)    { return u.c.RegRead(reg) }
+func (u *intUsercorn) RegWrite(reg int, val uint64) error { return u.c.RegWrite(reg, val) }
+func (u *intUsercorn) Mem() io.ReadWriteSeeker            { return u.c.Mem() }
+func (u *intUsercorn) ByteOrder() binary.ByteOrder        { return binary.LittleEndian }
+
+func (u *intUsercorn) Syscall(num int, name string, getArgs models.SysGetArgs) (uint64, error) {
+	u.syscalls = append(u.syscalls, dosSyscall{num, name})
+	return 0, nil
+}
+
+func TestDosInterrupts(t *testing.T) {
+	c, err := Arch.Cpu.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &intUsercorn{c: c}
+	if _, err := c.HookInterrupt(func(intno uint32) { DosInterrupt(u, intno) }, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.MemMap(0, 0x10000, cpu.PROT_ALL); err != nil {
+		t.Fatal(err)
+	}
+	const base, handler, stack = 0x1000, 0x1100, 0x8000
+	code := []byte{
+		0xb8, 0x00, 0x00, // mov ax, 0
+		0xcd, 0x60, // int 60h, set by the guest
+		0x89, 0xc3, // mov bx, ax
+		0xb4, 0x77, // mov ah, 77h
+		0xcd, 0x21, // int 21h, an unknown service
+		0xb4, 0x4c, // mov ah, 4ch
+		0xcd, 0x21, // int 21h, exit
+		0xcd, 0x61, // int 61h, not set
+	}
+	handlerCode := []byte{
+		0xb8, 0x34, 0x12, // mov ax, 1234h
+		0xcf, // iret
+	}
+	ivt := []byte{handler & 0xff, handler >> 8, 0, 0}
+	for addr, data := range map[uint64][]byte{base: code, handler: handlerCode, 0x60 * 4: ivt} {
+		if err := c.MemWrite(addr, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.RegWrite(uc.X86_REG_SP, stack)
+	if err := c.Start(base, base+uint64(len(code))); err != nil {
+		t.Fatal(err)
+	}
+
+	if bx, _ := c.RegRead(uc.X86_REG_BX); bx != 0x1234 {
+		t.Errorf("bx is %#x, the guest's handler did not run", bx)
+	}
+	if sp, _ := c.RegRead(uc.X86_REG_SP); sp != stack {
+		t.Errorf("sp is %#x after iret, want %#x", sp, stack)
+	}
+	want := []dosSyscall{{0x2177, ""}, {0x214c, "exit"}, {0x6100, ""}}
+	if len(u.syscalls) != len(want) {
+		t.Fatalf("syscalls %v, want %v", u.syscalls, want)
+	}
+	for i := range want {
+		if u.syscalls[i] != want[i] {
+			t.Errorf("syscall %d is %v, want %v", i, u.syscalls[i], want[i])
+		}
+	}
+}
@@ -4,15 +4,15 @@ import (
 	"testing"
 )
 
-var testAsm = `
-mov rax, 100
-l1:
-dec rax
-cmp rax, 0
-jg l1
-`
+// testCode is a countdown loop.
+var testCode = []byte{
+	0x48, 0xc7, 0xc0, 0x64, 0x00, 0x00, 0x00, // mov rax, 100
+	0x48, 0xff, 0xc8, // l1: dec rax
+	0x48, 0x83, 0xf8, 0x00, // cmp rax, 0
+	0x7f, 0xf7, // jg l1
+}
 
 func TestX86_64(t *testing.T)          { Arch.SmokeTest(t) }
-func TestX86_64Exec(t *testing.T)      { Arch.TestExec(t, testAsm) }
+func TestX86_64Exec(t *testing.T)      { Arch.TestExec(t, testCode) }
 func BenchmarkX86_64Regs(b *testing.B) { Arch.BenchRegs(b) }
-func BenchmarkX86_64Exec(b *testing.B) { Arch.BenchExec(b, testAsm) }
+func BenchmarkX86_64Exec(b *testing.B) { Arch.BenchExec(b, testCode) }
@@ -2,166 +2,122 @@ package x86_64
 
 import (
 	uc "github.com/felberj/binemu/cpu/unicorn"
-	"github.com/lunixbochs/ghostrace/ghost/sys/num"
 
 	"github.com/felberj/binemu/kernel/common"
+	"github.com/felberj/binemu/kernel/darwin"
 	"github.com/felberj/binemu/models"
 )
 
-type NameMapEntry struct {
-	id     int
-	subMap map[string]NameMapEntry
-}
-
-var SysctlNameMapKern = map[string]NameMapEntry{
-	"ostype":          {1, nil},
-	"osrelease":       {2, nil},
-	"osrevision":      {3, nil},
-	"version":         {4, nil},
-	"maxvnodes":       {5, nil},
-	"maxproc":         {6, nil},
-	"maxfiles":        {7, nil},
-	"argmax":          {8, nil},
-	"securelevel":     {9, nil},
-	"hostname":        {10, nil},
-	"hostid":          {11, nil},
-	"clockrate":       {12, nil},
-	"vnode":           {13, nil},
-	"proc":            {14, nil},
-	"file":            {15, nil},
-	"profiling":       {16, nil},
-	"posix1version":   {17, nil},
-	"ngroups":         {18, nil},
-	"job_control":     {19, nil},
-	"saved_ids":       {20, nil},
-	"boottime":        {21, nil},
-	"nisdomainname":   {22, nil},
-	"maxpartitions":   {23, nil},
-	"kdebug":          {24, nil},
-	"update":          {25, nil},
-	"osreldate":       {26, nil},
-	"ntp_pll":         {27, nil},
-	"bootfile":        {28, nil},
-	"maxfilesperproc": {29, nil},
-	"maxprocperuid":   {30, nil},
-	"dumpdev":         {31, nil}, /* we lie; don't print as int */
-	"ipc":             {32, nil},
+// Syscall classes, stored in the top byte of rax.
+const (
+	dwMach = 1
+	dwUnix = 2
+	dwMdep = 3
+	dwDiag = 4
 
-	"usrstack":   {35, nil},
-	"logsigexit": {36, nil},
-	"symfile":    {37, nil},
-	"procargs":   {38, nil},
-
-	"netboot":   {40, nil},
-	"panicinfo": {41, nil},
-	"sysv":      {42, nil},
+	dwClassShift = 24
+	dwClassMask  = 1<<dwClassShift - 1
+)
 
-	"exec":           {45, nil},
-	"aiomax":         {46, nil},
-	"aioprocmax":     {47, nil},
-	"aiothreads":     {48, nil},
-	"procargs2":      {49, nil},
-	"corefile":       {50, nil},
-	"coredump":       {51, nil},
-	"sugid_coredump": {52, nil},
-	"delayterm":      {53, nil},
-	"shreg_private":  {54, nil},
+var darwinUnixSyscalls = map[int]string{
+	1:   "exit",
+	3:   "read",
+	4:   "write",
+	5:   "open",
+	6:   "close",
+	20:  "getpid",
+	54:  "ioctl",
+	73:  "munmap",
+	74:  "mprotect",
+	197: "mmap",
+	199: "lseek",
+	202: "sysctl",
+	327: "issetugid",
+	372: "thread_selfid",
+}
 
-	"low_pri_window":             {56, nil},
-	"low_pri_delay":              {57, nil},
-	"posix":                      {58, nil},
-	"usrstack64":                 {59, nil},
-	"nx":                         {60, nil},
-	"tfp":                        {61, nil},
-	"procname":                   {62, nil},
-	"threadsigaltstack":          {63, nil},
-	"speculative_reads_disabled": {64, nil},
-	"osversion":                  {65, nil},
-	"safeboot":                   {66, nil},
-	"lctx":                       {67, nil},
-	"rage_vnode":                 {68, nil},
-	"tty":                        {69, nil},
-	"check_openevt":              {70, nil},
-	"thread_name":                {71, nil},
+var darwinMachTraps = map[int]string{
+	10: "kernelrpc_mach_vm_allocate_trap",
+	12: "kernelrpc_mach_vm_deallocate_trap",
+	14: "kernelrpc_mach_vm_protect_trap",
+	16: "kernelrpc_mach_port_allocate_trap",
+	18: "kernelrpc_mach_port_deallocate_trap",
+	19: "kernelrpc_mach_port_mod_refs_trap",
+	26: "mach_reply_port",
+	27: "thread_self_trap",
+	28: "task_self_trap",
+	29: "host_self_trap",
+	31: "mach_msg_trap",
+	33: "semaphore_signal_trap",
+	36: "semaphore_wait_trap",
+	89: "mach_timebase_info_trap",
 }
 
-var SysctlNameMapVfs = map[string]NameMapEntry{
-	"vfsconf": {0, nil},
+var darwinMdepSyscalls = map[int]string{
+	3: "thread_fast_set_cthread_self",
 }
 
-var SysctlNameMapVm = map[string]NameMapEntry{
-	"vmmeter": {1, nil},
-	"loadavg": {2, nil},
+// DarwinAMD64Kernel implements the machine dependent calls.
+type DarwinAMD64Kernel struct {
+	common.KernelBase
+}
 
-	"swapusage": {5, nil},
+// ThreadFastSetCthreadSelf points gs at the thread's TSD area.
+func (k *DarwinAMD64Kernel) ThreadFastSetCthreadSelf(addr uint64) uint64 {
+	gsmsr := uint64(0xC0000101)
+	k.U.GetCPU().Unicorn.RegWriteX86Msr(gsmsr, addr)
+	return 0
 }
 
-var SysctlNameMapHw = map[string]NameMapEntry{
-	"machine":       {1, nil},
-	"model":         {2, nil},
-	"ncpu":          {3, nil},
-	"byteorder":     {4, nil},
-	"physmem":       {5, nil},
-	"usermem":       {6, nil},
-	"pagesize":      {7, nil},
-	"disknames":     {8, nil},
-	"diskstats":     {9, nil},
-	"epoch":         {10, nil},
-	"floatingpoint": {11, nil},
-	"machinearch":   {12, nil},
-	"vectorunit":    {13, nil},
-	"busfrequency":  {14, nil},
-	"cpufrequency":  {15, nil},
-	"cachelinesize": {16, nil},
-	"l1icachesize":  {17, nil},
-	"l1dcachesize":  {18, nil},
-	"l2settings":    {19, nil},
-	"l2cachesize":   {20, nil},
-	"l3settings":    {21, nil},
-	"l3cachesize":   {22, nil},
-	"tbfrequency":   {23, nil},
-	"memsize":       {24, nil},
-	"availcpu":      {25, nil},
+func DarwinKernels(u models.Usercorn) []interface{} {
+	return []interface{}{&DarwinAMD64Kernel{}, darwin.NewKernel(u.Fs())}
 }
 
-var SysctlNameMapUser = map[string]NameMapEntry{
-	"cs_path":          {1, nil},
-	"bc_base_max":      {2, nil},
-	"bc_dim_max":       {3, nil},
-	"bc_scale_max":     {4, nil},
-	"bc_string_max":    {5, nil},
-	"coll_weights_max": {6, nil},
-	"expr_nest_max":    {7, nil},
-	"line_max":         {8, nil},
-	"re_dup_max":       {9, nil},
-	"posix2_version":   {10, nil},
-	"posix2_c_bind":    {11, nil},
-	"posix2_c_dev":     {12, nil},
-	"posix2_char_term": {13, nil},
-	"posix2_fort_dev":  {14, nil},
-	"posix2_fort_run":  {15, nil},
-	"posix2_localedef": {16, nil},
-	"posix2_sw_dev":    {17, nil},
-	"posix2_upe":       {18, nil},
-	"stream_max":       {19, nil},
-	"tzname_max":       {20, nil},
+func DarwinInit(u models.Usercorn, args, env []string) error {
+	if err := darwin.StackInit(u, args, env); err != nil {
+		return err
+	}
+	return AbiInit(u, DarwinSyscall)
 }
 
-var SysctlNameMapCTL = map[string]NameMapEntry{
-	"kern":    {1, SysctlNameMapKern},
-	"vm":      {2, SysctlNameMapVm},
-	"vfs":     {3, SysctlNameMapVfs},
-	"net":     {4, nil},
-	"debug":   {5, nil},
-	"hw":      {6, SysctlNameMapHw},
-	"machdep": {7, nil},
-	"user":    {8, SysctlNameMapUser},
+// setCarry reports BSD syscall errors to libsyscall, which checks the
+// carry flag after every syscall instruction.
+func setCarry(u models.Usercorn, set bool) {
+	eflags, _ := u.RegRead(uc.X86_REG_EFLAGS)
+	if set {
+		eflags |= 1
+	} else {
+		eflags &^= 1
+	}
+	u.RegWrite(uc.X86_REG_EFLAGS, eflags)
 }
 
 func DarwinSyscall(u models.Usercorn) {
 	rax, _ := u.RegRead(uc.X86_REG_RAX)
-	name, _ := num.Darwin_x86_mach[int(rax)]
-	ret, _ := u.Syscall(int(rax), name, common.RegArgs(u, AbiRegs))
+	class, nr := int(rax>>dwClassShift), int(rax&dwClassMask)
+	var name string
+	switch class {
+	case dwUnix:
+		name = darwinUnixSyscalls[nr]
+	case dwMach:
+		name = darwinMachTraps[nr]
+	case dwMdep:
+		name = darwinMdepSyscalls[nr]
+	}
+	// without a name, Syscall stops the guest as unsupported
+	ret, err := u.Syscall(int(rax), name, common.RegArgs(u, AbiRegs))
+	if err != nil {
+		return
+	}
+	if class == dwUnix {
+		// Mach traps return a kern_return_t and leave the flags alone
+		if int64(ret) < 0 && int64(ret) > -4096 {
+			ret = -ret
+			setCarry(u, true)
+		} else {
+			setCarry(u, false)
+		}
+	}
 	u.RegWrite(uc.X86_REG_RAX, ret)
 }
 
@@ -170,3 +126,12 @@ func DarwinInterrupt(u models.Usercorn, intno uint32) {
 		DarwinSyscall(u)
 	}
 }
+
+func init() {
+	Arch.RegisterOS(&models.OS{
+		Name:      "darwin",
+		Kernels:   DarwinKernels,
+		Init:      DarwinInit,
+		Interrupt: DarwinInterrupt,
+	})
+}
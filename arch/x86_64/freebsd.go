@@ -0,0 +1,123 @@
+package x86_64
+
+import (
+	uc "github.com/felberj/binemu/cpu/unicorn"
+
+	"github.com/felberj/binemu/kernel/bsd"
+	"github.com/felberj/binemu/kernel/common"
+	"github.com/felberj/binemu/kernel/freebsd"
+	"github.com/felberj/binemu/models"
+)
+
+var freebsdSyscalls = map[int]string{
+	1:   "exit",
+	3:   "read",
+	4:   "write",
+	5:   "open",
+	6:   "close",
+	20:  "getpid",
+	33:  "access",
+	54:  "ioctl",
+	58:  "readlink",
+	73:  "munmap",
+	74:  "mprotect",
+	116: "gettimeofday",
+	121: "writev",
+	165: "sysarch",
+	202: "sysctl",
+	232: "clock_gettime",
+	253: "issetugid",
+	340: "sigprocmask",
+	416: "sigaction",
+	432: "thr_self",
+	477: "mmap",
+	499: "openat",
+	551: "fstat",
+	552: "newfstatat",
+	570: "sysctlbyname",
+}
+
+// sysarch operations
+const (
+	AMD64_GET_FSBASE = 128
+	AMD64_SET_FSBASE = 129
+	AMD64_GET_GSBASE = 130
+	AMD64_SET_GSBASE = 131
+)
+
+// FreebsdAMD64Kernel implements the machine dependent syscalls.
+type FreebsdAMD64Kernel struct {
+	common.KernelBase
+}
+
+// Sysarch syscall. Only the segment base operations used for TLS exist.
+func (k *FreebsdAMD64Kernel) Sysarch(op int, parms common.Buf) uint64 {
+	msr := uint64(0xC0000100)
+	if op == AMD64_GET_GSBASE || op == AMD64_SET_GSBASE {
+		msr = 0xC0000101
+	}
+	u := k.U.GetCPU().Unicorn
+	switch op {
+	case AMD64_SET_FSBASE, AMD64_SET_GSBASE:
+		var base uint64
+		if err := parms.Unpack(&base); err != nil {
+			return bsd.Errno(bsd.EFAULT)
+		}
+		u.RegWriteX86Msr(msr, base)
+	case AMD64_GET_FSBASE, AMD64_GET_GSBASE:
+		base, _ := u.RegReadX86Msr(msr)
+		if err := parms.Pack(base); err != nil {
+			return bsd.Errno(bsd.EFAULT)
+		}
+	default:
+		return bsd.Errno(bsd.EINVAL)
+	}
+	return 0
+}
+
+func FreebsdKernels(u models.Usercorn) []interface{} {
+	return []interface{}{&FreebsdAMD64Kernel{}, freebsd.NewKernel(u.Fs())}
+}
+
+func FreebsdInit(u models.Usercorn, args, env []string) error {
+	if err := freebsd.StackInit(u, args, env); err != nil {
+		return err
+	}
+	// the entry point gets the initial stack pointer in rdi
+	sp, _ := u.RegRead(uc.X86_REG_RSP)
+	if err := u.RegWrite(uc.X86_REG_RDI, sp); err != nil {
+		return err
+	}
+	return AbiInit(u, FreebsdSyscall)
+}
+
+func FreebsdSyscall(u models.Usercorn) {
+	rax, _ := u.RegRead(uc.X86_REG_RAX)
+	// without a name, Syscall stops the guest as unsupported
+	ret, err := u.Syscall(int(rax), freebsdSyscalls[int(rax)], common.RegArgs(u, AbiRegs))
+	if err != nil {
+		return
+	}
+	if int64(ret) < 0 && int64(ret) > -4096 {
+		ret = -ret
+		setCarry(u, true)
+	} else {
+		setCarry(u, false)
+	}
+	u.RegWrite(uc.X86_REG_RAX, ret)
+}
+
+func FreebsdInterrupt(u models.Usercorn, intno uint32) {
+	if intno == 0x80 {
+		FreebsdSyscall(u)
+	}
+}
+
+func init() {
+	Arch.RegisterOS(&models.OS{
+		Name:      "freebsd",
+		Kernels:   FreebsdKernels,
+		Init:      FreebsdInit,
+		Interrupt: FreebsdInterrupt,
+	})
+}
@@ -1,6 +1,7 @@
 package x86_64
 
 import (
+	"debug/elf"
 	"fmt"
 	"io"
 	"log"
@@ -45,17 +46,17 @@ func setupVsyscall(u models.Usercorn) error {
 	if _, err := mem.Write(ret); err != nil {
 		return err
 	}
+	gettimeofday := vsyscallFunc(u, 96, "gettimeofday")
+	time := vsyscallFunc(u, 201, "time")
+	getcpu := vsyscallFunc(u, 309, "getcpu")
 	_, err := u.GetCPU().HookCode(func(addr uint64, size uint32) {
 		switch addr {
 		case vgettimeofday:
-			ret, _ := u.Syscall(96, "gettimeofday", common.RegArgs(u, AbiRegs))
-			u.RegWrite(uc.X86_REG_RAX, ret)
+			gettimeofday()
 		case vtime:
-			ret, _ := u.Syscall(201, "time", common.RegArgs(u, AbiRegs))
-			u.RegWrite(uc.X86_REG_RAX, ret)
+			time()
 		case vgetcpu:
-			ret, _ := u.Syscall(309, "getcpu", common.RegArgs(u, AbiRegs))
-			u.RegWrite(uc.X86_REG_RAX, ret)
+			getcpu()
 		default:
 			panic(fmt.Sprintf("unsupported vsyscall trap: 0x%x\n", addr))
 		}
@@ -63,6 +64,24 @@ func setupVsyscall(u models.Usercorn) error {
 	return errors.Wrap(err, "u.HookAdd() failed")
 }
 
+// vsyscallFunc forwards a vsyscall or vDSO call to the kernel.
+func vsyscallFunc(u models.Usercorn, num int, name string) func() {
+	return func() {
+		ret, _ := u.Syscall(num, name, common.RegArgs(u, AbiRegs))
+		u.RegWrite(uc.X86_REG_RAX, ret)
+	}
+}
+
+func setupVdso(u models.Usercorn) error {
+	_, err := linux.MapVdso(u, elf.EM_X86_64, []byte{0xc3}, []linux.VdsoFunc{
+		{Name: "__vdso_clock_gettime", Call: vsyscallFunc(u, 228, "clock_gettime")},
+		{Name: "__vdso_gettimeofday", Call: vsyscallFunc(u, 96, "gettimeofday")},
+		{Name: "__vdso_time", Call: vsyscallFunc(u, 201, "time")},
+		{Name: "__vdso_getcpu", Call: vsyscallFunc(u, 309, "getcpu")},
+	})
+	return err
+}
+
 // TODO: put these somewhere. ghostrace maybe.
 const (
 	ARCH_SET_GS = 0x1001
@@ -108,6 +127,9 @@ func LinuxKernels(u models.Usercorn) []interface{} {
 }
 
 func LinuxInit(u models.Usercorn, args, env []string) error {
+	if err := setupVdso(u); err != nil {
+		return err
+	}
 	if err := linux.StackInit(u, args, env); err != nil {
 		return err
 	}
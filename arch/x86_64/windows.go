@@ -0,0 +1,28 @@
+package x86_64
+
+import (
+	"github.com/felberj/binemu/kernel/windows"
+	"github.com/felberj/binemu/models"
+)
+
+func WindowsKernels(u models.Usercorn) []interface{} {
+	return []interface{}{windows.NewKernel(u.Fs())}
+}
+
+// WindowsInit points gs at the TEB.
+func WindowsInit(u models.Usercorn, args, env []string) error {
+	teb, err := windows.Init(u, args, env)
+	if err != nil {
+		return err
+	}
+	return u.GetCPU().Unicorn.RegWriteX86Msr(0xC0000101, teb)
+}
+
+func init() {
+	Arch.RegisterOS(&models.OS{
+		Name:      "windows",
+		Kernels:   WindowsKernels,
+		Init:      WindowsInit,
+		Interrupt: windows.Interrupt,
+	})
+}
@@ -0,0 +1,14 @@
+// libgreet.so for the built-in linker's test, without a libc:
+// gcc -shared -fPIC -nostdlib -fno-stack-protector -o lib/libgreet.so greet.c
+int ready;
+
+static const char msg[] = "hello from libgreet\n";
+
+__attribute__((constructor)) static void init(void) {
+	ready = 42;
+}
+
+void greet(void) {
+	long ret;
+	__asm__ volatile("syscall" : "=a"(ret) : "a"(1), "D"(1), "S"(msg), "d"(sizeof(msg) - 1) : "rcx", "r11", "memory");
+}
@@ -0,0 +1,12 @@
+// calls into lib/libgreet.so, found through $ORIGIN, and exits with what
+// the library's constructor left in ready:
+// gcc -nostdlib -fno-stack-protector -no-pie -o hello hello.c -Llib -lgreet -Wl,-rpath,'$ORIGIN/lib' -Wl,--enable-new-dtags
+extern int ready;
+void greet(void);
+
+void _start(void) {
+	greet();
+	__asm__ volatile("syscall" : : "a"(60), "D"(ready));
+	for (;;) {
+	}
+}
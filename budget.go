@@ -0,0 +1,81 @@
+package binemu
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	uc "github.com/felberj/binemu/cpu/unicorn"
+)
+
+var (
+	// ErrInsnLimit stops a guest that ran ExecConfig.InsnLimit instructions.
+	ErrInsnLimit = errors.New("instruction limit reached")
+	// ErrTimeout stops a guest that ran longer than ExecConfig.Timeout.
+	ErrTimeout = errors.New("timeout")
+)
+
+// budget is what is left of the limits of a run. Unicorn enforces the
+// deadline, each start of the CPU gets the time the ones before left over.
+// The instructions are counted by a code hook across all starts, as
+// Unicorn doesn't tell how many ran when something else stopped the CPU.
+// A guest blocked in a syscall is only stopped once the syscall returns.
+type budget struct {
+	insns    uint64 // 0 without a limit
+	ran      uint64
+	deadline time.Time
+}
+
+func newBudget(insns uint64, timeout time.Duration, now time.Time) *budget {
+	b := &budget{insns: insns}
+	if timeout > 0 {
+		b.deadline = now.Add(timeout)
+	}
+	return b
+}
+
+// step counts an instruction about to run and reports whether the limit
+// allows it.
+func (b *budget) step() bool {
+	b.ran++
+	return b.insns == 0 || b.ran <= b.insns
+}
+
+// exhausted reports whether the guest ran all instructions it may.
+func (b *budget) exhausted() bool {
+	return b.insns > 0 && b.ran > b.insns
+}
+
+// options returns the limits of the next start of the CPU, or the error
+// the run ends with if nothing is left.
+func (b *budget) options(now time.Time) (*uc.UcOptions, error) {
+	if b.exhausted() {
+		return nil, ErrInsnLimit
+	}
+	opts := &uc.UcOptions{}
+	if !b.deadline.IsZero() {
+		left := b.deadline.Sub(now)
+		if left <= 0 {
+			return nil, ErrTimeout
+		}
+		// Unicorn counts in microseconds, and 0 is no timeout
+		opts.Timeout = uint64(left / time.Microsecond)
+		if opts.Timeout == 0 {
+			opts.Timeout = 1
+		}
+	}
+	return opts, nil
+}
+
+// spent returns the error a start of the CPU that returned at now without
+// anything having stopped it ends the run with, nil if no limit was
+// reached.
+func (b *budget) spent(now time.Time) error {
+	if !b.deadline.IsZero() && !now.Before(b.deadline) {
+		return ErrTimeout
+	}
+	if b.exhausted() {
+		return ErrInsnLimit
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package binemu
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBudget(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	b := newBudget(0, 0, now)
+	if opts, err := b.options(now); err != nil || opts.Count != 0 || opts.Timeout != 0 {
+		t.Fatalf("unlimited run got %+v, %v", opts, err)
+	}
+	if err := b.spent(now); err != nil {
+		t.Fatalf("unlimited run spent: %v", err)
+	}
+
+	// the instructions of every start count against one limit
+	b = newBudget(100, 0, now)
+	for start := 0; start < 2; start++ {
+		if opts, err := b.options(now); err != nil || opts.Count != 0 || opts.Timeout != 0 {
+			t.Fatalf("start %d got %+v, %v", start, opts, err)
+		}
+		for i := 0; i < 50; i++ {
+			if !b.step() {
+				t.Fatalf("start %d stopped after %d instructions", start, i)
+			}
+		}
+		if err := b.spent(now); err != nil {
+			t.Fatalf("start %d spent: %v", start, err)
+		}
+	}
+	if b.step() {
+		t.Fatal("ran past the limit")
+	}
+	if err := b.spent(now); err != ErrInsnLimit {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := b.options(now); err != ErrInsnLimit {
+		t.Fatalf("restarted after the limit: %v", err)
+	}
+
+	// every start gets the time that is left
+	b = newBudget(100, time.Second, now)
+	if opts, err := b.options(now.Add(300 * time.Millisecond)); err != nil || opts.Timeout != 700000 {
+		t.Fatalf("got %+v, %v", opts, err)
+	}
+	if opts, err := b.options(now.Add(time.Second - time.Nanosecond)); err != nil || opts.Timeout != 1 {
+		t.Fatalf("got %+v, %v", opts, err)
+	}
+	if _, err := b.options(now.Add(time.Second)); err != ErrTimeout {
+		t.Fatalf("got %v", err)
+	}
+	for i := 0; i <= 100; i++ {
+		b.step()
+	}
+	// the deadline wins over the instruction limit
+	if err := b.spent(now.Add(time.Second)); err != ErrTimeout {
+		t.Fatalf("got %v", err)
+	}
+	if err := b.spent(now.Add(time.Millisecond)); err != ErrInsnLimit {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -1,16 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 
 	"github.com/felberj/binemu/arch"
 	"github.com/felberj/binemu/loader"
-	"github.com/felberj/ramfs"
+	"github.com/felberj/binemu/loader/dynlink"
+	"github.com/felberj/binemu/loader/ldcache"
+	"github.com/felberj/binemu/models"
+	"github.com/felberj/binemu/vfs"
 	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
 
@@ -21,109 +31,465 @@ import (
 var (
 	config     = flag.String("config", "", "configuration of the environment (as textproto)")
 	configPath = flag.String("config_path", "", "path to the configurations file")
+
+	raw       = flag.Bool("raw", false, "load the program as a flat binary, Intel HEX or S-record image")
+	rawArch   = flag.String("arch", "x86_64", "architecture of a raw image")
+	rawBase   = flag.String("base", "0x400000", "address a raw image is loaded at")
+	rawEntry  = flag.String("entry", "", "entry point of a raw image, relative to -base (default: start of the image)")
+	rawEndian = flag.String("endian", "little", "byte order of a raw image (little or big)")
+
+	export     = flag.String("export", "", "write the guest filesystem to this tar, tar.gz or directory after the run")
+	exportDiff = flag.Bool("export_diff", false, "only export the files the guest changed")
+
+	summary = flag.Bool("summary", false, "print how the guest ended as a line of JSON to stderr")
 )
 
-func loadFiles(fs *ramfs.Filesystem, c *pb.Config) error {
+// rawLoader loads f as configured by the -raw flags. Syscalls go to the
+// kernel from the config, or linux if there is none.
+func rawLoader(f *os.File, kernel string) (loader.Loader, error) {
+	if kernel == "" {
+		kernel = "linux"
+	}
+	base, err := strconv.ParseUint(*rawBase, 0, 64)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid -base")
+	}
+	var entry *uint64
+	if *rawEntry != "" {
+		e, err := strconv.ParseUint(*rawEntry, 0, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid -entry")
+		}
+		entry = &e
+	}
+	var order binary.ByteOrder
+	switch *rawEndian {
+	case "little":
+		order = binary.LittleEndian
+	case "big":
+		order = binary.BigEndian
+	default:
+		return nil, errors.Errorf("invalid -endian %q", *rawEndian)
+	}
+	return loader.NewRawLoader(f, *rawArch, kernel, order, base, entry)
+}
+
+func loadFiles(fs *vfs.Filesystem, c *pb.Config) error {
+	for _, r := range c.Rootfs {
+		f := path.Join(c.ConfigDir, r.HostPath)
+		if err := fs.Import(f, r.GuestPath); err != nil {
+			return errors.Wrapf(err, "unable to import %q into the guest at %q", f, r.GuestPath)
+		}
+	}
+	for _, l := range c.Symlinks {
+		if err := fs.MkdirAll(path.Dir(l.GuestPath), 0755); err != nil {
+			return errors.Wrapf(err, "unable to create the directory of %q", l.GuestPath)
+		}
+		// like files, links replace what the rootfs has there
+		if fi, err := fs.Lstat(l.GuestPath); err == nil && !fi.IsDir() {
+			fs.Remove(l.GuestPath)
+		}
+		if err := fs.Symlink(l.Target, l.GuestPath); err != nil {
+			return errors.Wrapf(err, "unable to create symlink %q to %q", l.GuestPath, l.Target)
+		}
+	}
 	for _, p := range c.Files {
 		f := path.Join(c.ConfigDir, p.HostPath)
 		if err := fs.MapFile(f, p.GuestPath); err != nil {
-			return errors.Wrapf(err, "unable to load file %q into ramfs to %q", f, p.GuestPath)
+			return errors.Wrapf(err, "unable to load file %q into the guest at %q", f, p.GuestPath)
 		}
-		if err := fs.Chmod(p.GuestPath, os.FileMode(p.Mode)); err != nil {
+		if err := fs.Chmod(p.GuestPath, vfs.FileMode(uint32(p.Mode))); err != nil {
 			return errors.Wrapf(err, "unable to chmod %q", p.GuestPath)
 		}
 	}
 	return nil
 }
 
-func run(c *pb.Config, args []string) error {
-	fs := ramfs.New()
+// setupInterp makes sure the interpreter a binary names is in the guest
+// filesystem, copying it from the host loader of the config if needed.
+// It returns true if the config has the binary linked in the emulator
+// instead.
+func setupInterp(fs *vfs.Filesystem, c *pb.Config, interp string) (bool, error) {
+	if interp == "" {
+		return false, nil
+	}
+	if c.BuiltinLinker {
+		return true, nil
+	}
+	if _, err := fs.Stat(interp); err == nil {
+		return false, nil
+	}
+	if c.Loader == "" {
+		return false, errors.Errorf("the binary needs %q, but it is not in the filesystem and the config has neither a loader nor builtin_linker", interp)
+	}
+	f := path.Join(c.ConfigDir, c.Loader)
+	if err := fs.MapFile(f, interp); err != nil {
+		return false, errors.Wrapf(err, "unable to load loader %q into the guest at %q", f, interp)
+	}
+	return false, nil
+}
 
-	exe := args[0]
-	f, err := os.Open(exe)
-	if err != nil {
-		return err
+// cred returns the ids the guest starts with. A setuid or setgid exe makes
+// its owner the effective user or group.
+func cred(fs *vfs.Filesystem, c *pb.Config) (models.Cred, error) {
+	cr := models.Cred{Uid: int(c.Uid), Euid: int(c.Uid), Gid: int(c.Gid), Egid: int(c.Gid)}
+	for _, g := range c.Groups {
+		cr.Groups = append(cr.Groups, int(g))
 	}
-	defer f.Close()
-	l, err := loader.LoaderFor(f)
+	if c.Exe == "" {
+		return cr, nil
+	}
+	info, err := fs.Info(c.Exe, true)
 	if err != nil {
+		return cr, errors.Wrapf(err, "unable to find the exe %q", c.Exe)
+	}
+	if info.Mode&os.ModeSetuid != 0 {
+		cr.Euid = info.Uid
+	}
+	if info.Mode&os.ModeSetgid != 0 {
+		cr.Egid = info.Gid
+	}
+	return cr, nil
+}
+
+// openStdio returns the streams the config gives the guest, nil for the
+// host's, and a function that closes the files it opened.
+func openStdio(c *pb.Config) (stdin io.Reader, stdout, stderr io.Writer, closeAll func() error, err error) {
+	var files []*os.File
+	closeAll = func() error {
+		var err error
+		for _, f := range files {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
 		return err
 	}
-	if l.Interp() != "" {
-		if c.Loader == "" {
-			return errors.New("the binary is interp, but no loader in config")
+	s := c.Stdio
+	if s == nil {
+		return nil, nil, nil, closeAll, nil
+	}
+	if s.StdinFile != "" {
+		f, err := os.Open(path.Join(c.ConfigDir, s.StdinFile))
+		if err != nil {
+			return nil, nil, nil, closeAll, err
 		}
-		a := []string{"ld", "/bin/exec"}
-		a = append(a, args[1:]...)
-		args = a
-		e, err := fs.Create("/bin/exec")
+		files = append(files, f)
+		stdin = f
+	} else if len(s.Stdin) > 0 {
+		stdin = bytes.NewReader(s.Stdin)
+	}
+	output := func(name string, host *os.File) (io.Writer, error) {
+		if name == "" && s.OutputLimit <= 0 {
+			return nil, nil
+		}
+		w := host
+		if name != "" {
+			f, err := os.Create(path.Join(c.ConfigDir, name))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, f)
+			w = f
+		}
+		return usercorn.LimitWriter(w, s.OutputLimit), nil
+	}
+	if stdout, err = output(s.StdoutFile, os.Stdout); err != nil {
+		return nil, nil, nil, closeAll, err
+	}
+	// both streams going to one file share it, and its limit
+	if s.StderrFile != "" && path.Join(c.ConfigDir, s.StderrFile) == path.Join(c.ConfigDir, s.StdoutFile) {
+		return stdin, stdout, stdout, closeAll, nil
+	}
+	if stderr, err = output(s.StderrFile, os.Stderr); err != nil {
+		return nil, nil, nil, closeAll, err
+	}
+	return stdin, stdout, stderr, closeAll, nil
+}
+
+// newScript returns the script of the config, nil if there is none. It
+// passes the guest's stdout on to stdout, the host's if nil. The returned
+// function closes the transcript.
+func newScript(c *pb.Config, stdout io.Writer, order binary.ByteOrder) (*usercorn.Script, func() error, error) {
+	noop := func() error { return nil }
+	sc := c.Script
+	if c.ScriptFile != "" {
+		if sc != nil {
+			return nil, noop, errors.New("the config has both a script and a script_file")
+		}
+		d, err := ioutil.ReadFile(path.Join(c.ConfigDir, c.ScriptFile))
 		if err != nil {
-			return err
+			return nil, noop, err
 		}
-		defer e.Close()
-		if _, err := io.Copy(e, f); err != nil {
-			return err
+		sc = &pb.Script{}
+		if err := proto.UnmarshalText(string(d), sc); err != nil {
+			return nil, noop, errors.Wrapf(err, "unable to parse %q", c.ScriptFile)
 		}
-		exe = path.Join(c.ConfigDir, c.Loader)
-		f, err = os.Open(exe)
+	}
+	if sc == nil {
+		return nil, noop, nil
+	}
+	if c.Stdio != nil && (len(c.Stdio.Stdin) > 0 || c.Stdio.StdinFile != "") {
+		return nil, noop, errors.New("the script and stdio both feed stdin")
+	}
+	var steps []usercorn.Step
+	for _, st := range sc.Steps {
+		steps = append(steps, usercorn.Step{Expect: st.Expect, Send: st.Send})
+	}
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	script, err := usercorn.NewScript(steps, stdout)
+	if err != nil {
+		return nil, noop, err
+	}
+	script.Order = order
+	if sc.TranscriptFile == "" {
+		return script, noop, nil
+	}
+	f, err := os.Create(path.Join(c.ConfigDir, sc.TranscriptFile))
+	if err != nil {
+		return nil, noop, err
+	}
+	script.Transcript = f
+	return script, f.Close, nil
+}
+
+// exportFs writes fs to the -export path and logs what changed since
+// base.
+func exportFs(fs *vfs.Filesystem, base vfs.Snapshot) error {
+	var changes []vfs.Change
+	if strings.HasSuffix(*export, ".tar") || strings.HasSuffix(*export, ".tar.gz") || strings.HasSuffix(*export, ".tgz") {
+		f, err := os.Create(*export)
 		if err != nil {
-			return errors.Wrapf(err, "unable to open loader")
+			return err
 		}
 		defer f.Close()
-		l, err = loader.LoaderFor(f)
+		if strings.HasSuffix(*export, ".tar") {
+			changes, err = fs.ExportTar(f, base)
+		} else {
+			gz := gzip.NewWriter(f)
+			if changes, err = fs.ExportTar(gz, base); err == nil {
+				err = gz.Close()
+			}
+		}
 		if err != nil {
 			return err
 		}
+	} else {
+		var err error
+		if changes, err = fs.ExportDir(*export, base); err != nil {
+			return err
+		}
 	}
-	a, os, err := arch.GetArch(l.Arch(), c.Kernel)
+	if base != nil {
+		for _, c := range changes {
+			log.Printf("%s %s", c.Kind, c.Path)
+		}
+	}
+	return nil
+}
+
+// run runs the binary args[0] as c describes and returns how the guest
+// ended. An error means it could not be run. override, if not nil, can
+// change the settings of the guest before it starts.
+func run(c *pb.Config, args []string, override func(*usercorn.ExecConfig)) (term *usercorn.Termination, err error) {
+	defer func() {
+		// a guest that crashes the emulator must not take serve's other
+		// connections down
+		if e := recover(); e != nil {
+			term, err = &usercorn.Termination{Reason: usercorn.ReasonFault, Code: usercorn.ExitFault, Error: fmt.Sprintf("panic: %v", e)}, nil
+		}
+	}()
+	fs := vfs.New()
+
+	exe := args[0]
+	f, err := os.Open(exe)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer f.Close()
+	var l loader.Loader
+	if *raw {
+		l, err = rawLoader(f, c.Kernel)
+	} else {
+		l, err = loader.LoaderFor(f, c.Kernel)
 	}
-	cpu, err := a.Cpu.New()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	// the configured kernel wins over the OS the loader picked, which only
+	// ELF binaries can name
+	osName := c.Kernel
+	if osName == loader.NoOSHint {
+		osName = l.OS()
+	}
+	a, os, err := arch.GetArch(l.Arch(), osName)
+	if err != nil {
+		return nil, err
+	}
+	cpu, err := a.Cpu.NewWithOrder(l.ByteOrder())
+	if err != nil {
+		return nil, err
 	}
 	if err := loadFiles(fs, c); err != nil {
-		return err
+		return nil, err
+	}
+	var guestPaths []string
+	for _, p := range c.Files {
+		guestPaths = append(guestPaths, p.GuestPath)
+	}
+	if err := ldcache.Generate(fs, guestPaths, l.ByteOrder()); err != nil {
+		return nil, errors.Wrap(err, "unable to generate the ld.so cache")
+	}
+	builtinLinker, err := setupInterp(fs, c, l.Interp())
+	if err != nil {
+		return nil, err
+	}
+	cr, err := cred(fs, c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Cwd != "" {
+		if fi, err := fs.Stat(c.Cwd); err != nil || !fi.IsDir() {
+			return nil, errors.Errorf("the working directory %q is not a directory in the guest", c.Cwd)
+		}
+	}
+	stdin, stdout, stderr, closeStdio, err := openStdio(c)
+	defer closeStdio()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open the stdio files")
+	}
+	script, closeScript, err := newScript(c, stdout, l.ByteOrder())
+	defer closeScript()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to set up the script")
+	}
+	if script != nil {
+		stdin, stdout = script, script
+	}
+	guestArgs := args
+	if c.Argv0 != "" {
+		guestArgs = append([]string{c.Argv0}, args[1:]...)
+	}
+	var base vfs.Snapshot
+	if *export != "" && *exportDiff {
+		if base, err = fs.Snapshot(); err != nil {
+			return nil, errors.Wrap(err, "unable to snapshot the filesystem")
+		}
+	}
+	ex := &usercorn.ExecConfig{
+		Args:     guestArgs,
+		Env:      c.Env,
+		Exe:      c.Exe,
+		Seed:     c.Seed,
+		NoInterp: builtinLinker,
+		Cred:     cr,
+		Cwd:      c.Cwd,
+		Stdin:    stdin,
+		Stdout:   stdout,
+		Stderr:   stderr,
+	}
+	if override != nil {
+		override(ex)
 	}
 	task := usercorn.NewTask(cpu, a, os, l.ByteOrder())
-	u := usercorn.NewUsercornWrapper(exe, task, fs, l, os, &usercorn.ExecConfig{
-		Args: args,
-	})
+	u := usercorn.NewUsercornWrapper(exe, task, fs, l, os, ex)
+	defer u.Close()
 	if err := u.LoadBinary(f); err != nil {
-		return err
+		return nil, err
+	}
+	if builtinLinker {
+		if _, err := dynlink.Link(u, f, c.LibraryPath); err != nil {
+			return nil, errors.Wrap(err, "failed to link")
+		}
 	}
-	return u.Run()
+	if script != nil {
+		script.Stop = u.Exit
+	}
+	err = u.Run()
+	term = usercorn.Terminated(err)
+	if script != nil {
+		// a script that failed stopped the guest with its error, but a
+		// crash says more than the steps it left
+		if serr := script.Done(); serr != nil && (serr == err || term.Reason == usercorn.ReasonExit) {
+			term = &usercorn.Termination{Reason: usercorn.ReasonError, Code: usercorn.ExitError, Error: serr.Error()}
+		}
+	}
+	if *export != "" {
+		// files dropped before a crash are often the interesting ones
+		if err := exportFs(fs, base); err != nil {
+			return nil, errors.Wrap(err, "unable to export the filesystem")
+		}
+	}
+	return term, nil
 }
 
-func main() {
-	flag.Parse()
+// loadConfig parses the config from the file at configPath, or from text
+// if there is none.
+func loadConfig(text, configPath string) (*pb.Config, error) {
 	var c pb.Config
-	if *configPath != "" {
-		d, err := ioutil.ReadFile(*configPath)
+	if configPath != "" {
+		d, err := ioutil.ReadFile(configPath)
 		if err != nil {
-			log.Fatalf("unable to read config file: %v", err)
+			return nil, errors.Wrap(err, "unable to read config file")
 		}
 		if err := proto.UnmarshalText(string(d), &c); err != nil {
-			log.Fatalf("Unable to parse config: %v", err)
+			return nil, errors.Wrap(err, "unable to parse config")
 		}
-		c.ConfigDir = path.Dir(*configPath)
+		c.ConfigDir = path.Dir(configPath)
 	} else {
-		if err := proto.UnmarshalText(*config, &c); err != nil {
-			log.Fatalf("Unable to parse config: %v", err)
+		if err := proto.UnmarshalText(text, &c); err != nil {
+			return nil, errors.Wrap(err, "unable to parse config")
 		}
 		c.ConfigDir = "./"
 	}
+	return &c, nil
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "mkconfig" {
+		if err := mkconfig(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		if err := serve(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	flag.Parse()
+	c, err := loadConfig(*config, *configPath)
+	if err != nil {
+		exit(nil, err)
+	}
 	args := flag.Args()
 	if len(args) == 0 {
-		log.Fatalf("No program specified")
+		exit(nil, errors.New("no program specified"))
 	}
 	/*	v := vm.NewVM()
-		p, err := v.Process(&c, args[0], args[1:], nil)
+		p, err := v.Process(c, args[0], args[1:], nil)
 		if err != nil {
 			log.Fatal(err)
 		}*/
-	if err := run(&c, args); err != nil {
-		log.Fatalf("Error while running the binary: %v", err)
+	exit(run(c, args, nil))
+}
+
+// exit reports how the guest ended and exits with its code, ExitError if
+// it could not be run.
+func exit(term *usercorn.Termination, err error) {
+	if err != nil {
+		log.Printf("Error while running the binary: %v", err)
+		term = &usercorn.Termination{Reason: usercorn.ReasonError, Code: usercorn.ExitError, Error: err.Error()}
+	} else if term.Reason != usercorn.ReasonExit {
+		log.Printf("The binary stopped: %v", term)
+	}
+	if *summary {
+		if err := json.NewEncoder(os.Stderr).Encode(term); err != nil {
+			log.Print(err)
+		}
 	}
+	os.Exit(term.Code)
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/felberj/binemu/loader"
+	"github.com/felberj/binemu/loader/dynlink"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+
+	pb "github.com/felberj/binemu/proto_gen"
+)
+
+const mkconfigUsage = "usage: binemu mkconfig --sysroot DIR [-o FILE] BINARY"
+
+// mkconfig prints a config that maps every library BINARY needs from a
+// sysroot into the guest.
+func mkconfig(args []string) error {
+	fl := flag.NewFlagSet("mkconfig", flag.ExitOnError)
+	sysroot := fl.String("sysroot", "", "directory holding the guest's libraries")
+	out := fl.String("o", "", "file to write the config to (default: stdout)")
+	fl.Usage = func() {
+		fmt.Fprintln(fl.Output(), mkconfigUsage)
+		fl.PrintDefaults()
+	}
+	fl.Parse(args)
+	if *sysroot == "" || fl.NArg() != 1 {
+		return errors.New(mkconfigUsage)
+	}
+	c, err := sysrootConfig(*sysroot, fl.Arg(0))
+	if err != nil {
+		return err
+	}
+	// host paths are relative to the config
+	configDir := "."
+	if *out != "" {
+		configDir = filepath.Dir(*out)
+	}
+	if configDir, err = filepath.Abs(configDir); err != nil {
+		return err
+	}
+	for _, f := range c.Files {
+		host, err := filepath.Abs(f.HostPath)
+		if err != nil {
+			return err
+		}
+		if f.HostPath, err = filepath.Rel(configDir, host); err != nil {
+			return err
+		}
+	}
+	text := proto.MarshalTextString(c)
+	if *out == "" {
+		fmt.Print(text)
+		return nil
+	}
+	return ioutil.WriteFile(*out, []byte(text), 0644)
+}
+
+// sysrootConfig follows the DT_NEEDED entries of exe through the sysroot
+// and returns a config with the interpreter and every library it found.
+func sysrootConfig(sysroot, exe string) (*pb.Config, error) {
+	l, err := loader.LoadFile(exe)
+	if err != nil {
+		return nil, err
+	}
+	c := &pb.Config{Kernel: l.OS()}
+	added := make(map[string]bool)
+	add := func(guest string) error {
+		if added[guest] {
+			return nil
+		}
+		added[guest] = true
+		host, err := sysrootPath(sysroot, guest)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(host)
+		if err != nil {
+			return err
+		}
+		c.Files = append(c.Files, &pb.File{HostPath: host, GuestPath: guest, Mode: int32(fi.Mode().Perm())})
+		return nil
+	}
+	// libc usually needs the interpreter as well, add keeps it once
+	if interp := l.Interp(); interp != "" {
+		if err := add(interp); err != nil {
+			return nil, errors.Wrapf(err, "interpreter %q", interp)
+		}
+	}
+	type object struct {
+		elf    *loader.ElfLoader
+		name   string
+		origin string
+	}
+	exeElf, ok := l.(*loader.ElfLoader)
+	if !ok {
+		// nothing to follow
+		return c, nil
+	}
+	// the binary's own $ORIGIN only means something if it is in the sysroot
+	origin := ""
+	if abs, err := filepath.Abs(exe); err == nil {
+		if root, err := filepath.Abs(sysroot); err == nil {
+			if rel, err := filepath.Rel(root, filepath.Dir(abs)); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+				origin = path.Join("/", filepath.ToSlash(rel))
+			}
+		}
+	}
+	queue := []object{{exeElf, exe, origin}}
+	seen := make(map[string]bool)
+	for len(queue) > 0 {
+		o := queue[0]
+		queue = queue[1:]
+		needed, err := o.elf.Needed()
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read the dependencies of %s", o.name)
+		}
+		var dirs []string
+		for _, dir := range o.elf.SearchPath() {
+			if strings.Contains(dir, "$ORIGIN") || strings.Contains(dir, "${ORIGIN}") {
+				if o.origin == "" {
+					continue
+				}
+				dir = loader.ExpandOrigin(dir, o.origin)
+			}
+			dirs = append(dirs, dir)
+		}
+		dirs = append(dirs, dynlink.DefaultDirs(l.Arch())...)
+		for _, name := range needed {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			guest, lib, err := findLibrary(sysroot, name, dirs, l.Arch())
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s needed by %s", name, o.name)
+			}
+			if err := add(guest); err != nil {
+				return nil, err
+			}
+			queue = append(queue, object{lib, name, path.Dir(guest)})
+		}
+	}
+	return c, nil
+}
+
+// findLibrary looks for a library of arch in the sysroot and returns its
+// guest path.
+func findLibrary(sysroot, name string, dirs []string, arch string) (string, *loader.ElfLoader, error) {
+	if strings.Contains(name, "/") {
+		dirs = []string{""}
+	}
+	for _, dir := range dirs {
+		guest := path.Join("/", dir, name)
+		host, err := sysrootPath(sysroot, guest)
+		if err != nil {
+			continue
+		}
+		l, err := loader.LoadFile(host)
+		if err != nil || l.Arch() != arch {
+			continue
+		}
+		if lib, ok := l.(*loader.ElfLoader); ok {
+			return guest, lib, nil
+		}
+	}
+	return "", nil, errors.New("not found in the sysroot")
+}
+
+// sysrootPath returns where a guest path is in the sysroot, following
+// symlinks relative to the sysroot instead of the host.
+func sysrootPath(sysroot, guest string) (string, error) {
+	parts := strings.Split(guest, "/")
+	resolved := "/"
+	for links := 0; len(parts) > 0; {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+		next := path.Join(resolved, part)
+		host := filepath.Join(sysroot, filepath.FromSlash(next))
+		fi, err := os.Lstat(host)
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > 40 {
+			return "", errors.Errorf("too many levels of symbolic links in %q", guest)
+		}
+		target, err := os.Readlink(host)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		parts = append(strings.Split(target, "/"), parts...)
+	}
+	return filepath.Join(sysroot, filepath.FromSlash(resolved)), nil
+}
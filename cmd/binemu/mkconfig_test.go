@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testSysroot returns a sysroot of x86_64 libraries behind symlinks:
+//
+//	lib -> usr/lib
+//	lib64 -> /usr/lib
+//	lib32/libc.so.6            an x86 binary
+//	usr/lib/libc-2.27.so
+//	usr/lib/libc.so.6 -> libc-2.27.so
+//	usr/lib/abs -> /usr/lib/libc-2.27.so
+//	usr/lib/ld-linux-x86-64.so.2
+//	usr/lib/libgreet.so
+//	app/hello                  needs libgreet.so from $ORIGIN/lib
+//	app/lib -> ../usr/lib
+//	loop -> loop
+func testSysroot(t *testing.T) string {
+	t.Helper()
+	root, err := ioutil.TempDir("", "sysroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			os.RemoveAll(root)
+			t.Fatal(err)
+		}
+	}
+	lib, err := ioutil.ReadFile("../../bins/dynlink/lib/libgreet.so")
+	must(err)
+	hello, err := ioutil.ReadFile("../../bins/dynlink/hello")
+	must(err)
+	x86, err := ioutil.ReadFile("../../bins/x86.linux.elf")
+	must(err)
+	for _, dir := range []string{"usr/lib", "lib32", "app"} {
+		must(os.MkdirAll(filepath.Join(root, dir), 0755))
+	}
+	for name, data := range map[string][]byte{
+		"usr/lib/libc-2.27.so":         lib,
+		"usr/lib/libgreet.so":          lib,
+		"usr/lib/ld-linux-x86-64.so.2": lib,
+		"lib32/libc.so.6":              x86,
+		"app/hello":                    hello,
+	} {
+		must(ioutil.WriteFile(filepath.Join(root, name), data, 0755))
+	}
+	for name, target := range map[string]string{
+		"lib":               "usr/lib",
+		"lib64":             "/usr/lib",
+		"usr/lib/libc.so.6": "libc-2.27.so",
+		"usr/lib/abs":       "/usr/lib/libc-2.27.so",
+		"app/lib":           "../usr/lib",
+		"loop":              "loop",
+	} {
+		must(os.Symlink(target, filepath.Join(root, name)))
+	}
+	return root
+}
+
+func TestSysrootPath(t *testing.T) {
+	root := testSysroot(t)
+	defer os.RemoveAll(root)
+	libc := filepath.Join(root, "usr", "lib", "libc-2.27.so")
+	for _, guest := range []string{
+		"/lib/libc.so.6",
+		"/lib64/libc.so.6",
+		"/usr/lib/abs",
+		"/app/lib/libc.so.6",
+		// .. stops at the sysroot
+		"/../../lib/libc.so.6",
+		"/usr/../../../usr/lib/libc.so.6",
+	} {
+		if got, err := sysrootPath(root, guest); err != nil || got != libc {
+			t.Errorf("sysrootPath(%q) = %q, %v", guest, got, err)
+		}
+	}
+	for _, guest := range []string{"/loop", "/lib/missing"} {
+		if got, err := sysrootPath(root, guest); err == nil {
+			t.Errorf("sysrootPath(%q) = %q", guest, got)
+		}
+	}
+}
+
+func TestFindLibrary(t *testing.T) {
+	root := testSysroot(t)
+	defer os.RemoveAll(root)
+	// libraries of the wrong architecture are skipped
+	guest, _, err := findLibrary(root, "libc.so.6", []string{"/missing", "/lib32", "/lib"}, "x86_64")
+	if err != nil || guest != "/lib/libc.so.6" {
+		t.Errorf("found %q, %v", guest, err)
+	}
+	if guest, _, err := findLibrary(root, "libc.so.6", []string{"/lib32"}, "x86_64"); err == nil {
+		t.Errorf("found %q", guest)
+	}
+}
+
+func TestSysrootConfig(t *testing.T) {
+	root := testSysroot(t)
+	defer os.RemoveAll(root)
+	c, err := sysrootConfig(root, filepath.Join(root, "app", "hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/lib64/ld-linux-x86-64.so.2": filepath.Join(root, "usr", "lib", "ld-linux-x86-64.so.2"),
+		// the binary's RUNPATH of $ORIGIN/lib is searched in the sysroot
+		"/app/lib/libgreet.so": filepath.Join(root, "usr", "lib", "libgreet.so"),
+	}
+	if len(c.Files) != len(want) {
+		t.Fatalf("got files %v", c.Files)
+	}
+	for _, f := range c.Files {
+		if want[f.GuestPath] != f.HostPath {
+			t.Errorf("%s maps %q", f.GuestPath, f.HostPath)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	usercorn "github.com/felberj/binemu"
+	pb "github.com/felberj/binemu/proto_gen"
+)
+
+const serveUsage = "usage: binemu serve [-listen ADDR] [-max_conns N] [-insns N] [-timeout D] (-config TEXT | -config_path FILE) BINARY [ARGS...]"
+
+// serve runs BINARY for every connection to a TCP port, like xinetd does,
+// each time in a fresh guest with its stdio bound to the connection.
+func serve(args []string) error {
+	fl := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fl.String("listen", "localhost:1337", "address to listen on")
+	maxConns := fl.Int("max_conns", 16, "connections served at the same time, more are closed right away (0: no limit)")
+	insns := fl.Uint64("insns", 0, "instructions a connection's guest may run (0: no limit)")
+	timeout := fl.Duration("timeout", time.Minute, "how long a connection's guest may run (0: no limit)")
+	config := fl.String("config", "", "configuration of the environment (as textproto)")
+	configPath := fl.String("config_path", "", "path to the configurations file")
+	fl.Usage = func() {
+		fmt.Fprintln(fl.Output(), serveUsage)
+		fl.PrintDefaults()
+	}
+	fl.Parse(args)
+	if fl.NArg() == 0 {
+		return errors.New(serveUsage)
+	}
+	c, err := loadConfig(*config, *configPath)
+	if err != nil {
+		return err
+	}
+	if c.Stdio != nil || c.Script != nil || c.ScriptFile != "" {
+		return errors.New("the guest's stdio is the connection, a config with stdio or a script can't be served")
+	}
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	log.Printf("serving %s on %s", fl.Arg(0), l.Addr())
+
+	var active int32
+	for id := 1; ; id++ {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		if *maxConns > 0 && atomic.LoadInt32(&active) >= int32(*maxConns) {
+			log.Printf("conn %d from %s: refused, %d connections are active", id, conn.RemoteAddr(), *maxConns)
+			conn.Close()
+			continue
+		}
+		atomic.AddInt32(&active, 1)
+		go func(id int, conn net.Conn) {
+			defer atomic.AddInt32(&active, -1)
+			serveConn(id, conn, c, fl.Args(), *insns, *timeout)
+		}(id, conn)
+	}
+}
+
+// serveConn runs the guest for one connection and logs how it ended.
+func serveConn(id int, conn net.Conn, c *pb.Config, args []string, insns uint64, timeout time.Duration) {
+	start := time.Now()
+	log.Printf("conn %d from %s", id, conn.RemoteAddr())
+	defer conn.Close()
+	// one guest crashing the emulator must not take the others down
+	defer func() {
+		if e := recover(); e != nil {
+			log.Printf("conn %d from %s: panic: %v\n%s", id, conn.RemoteAddr(), e, debug.Stack())
+		}
+	}()
+	if timeout > 0 {
+		// a guest blocked on the connection never returns to the CPU,
+		// which enforces the timeout
+		conn.SetDeadline(start.Add(timeout))
+	}
+	term, err := run(c, args, func(ex *usercorn.ExecConfig) {
+		ex.Stdin, ex.Stdout, ex.Stderr = conn, conn, conn
+		ex.InsnLimit = insns
+		ex.Timeout = timeout
+	})
+	status := fmt.Sprint(term)
+	if err != nil {
+		status = err.Error()
+	}
+	log.Printf("conn %d from %s: %s after %v", id, conn.RemoteAddr(), status, time.Since(start).Round(time.Millisecond))
+}
@@ -1,7 +1,37 @@
 package binemu
 
+import (
+	"io"
+	"time"
+
+	"github.com/felberj/binemu/models"
+)
+
 // ExecConfig describes the arguments and environment that should be passed to the executable.
 type ExecConfig struct {
 	Env  []string
 	Args []string
+	// Exe is the guest path the program was executed as, which it finds
+	// in AT_EXECFN and /proc/self/exe. The path it was loaded from if
+	// empty.
+	Exe string
+	// Seed starts the stream the emulator's own randomness is taken from
+	// (Usercorn.Rand), such as the CGC magic page, so runs with the same
+	// seed see the same values. 0 draws a fresh seed for every run.
+	Seed int64
+	// NoInterp leaves PT_INTERP alone, for binaries the emulator links.
+	NoInterp bool
+	// Cred are the ids the guest starts with, root if unset.
+	Cred models.Cred
+	// Cwd is the working directory of the guest, / if empty.
+	Cwd string
+	// Stdin, Stdout and Stderr replace the host's stdio if set. See
+	// Capture and LimitWriter to keep the output.
+	Stdin          io.Reader
+	Stdout, Stderr io.Writer
+	// InsnLimit stops the guest with ErrInsnLimit after that many
+	// instructions, and Timeout with ErrTimeout once it ran that long.
+	// Both are unlimited if 0.
+	InsnLimit uint64
+	Timeout   time.Duration
 }
@@ -74,3 +74,21 @@ func (u *Cpu) HookInstruction(cb InstructionHook, start, end uint64, instruction
 	wrap := func(_ *uc.Unicorn) { cb() }
 	return u.Unicorn.HookAdd(uc.HOOK_INSN, wrap, start, end, instruction)
 }
+
+// X86InHook is used to hook the x86 in instruction
+type X86InHook func(port, size uint32) uint32
+
+// X86OutHook is used to hook the x86 out instruction
+type X86OutHook func(port, size, value uint32)
+
+// HookX86In hooks port reads, the callback returns the value read
+func (u *Cpu) HookX86In(cb X86InHook, start, end uint64) (uc.Hook, error) {
+	wrap := func(_ *uc.Unicorn, port, size uint32) uint32 { return cb(port, size) }
+	return u.Unicorn.HookAdd(uc.HOOK_INSN, wrap, start, end, uc.X86_INS_IN)
+}
+
+// HookX86Out hooks port writes
+func (u *Cpu) HookX86Out(cb X86OutHook, start, end uint64) (uc.Hook, error) {
+	wrap := func(_ *uc.Unicorn, port, size, value uint32) { cb(port, size, value) }
+	return u.Unicorn.HookAdd(uc.HOOK_INSN, wrap, start, end, uc.X86_INS_OUT)
+}
@@ -1,6 +1,8 @@
 package cpu
 
 import (
+	"encoding/binary"
+
 	"github.com/pkg/errors"
 
 	uc "github.com/felberj/binemu/cpu/unicorn"
@@ -18,6 +20,15 @@ func (b *Builder) New() (*Cpu, error) {
 	return &Cpu{u}, nil
 }
 
+// NewWithOrder creates a Cpu, switching Unicorn to big endian mode for big endian binaries.
+func (b *Builder) NewWithOrder(order binary.ByteOrder) (*Cpu, error) {
+	mode := b.Mode
+	if order == binary.BigEndian {
+		mode |= uc.MODE_BIG_ENDIAN
+	}
+	return (&Builder{Arch: b.Arch, Mode: mode}).New()
+}
+
 type Cpu struct {
 	*uc.Unicorn
 }
@@ -0,0 +1,22 @@
+package unicorn
+
+import (
+	"unsafe"
+)
+
+// #include <unicorn/unicorn.h>
+import "C"
+
+// RegRead128 reads a 128-bit register, like q0-q31 on arm64, as its low
+// and high halves.
+func (u *Unicorn) RegRead128(reg int) (lo, hi uint64, err error) {
+	var val [2]C.uint64_t
+	ucerr := C.uc_reg_read(u.handle, C.int(reg), unsafe.Pointer(&val[0]))
+	return uint64(val[0]), uint64(val[1]), errReturn(ucerr)
+}
+
+// RegWrite128 writes a 128-bit register from its low and high halves.
+func (u *Unicorn) RegWrite128(reg int, lo, hi uint64) error {
+	val := [2]C.uint64_t{C.uint64_t(lo), C.uint64_t(hi)}
+	return errReturn(C.uc_reg_write(u.handle, C.int(reg), unsafe.Pointer(&val[0])))
+}
@@ -0,0 +1,95 @@
+// Package bsd holds what the FreeBSD and Darwin kernels have in common.
+// Both build on the Linux kernel, so they share its filesystem and file
+// descriptors, and only translate the flags and errors that differ.
+package bsd
+
+import (
+	co "github.com/felberj/binemu/kernel/common"
+	"github.com/felberj/binemu/kernel/linux"
+	"github.com/felberj/binemu/native/enum"
+	"github.com/felberj/binemu/vfs"
+)
+
+// Errno values both BSDs agree on. Syscalls return them negated, the arch
+// code moves them into rax and sets the carry flag.
+const (
+	EPERM  = 1
+	ENOENT = 2
+	EBADF  = 9
+	ENOMEM = 12
+	EFAULT = 14
+	EINVAL = 22
+	ENOTTY = 25
+)
+
+// Errno encodes err as a syscall return value.
+func Errno(err int) uint64 {
+	return uint64(-int64(err))
+}
+
+const (
+	mapFixed = 0x10
+	mapAnon  = 0x1000
+)
+
+// Kernel implements the syscalls that behave like Linux apart from their
+// flag bits and errors.
+type Kernel struct {
+	*linux.LinuxKernel
+	// openFlags maps the guest's open flags to the host's
+	openFlags map[int]int
+}
+
+// NewKernel creates a kernel on top of fs that translates open flags with
+// openFlags.
+func NewKernel(fs *vfs.Filesystem, openFlags map[int]int) *Kernel {
+	return &Kernel{LinuxKernel: linux.NewKernel(fs), openFlags: openFlags}
+}
+
+func (k *Kernel) openFlag(flags uint64) enum.OpenFlag {
+	var out enum.OpenFlag
+	for a, b := range k.openFlags {
+		if int(flags)&a == a {
+			out |= enum.OpenFlag(b)
+		}
+	}
+	return out
+}
+
+// Open syscall
+func (k *Kernel) Open(path string, flags uint64, mode uint64) uint64 {
+	fd := k.LinuxKernel.Open(path, k.openFlag(flags), mode)
+	if fd == linux.MinusOne {
+		return Errno(ENOENT)
+	}
+	return fd
+}
+
+// Openat syscall
+func (k *Kernel) Openat(dirfd co.Fd, path string, flags uint64, mode uint64) uint64 {
+	fd := k.LinuxKernel.Openat(dirfd, path, k.openFlag(flags), mode)
+	if fd == linux.MinusOne {
+		return Errno(ENOENT)
+	}
+	return fd
+}
+
+// Mmap syscall
+func (k *Kernel) Mmap(addrHint, size uint64, prot enum.MmapProt, flags uint64, fd co.Fd, off co.Off) uint64 {
+	if flags&mapAnon != 0 {
+		fd = -1
+	}
+	addr := k.LinuxKernel.Mmap(addrHint, size, prot, enum.MmapFlag(flags&mapFixed), fd, off)
+	if addr == linux.MinusOne {
+		return Errno(ENOMEM)
+	}
+	return addr
+}
+
+// Ioctl syscall. There is no terminal, so libc's isatty() checks fail.
+func (k *Kernel) Ioctl(fd co.Fd, request uint64, arg co.Buf) uint64 {
+	if _, ok := k.Fds[fd]; !ok {
+		return Errno(EBADF)
+	}
+	return Errno(ENOTTY)
+}
@@ -0,0 +1,210 @@
+// Package cgc provides the DECREE kernel used by DARPA Cyber Grand
+// Challenge binaries. DECREE has seven syscalls and no filesystem.
+package cgc
+
+import (
+	"io"
+	"math/rand"
+	"os"
+
+	"github.com/felberj/binemu/cpu"
+	"github.com/felberj/binemu/models"
+
+	co "github.com/felberj/binemu/kernel/common"
+)
+
+// DECREE errno values, returned directly from the syscalls.
+const (
+	EBADF  = 1
+	EFAULT = 2
+	EINVAL = 3
+	ENOMEM = 4
+	ENOSYS = 5
+	EPIPE  = 6
+)
+
+const (
+	// MagicPage is filled with random bytes and passed to the binary in ecx.
+	MagicPage     = 0x4347c000
+	MagicPageSize = 0x1000
+	pageSize      = 0x1000
+)
+
+// CgcKernel implements the DECREE syscalls. The fds 0 and 1 are both ends
+// of the same connection, so either can be used to receive and transmit.
+type CgcKernel struct {
+	*co.KernelBase
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	Rand   *rand.Rand
+}
+
+// NewKernel creates a DECREE kernel attached to the host's stdio, which
+// takes its randomness from r.
+func NewKernel(r *rand.Rand) *CgcKernel {
+	return &CgcKernel{
+		KernelBase: &co.KernelBase{},
+		Stdin:      os.Stdin,
+		Stdout:     os.Stdout,
+		Stderr:     os.Stderr,
+		Rand:       r,
+	}
+}
+
+// SetStdio replaces the host's stdio the guest starts with.
+func (k *CgcKernel) SetStdio(stdin io.Reader, stdout, stderr io.Writer) {
+	if stdin != nil {
+		k.Stdin = stdin
+	}
+	if stdout != nil {
+		k.Stdout = stdout
+	}
+	if stderr != nil {
+		k.Stderr = stderr
+	}
+}
+
+// putCount stores n at ptr unless it is null.
+func putCount(ptr co.Obuf, n uint64) uint64 {
+	if ptr.Addr == 0 {
+		return 0
+	}
+	if err := ptr.Pack(uint32(n)); err != nil {
+		return EFAULT
+	}
+	return 0
+}
+
+// MapMagicPage maps the read-only flag page and fills it from r.
+func MapMagicPage(u models.Usercorn, r *rand.Rand) error {
+	if err := u.MemMap(MagicPage, MagicPageSize, cpu.PROT_READ|cpu.PROT_WRITE); err != nil {
+		return err
+	}
+	tmp := make([]byte, MagicPageSize)
+	r.Read(tmp)
+	mem := u.Mem()
+	mem.Seek(MagicPage, io.SeekStart)
+	if _, err := mem.Write(tmp); err != nil {
+		return err
+	}
+	return u.MemProt(MagicPage, MagicPageSize, cpu.PROT_READ)
+}
+
+// Terminate syscall
+func (k *CgcKernel) Terminate(code int) {
+	k.U.Exit(models.ExitStatus(code))
+}
+
+// Transmit syscall
+func (k *CgcKernel) Transmit(fd co.Fd, buf co.Buf, size co.Len, txBytes co.Obuf) uint64 {
+	var w io.Writer
+	switch fd {
+	case 0, 1:
+		w = k.Stdout
+	case 2:
+		w = k.Stderr
+	default:
+		return EBADF
+	}
+	tmp := make([]byte, size)
+	if err := buf.Unpack(tmp); err != nil {
+		return EFAULT
+	}
+	n, err := w.Write(tmp)
+	if err != nil {
+		return EPIPE
+	}
+	return putCount(txBytes, uint64(n))
+}
+
+// Receive syscall
+func (k *CgcKernel) Receive(fd co.Fd, buf co.Obuf, size co.Len, rxBytes co.Obuf) uint64 {
+	if fd != 0 && fd != 1 {
+		return EBADF
+	}
+	tmp := make([]byte, size)
+	n, err := k.Stdin.Read(tmp)
+	if err != nil && err != io.EOF {
+		return EFAULT
+	}
+	if err := buf.Pack(tmp[:n]); err != nil {
+		return EFAULT
+	}
+	return putCount(rxBytes, uint64(n))
+}
+
+// Fdwait syscall. The standard fds never block, so they are reported
+// ready right away and the timeout is ignored.
+func (k *CgcKernel) Fdwait(nfds int, readfds, writefds co.Buf, timeout co.Buf, readyfds co.Obuf) uint64 {
+	if nfds < 0 {
+		return EINVAL
+	}
+	ready := 0
+	for _, set := range []co.Buf{readfds, writefds} {
+		if set.Addr == 0 {
+			continue
+		}
+		var bits uint32
+		if err := set.Unpack(&bits); err != nil {
+			return EFAULT
+		}
+		if nfds < 32 {
+			bits &= 1<<uint(nfds) - 1
+		}
+		// only the standard fds exist
+		bits &= 7
+		for i := uint(0); i < 3; i++ {
+			ready += int(bits >> i & 1)
+		}
+		if err := set.Pack(bits); err != nil {
+			return EFAULT
+		}
+	}
+	return putCount(readyfds, uint64(ready))
+}
+
+// Allocate syscall
+func (k *CgcKernel) Allocate(size co.Len, executable int, addr co.Obuf) uint64 {
+	if size == 0 {
+		return EINVAL
+	}
+	prot := cpu.PROT_READ | cpu.PROT_WRITE
+	if executable != 0 {
+		prot |= cpu.PROT_EXEC
+	}
+	size = (size + pageSize - 1) &^ (pageSize - 1)
+	mem, err := k.U.Mmap(0, uint64(size), prot, false, "allocate", nil)
+	if err != nil {
+		return ENOMEM
+	}
+	if addr.Addr != 0 {
+		if err := addr.Pack(uint32(mem)); err != nil {
+			k.U.MemUnmap(mem, uint64(size))
+			return EFAULT
+		}
+	}
+	return 0
+}
+
+// Deallocate syscall
+func (k *CgcKernel) Deallocate(addr uint64, size co.Len) uint64 {
+	if addr&(pageSize-1) != 0 || size == 0 {
+		return EINVAL
+	}
+	size = (size + pageSize - 1) &^ (pageSize - 1)
+	if err := k.U.MemUnmap(addr, uint64(size)); err != nil {
+		return EINVAL
+	}
+	return 0
+}
+
+// Random syscall
+func (k *CgcKernel) Random(buf co.Obuf, size co.Len, rndBytes co.Obuf) uint64 {
+	tmp := make([]byte, size)
+	k.Rand.Read(tmp)
+	if err := buf.Pack(tmp); err != nil {
+		return EFAULT
+	}
+	return putCount(rndBytes, uint64(size))
+}
@@ -0,0 +1,45 @@
+package common
+
+import (
+	"errors"
+	"io"
+)
+
+// StdioKernel is implemented by kernels whose standard streams can be
+// replaced. Streams that are nil are left as they are.
+type StdioKernel interface {
+	SetStdio(stdin io.Reader, stdout, stderr io.Writer)
+}
+
+// CwdKernel is implemented by kernels that resolve relative paths against
+// a working directory.
+type CwdKernel interface {
+	SetCwd(dir string)
+}
+
+// Stream is a standard stream of the guest that reads from R or writes
+// to W.
+type Stream struct {
+	R io.Reader
+	W io.Writer
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	if s.R == nil {
+		return 0, errors.New("stream is not readable")
+	}
+	return s.R.Read(p)
+}
+
+func (s *Stream) Write(p []byte) (int, error) {
+	if s.W == nil {
+		return 0, errors.New("stream is not writable")
+	}
+	return s.W.Write(p)
+}
+
+// Close leaves the underlying reader or writer open, as the caller that
+// passed it in owns it.
+func (s *Stream) Close() error {
+	return nil
+}
@@ -43,6 +43,11 @@ func (b Buf) Unpack(i interface{}) error {
 	return errors.Wrap(b.Struc().Unpack(i), "struc.Unpack() failed")
 }
 
+// CString reads the NUL terminated string at b, like string arguments.
+func (b Buf) CString() (string, error) {
+	return b.K.readCStringAt(b.Addr, 255)
+}
+
 func (b Buf) Sizeof(i interface{}) (int, error) {
 	n, err := b.Struc().Sizeof(i)
 	return n, errors.Wrap(err, "struc.Sizeof() failed")
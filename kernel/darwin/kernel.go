@@ -0,0 +1,115 @@
+// Package darwin provides a kernel for static Mach-O binaries.
+package darwin
+
+import (
+	"syscall"
+
+	"github.com/felberj/binemu/kernel/bsd"
+	"github.com/felberj/binemu/kernel/linux"
+	"github.com/felberj/binemu/models"
+	"github.com/felberj/binemu/vfs"
+)
+
+const (
+	STACK_BASE = 0x7fff5f400000
+	STACK_SIZE = 0x00800000
+
+	pid = 1
+	tid = 1
+)
+
+// DarwinKernel implements the BSD syscalls and stubs the Mach traps.
+type DarwinKernel struct {
+	*bsd.Kernel
+	nextPort uint32
+}
+
+// NewKernel creates a Darwin kernel on top of fs.
+func NewKernel(fs *vfs.Filesystem) *DarwinKernel {
+	return &DarwinKernel{Kernel: bsd.NewKernel(fs, openFlagMap), nextPort: firstPort}
+}
+
+// openFlagMap maps Darwin open flags to the host's.
+var openFlagMap = map[int]int{
+	0x0000:    syscall.O_RDONLY,
+	0x0001:    syscall.O_WRONLY,
+	0x0002:    syscall.O_RDWR,
+	0x0004:    syscall.O_NONBLOCK,
+	0x0008:    syscall.O_APPEND,
+	0x0080:    syscall.O_SYNC,
+	0x0100:    syscall.O_NOFOLLOW,
+	0x0200:    syscall.O_CREAT,
+	0x0400:    syscall.O_TRUNC,
+	0x0800:    syscall.O_EXCL,
+	0x20000:   syscall.O_NOCTTY,
+	0x100000:  syscall.O_DIRECTORY,
+	0x400000:  syscall.O_DSYNC,
+	0x1000000: syscall.O_CLOEXEC,
+}
+
+// Issetugid syscall
+func (k *DarwinKernel) Issetugid() uint64 {
+	if c := k.U.Cred(); c.Euid != c.Uid || c.Egid != c.Gid {
+		return 1
+	}
+	return 0
+}
+
+// Getpid syscall
+func (k *DarwinKernel) Getpid() uint64 {
+	return pid
+}
+
+// ThreadSelfid syscall
+func (k *DarwinKernel) ThreadSelfid() uint64 {
+	return tid
+}
+
+// StackInit maps the stack and lays out argc, argv, envp and the apple
+// strings the way xnu does for an executable without dyld.
+func StackInit(u models.Usercorn, args, env []string) error {
+	if err := u.MapStack(STACK_BASE, STACK_SIZE, false); err != nil {
+		return err
+	}
+	path := ""
+	if len(args) > 0 {
+		path = args[0]
+	}
+	if _, err := u.PushBytes([]byte(path + "\x00")); err != nil {
+		return err
+	}
+	apple, err := linux.PushStrings(u, "executable_path="+path)
+	if err != nil {
+		return err
+	}
+	envp, err := linux.PushStrings(u, env...)
+	if err != nil {
+		return err
+	}
+	argv, err := linux.PushStrings(u, args...)
+	if err != nil {
+		return err
+	}
+	var init []byte
+	for _, addrs := range [][]uint64{argv, envp, apple} {
+		b, err := linux.PackAddrs(u, addrs)
+		if err != nil {
+			return err
+		}
+		init = append(init, b...)
+	}
+	var tmp [8]byte
+	argcb, err := u.PackAddr(tmp[:], uint64(len(argv)))
+	if err != nil {
+		return err
+	}
+	init = append(argcb, init...)
+	// argc must end up 16-byte aligned
+	sp, _ := u.RegRead(u.Arch().SP)
+	sp = (sp - uint64(len(init))) &^ 15
+	if err := u.RegWrite(u.Arch().SP, sp+uint64(len(init))); err != nil {
+		return err
+	}
+	_, err = u.PushBytes(init)
+	return err
+}
@@ -0,0 +1,135 @@
+package darwin
+
+import (
+	"github.com/felberj/binemu/cpu"
+	co "github.com/felberj/binemu/kernel/common"
+	"github.com/felberj/binemu/kernel/linux"
+)
+
+// kern_return_t values returned by the Mach traps.
+const (
+	KERN_SUCCESS           = 0
+	KERN_INVALID_ADDRESS   = 1
+	KERN_NO_SPACE          = 3
+	KERN_INVALID_ARGUMENT  = 4
+	MACH_SEND_INVALID_DEST = 0x10000003
+)
+
+// Port names handed out by the traps. There is no IPC, the names only
+// need to be distinct and non-null.
+const (
+	taskPort   = 0x103
+	threadPort = 0x203
+	hostPort   = 0x303
+	firstPort  = 0x1003
+)
+
+const vmFlagsAnywhere = 1
+
+func (k *DarwinKernel) allocPort() uint64 {
+	port := k.nextPort
+	k.nextPort += 0x100
+	return uint64(port)
+}
+
+// MachReplyPort trap
+func (k *DarwinKernel) MachReplyPort() uint64 {
+	return k.allocPort()
+}
+
+// ThreadSelfTrap trap
+func (k *DarwinKernel) ThreadSelfTrap() uint64 {
+	return threadPort
+}
+
+// TaskSelfTrap trap
+func (k *DarwinKernel) TaskSelfTrap() uint64 {
+	return taskPort
+}
+
+// HostSelfTrap trap
+func (k *DarwinKernel) HostSelfTrap() uint64 {
+	return hostPort
+}
+
+// MachMsgTrap trap. Nothing listens on any port, so every send fails.
+func (k *DarwinKernel) MachMsgTrap(msg co.Buf, option uint64) uint64 {
+	return MACH_SEND_INVALID_DEST
+}
+
+// KernelrpcMachVmAllocateTrap trap
+func (k *DarwinKernel) KernelrpcMachVmAllocateTrap(target uint64, addr co.Buf, size uint64, flags uint64) uint64 {
+	var hint uint64
+	if err := addr.Unpack(&hint); err != nil {
+		return KERN_INVALID_ADDRESS
+	}
+	fixed := flags&vmFlagsAnywhere == 0
+	if size%linux.PageSize != 0 {
+		size += linux.PageSize - size%linux.PageSize
+	}
+	mem, err := k.U.Mmap(hint, size, cpu.PROT_READ|cpu.PROT_WRITE, fixed, "vm_allocate", nil)
+	if err != nil {
+		return KERN_NO_SPACE
+	}
+	if err := addr.Pack(mem); err != nil {
+		return KERN_INVALID_ADDRESS
+	}
+	return KERN_SUCCESS
+}
+
+// KernelrpcMachVmDeallocateTrap trap
+func (k *DarwinKernel) KernelrpcMachVmDeallocateTrap(target, addr, size uint64) uint64 {
+	if err := k.U.MemUnmap(addr, size); err != nil {
+		return KERN_INVALID_ADDRESS
+	}
+	return KERN_SUCCESS
+}
+
+// KernelrpcMachVmProtectTrap trap
+func (k *DarwinKernel) KernelrpcMachVmProtectTrap(target, addr, size, setMax, prot uint64) uint64 {
+	if setMax != 0 {
+		// maximum protections aren't tracked
+		return KERN_SUCCESS
+	}
+	if k.LinuxKernel.Mprotect(addr, size, prot) != 0 {
+		return KERN_INVALID_ADDRESS
+	}
+	return KERN_SUCCESS
+}
+
+// KernelrpcMachPortAllocateTrap trap
+func (k *DarwinKernel) KernelrpcMachPortAllocateTrap(target, right uint64, name co.Obuf) uint64 {
+	if err := name.Pack(uint32(k.allocPort())); err != nil {
+		return KERN_INVALID_ADDRESS
+	}
+	return KERN_SUCCESS
+}
+
+// KernelrpcMachPortDeallocateTrap trap
+func (k *DarwinKernel) KernelrpcMachPortDeallocateTrap(target, name uint64) uint64 {
+	return KERN_SUCCESS
+}
+
+// KernelrpcMachPortModRefsTrap trap
+func (k *DarwinKernel) KernelrpcMachPortModRefsTrap(target, name, right, delta uint64) uint64 {
+	return KERN_SUCCESS
+}
+
+// MachTimebaseInfoTrap trap. Absolute time is counted in nanoseconds.
+func (k *DarwinKernel) MachTimebaseInfoTrap(info co.Obuf) uint64 {
+	if err := info.Pack([2]uint32{1, 1}); err != nil {
+		return KERN_INVALID_ADDRESS
+	}
+	return KERN_SUCCESS
+}
+
+// SemaphoreSignalTrap trap
+func (k *DarwinKernel) SemaphoreSignalTrap(sem uint64) uint64 {
+	return KERN_SUCCESS
+}
+
+// SemaphoreWaitTrap trap. There is only one thread, so nobody could ever
+// signal; pretend the semaphore was already signalled.
+func (k *DarwinKernel) SemaphoreWaitTrap(sem uint64) uint64 {
+	return KERN_SUCCESS
+}
@@ -0,0 +1,298 @@
+package darwin
+
+import (
+	"strings"
+
+	"github.com/felberj/binemu/kernel/bsd"
+	co "github.com/felberj/binemu/kernel/common"
+)
+
+type NameMapEntry struct {
+	id     int
+	subMap map[string]NameMapEntry
+}
+
+var SysctlNameMapKern = map[string]NameMapEntry{
+	"ostype":          {1, nil},
+	"osrelease":       {2, nil},
+	"osrevision":      {3, nil},
+	"version":         {4, nil},
+	"maxvnodes":       {5, nil},
+	"maxproc":         {6, nil},
+	"maxfiles":        {7, nil},
+	"argmax":          {8, nil},
+	"securelevel":     {9, nil},
+	"hostname":        {10, nil},
+	"hostid":          {11, nil},
+	"clockrate":       {12, nil},
+	"vnode":           {13, nil},
+	"proc":            {14, nil},
+	"file":            {15, nil},
+	"profiling":       {16, nil},
+	"posix1version":   {17, nil},
+	"ngroups":         {18, nil},
+	"job_control":     {19, nil},
+	"saved_ids":       {20, nil},
+	"boottime":        {21, nil},
+	"nisdomainname":   {22, nil},
+	"maxpartitions":   {23, nil},
+	"kdebug":          {24, nil},
+	"update":          {25, nil},
+	"osreldate":       {26, nil},
+	"ntp_pll":         {27, nil},
+	"bootfile":        {28, nil},
+	"maxfilesperproc": {29, nil},
+	"maxprocperuid":   {30, nil},
+	"dumpdev":         {31, nil}, /* we lie; don't print as int */
+	"ipc":             {32, nil},
+
+	"usrstack":   {35, nil},
+	"logsigexit": {36, nil},
+	"symfile":    {37, nil},
+	"procargs":   {38, nil},
+
+	"netboot":   {40, nil},
+	"panicinfo": {41, nil},
+	"sysv":      {42, nil},
+
+	"exec":           {45, nil},
+	"aiomax":         {46, nil},
+	"aioprocmax":     {47, nil},
+	"aiothreads":     {48, nil},
+	"procargs2":      {49, nil},
+	"corefile":       {50, nil},
+	"coredump":       {51, nil},
+	"sugid_coredump": {52, nil},
+	"delayterm":      {53, nil},
+	"shreg_private":  {54, nil},
+
+	"low_pri_window":             {56, nil},
+	"low_pri_delay":              {57, nil},
+	"posix":                      {58, nil},
+	"usrstack64":                 {59, nil},
+	"nx":                         {60, nil},
+	"tfp":                        {61, nil},
+	"procname":                   {62, nil},
+	"threadsigaltstack":          {63, nil},
+	"speculative_reads_disabled": {64, nil},
+	"osversion":                  {65, nil},
+	"safeboot":                   {66, nil},
+	"lctx":                       {67, nil},
+	"rage_vnode":                 {68, nil},
+	"tty":                        {69, nil},
+	"check_openevt":              {70, nil},
+	"thread_name":                {71, nil},
+}
+
+var SysctlNameMapVfs = map[string]NameMapEntry{
+	"vfsconf": {0, nil},
+}
+
+var SysctlNameMapVm = map[string]NameMapEntry{
+	"vmmeter": {1, nil},
+	"loadavg": {2, nil},
+
+	"swapusage": {5, nil},
+}
+
+var SysctlNameMapHw = map[string]NameMapEntry{
+	"machine":       {1, nil},
+	"model":         {2, nil},
+	"ncpu":          {3, nil},
+	"byteorder":     {4, nil},
+	"physmem":       {5, nil},
+	"usermem":       {6, nil},
+	"pagesize":      {7, nil},
+	"disknames":     {8, nil},
+	"diskstats":     {9, nil},
+	"epoch":         {10, nil},
+	"floatingpoint": {11, nil},
+	"machinearch":   {12, nil},
+	"vectorunit":    {13, nil},
+	"busfrequency":  {14, nil},
+	"cpufrequency":  {15, nil},
+	"cachelinesize": {16, nil},
+	"l1icachesize":  {17, nil},
+	"l1dcachesize":  {18, nil},
+	"l2settings":    {19, nil},
+	"l2cachesize":   {20, nil},
+	"l3settings":    {21, nil},
+	"l3cachesize":   {22, nil},
+	"tbfrequency":   {23, nil},
+	"memsize":       {24, nil},
+	"availcpu":      {25, nil},
+}
+
+var SysctlNameMapUser = map[string]NameMapEntry{
+	"cs_path":          {1, nil},
+	"bc_base_max":      {2, nil},
+	"bc_dim_max":       {3, nil},
+	"bc_scale_max":     {4, nil},
+	"bc_string_max":    {5, nil},
+	"coll_weights_max": {6, nil},
+	"expr_nest_max":    {7, nil},
+	"line_max":         {8, nil},
+	"re_dup_max":       {9, nil},
+	"posix2_version":   {10, nil},
+	"posix2_c_bind":    {11, nil},
+	"posix2_c_dev":     {12, nil},
+	"posix2_char_term": {13, nil},
+	"posix2_fort_dev":  {14, nil},
+	"posix2_fort_run":  {15, nil},
+	"posix2_localedef": {16, nil},
+	"posix2_sw_dev":    {17, nil},
+	"posix2_upe":       {18, nil},
+	"stream_max":       {19, nil},
+	"tzname_max":       {20, nil},
+}
+
+var SysctlNameMapCTL = map[string]NameMapEntry{
+	"kern":    {1, SysctlNameMapKern},
+	"vm":      {2, SysctlNameMapVm},
+	"vfs":     {3, SysctlNameMapVfs},
+	"net":     {4, nil},
+	"debug":   {5, nil},
+	"hw":      {6, SysctlNameMapHw},
+	"machdep": {7, nil},
+	"user":    {8, SysctlNameMapUser},
+}
+
+// sysctlValues holds the values reported for a MIB, by name. Everything
+// else is reported as missing.
+var sysctlValues = map[string]interface{}{
+	"kern.ostype":          "Darwin",
+	"kern.osrelease":       "19.6.0",
+	"kern.osrevision":      int32(199506),
+	"kern.version":         "Darwin Kernel Version 19.6.0: root:xnu/RELEASE_X86_64",
+	"kern.osversion":       "19H2",
+	"kern.hostname":        "binemu",
+	"kern.argmax":          int32(262144),
+	"kern.maxfiles":        int32(12288),
+	"kern.maxfilesperproc": int32(10240),
+	"kern.securelevel":     int32(0),
+	"kern.usrstack64":      uint64(STACK_BASE + STACK_SIZE),
+	"hw.machine":           "x86_64",
+	"hw.model":             "binemu",
+	"hw.ncpu":              int32(1),
+	"hw.availcpu":          int32(1),
+	"hw.byteorder":         int32(1234),
+	"hw.pagesize":          int32(0x1000),
+	"hw.physmem":           int32(1 << 30),
+	"hw.usermem":           int32(1 << 30),
+	"hw.memsize":           uint64(1 << 30),
+	"hw.cachelinesize":     int32(64),
+}
+
+// CTL_UNSPEC followed by one of these is handled by the kernel itself.
+const (
+	sysctlName2oid = 3
+)
+
+// sysctlOid resolves a dotted name such as "kern.ostype" into its MIB.
+func sysctlOid(name string) ([]int32, bool) {
+	var oid []int32
+	table := SysctlNameMapCTL
+	for _, part := range strings.Split(name, ".") {
+		entry, ok := table[part]
+		if !ok {
+			return nil, false
+		}
+		oid = append(oid, int32(entry.id))
+		table = entry.subMap
+	}
+	return oid, len(oid) > 0
+}
+
+// sysctlName is the inverse of sysctlOid.
+func sysctlName(oid []int32) (string, bool) {
+	var parts []string
+	table := SysctlNameMapCTL
+	for _, id := range oid {
+		found := false
+		for name, entry := range table {
+			if int32(entry.id) == id {
+				parts = append(parts, name)
+				table = entry.subMap
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", false
+		}
+	}
+	return strings.Join(parts, "."), len(parts) > 0
+}
+
+// Sysctl syscall. Values can't be changed, newp is only used to pass the
+// name to sysctlbyname()'s name-to-oid lookup.
+func (k *DarwinKernel) Sysctl(name co.Buf, namelen uint64, old co.Obuf, oldlenp co.Buf, newp co.Buf, newlen co.Len) uint64 {
+	if namelen < 2 || namelen > 12 {
+		return bsd.Errno(bsd.EINVAL)
+	}
+	raw := make([]byte, namelen*4)
+	if err := name.Unpack(raw); err != nil {
+		return bsd.Errno(bsd.EFAULT)
+	}
+	order := k.U.ByteOrder()
+	oid := make([]int32, namelen)
+	for i := range oid {
+		oid[i] = int32(order.Uint32(raw[i*4:]))
+	}
+	var out []byte
+	if oid[0] == 0 && oid[1] == sysctlName2oid {
+		tmp := make([]byte, newlen)
+		if err := newp.Unpack(tmp); err != nil {
+			return bsd.Errno(bsd.EFAULT)
+		}
+		res, ok := sysctlOid(strings.TrimRight(string(tmp), "\x00"))
+		if !ok {
+			return bsd.Errno(bsd.ENOENT)
+		}
+		for _, id := range res {
+			var b [4]byte
+			order.PutUint32(b[:], uint32(id))
+			out = append(out, b[:]...)
+		}
+	} else {
+		if newp.Addr != 0 {
+			return bsd.Errno(bsd.EPERM)
+		}
+		key, ok := sysctlName(oid)
+		if !ok {
+			return bsd.Errno(bsd.ENOENT)
+		}
+		switch v := sysctlValues[key].(type) {
+		case string:
+			out = []byte(v + "\x00")
+		case int32:
+			out = make([]byte, 4)
+			order.PutUint32(out, uint32(v))
+		case uint64:
+			out = make([]byte, 8)
+			order.PutUint64(out, v)
+		default:
+			return bsd.Errno(bsd.ENOENT)
+		}
+	}
+	var size uint64
+	if oldlenp.Addr != 0 {
+		if err := oldlenp.Unpack(&size); err != nil {
+			return bsd.Errno(bsd.EFAULT)
+		}
+	}
+	if old.Addr != 0 {
+		if size < uint64(len(out)) {
+			return bsd.Errno(bsd.ENOMEM)
+		}
+		if err := old.Pack(out); err != nil {
+			return bsd.Errno(bsd.EFAULT)
+		}
+	}
+	if oldlenp.Addr != 0 {
+		if err := oldlenp.Pack(uint64(len(out))); err != nil {
+			return bsd.Errno(bsd.EFAULT)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,378 @@
+// Package dos provides a kernel for DOS .COM programs. It implements the
+// int 21h services and int 10h text output on top of the guest filesystem.
+package dos
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+
+	co "github.com/felberj/binemu/kernel/common"
+	"github.com/felberj/binemu/models"
+	"github.com/felberj/binemu/vfs"
+
+	uc "github.com/felberj/binemu/cpu/unicorn"
+)
+
+// DOS error codes returned in AX with the carry flag set.
+const (
+	ERROR_INVALID_FUNCTION = 1
+	ERROR_FILE_NOT_FOUND   = 2
+	ERROR_ACCESS_DENIED    = 5
+	ERROR_INVALID_HANDLE   = 6
+	ERROR_INVALID_ACCESS   = 12
+)
+
+const flagCarry = 1
+
+// File is an open DOS file handle.
+type File interface {
+	io.ReadWriter
+	io.Closer
+}
+
+// DosKernel implements the DOS services. The services take their
+// arguments from and return their results in registers themselves.
+type DosKernel struct {
+	*co.KernelBase
+	Fs     *vfs.Filesystem
+	Files  map[uint16]File
+	stdin  *bufio.Reader
+	stdout io.Writer
+	nextfd uint16
+	cursor uint16
+}
+
+// NewKernel creates a DOS kernel with the standard handles attached to the host.
+func NewKernel(fs *vfs.Filesystem) *DosKernel {
+	return &DosKernel{
+		KernelBase: &co.KernelBase{},
+		Fs:         fs,
+		Files: map[uint16]File{
+			0: os.Stdin,
+			1: os.Stdout,
+			2: os.Stderr,
+		},
+		stdin:  bufio.NewReader(os.Stdin),
+		stdout: os.Stdout,
+		nextfd: 5,
+	}
+}
+
+// SetStdio replaces the host's stdio the guest starts with.
+func (k *DosKernel) SetStdio(stdin io.Reader, stdout, stderr io.Writer) {
+	if stdin != nil {
+		k.Files[0] = &co.Stream{R: stdin}
+		k.stdin = bufio.NewReader(stdin)
+	}
+	if stdout != nil {
+		k.Files[1] = &co.Stream{W: stdout}
+		k.stdout = stdout
+	}
+	if stderr != nil {
+		k.Files[2] = &co.Stream{W: stderr}
+	}
+}
+
+func (k *DosKernel) reg(enum int) uint64 {
+	val, _ := k.U.RegRead(enum)
+	return val
+}
+
+// farPtr returns the linear address of seg:off.
+func (k *DosKernel) farPtr(seg, off int) uint64 {
+	return k.reg(seg)<<4 + k.reg(off)&0xffff
+}
+
+func (k *DosKernel) readString(addr uint64, term byte) string {
+	var s []byte
+	var tmp [1]byte
+	mem := k.U.Mem()
+	mem.Seek(int64(addr), io.SeekStart)
+	for len(s) < 0x10000 {
+		if _, err := mem.Read(tmp[:]); err != nil || tmp[0] == term {
+			break
+		}
+		s = append(s, tmp[0])
+	}
+	return string(s)
+}
+
+// path converts a DOS file name into a guest path.
+func (k *DosKernel) path(addr uint64) string {
+	name := k.readString(addr, 0)
+	if len(name) >= 2 && name[1] == ':' {
+		name = name[2:]
+	}
+	return "/" + strings.TrimLeft(strings.Replace(name, "\\", "/", -1), "/")
+}
+
+func (k *DosKernel) setCarry(set bool) {
+	flags := k.reg(uc.X86_REG_EFLAGS)
+	if set {
+		flags |= flagCarry
+	} else {
+		flags &^= flagCarry
+	}
+	k.U.RegWrite(uc.X86_REG_EFLAGS, flags)
+}
+
+// ok clears the carry flag and returns val in AX.
+func (k *DosKernel) ok(val uint64) {
+	k.U.RegWrite(uc.X86_REG_AX, val&0xffff)
+	k.setCarry(false)
+}
+
+// fail sets the carry flag and returns the error code in AX.
+func (k *DosKernel) fail(code uint64) {
+	k.U.RegWrite(uc.X86_REG_AX, code)
+	k.setCarry(true)
+}
+
+func (k *DosKernel) readChar() byte {
+	c, err := k.stdin.ReadByte()
+	if err != nil {
+		return 0x1a // ^Z
+	}
+	return c
+}
+
+// Terminate (int 20h and AH=00h) exits with status 0.
+func (k *DosKernel) Terminate() {
+	k.U.Exit(models.ExitStatus(0))
+}
+
+// Exit (AH=4Ch) exits with the status in AL.
+func (k *DosKernel) Exit() {
+	k.U.Exit(models.ExitStatus(k.reg(uc.X86_REG_AL)))
+}
+
+// ReadCharEcho (AH=01h) reads a character into AL and echoes it.
+func (k *DosKernel) ReadCharEcho() {
+	c := k.readChar()
+	k.stdout.Write([]byte{c})
+	k.U.RegWrite(uc.X86_REG_AL, uint64(c))
+}
+
+// ReadChar (AH=07h and AH=08h) reads a character into AL without echo.
+func (k *DosKernel) ReadChar() {
+	k.U.RegWrite(uc.X86_REG_AL, uint64(k.readChar()))
+}
+
+// WriteChar (AH=02h) writes the character in DL.
+func (k *DosKernel) WriteChar() {
+	dl := byte(k.reg(uc.X86_REG_DL))
+	k.stdout.Write([]byte{dl})
+	k.U.RegWrite(uc.X86_REG_AL, uint64(dl))
+}
+
+// DirectConsoleIo (AH=06h) writes DL, or reads a character if DL is FFh.
+func (k *DosKernel) DirectConsoleIo() {
+	dl := byte(k.reg(uc.X86_REG_DL))
+	if dl != 0xff {
+		k.stdout.Write([]byte{dl})
+		k.U.RegWrite(uc.X86_REG_AL, uint64(dl))
+		return
+	}
+	k.U.RegWrite(uc.X86_REG_AL, uint64(k.readChar()))
+	flags := k.reg(uc.X86_REG_EFLAGS) &^ (1 << 6) // ZF clear, a character is available
+	k.U.RegWrite(uc.X86_REG_EFLAGS, flags)
+}
+
+// PrintString (AH=09h) writes the '$' terminated string at DS:DX.
+func (k *DosKernel) PrintString() {
+	s := k.readString(k.farPtr(uc.X86_REG_DS, uc.X86_REG_DX), '$')
+	io.WriteString(k.stdout, s)
+	k.U.RegWrite(uc.X86_REG_AL, '$')
+}
+
+// BufferedInput (AH=0Ah) reads a line into the buffer at DS:DX.
+func (k *DosKernel) BufferedInput() {
+	addr := k.farPtr(uc.X86_REG_DS, uc.X86_REG_DX)
+	var max [1]byte
+	mem := k.U.Mem()
+	mem.Seek(int64(addr), io.SeekStart)
+	if _, err := mem.Read(max[:]); err != nil || max[0] == 0 {
+		return
+	}
+	line, _ := k.stdin.ReadString('\n')
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) > int(max[0])-1 {
+		line = line[:max[0]-1]
+	}
+	buf := append([]byte{byte(len(line))}, line...)
+	buf = append(buf, '\r')
+	mem.Seek(int64(addr+1), io.SeekStart)
+	mem.Write(buf)
+}
+
+// GetDrive (AH=19h) returns C: in AL.
+func (k *DosKernel) GetDrive() {
+	k.U.RegWrite(uc.X86_REG_AL, 2)
+}
+
+// SetVector (AH=25h) points interrupt vector AL at DS:DX.
+func (k *DosKernel) SetVector() {
+	var tmp [4]byte
+	vec := k.reg(uc.X86_REG_DS)<<16 | k.reg(uc.X86_REG_DX)
+	k.U.ByteOrder().PutUint32(tmp[:], uint32(vec))
+	mem := k.U.Mem()
+	mem.Seek(int64(k.reg(uc.X86_REG_AL)*4), io.SeekStart)
+	mem.Write(tmp[:])
+}
+
+// GetVector (AH=35h) returns interrupt vector AL in ES:BX.
+func (k *DosKernel) GetVector() {
+	var tmp [4]byte
+	mem := k.U.Mem()
+	mem.Seek(int64(k.reg(uc.X86_REG_AL)*4), io.SeekStart)
+	mem.Read(tmp[:])
+	vec := k.U.ByteOrder().Uint32(tmp[:])
+	k.U.RegWrite(uc.X86_REG_ES, uint64(vec>>16))
+	k.U.RegWrite(uc.X86_REG_BX, uint64(vec&0xffff))
+}
+
+// GetVersion (AH=30h) reports DOS 5.0.
+func (k *DosKernel) GetVersion() {
+	k.U.RegWrite(uc.X86_REG_AX, 5)
+	k.U.RegWrite(uc.X86_REG_BX, 0)
+	k.U.RegWrite(uc.X86_REG_CX, 0)
+}
+
+func (k *DosKernel) openFile(flag int) {
+	f, err := k.Fs.OpenFile(k.path(k.farPtr(uc.X86_REG_DS, uc.X86_REG_DX)), flag, 0644)
+	if err != nil {
+		k.fail(ERROR_FILE_NOT_FOUND)
+		return
+	}
+	fd := k.nextfd
+	k.nextfd++
+	k.Files[fd] = f
+	k.ok(uint64(fd))
+}
+
+// CreateFile (AH=3Ch) creates or truncates the file named at DS:DX.
+func (k *DosKernel) CreateFile() {
+	k.openFile(os.O_RDWR | os.O_CREATE | os.O_TRUNC)
+}
+
+// OpenFile (AH=3Dh) opens the file named at DS:DX with the access mode in AL.
+func (k *DosKernel) OpenFile() {
+	switch k.reg(uc.X86_REG_AL) & 3 {
+	case 0:
+		k.openFile(os.O_RDONLY)
+	case 1:
+		k.openFile(os.O_WRONLY)
+	case 2:
+		k.openFile(os.O_RDWR)
+	default:
+		k.fail(ERROR_INVALID_ACCESS)
+	}
+}
+
+func (k *DosKernel) file() (uint16, File, bool) {
+	fd := uint16(k.reg(uc.X86_REG_BX))
+	f, ok := k.Files[fd]
+	if !ok {
+		k.fail(ERROR_INVALID_HANDLE)
+	}
+	return fd, f, ok
+}
+
+// CloseFile (AH=3Eh) closes handle BX.
+func (k *DosKernel) CloseFile() {
+	fd, f, ok := k.file()
+	if !ok {
+		return
+	}
+	delete(k.Files, fd)
+	if fd > 2 {
+		f.Close()
+	}
+	k.ok(0)
+}
+
+// ReadFile (AH=3Fh) reads CX bytes from handle BX to DS:DX.
+func (k *DosKernel) ReadFile() {
+	fd, f, ok := k.file()
+	if !ok {
+		return
+	}
+	tmp := make([]byte, k.reg(uc.X86_REG_CX))
+	var n int
+	var err error
+	if fd == 0 {
+		// console reads return at most one line
+		for n < len(tmp) {
+			c, err := k.stdin.ReadByte()
+			if err != nil {
+				break
+			}
+			tmp[n] = c
+			n++
+			if c == '\n' {
+				break
+			}
+		}
+	} else if n, err = f.Read(tmp); err != nil && err != io.EOF {
+		k.fail(ERROR_ACCESS_DENIED)
+		return
+	}
+	mem := k.U.Mem()
+	mem.Seek(int64(k.farPtr(uc.X86_REG_DS, uc.X86_REG_DX)), io.SeekStart)
+	mem.Write(tmp[:n])
+	k.ok(uint64(n))
+}
+
+// WriteFile (AH=40h) writes CX bytes from DS:DX to handle BX.
+func (k *DosKernel) WriteFile() {
+	_, f, ok := k.file()
+	if !ok {
+		return
+	}
+	tmp := make([]byte, k.reg(uc.X86_REG_CX))
+	mem := k.U.Mem()
+	mem.Seek(int64(k.farPtr(uc.X86_REG_DS, uc.X86_REG_DX)), io.SeekStart)
+	if _, err := mem.Read(tmp); err != nil {
+		k.fail(ERROR_ACCESS_DENIED)
+		return
+	}
+	n, err := f.Write(tmp)
+	if err != nil {
+		k.fail(ERROR_ACCESS_DENIED)
+		return
+	}
+	k.ok(uint64(n))
+}
+
+// DeleteFile (AH=41h) removes the file named at DS:DX.
+func (k *DosKernel) DeleteFile() {
+	if err := k.Fs.Remove(k.path(k.farPtr(uc.X86_REG_DS, uc.X86_REG_DX))); err != nil {
+		k.fail(ERROR_FILE_NOT_FOUND)
+		return
+	}
+	k.ok(0)
+}
+
+// SeekFile (AH=42h) moves handle BX to CX:DX relative to the origin in AL
+// and returns the new position in DX:AX.
+func (k *DosKernel) SeekFile() {
+	_, f, ok := k.file()
+	if !ok {
+		return
+	}
+	s, ok := f.(io.Seeker)
+	if !ok {
+		k.fail(ERROR_INVALID_HANDLE)
+		return
+	}
+	off := int64(int32(k.reg(uc.X86_REG_CX)<<16 | k.reg(uc.X86_REG_DX)))
+	pos, err := s.Seek(off, int(k.reg(uc.X86_REG_AL)))
+	if err != nil {
+		k.fail(ERROR_INVALID_FUNCTION)
+		return
+	}
+	k.U.RegWrite(uc.X86_REG_DX, uint64(pos>>16)&0xffff)
+	k.ok(uint64(pos))
+}
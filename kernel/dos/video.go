@@ -0,0 +1,87 @@
+package dos
+
+import (
+	"bytes"
+	"io"
+
+	uc "github.com/felberj/binemu/cpu/unicorn"
+)
+
+// The int 10h services only support text output, which goes to stdout.
+// The cursor is tracked so programs can query it, but never moves output.
+
+// VideoSetMode (AH=00h) accepts any mode.
+func (k *DosKernel) VideoSetMode() {}
+
+// VideoSetCursor (AH=02h) moves the cursor to DH:DL.
+func (k *DosKernel) VideoSetCursor() {
+	k.cursor = uint16(k.reg(uc.X86_REG_DX))
+}
+
+// VideoGetCursor (AH=03h) returns the cursor in DH:DL.
+func (k *DosKernel) VideoGetCursor() {
+	k.U.RegWrite(uc.X86_REG_DX, uint64(k.cursor))
+	k.U.RegWrite(uc.X86_REG_CX, 0x0607)
+}
+
+func (k *DosKernel) videoWrite(p []byte) {
+	k.stdout.Write(p)
+	for _, c := range p {
+		row, col := k.cursor>>8, k.cursor&0xff
+		switch c {
+		case '\r':
+			col = 0
+		case '\n':
+			row++
+		case '\b':
+			if col > 0 {
+				col--
+			}
+		default:
+			col++
+		}
+		if col >= 80 {
+			row, col = row+1, 0
+		}
+		if row >= 25 {
+			row = 24
+		}
+		k.cursor = row<<8 | col
+	}
+}
+
+// VideoWriteChar (AH=09h and AH=0Ah) writes AL CX times.
+func (k *DosKernel) VideoWriteChar() {
+	al := byte(k.reg(uc.X86_REG_AL))
+	k.videoWrite(bytes.Repeat([]byte{al}, int(k.reg(uc.X86_REG_CX)&0xffff)))
+}
+
+// VideoTeletype (AH=0Eh) writes AL and advances the cursor.
+func (k *DosKernel) VideoTeletype() {
+	k.videoWrite([]byte{byte(k.reg(uc.X86_REG_AL))})
+}
+
+// VideoGetMode (AH=0Fh) reports 80x25 color text mode.
+func (k *DosKernel) VideoGetMode() {
+	k.U.RegWrite(uc.X86_REG_AX, 80<<8|3)
+	k.U.RegWrite(uc.X86_REG_BH, 0)
+}
+
+// VideoWriteString (AH=13h) writes CX characters from ES:BP.
+func (k *DosKernel) VideoWriteString() {
+	n := k.reg(uc.X86_REG_CX) & 0xffff
+	stride := uint64(1)
+	if k.reg(uc.X86_REG_AL)&2 != 0 {
+		// string alternates characters and attributes
+		stride = 2
+	}
+	tmp := make([]byte, n*stride)
+	mem := k.U.Mem()
+	mem.Seek(int64(k.farPtr(uc.X86_REG_ES, uc.X86_REG_BP)), io.SeekStart)
+	mem.Read(tmp)
+	out := make([]byte, 0, n)
+	for i := uint64(0); i < n; i++ {
+		out = append(out, tmp[i*stride])
+	}
+	k.videoWrite(out)
+}
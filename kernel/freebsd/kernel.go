@@ -0,0 +1,146 @@
+// Package freebsd provides a kernel for FreeBSD ELF binaries.
+package freebsd
+
+import (
+	"crypto/rand"
+	"syscall"
+
+	"github.com/felberj/binemu/kernel/bsd"
+	co "github.com/felberj/binemu/kernel/common"
+	"github.com/felberj/binemu/kernel/linux"
+	"github.com/felberj/binemu/models"
+	"github.com/felberj/binemu/vfs"
+)
+
+const (
+	// OsRelDate is the __FreeBSD_version the guest sees, 12.2-RELEASE.
+	OsRelDate = 1202000
+
+	pid = 1
+	// thread ids start above PID_MAX
+	tid = 100001
+)
+
+// FreebsdKernel implements the FreeBSD syscalls that differ from Linux.
+type FreebsdKernel struct {
+	*bsd.Kernel
+}
+
+// NewKernel creates a FreeBSD kernel on top of fs.
+func NewKernel(fs *vfs.Filesystem) *FreebsdKernel {
+	return &FreebsdKernel{Kernel: bsd.NewKernel(fs, openFlagMap)}
+}
+
+// openFlagMap maps FreeBSD open flags to the host's.
+var openFlagMap = map[int]int{
+	0x0000:   syscall.O_RDONLY,
+	0x0001:   syscall.O_WRONLY,
+	0x0002:   syscall.O_RDWR,
+	0x0004:   syscall.O_NONBLOCK,
+	0x0008:   syscall.O_APPEND,
+	0x0080:   syscall.O_SYNC,
+	0x0100:   syscall.O_NOFOLLOW,
+	0x0200:   syscall.O_CREAT,
+	0x0400:   syscall.O_TRUNC,
+	0x0800:   syscall.O_EXCL,
+	0x8000:   syscall.O_NOCTTY,
+	0x20000:  syscall.O_DIRECTORY,
+	0x100000: syscall.O_CLOEXEC,
+}
+
+// Sigaction syscall (not implemented)
+func (k *FreebsdKernel) Sigaction() {}
+
+// Sigprocmask syscall (not implemented)
+func (k *FreebsdKernel) Sigprocmask() {}
+
+// Issetugid syscall
+func (k *FreebsdKernel) Issetugid() uint64 {
+	if c := k.U.Cred(); c.Euid != c.Uid || c.Egid != c.Gid {
+		return 1
+	}
+	return 0
+}
+
+// Getpid syscall
+func (k *FreebsdKernel) Getpid() uint64 {
+	return pid
+}
+
+// ThrSelf syscall
+func (k *FreebsdKernel) ThrSelf(id co.Obuf) uint64 {
+	if err := id.Pack(int64(tid)); err != nil {
+		return bsd.Errno(bsd.EFAULT)
+	}
+	return 0
+}
+
+// FreeBSD auxv types. They only match Linux up to AT_EGID.
+const (
+	AT_EXECPATH     = 15
+	AT_CANARY       = 16
+	AT_CANARYLEN    = 17
+	AT_OSRELDATE    = 18
+	AT_NCPUS        = 19
+	AT_PAGESIZES    = 20
+	AT_PAGESIZESLEN = 21
+	AT_STACKPROT    = 23
+)
+
+func setupAuxv(u models.Usercorn) ([]byte, error) {
+	var canary [64]byte
+	if _, err := rand.Read(canary[:]); err != nil {
+		return nil, err
+	}
+	canaryAddr, err := u.PushBytes(canary[:])
+	if err != nil {
+		return nil, err
+	}
+	pagesizes, err := linux.PackAddrs(u, []uint64{0x1000, 0x200000})
+	if err != nil {
+		return nil, err
+	}
+	// PackAddrs adds a null terminator, which isn't part of the array
+	pagesizes = pagesizes[:len(pagesizes)-int(u.Bits()/8)]
+	pagesizesAddr, err := u.PushBytes(pagesizes)
+	if err != nil {
+		return nil, err
+	}
+	execAddr, err := u.PushBytes([]byte(u.Exe() + "\x00"))
+	if err != nil {
+		return nil, err
+	}
+	auxv := []linux.ElfAuxv{
+		{Type: linux.ELF_AT_PAGESZ, Val: 4096},
+		{Type: linux.ELF_AT_BASE, Val: u.InterpBase()},
+		{Type: linux.ELF_AT_FLAGS, Val: 0},
+		{Type: linux.ELF_AT_ENTRY, Val: uint64(u.BinEntry())},
+		{Type: linux.ELF_AT_UID, Val: uint64(u.Cred().Uid)},
+		{Type: linux.ELF_AT_EUID, Val: uint64(u.Cred().Euid)},
+		{Type: linux.ELF_AT_GID, Val: uint64(u.Cred().Gid)},
+		{Type: linux.ELF_AT_EGID, Val: uint64(u.Cred().Egid)},
+		{Type: AT_EXECPATH, Val: execAddr},
+		{Type: AT_CANARY, Val: canaryAddr},
+		{Type: AT_CANARYLEN, Val: uint64(len(canary))},
+		{Type: AT_OSRELDATE, Val: OsRelDate},
+		{Type: AT_NCPUS, Val: 1},
+		{Type: AT_PAGESIZES, Val: pagesizesAddr},
+		{Type: AT_PAGESIZESLEN, Val: uint64(len(pagesizes))},
+		{Type: AT_STACKPROT, Val: 7},
+		{Type: linux.ELF_AT_NULL, Val: 0},
+	}
+	if phdr, phent, phnum := linux.ElfPhdr(u); phdr > 0 {
+		auxv = append([]linux.ElfAuxv{
+			{Type: linux.ELF_AT_PHDR, Val: phdr},
+			{Type: linux.ELF_AT_PHENT, Val: phent},
+			{Type: linux.ELF_AT_PHNUM, Val: phnum},
+		}, auxv...)
+	}
+	return linux.PackAuxv(u, auxv)
+}
+
+// StackInit lays out the initial stack like Linux does, with the FreeBSD
+// auxiliary vector.
+func StackInit(u models.Usercorn, args, env []string) error {
+	return linux.StackInitAuxv(u, args, env, setupAuxv)
+}
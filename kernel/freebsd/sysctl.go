@@ -0,0 +1,180 @@
+package freebsd
+
+import (
+	"crypto/rand"
+	"strings"
+
+	"github.com/felberj/binemu/kernel/bsd"
+	co "github.com/felberj/binemu/kernel/common"
+	"github.com/felberj/binemu/kernel/linux"
+)
+
+type sysctlEntry struct {
+	name  string
+	oid   []int32
+	value interface{}
+}
+
+// sysctlArandom stands for kern.arandom, which returns fresh random bytes.
+type sysctlArandom struct{}
+
+var sysctls = []sysctlEntry{
+	{"kern.ostype", []int32{1, 1}, "FreeBSD"},
+	{"kern.osrelease", []int32{1, 2}, "12.2-RELEASE"},
+	{"kern.osrevision", []int32{1, 3}, int32(199506)},
+	{"kern.version", []int32{1, 4}, "FreeBSD 12.2-RELEASE r366954 GENERIC\n"},
+	{"kern.argmax", []int32{1, 8}, int32(262144)},
+	{"kern.hostname", []int32{1, 10}, "binemu"},
+	{"kern.osreldate", []int32{1, 24}, int32(OsRelDate)},
+	{"kern.usrstack", []int32{1, 33}, uint64(linux.STACK_BASE + linux.STACK_SIZE)},
+	{"kern.iov_max", []int32{1, 35}, int32(1024)},
+	{"kern.arandom", []int32{1, 37}, sysctlArandom{}},
+	{"vm.overcommit", []int32{2, 12}, int32(0)},
+	{"hw.machine", []int32{6, 1}, "amd64"},
+	{"hw.model", []int32{6, 2}, "binemu"},
+	{"hw.ncpu", []int32{6, 3}, int32(1)},
+	{"hw.byteorder", []int32{6, 4}, int32(1234)},
+	{"hw.physmem", []int32{6, 5}, uint64(1 << 30)},
+	{"hw.pagesize", []int32{6, 7}, int32(0x1000)},
+	{"hw.machine_arch", []int32{6, 11}, "amd64"},
+}
+
+// CTL_UNSPEC followed by one of these is handled by the kernel itself.
+const (
+	sysctlName2oid = 3
+)
+
+func sysctlByName(name string) *sysctlEntry {
+	for i := range sysctls {
+		if sysctls[i].name == name {
+			return &sysctls[i]
+		}
+	}
+	return nil
+}
+
+func sysctlByOid(oid []int32) *sysctlEntry {
+	for i, e := range sysctls {
+		if len(e.oid) != len(oid) {
+			continue
+		}
+		match := true
+		for j := range oid {
+			match = match && e.oid[j] == oid[j]
+		}
+		if match {
+			return &sysctls[i]
+		}
+	}
+	return nil
+}
+
+// readString reads a name of the given length, which may or may not
+// include the terminator.
+func readString(buf co.Buf, size uint64) (string, bool) {
+	tmp := make([]byte, size)
+	if err := buf.Unpack(tmp); err != nil {
+		return "", false
+	}
+	return strings.TrimRight(string(tmp), "\x00"), true
+}
+
+// sysctlRead copies the value of e to old, following the oldp/oldlenp
+// conventions of sysctl(3).
+func (k *FreebsdKernel) sysctlRead(e *sysctlEntry, old co.Obuf, oldlenp co.Buf) uint64 {
+	var size uint64
+	if oldlenp.Addr != 0 {
+		if err := oldlenp.Unpack(&size); err != nil {
+			return bsd.Errno(bsd.EFAULT)
+		}
+	}
+	order := k.U.ByteOrder()
+	var out []byte
+	switch v := e.value.(type) {
+	case string:
+		out = []byte(v + "\x00")
+	case int32:
+		out = make([]byte, 4)
+		order.PutUint32(out, uint32(v))
+	case uint64:
+		out = make([]byte, 8)
+		order.PutUint64(out, v)
+	case []int32:
+		out = make([]byte, 4*len(v))
+		for i, id := range v {
+			order.PutUint32(out[i*4:], uint32(id))
+		}
+	case sysctlArandom:
+		if size > 256 {
+			size = 256
+		}
+		out = make([]byte, size)
+		rand.Read(out)
+	}
+	if old.Addr != 0 {
+		if size < uint64(len(out)) {
+			return bsd.Errno(bsd.ENOMEM)
+		}
+		if err := old.Pack(out); err != nil {
+			return bsd.Errno(bsd.EFAULT)
+		}
+	}
+	if oldlenp.Addr != 0 {
+		if err := oldlenp.Pack(uint64(len(out))); err != nil {
+			return bsd.Errno(bsd.EFAULT)
+		}
+	}
+	return 0
+}
+
+// Sysctl syscall. Values can't be changed, newp is only used to pass the
+// name to the name-to-oid lookup.
+func (k *FreebsdKernel) Sysctl(name co.Buf, namelen uint64, old co.Obuf, oldlenp co.Buf, newp co.Buf, newlen co.Len) uint64 {
+	if namelen < 2 || namelen > 24 {
+		return bsd.Errno(bsd.EINVAL)
+	}
+	raw := make([]byte, namelen*4)
+	if err := name.Unpack(raw); err != nil {
+		return bsd.Errno(bsd.EFAULT)
+	}
+	order := k.U.ByteOrder()
+	oid := make([]int32, namelen)
+	for i := range oid {
+		oid[i] = int32(order.Uint32(raw[i*4:]))
+	}
+	if oid[0] == 0 && oid[1] == sysctlName2oid {
+		s, ok := readString(newp, uint64(newlen))
+		if !ok {
+			return bsd.Errno(bsd.EFAULT)
+		}
+		e := sysctlByName(s)
+		if e == nil {
+			return bsd.Errno(bsd.ENOENT)
+		}
+		return k.sysctlRead(&sysctlEntry{value: e.oid}, old, oldlenp)
+	}
+	if newp.Addr != 0 {
+		return bsd.Errno(bsd.EPERM)
+	}
+	e := sysctlByOid(oid)
+	if e == nil {
+		return bsd.Errno(bsd.ENOENT)
+	}
+	return k.sysctlRead(e, old, oldlenp)
+}
+
+// Sysctlbyname syscall
+func (k *FreebsdKernel) Sysctlbyname(name co.Buf, namelen uint64, old co.Obuf, oldlenp co.Buf, newp co.Buf, newlen co.Len) uint64 {
+	s, ok := readString(name, namelen)
+	if !ok {
+		return bsd.Errno(bsd.EFAULT)
+	}
+	if newp.Addr != 0 {
+		return bsd.Errno(bsd.EPERM)
+	}
+	e := sysctlByName(s)
+	if e == nil {
+		return bsd.Errno(bsd.ENOENT)
+	}
+	return k.sysctlRead(e, old, oldlenp)
+}
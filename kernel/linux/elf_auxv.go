@@ -3,7 +3,6 @@ package linux
 import (
 	"bytes"
 	"crypto/rand"
-	"os"
 
 	"github.com/lunixbochs/struc"
 
@@ -30,6 +29,7 @@ const (
 	ELF_AT_HWCAP
 	ELF_AT_CLKTCK       = 17
 	ELF_AT_RANDOM       = 25
+	ELF_AT_EXECFN       = 31
 	ELF_AT_SYSINFO      = 32
 	ELF_AT_SYSINFO_EHDR = 33
 )
@@ -57,23 +57,44 @@ func setupElfAuxv(u models.Usercorn) ([]ElfAuxv, error) {
 	if err != nil {
 		return nil, err
 	}
+	execfnAddr, err := u.PushBytes([]byte(u.Exe() + "\x00"))
+	if err != nil {
+		return nil, err
+	}
 	// main auxv table
 	auxv := []ElfAuxv{
 		// TODO: set/track a page size somewhere - on Arch.OS?
 		{ELF_AT_PAGESZ, 4096},
-		{ELF_AT_BASE, u.Base()},
+		{ELF_AT_BASE, u.InterpBase()},
 		{ELF_AT_FLAGS, 0},
 		{ELF_AT_ENTRY, uint64(u.BinEntry())},
-		{ELF_AT_UID, uint64(os.Getuid())},
-		{ELF_AT_EUID, uint64(os.Geteuid())},
-		{ELF_AT_GID, uint64(os.Getgid())},
-		{ELF_AT_EGID, uint64(os.Getegid())},
+		{ELF_AT_UID, uint64(u.Cred().Uid)},
+		{ELF_AT_EUID, uint64(u.Cred().Euid)},
+		{ELF_AT_GID, uint64(u.Cred().Gid)},
+		{ELF_AT_EGID, uint64(u.Cred().Egid)},
 		{ELF_AT_PLATFORM, platformAddr},
 		{ELF_AT_CLKTCK, 100}, // 100hz, totally fake
 		{ELF_AT_RANDOM, randAddr},
+		{ELF_AT_EXECFN, execfnAddr},
 		{ELF_AT_NULL, 0},
 	}
+	if vdso, ok := vdsoBase(u); ok {
+		auxv = append([]ElfAuxv{{ELF_AT_SYSINFO_EHDR, vdso}}, auxv...)
+	}
 	// add phdr information if present in binary
+	if phdr, phent, phnum := ElfPhdr(u); phdr > 0 {
+		auxv = append([]ElfAuxv{
+			{ELF_AT_PHDR, phdr},
+			{ELF_AT_PHENT, phent},
+			{ELF_AT_PHNUM, phnum},
+		}, auxv...)
+	}
+	return auxv, nil
+}
+
+// ElfPhdr returns the address, entry size and count of the loaded program
+// headers. The address is 0 if they aren't part of any segment.
+func ElfPhdr(u models.Usercorn) (addr, ent, num uint64) {
 	phdrOff, _, phdrCount := u.Loader().Header()
 	segments, _ := u.Loader().Segments()
 	for _, s := range segments {
@@ -82,26 +103,28 @@ func setupElfAuxv(u models.Usercorn) ([]ElfAuxv, error) {
 			break
 		}
 	}
-	phdrEnt := 56
+	ent = 56
 	if u.Bits() == 32 {
-		phdrEnt = 32
+		ent = 32
 	}
-	if phdrOff > 0 {
-		auxv = append([]ElfAuxv{
-			{ELF_AT_PHDR, phdrOff + u.Base()}, // TODO always correct?
-			{ELF_AT_PHENT, uint64(phdrEnt)},
-			{ELF_AT_PHNUM, uint64(phdrCount)},
-		}, auxv...)
+	if phdrOff == 0 {
+		return 0, ent, uint64(phdrCount)
 	}
-	return auxv, nil
+	// TODO always correct?
+	return phdrOff + u.Base(), ent, uint64(phdrCount)
 }
 
 func SetupElfAuxv(u models.Usercorn) ([]byte, error) {
-	var buf bytes.Buffer
 	auxv, err := setupElfAuxv(u)
 	if err != nil {
 		return nil, err
 	}
+	return PackAuxv(u, auxv)
+}
+
+// PackAuxv encodes auxv with the guest's word size and byte order.
+func PackAuxv(u models.Usercorn, auxv []ElfAuxv) ([]byte, error) {
+	var buf bytes.Buffer
 	options := &struc.Options{
 		PtrSize: int(u.Bits()),
 		Order:   u.ByteOrder(),
@@ -111,5 +134,5 @@ func SetupElfAuxv(u models.Usercorn) ([]byte, error) {
 			return nil, err
 		}
 	}
-	return buf.Bytes(), err
+	return buf.Bytes(), nil
 }
@@ -0,0 +1,79 @@
+package linux
+
+import (
+	"os"
+	"syscall"
+)
+
+// Linux errno values, which need not match the host's.
+const (
+	EPERM        = 1
+	ENOENT       = 2
+	ESRCH        = 3
+	EBADF        = 9
+	EACCES       = 13
+	EEXIST       = 17
+	EXDEV        = 18
+	ENOTDIR      = 20
+	EISDIR       = 21
+	EINVAL       = 22
+	ENOSPC       = 28
+	ESPIPE       = 29
+	EROFS        = 30
+	ERANGE       = 34
+	ENAMETOOLONG = 36
+	ENOSYS       = 38
+	ENOTEMPTY    = 39
+	ELOOP        = 40
+)
+
+// hostErrno maps the host's errno values to the Linux ones.
+var hostErrno = map[syscall.Errno]uint64{
+	syscall.EPERM:        EPERM,
+	syscall.ENOENT:       ENOENT,
+	syscall.ESRCH:        ESRCH,
+	syscall.EBADF:        EBADF,
+	syscall.EACCES:       EACCES,
+	syscall.EEXIST:       EEXIST,
+	syscall.EXDEV:        EXDEV,
+	syscall.ENOTDIR:      ENOTDIR,
+	syscall.EISDIR:       EISDIR,
+	syscall.EINVAL:       EINVAL,
+	syscall.ENOSPC:       ENOSPC,
+	syscall.ESPIPE:       ESPIPE,
+	syscall.EROFS:        EROFS,
+	syscall.ERANGE:       ERANGE,
+	syscall.ENAMETOOLONG: ENAMETOOLONG,
+	syscall.ENOSYS:       ENOSYS,
+	syscall.ENOTEMPTY:    ENOTEMPTY,
+	syscall.ELOOP:        ELOOP,
+}
+
+// Errno encodes a Linux errno as a syscall return value.
+func Errno(errno uint64) uint64 {
+	return -errno
+}
+
+// errno returns the syscall return value for a filesystem error.
+// Errors without an errno fail with EPERM, which is -1.
+func errno(err error) uint64 {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	} else if le, ok := err.(*os.LinkError); ok {
+		err = le.Err
+	}
+	if e, ok := err.(syscall.Errno); ok {
+		if n, ok := hostErrno[e]; ok {
+			return Errno(n)
+		}
+	}
+	switch {
+	case os.IsNotExist(err):
+		return Errno(ENOENT)
+	case os.IsExist(err):
+		return Errno(EEXIST)
+	case os.IsPermission(err):
+		return Errno(EACCES)
+	}
+	return MinusOne
+}
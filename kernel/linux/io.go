@@ -1,14 +1,26 @@
 package linux
 
 import (
-	"crypto/md5"
-	"encoding/binary"
 	"io"
 	"os"
+	"strings"
+	"time"
 
 	co "github.com/felberj/binemu/kernel/common"
 	"github.com/felberj/binemu/models"
 	"github.com/felberj/binemu/native/enum"
+	"github.com/felberj/binemu/vfs"
+)
+
+const (
+	// AT_FDCWD makes *at syscalls resolve relative to the working directory.
+	AT_FDCWD = -100
+	// AT_SYMLINK_NOFOLLOW makes *at syscalls operate on a symlink itself.
+	AT_SYMLINK_NOFOLLOW = 0x100
+	// AT_SYMLINK_FOLLOW makes linkat follow a symlink it links to.
+	AT_SYMLINK_FOLLOW = 0x400
+	// AT_EMPTY_PATH makes *at syscalls operate on dirfd itself.
+	AT_EMPTY_PATH = 0x1000
 )
 
 type File interface {
@@ -24,7 +36,11 @@ func (k *LinuxKernel) Readlink(path string, buf co.Obuf, size co.Len) uint64 {
 	if path == "/proc/self/exe" {
 		name = k.U.Exe()
 	} else {
-		panic("Readlink not implemented")
+		target, err := k.Fs.Readlink(k.abs(path))
+		if err != nil {
+			return errno(err)
+		}
+		name = target
 	}
 	if len(name) > int(size) {
 		name = name[:size]
@@ -35,40 +51,112 @@ func (k *LinuxKernel) Readlink(path string, buf co.Obuf, size co.Len) uint64 {
 	return uint64(len(name))
 }
 
-// Access syscall
-func (k *LinuxKernel) Access(path string, mode uint32) uint64 {
-	f, err := k.Fs.Open(path)
-	if err != nil {
-		return MinusOne
+// abs returns the absolute path of name, which is relative to the
+// working directory unless it starts with a slash. It isn't cleaned, as
+// ".." after a symlink is resolved from the link target.
+func (k *LinuxKernel) abs(name string) string {
+	if strings.HasPrefix(name, "/") {
+		return name
 	}
-	defer f.Close()
-	stat, err := f.Stat()
+	return strings.TrimSuffix(k.cwd, "/") + "/" + name
+}
+
+// resolveAt returns the path a *at syscall refers to. Relative paths are
+// resolved against the directory open as dirfd, or the working directory
+// for AT_FDCWD.
+func (k *LinuxKernel) resolveAt(dirfd co.Fd, path string) (string, uint64) {
+	if strings.HasPrefix(path, "/") || dirfd == AT_FDCWD {
+		return k.abs(path), 0
+	}
+	f, ok := k.fdFile(dirfd)
+	if !ok {
+		if _, open := k.Fds[dirfd]; open {
+			return "", Errno(ENOTDIR)
+		}
+		return "", Errno(EBADF)
+	}
+	info, err := f.Info()
 	if err != nil {
-		return MinusOne
+		return "", errno(err)
 	}
-	if mode&1 != 0 && stat.Mode()&1 == 0 {
-		return MinusOne
+	if !info.Mode.IsDir() {
+		return "", Errno(ENOTDIR)
 	}
-	if mode&2 != 0 && stat.Mode()&2 == 0 {
-		return MinusOne
+	return strings.TrimSuffix(f.Name(), "/") + "/" + path, 0
+}
+
+// Getcwd syscall
+func (k *LinuxKernel) Getcwd(buf co.Obuf, size co.Len) uint64 {
+	cwd := append([]byte(k.cwd), 0)
+	if uint64(len(cwd)) > uint64(size) {
+		return Errno(ERANGE)
 	}
-	if mode&4 != 0 && stat.Mode()&4 == 0 {
+	if err := buf.Pack(cwd); err != nil {
 		return MinusOne
 	}
+	return uint64(len(cwd))
+}
+
+// Chdir syscall
+func (k *LinuxKernel) Chdir(path string) uint64 {
+	p, e := k.resolve(k.abs(path), true, false)
+	if e != 0 {
+		return e
+	}
+	info, err := k.Fs.Info(p, false)
+	if err != nil {
+		return errno(err)
+	}
+	if !info.Mode.IsDir() {
+		return Errno(ENOTDIR)
+	}
+	if !k.may(info, X_OK, false) {
+		return Errno(EACCES)
+	}
+	k.cwd = p
 	return 0
 }
 
+// Readlinkat syscall
+func (k *LinuxKernel) Readlinkat(dirfd co.Fd, path string, buf co.Obuf, size co.Len) uint64 {
+	p, e := k.resolveAt(dirfd, path)
+	if e != 0 {
+		return e
+	}
+	return k.Readlink(p, buf, size)
+}
+
 // Fstat syscall
 func (k *LinuxKernel) Fstat(fd co.Fd, buf co.Obuf) uint64 {
-	f, ok := k.Fds[fd]
+	info, ok := k.fdInfo(fd)
 	if !ok {
 		return MinusOne
 	}
+	return handleStat(buf, info, k.U)
+}
+
+// infoer is implemented by files that describe themselves, such as the
+// files of the guest filesystem.
+type infoer interface {
+	Info() (*vfs.Info, error)
+}
+
+// fdInfo describes the file open as fd. Files from outside the guest
+// filesystem, like the host's stdio, are described by the host.
+func (k *LinuxKernel) fdInfo(fd co.Fd) (*vfs.Info, bool) {
+	f, ok := k.Fds[fd]
+	if !ok {
+		return nil, false
+	}
+	if f, ok := f.(infoer); ok {
+		info, err := f.Info()
+		return info, err == nil
+	}
 	stat, err := f.Stat()
 	if err != nil {
-		return MinusOne
+		return nil, false
 	}
-	return handleStat(buf, stat, k.U)
+	return vfs.InfoOf(stat), true
 }
 
 // Write syscall
@@ -111,9 +199,21 @@ func (k *LinuxKernel) Writev(fd co.Fd, iov co.Buf, count uint64) uint64 {
 
 // Open syscall
 func (k *LinuxKernel) Open(path string, flags enum.OpenFlag, mode uint64) uint64 {
-	f, err := k.Fs.OpenFile(path, int(flags), os.FileMode(mode))
+	path = k.abs(path)
+	e, create := k.checkOpen(path, int(flags))
+	if e != 0 {
+		return e
+	}
+	f, err := k.Fs.OpenFile(path, int(flags), vfs.FileMode(uint32(mode))&^k.umask)
 	if err != nil {
-		return MinusOne
+		return errno(err)
+	}
+	if create {
+		c := k.U.Cred()
+		if err := k.Fs.Chown(path, c.Euid, c.Egid); err != nil {
+			f.Close()
+			return errno(err)
+		}
 	}
 	fd := k.nextfd
 	k.nextfd++
@@ -121,6 +221,15 @@ func (k *LinuxKernel) Open(path string, flags enum.OpenFlag, mode uint64) uint64
 	return uint64(fd)
 }
 
+// Openat syscall
+func (k *LinuxKernel) Openat(dirfd co.Fd, path string, flags enum.OpenFlag, mode uint64) uint64 {
+	p, e := k.resolveAt(dirfd, path)
+	if e != 0 {
+		return e
+	}
+	return k.Open(p, flags, mode)
+}
+
 // Read syscall
 func (k *LinuxKernel) Read(fd co.Fd, buf co.Obuf, size co.Len) uint64 {
 	file, ok := k.Fds[fd]
@@ -134,14 +243,16 @@ func (k *LinuxKernel) Read(fd co.Fd, buf co.Obuf, size co.Len) uint64 {
 			tmp = tmp[:size-i]
 		}
 		count, err := file.Read(tmp)
-		if err != nil {
+		if err != nil && err != io.EOF {
 			return MinusOne
 		}
 		if err := buf.Pack(tmp[:count]); err != nil {
 			return MinusOne
 		}
 		n += uint64(count)
-		if count < 1024 {
+		// like a pipe, a stream only returns what it has, so reading on
+		// could block on input that depends on what the guest does next
+		if _, ok := file.(*stdioFile); count < 1024 || err == io.EOF || ok {
 			break
 		}
 	}
@@ -160,27 +271,128 @@ func (k *LinuxKernel) Close(fd co.Fd) uint64 {
 	return 0
 }
 
+// Lseek syscall
+func (k *LinuxKernel) Lseek(fd co.Fd, offset co.Off, whence int) uint64 {
+	file, ok := k.Fds[fd]
+	if !ok {
+		return Errno(EBADF)
+	}
+	seeker, ok := file.(io.Seeker)
+	if _, stdio := file.(*stdioFile); !ok || stdio {
+		return Errno(ESPIPE)
+	}
+	if whence < io.SeekStart || whence > io.SeekEnd {
+		return Errno(EINVAL)
+	}
+	pos, err := seeker.Seek(int64(offset), whence)
+	if err != nil {
+		return Errno(EINVAL)
+	}
+	return uint64(pos)
+}
+
 // Stat syscall
 func (k *LinuxKernel) Stat(path string, buf co.Obuf) uint64 {
-	file, err := k.Fs.Open(path)
+	info, err := k.Fs.Info(k.abs(path), true)
 	if err != nil {
-		return MinusOne
+		return errno(err)
 	}
-	stat, err := file.Stat()
+	return handleStat(buf, info, k.U)
+}
+
+// Lstat syscall
+func (k *LinuxKernel) Lstat(path string, buf co.Obuf) uint64 {
+	info, err := k.Fs.Info(k.abs(path), false)
 	if err != nil {
+		return errno(err)
+	}
+	return handleStat(buf, info, k.U)
+}
+
+// Newfstatat syscall
+func (k *LinuxKernel) Newfstatat(dirfd co.Fd, path string, buf co.Obuf, flags int) uint64 {
+	if path == "" && flags&AT_EMPTY_PATH != 0 {
+		return k.Fstat(dirfd, buf)
+	}
+	p, e := k.resolveAt(dirfd, path)
+	if e != 0 {
+		return e
+	}
+	if flags&AT_SYMLINK_NOFOLLOW != 0 {
+		return k.Lstat(p, buf)
+	}
+	return k.Stat(p, buf)
+}
+
+// STATX_BASIC_STATS are the fields of struct statx every file has.
+const STATX_BASIC_STATS = 0x7ff
+
+// Statx syscall
+func (k *LinuxKernel) Statx(dirfd co.Fd, path string, flags int, mask uint32, buf co.Obuf) uint64 {
+	var info *vfs.Info
+	if path == "" && flags&AT_EMPTY_PATH != 0 {
+		var ok bool
+		if info, ok = k.fdInfo(dirfd); !ok {
+			return Errno(EBADF)
+		}
+	} else {
+		p, e := k.resolveAt(dirfd, path)
+		if e != 0 {
+			return e
+		}
+		var err error
+		if info, err = k.Fs.Info(p, flags&AT_SYMLINK_NOFOLLOW == 0); err != nil {
+			return errno(err)
+		}
+	}
+	stamp := func(t time.Time) StatxTimestamp {
+		return StatxTimestamp{Sec: t.Unix(), Nsec: uint32(t.Nanosecond())}
+	}
+	s := &Statx{
+		Mask:      STATX_BASIC_STATS,
+		Blksize:   blockSize,
+		Nlink:     uint32(info.Nlink),
+		Uid:       uint32(info.Uid),
+		Gid:       uint32(info.Gid),
+		Mode:      uint16(vfs.UnixMode(info.Mode)),
+		Ino:       info.Ino,
+		Size:      uint64(info.Size),
+		Blocks:    uint64(info.Size+511) / 512,
+		Atime:     stamp(info.Atime),
+		Mtime:     stamp(info.Mtime),
+		Ctime:     stamp(info.Ctime),
+		RdevMajor: vfs.Major(info.Rdev),
+		RdevMinor: vfs.Minor(info.Rdev),
+		DevMajor:  vfs.Major(vfs.Dev),
+		DevMinor:  vfs.Minor(vfs.Dev),
+	}
+	if err := buf.Pack(s); err != nil {
 		return MinusOne
 	}
-	return handleStat(buf, stat, k.U)
+	return 0
 }
 
-func handleStat(buf co.Obuf, stat os.FileInfo, u models.Usercorn) uint64 {
-	sum := md5.Sum([]byte(stat.Name()))
-	ino := binary.BigEndian.Uint64(sum[:])
+// blockSize is the preferred I/O size stat reports.
+const blockSize = 4096
+
+func handleStat(buf co.Obuf, info *vfs.Info, u models.Usercorn) uint64 {
 	s := &LinuxStat64_x86{
-		Ino:     ino,
-		Size:    stat.Size(),
-		Blksize: 1024,
-		Mode:    uint32(stat.Mode()),
+		Dev:       vfs.Dev,
+		Ino:       info.Ino,
+		Nlink:     uint64(info.Nlink),
+		Mode:      vfs.UnixMode(info.Mode),
+		Uid:       uint32(info.Uid),
+		Gid:       uint32(info.Gid),
+		Rdev:      info.Rdev,
+		Size:      info.Size,
+		Blksize:   blockSize,
+		Blkcnt:    (info.Size + 511) / 512,
+		Atime:     uint64(info.Atime.Unix()),
+		AtimeNsec: uint64(info.Atime.Nanosecond()),
+		Mtime:     uint64(info.Mtime.Unix()),
+		MtimeNsec: uint64(info.Mtime.Nanosecond()),
+		Ctime:     uint64(info.Ctime.Unix()),
+		CtimeNsec: uint64(info.Ctime.Nanosecond()),
 	}
 	return HandleStat(buf, s, u, false)
 }
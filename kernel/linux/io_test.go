@@ -0,0 +1,54 @@
+package linux
+
+import (
+	"os"
+	"testing"
+
+	co "github.com/felberj/binemu/kernel/common"
+	"github.com/felberj/binemu/native/enum"
+)
+
+func TestResolveAt(t *testing.T) {
+	k := permKernel(t)
+	dir := k.Open("/home/user", enum.OpenFlag(os.O_RDONLY), 0)
+	if dir == MinusOne || int64(dir) < 0 {
+		t.Fatalf("open(/home/user) = %d", int64(dir))
+	}
+	file := k.Open("/home/user/file", enum.OpenFlag(os.O_WRONLY|os.O_CREATE), 0644)
+	if file == MinusOne || int64(file) < 0 {
+		t.Fatalf("open(/home/user/file) = %d", int64(file))
+	}
+	if e := k.Mkdirat(AT_FDCWD, "/home/user/sub", 0755); e != 0 {
+		t.Fatalf("mkdirat = %d", int64(e))
+	}
+	tests := []struct {
+		dirfd uint64
+		path  string
+		want  string
+		e     uint64
+	}{
+		{dir, "sub/x", "/home/user/sub/x", 0},
+		{dir, "/tmp/x", "/tmp/x", 0},
+		{file, "x", "", Errno(ENOTDIR)},
+		{0, "x", "", Errno(ENOTDIR)},
+		{99, "x", "", Errno(EBADF)},
+	}
+	for _, test := range tests {
+		p, e := k.resolveAt(co.Fd(test.dirfd), test.path)
+		if p != test.want || e != test.e {
+			t.Errorf("resolveAt(%d, %q) = %q, %d, want %q, %d", test.dirfd, test.path, p, int64(e), test.want, int64(test.e))
+		}
+	}
+	// the *at syscalls create their files in the directory
+	if e := k.Symlinkat("/flag", co.Fd(dir), "sub/l"); e != 0 {
+		t.Fatalf("symlinkat = %d", int64(e))
+	}
+	if e := k.Linkat(co.Fd(dir), "file", co.Fd(dir), "sub/f", 0); e != 0 {
+		t.Fatalf("linkat = %d", int64(e))
+	}
+	for _, name := range []string{"/home/user/sub/l", "/home/user/sub/f"} {
+		if _, err := k.Fs.Info(name, false); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -4,13 +4,16 @@ package linux
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"path"
+	"time"
 
 	co "github.com/felberj/binemu/kernel/common"
 	"github.com/felberj/binemu/models"
-	"github.com/felberj/ramfs"
+	"github.com/felberj/binemu/vfs"
 )
 
 const (
@@ -25,9 +28,12 @@ const (
 type LinuxKernel struct {
 	*co.KernelBase
 	Unpack func(co.Buf, interface{})
-	Fs     *ramfs.Filesystem
+	Fs     *vfs.Filesystem
 	Fds    map[co.Fd]File // Open file descriptors
+	Clock  *Clock
 	nextfd co.Fd
+	umask  os.FileMode
+	cwd    string
 }
 
 type netFile struct {
@@ -38,20 +44,48 @@ func (f *netFile) Stat() (os.FileInfo, error) {
 	return nil, fmt.Errorf("stat on netfile not implemented")
 }
 
+// Info describes the connection as a socket.
+func (f *netFile) Info() (*vfs.Info, error) {
+	return &vfs.Info{Mode: os.ModeSocket | 0777, Nlink: 1}, nil
+}
+
 func (f *netFile) Truncate(int64) error {
 	return fmt.Errorf("truncate on netfile not implemented")
 }
 
+// stdioFile is a standard stream from the Go API, which looks like a pipe
+// to the guest.
+type stdioFile struct {
+	*co.Stream
+}
+
+func (f *stdioFile) Stat() (os.FileInfo, error) {
+	return nil, fmt.Errorf("stat on stdio stream not implemented")
+}
+
+// Info describes the stream as a pipe.
+func (f *stdioFile) Info() (*vfs.Info, error) {
+	return &vfs.Info{Mode: os.ModeNamedPipe | 0600, Nlink: 1}, nil
+}
+
+func (f *stdioFile) Truncate(int64) error {
+	return fmt.Errorf("truncate on stdio stream not implemented")
+}
+
 // NewKernel creates a Linux Kernel that is isolated from the operating system.
-func NewKernel(fs *ramfs.Filesystem) *LinuxKernel {
+func NewKernel(fs *vfs.Filesystem) *LinuxKernel {
 	kernel := &LinuxKernel{
 		KernelBase: &co.KernelBase{},
 		Fs:         fs,
 		Fds:        map[co.Fd]File{},
+		Clock:      NewClock(time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)),
+		umask:      022,
+		cwd:        "/",
 	}
 	kernel.Argjoy.Register(func(arg interface{}, vals []interface{}) error {
 		return Unpack(kernel, arg, vals)
 	})
+	fs.Clock = kernel.Clock.Now
 	kernel.initFs()
 	return kernel
 }
@@ -63,6 +97,24 @@ func (k *LinuxKernel) initFs() {
 	k.nextfd = 3
 }
 
+// SetStdio replaces the host's stdio the guest starts with.
+func (k *LinuxKernel) SetStdio(stdin io.Reader, stdout, stderr io.Writer) {
+	if stdin != nil {
+		k.Fds[0] = &stdioFile{&co.Stream{R: stdin}}
+	}
+	if stdout != nil {
+		k.Fds[1] = &stdioFile{&co.Stream{W: stdout}}
+	}
+	if stderr != nil {
+		k.Fds[2] = &stdioFile{&co.Stream{W: stderr}}
+	}
+}
+
+// SetCwd sets the working directory relative paths are resolved against.
+func (k *LinuxKernel) SetCwd(dir string) {
+	k.cwd = path.Clean("/" + dir)
+}
+
 // StdinOutPort redirects stdin and stout to the connection that connects
 // to the specified port.
 func (k *LinuxKernel) StdinOutPort(port int) error {
@@ -84,10 +136,16 @@ func (k *LinuxKernel) StdinOutPort(port int) error {
 }
 
 func StackInit(u models.Usercorn, args, env []string) error {
+	return StackInitAuxv(u, args, env, SetupElfAuxv)
+}
+
+// StackInitAuxv is StackInit with a custom auxiliary vector, for kernels
+// that use the Linux stack layout but their own auxv types.
+func StackInitAuxv(u models.Usercorn, args, env []string, setupAuxv func(models.Usercorn) ([]byte, error)) error {
 	if err := u.MapStack(STACK_BASE, STACK_SIZE, false); err != nil {
 		return err
 	}
-	auxv, err := SetupElfAuxv(u)
+	auxv, err := setupAuxv(u)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,79 @@
+package linux
+
+import (
+	"os"
+
+	co "github.com/felberj/binemu/kernel/common"
+)
+
+// Symlink syscall
+func (k *LinuxKernel) Symlink(target, linkpath string) uint64 {
+	p, e := k.mayChange(k.abs(linkpath))
+	if e != 0 {
+		return e
+	}
+	if err := k.Fs.Symlink(target, p); err != nil {
+		return errno(err)
+	}
+	c := k.U.Cred()
+	if err := k.Fs.Lchown(p, c.Euid, c.Egid); err != nil {
+		return errno(err)
+	}
+	return 0
+}
+
+// Symlinkat syscall
+func (k *LinuxKernel) Symlinkat(target string, newdirfd co.Fd, linkpath string) uint64 {
+	p, e := k.resolveAt(newdirfd, linkpath)
+	if e != 0 {
+		return e
+	}
+	return k.Symlink(target, p)
+}
+
+// Link syscall
+func (k *LinuxKernel) Link(oldpath, newpath string) uint64 {
+	return k.link(oldpath, newpath, false)
+}
+
+// Linkat syscall
+func (k *LinuxKernel) Linkat(olddirfd co.Fd, oldpath string, newdirfd co.Fd, newpath string, flags int) uint64 {
+	oldp, e := k.resolveAt(olddirfd, oldpath)
+	if e != 0 {
+		return e
+	}
+	newp, e := k.resolveAt(newdirfd, newpath)
+	if e != 0 {
+		return e
+	}
+	return k.link(oldp, newp, flags&AT_SYMLINK_FOLLOW != 0)
+}
+
+// link creates newpath as a hard link to oldpath. Like Linux with
+// protected_hardlinks, only the owner may link a file it may not both read
+// and write, or a setuid or setgid one.
+func (k *LinuxKernel) link(oldpath, newpath string, follow bool) uint64 {
+	oldp, e := k.resolve(k.abs(oldpath), follow, false)
+	if e != 0 {
+		return e
+	}
+	info, err := k.Fs.Info(oldp, false)
+	if err != nil {
+		return errno(err)
+	}
+	newp, e := k.mayChange(k.abs(newpath))
+	if e != 0 {
+		return e
+	}
+	if !k.owns(info) {
+		safe := info.Mode.IsRegular() && info.Mode&os.ModeSetuid == 0 &&
+			(info.Mode&os.ModeSetgid == 0 || info.Mode&0010 == 0)
+		if !safe || !k.may(info, R_OK|W_OK, false) {
+			return Errno(EPERM)
+		}
+	}
+	if err := k.Fs.Link(oldp, newp); err != nil {
+		return errno(err)
+	}
+	return 0
+}
@@ -95,3 +95,11 @@ func (k *LinuxKernel) Mprotect(addr, size uint64, prot uint64) uint64 {
 	}
 	return 0
 }
+
+// Munmap syscall
+func (k *LinuxKernel) Munmap(addr, size uint64) uint64 {
+	if err := k.U.MemUnmap(addr, size); err != nil {
+		return MinusOne
+	}
+	return 0
+}
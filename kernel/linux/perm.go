@@ -0,0 +1,511 @@
+package linux
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	co "github.com/felberj/binemu/kernel/common"
+	"github.com/felberj/binemu/native"
+	"github.com/felberj/binemu/vfs"
+)
+
+// access modes of access and faccessat
+const (
+	F_OK = 0
+	X_OK = 1
+	W_OK = 2
+	R_OK = 4
+)
+
+const (
+	// AT_EACCESS makes faccessat check the effective ids.
+	AT_EACCESS = 0x200
+	// AT_REMOVEDIR makes unlinkat remove a directory.
+	AT_REMOVEDIR = 0x200
+)
+
+// special nanoseconds of utimensat
+const (
+	UTIME_NOW  = 1<<30 - 1
+	UTIME_OMIT = 1<<30 - 2
+)
+
+// noID is the uid or gid -1, which chown leaves as it is.
+const noID = ^uint32(0)
+
+// ids returns the user id and the group check access is decided by, the
+// effective ones unless real is set.
+func (k *LinuxKernel) ids(real bool) (int, func(int) bool) {
+	c := k.U.Cred()
+	if !real {
+		return c.Euid, c.InGroup
+	}
+	return c.Uid, func(gid int) bool {
+		if gid == c.Gid {
+			return true
+		}
+		for _, g := range c.Groups {
+			if g == gid {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// may tells whether the guest may access the file info describes in the
+// ways want asks for, a mask of R_OK, W_OK and X_OK.
+func (k *LinuxKernel) may(info *vfs.Info, want uint32, real bool) bool {
+	uid, inGroup := k.ids(real)
+	perm := uint32(info.Mode.Perm())
+	if uid == 0 {
+		// root reads and writes anything, and executes what anyone may
+		return want&X_OK == 0 || info.Mode.IsDir() || perm&0111 != 0
+	}
+	switch {
+	case uid == info.Uid:
+		perm >>= 6
+	case inGroup(info.Gid):
+		perm >>= 3
+	}
+	return perm&want == want
+}
+
+// errnoError carries an errno through vfs.Walk.
+type errnoError uint64
+
+func (e errnoError) Error() string {
+	return fmt.Sprintf("errno %d", -e)
+}
+
+// resolve returns the path name refers to, like Fs.Resolve, and checks
+// that the guest may search every directory it looks a name up in, also
+// inside symlink targets. It returns the path and 0, or an errno.
+func (k *LinuxKernel) resolve(name string, follow, real bool) (string, uint64) {
+	p, err := k.Fs.Walk(name, follow, func(dir string) error {
+		info, err := k.Fs.Info(dir, false)
+		if err != nil {
+			return err
+		}
+		if !info.Mode.IsDir() {
+			return errnoError(Errno(ENOTDIR))
+		}
+		if !k.may(info, X_OK, real) {
+			return errnoError(Errno(EACCES))
+		}
+		return nil
+	})
+	if e, ok := err.(errnoError); ok {
+		return "", uint64(e)
+	}
+	if err != nil {
+		return "", errno(err)
+	}
+	return p, 0
+}
+
+// mayChange checks that the guest may add or remove entries of the
+// directory name is in. A symlink at the end of name is not followed. It
+// returns the resolved name and 0, or an errno.
+func (k *LinuxKernel) mayChange(name string) (string, uint64) {
+	p, e := k.resolve(name, false, false)
+	if e != 0 {
+		return "", e
+	}
+	return p, k.mayCreate(p)
+}
+
+// mayCreate checks that the guest may add or remove the entry p, which is
+// resolved, of its directory. It returns 0 or an errno.
+func (k *LinuxKernel) mayCreate(p string) uint64 {
+	dir, err := k.Fs.Info(path.Dir(p), false)
+	if err != nil {
+		return errno(err)
+	}
+	if !k.may(dir, W_OK|X_OK, false) {
+		return Errno(EACCES)
+	}
+	return 0
+}
+
+// owns tells whether the guest may change the attributes of a file.
+func (k *LinuxKernel) owns(info *vfs.Info) bool {
+	euid := k.U.Cred().Euid
+	return euid == 0 || euid == info.Uid
+}
+
+// Access syscall
+func (k *LinuxKernel) Access(path string, mode uint32) uint64 {
+	return k.access(path, mode, true)
+}
+
+// Faccessat syscall
+func (k *LinuxKernel) Faccessat(dirfd co.Fd, path string, mode uint32, flags int) uint64 {
+	p, e := k.resolveAt(dirfd, path)
+	if e != 0 {
+		return e
+	}
+	return k.access(p, mode, flags&AT_EACCESS == 0)
+}
+
+// access checks name by the real ids, as access does, or the effective
+// ones.
+func (k *LinuxKernel) access(name string, mode uint32, real bool) uint64 {
+	p, e := k.resolve(k.abs(name), true, real)
+	if e != 0 {
+		return e
+	}
+	info, err := k.Fs.Info(p, false)
+	if err != nil {
+		return errno(err)
+	}
+	if !k.may(info, mode&(R_OK|W_OK|X_OK), real) {
+		return Errno(EACCES)
+	}
+	return 0
+}
+
+// checkOpen checks that the guest may open name with flags, or create it.
+// It returns 0 or an errno, and whether the file will be created. A
+// dangling symlink creates its target, in the target's directory.
+func (k *LinuxKernel) checkOpen(name string, flags int) (uint64, bool) {
+	p, e := k.resolve(name, flags&syscall.O_NOFOLLOW == 0, false)
+	if e != 0 {
+		return e, false
+	}
+	info, err := k.Fs.Info(p, false)
+	if err != nil {
+		if !os.IsNotExist(err) || flags&os.O_CREATE == 0 {
+			return errno(err), false
+		}
+		if e := k.mayCreate(p); e != 0 {
+			return e, false
+		}
+		return 0, true
+	}
+	var want uint32
+	switch flags & syscall.O_ACCMODE {
+	case os.O_RDONLY:
+		want = R_OK
+	case os.O_WRONLY:
+		want = W_OK
+	default:
+		want = R_OK | W_OK
+	}
+	if flags&os.O_TRUNC != 0 {
+		want |= W_OK
+	}
+	if !k.may(info, want, false) {
+		return Errno(EACCES), false
+	}
+	return 0, false
+}
+
+// Execve syscall. The permissions are checked, but replacing the process
+// image is not supported.
+func (k *LinuxKernel) Execve(path string, argv, envp co.Buf) uint64 {
+	p, e := k.resolve(k.abs(path), true, false)
+	if e != 0 {
+		return e
+	}
+	info, err := k.Fs.Info(p, false)
+	if err != nil {
+		return errno(err)
+	}
+	if !info.Mode.IsRegular() || !k.may(info, X_OK, false) {
+		return Errno(EACCES)
+	}
+	return Errno(ENOSYS)
+}
+
+// Unlink syscall
+func (k *LinuxKernel) Unlink(path string) uint64 {
+	return k.unlink(path, false)
+}
+
+// Rmdir syscall
+func (k *LinuxKernel) Rmdir(path string) uint64 {
+	return k.unlink(path, true)
+}
+
+// Unlinkat syscall
+func (k *LinuxKernel) Unlinkat(dirfd co.Fd, path string, flags int) uint64 {
+	p, e := k.resolveAt(dirfd, path)
+	if e != 0 {
+		return e
+	}
+	return k.unlink(p, flags&AT_REMOVEDIR != 0)
+}
+
+// unlink removes the file or, with dir, the empty directory name.
+func (k *LinuxKernel) unlink(name string, dir bool) uint64 {
+	p, e := k.mayChange(k.abs(name))
+	if e != 0 {
+		return e
+	}
+	info, err := k.Fs.Info(p, false)
+	if err != nil {
+		return errno(err)
+	}
+	switch {
+	case dir && !info.Mode.IsDir():
+		return Errno(ENOTDIR)
+	case !dir && info.Mode.IsDir():
+		return Errno(EISDIR)
+	}
+	// in sticky directories, only the owners may remove files
+	parent, err := k.Fs.Info(path.Dir(p), false)
+	if err != nil {
+		return errno(err)
+	}
+	if parent.Mode&os.ModeSticky != 0 && !k.owns(info) && !k.owns(parent) {
+		return Errno(EPERM)
+	}
+	if err := k.Fs.Remove(p); err != nil {
+		return errno(err)
+	}
+	return 0
+}
+
+// Mkdir syscall
+func (k *LinuxKernel) Mkdir(path string, mode uint32) uint64 {
+	p, e := k.mayChange(k.abs(path))
+	if e != 0 {
+		return e
+	}
+	if err := k.Fs.Mkdir(p, vfs.FileMode(mode)&^k.umask); err != nil {
+		return errno(err)
+	}
+	c := k.U.Cred()
+	if err := k.Fs.Lchown(p, c.Euid, c.Egid); err != nil {
+		return errno(err)
+	}
+	return 0
+}
+
+// Mkdirat syscall
+func (k *LinuxKernel) Mkdirat(dirfd co.Fd, path string, mode uint32) uint64 {
+	p, e := k.resolveAt(dirfd, path)
+	if e != 0 {
+		return e
+	}
+	return k.Mkdir(p, mode)
+}
+
+// attrFile is an open file of the filesystem, whose attributes can be
+// changed through it.
+type attrFile interface {
+	Name() string
+	Info() (*vfs.Info, error)
+	Chmod(mode os.FileMode) error
+	Chown(uid, gid int) error
+}
+
+// fdFile returns the file of the filesystem open as fd.
+func (k *LinuxKernel) fdFile(fd co.Fd) (attrFile, bool) {
+	f, ok := k.Fds[fd].(attrFile)
+	return f, ok
+}
+
+// Chmod syscall
+func (k *LinuxKernel) Chmod(path string, mode uint32) uint64 {
+	p, e := k.resolve(k.abs(path), true, false)
+	if e != 0 {
+		return e
+	}
+	info, err := k.Fs.Info(p, false)
+	if err != nil {
+		return errno(err)
+	}
+	if !k.owns(info) {
+		return Errno(EPERM)
+	}
+	if err := k.Fs.Chmod(p, vfs.FileMode(mode)); err != nil {
+		return errno(err)
+	}
+	return 0
+}
+
+// Fchmod syscall. The open file is changed, whatever its name is by now.
+func (k *LinuxKernel) Fchmod(fd co.Fd, mode uint32) uint64 {
+	f, ok := k.fdFile(fd)
+	if !ok {
+		return Errno(EBADF)
+	}
+	info, err := f.Info()
+	if err != nil {
+		return errno(err)
+	}
+	if !k.owns(info) {
+		return Errno(EPERM)
+	}
+	if err := f.Chmod(vfs.FileMode(mode)); err != nil {
+		return errno(err)
+	}
+	return 0
+}
+
+// Fchmodat syscall
+func (k *LinuxKernel) Fchmodat(dirfd co.Fd, path string, mode uint32) uint64 {
+	p, e := k.resolveAt(dirfd, path)
+	if e != 0 {
+		return e
+	}
+	return k.Chmod(p, mode)
+}
+
+// Chown syscall
+func (k *LinuxKernel) Chown(path string, uid, gid uint32) uint64 {
+	return k.chown(path, uid, gid, true)
+}
+
+// Lchown syscall
+func (k *LinuxKernel) Lchown(path string, uid, gid uint32) uint64 {
+	return k.chown(path, uid, gid, false)
+}
+
+// Fchown syscall. The open file is changed, whatever its name is by now.
+func (k *LinuxKernel) Fchown(fd co.Fd, uid, gid uint32) uint64 {
+	f, ok := k.fdFile(fd)
+	if !ok {
+		return Errno(EBADF)
+	}
+	info, err := f.Info()
+	if err != nil {
+		return errno(err)
+	}
+	newUid, newGid, e := k.mayChown(info, uid, gid)
+	if e != 0 {
+		return e
+	}
+	if err := f.Chown(newUid, newGid); err != nil {
+		return errno(err)
+	}
+	return 0
+}
+
+// Fchownat syscall
+func (k *LinuxKernel) Fchownat(dirfd co.Fd, path string, uid, gid uint32, flags int) uint64 {
+	p, e := k.resolveAt(dirfd, path)
+	if e != 0 {
+		return e
+	}
+	return k.chown(p, uid, gid, flags&AT_SYMLINK_NOFOLLOW == 0)
+}
+
+// chown changes the owner of name. Only root may give files away, owners
+// may change the group to one of theirs.
+func (k *LinuxKernel) chown(name string, uid, gid uint32, follow bool) uint64 {
+	p, e := k.resolve(k.abs(name), follow, false)
+	if e != 0 {
+		return e
+	}
+	info, err := k.Fs.Info(p, false)
+	if err != nil {
+		return errno(err)
+	}
+	newUid, newGid, e := k.mayChown(info, uid, gid)
+	if e != 0 {
+		return e
+	}
+	if err := k.Fs.Lchown(p, newUid, newGid); err != nil {
+		return errno(err)
+	}
+	return 0
+}
+
+// mayChown returns the owner chown(uid, gid) gives the file info
+// describes, and 0 if the guest may do that or else an errno.
+func (k *LinuxKernel) mayChown(info *vfs.Info, uid, gid uint32) (int, int, uint64) {
+	newUid, newGid := info.Uid, info.Gid
+	if uid != noID {
+		newUid = int(uid)
+	}
+	if gid != noID {
+		newGid = int(gid)
+	}
+	c := k.U.Cred()
+	if c.Euid != 0 {
+		if c.Euid != info.Uid || newUid != info.Uid || newGid != info.Gid && !c.InGroup(newGid) {
+			return 0, 0, Errno(EPERM)
+		}
+	}
+	return newUid, newGid, 0
+}
+
+// Umask syscall
+func (k *LinuxKernel) Umask(mask uint32) uint64 {
+	old := k.umask
+	k.umask = vfs.FileMode(mask) & os.ModePerm
+	return uint64(old)
+}
+
+// Utimensat syscall
+func (k *LinuxKernel) Utimensat(dirfd co.Fd, pathname co.Buf, times co.Buf, flags int) uint64 {
+	ts := [2]native.Timespec{{Nsec: UTIME_NOW}, {Nsec: UTIME_NOW}}
+	if times.Addr != 0 {
+		st := times.Struc()
+		for i := range ts {
+			if err := st.Unpack(&ts[i]); err != nil {
+				return MinusOne
+			}
+		}
+	}
+	var name string
+	var info *vfs.Info
+	if pathname.Addr == 0 {
+		// futimens
+		f, ok := k.fdFile(dirfd)
+		if !ok {
+			return Errno(EBADF)
+		}
+		var err error
+		if info, err = f.Info(); err != nil {
+			return errno(err)
+		}
+		name = f.Name()
+	} else {
+		s, err := pathname.CString()
+		if err != nil {
+			return MinusOne
+		}
+		p, e := k.resolveAt(dirfd, s)
+		if e != 0 {
+			return e
+		}
+		if name, e = k.resolve(p, flags&AT_SYMLINK_NOFOLLOW == 0, false); e != 0 {
+			return e
+		}
+		if info, err = k.Fs.Info(name, false); err != nil {
+			return errno(err)
+		}
+	}
+	// setting the times to now only needs write access
+	explicit := false
+	var at [2]time.Time
+	now := k.Clock.Now()
+	for i, t := range ts {
+		switch t.Nsec {
+		case UTIME_OMIT:
+		case UTIME_NOW:
+			at[i] = now
+		default:
+			explicit = true
+			at[i] = time.Unix(t.Sec, t.Nsec)
+		}
+	}
+	if !k.owns(info) && (explicit || !k.may(info, W_OK, false)) {
+		if explicit {
+			return Errno(EPERM)
+		}
+		return Errno(EACCES)
+	}
+	// name is resolved, a symlink at its end is the file itself
+	if err := k.Fs.Lchtimes(name, at[0], at[1]); err != nil {
+		return errno(err)
+	}
+	return 0
+}
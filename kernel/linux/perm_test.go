@@ -0,0 +1,213 @@
+package linux
+
+import (
+	"os"
+	"testing"
+
+	"github.com/felberj/binemu/models"
+	"github.com/felberj/binemu/vfs"
+)
+
+// credUsercorn is a Usercorn that only knows the guest's ids.
+type credUsercorn struct {
+	models.Usercorn
+	cred models.Cred
+}
+
+func (u *credUsercorn) Cred() *models.Cred {
+	return &u.cred
+}
+
+// permKernel returns a kernel running as uid 1000, group 100, over:
+//
+//	/root        0700 root
+//	/root/flag   0600 root
+//	/home/user   0755 user
+//	/tmp         1777 root
+//	/tmp/flag -> /root/flag
+//	/tmp/new  -> /root/new
+//	/tmp/mine -> /home/user/new
+func permKernel(t *testing.T) *LinuxKernel {
+	fs := vfs.New()
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(fs.MkdirAll("/root", 0700))
+	must(fs.Chmod("/root", 0700))
+	must(fs.WriteFile("/root/flag", []byte("flag"), 0600))
+	must(fs.MkdirAll("/home/user", 0755))
+	must(fs.Chown("/home/user", 1000, 100))
+	must(fs.Mkdir("/tmp", 0777))
+	must(fs.Chmod("/tmp", os.ModeSticky|0777))
+	must(fs.Symlink("/root/flag", "/tmp/flag"))
+	must(fs.Symlink("/root/new", "/tmp/new"))
+	must(fs.Symlink("/home/user/new", "/tmp/mine"))
+	k := NewKernel(fs)
+	k.U = &credUsercorn{cred: models.Cred{Uid: 1000, Euid: 1000, Gid: 100, Egid: 100}}
+	return k
+}
+
+func TestMay(t *testing.T) {
+	k := permKernel(t)
+	tests := []struct {
+		info vfs.Info
+		want uint32
+		ok   bool
+	}{
+		{vfs.Info{Mode: 0640, Uid: 1000}, R_OK | W_OK, true},
+		{vfs.Info{Mode: 0640, Uid: 1000}, X_OK, false},
+		{vfs.Info{Mode: 0640, Gid: 100}, R_OK, true},
+		{vfs.Info{Mode: 0640, Gid: 100}, W_OK, false},
+		{vfs.Info{Mode: 0604}, R_OK, true},
+		// the owner class applies even if others may do more
+		{vfs.Info{Mode: 0066, Uid: 1000}, R_OK, false},
+	}
+	for _, test := range tests {
+		if ok := k.may(&test.info, test.want, false); ok != test.ok {
+			t.Errorf("may(%v uid %d gid %d, %d) = %v", test.info.Mode, test.info.Uid, test.info.Gid, test.want, ok)
+		}
+	}
+	k.U.(*credUsercorn).cred = models.Cred{}
+	if !k.may(&vfs.Info{Mode: 0}, R_OK|W_OK, false) {
+		t.Error("root may not read and write")
+	}
+	if k.may(&vfs.Info{Mode: 0644}, X_OK, false) {
+		t.Error("root may execute a file without x bits")
+	}
+}
+
+func TestResolveSearch(t *testing.T) {
+	k := permKernel(t)
+	for name, want := range map[string]uint64{
+		"/home/user":      0,
+		"/root":           0,
+		"/root/flag":      Errno(EACCES),
+		"/tmp/flag":       Errno(EACCES),
+		"/missing/x":      Errno(ENOENT),
+		"/root/flag/x":    Errno(EACCES),
+		"/home/user/../x": 0,
+	} {
+		if _, e := k.resolve(name, true, false); e != want {
+			t.Errorf("resolve(%q) = %d, want %d", name, int64(e), int64(want))
+		}
+	}
+	if p, e := k.resolve("/tmp/flag", false, false); e != 0 || p != "/tmp/flag" {
+		t.Errorf("resolve without follow = %q, %d", p, int64(e))
+	}
+}
+
+func TestCheckOpen(t *testing.T) {
+	k := permKernel(t)
+	tests := []struct {
+		name   string
+		flags  int
+		e      uint64
+		create bool
+	}{
+		{"/root/flag", os.O_RDONLY, Errno(EACCES), false},
+		// the directories of a symlink's target are searched as well
+		{"/tmp/flag", os.O_RDONLY, Errno(EACCES), false},
+		// a dangling symlink creates its target
+		{"/tmp/new", os.O_WRONLY | os.O_CREATE, Errno(EACCES), false},
+		{"/tmp/mine", os.O_WRONLY | os.O_CREATE, 0, true},
+		{"/tmp/x", os.O_WRONLY | os.O_CREATE, 0, true},
+		{"/x", os.O_WRONLY | os.O_CREATE, Errno(EACCES), false},
+		{"/tmp/x", os.O_RDONLY, Errno(ENOENT), false},
+	}
+	for _, test := range tests {
+		e, create := k.checkOpen(test.name, test.flags)
+		if e != test.e || create != test.create {
+			t.Errorf("checkOpen(%q, %#x) = %d, %v, want %d, %v", test.name, test.flags, int64(e), create, int64(test.e), test.create)
+		}
+	}
+}
+
+func TestChown(t *testing.T) {
+	k := permKernel(t)
+	if err := k.Fs.WriteFile("/home/user/f", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Fs.Chown("/home/user/f", 1000, 100); err != nil {
+		t.Fatal(err)
+	}
+	k.U.(*credUsercorn).cred.Groups = []int{200}
+	tests := []struct {
+		name     string
+		uid, gid uint32
+		e        uint64
+	}{
+		{"/home/user/f", noID, 200, 0},
+		{"/home/user/f", noID, 300, Errno(EPERM)},
+		{"/home/user/f", 0, noID, Errno(EPERM)},
+		{"/home/user", 1000, 100, 0},
+		{"/tmp/flag", 1000, noID, Errno(EACCES)},
+	}
+	for _, test := range tests {
+		if e := k.chown(test.name, test.uid, test.gid, true); e != test.e {
+			t.Errorf("chown(%q, %d, %d) = %d, want %d", test.name, int32(test.uid), int32(test.gid), int64(e), int64(test.e))
+		}
+	}
+	if info, _ := k.Fs.Info("/home/user/f", true); info.Gid != 200 {
+		t.Errorf("group is %d, want 200", info.Gid)
+	}
+	// fchown checks the open file, not whatever its name is now
+	f, err := k.Fs.Open("/home/user/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.Fds[3] = f
+	if err := k.Fs.Rename("/home/user/f", "/home/user/g"); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Fs.WriteFile("/home/user/f", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if e := k.Fchown(3, noID, 100); e != 0 {
+		t.Errorf("fchown = %d", int64(e))
+	}
+	if info, _ := k.Fs.Info("/home/user/g", true); info.Gid != 100 {
+		t.Errorf("renamed file has group %d, want 100", info.Gid)
+	}
+	if info, _ := k.Fs.Info("/home/user/f", true); info.Gid != 0 {
+		t.Errorf("new file at the old name has group %d, want 0", info.Gid)
+	}
+}
+
+func TestLinks(t *testing.T) {
+	k := permKernel(t)
+	if err := k.Fs.WriteFile("/flag", []byte("flag"), 0400); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Fs.WriteFile("/shared", nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		old, new string
+		e        uint64
+	}{
+		// other users' files the guest may not write
+		{"/flag", "/home/user/flag", Errno(EPERM)},
+		{"/root/flag", "/home/user/flag", Errno(EACCES)},
+		{"/shared", "/home/user/shared", 0},
+		// directories the guest may not write
+		{"/home/user/shared", "/x", Errno(EACCES)},
+		{"/home/user/shared", "/root/x", Errno(EACCES)},
+	}
+	for _, test := range tests {
+		if e := k.Link(test.old, test.new); e != test.e {
+			t.Errorf("link(%q, %q) = %d, want %d", test.old, test.new, int64(e), int64(test.e))
+		}
+	}
+	if e := k.Symlink("/flag", "/x"); e != Errno(EACCES) {
+		t.Errorf("symlink in / = %d", int64(e))
+	}
+	if e := k.Symlink("/flag", "/home/user/l"); e != 0 {
+		t.Fatalf("symlink = %d", int64(e))
+	}
+	if info, _ := k.Fs.Info("/home/user/l", false); info.Uid != 1000 || info.Gid != 100 {
+		t.Errorf("symlink is owned by %d:%d", info.Uid, info.Gid)
+	}
+}
@@ -1,6 +1,9 @@
 package linux
 
-import "github.com/felberj/binemu/models"
+import (
+	co "github.com/felberj/binemu/kernel/common"
+	"github.com/felberj/binemu/models"
+)
 
 // Exit sycall
 func (k *LinuxKernel) Exit(code uint64) {
@@ -17,3 +20,45 @@ func (k *LinuxKernel) Ugetrlimit() {}
 
 // Getrlimit syscall (not implemented)
 func (k *LinuxKernel) Getrlimit() {}
+
+// Prlimit64 syscall (not implemented)
+func (k *LinuxKernel) Prlimit64() {}
+
+// Getuid syscall
+func (k *LinuxKernel) Getuid() uint64 {
+	return uint64(k.U.Cred().Uid)
+}
+
+// Geteuid syscall
+func (k *LinuxKernel) Geteuid() uint64 {
+	return uint64(k.U.Cred().Euid)
+}
+
+// Getgid syscall
+func (k *LinuxKernel) Getgid() uint64 {
+	return uint64(k.U.Cred().Gid)
+}
+
+// Getegid syscall
+func (k *LinuxKernel) Getegid() uint64 {
+	return uint64(k.U.Cred().Egid)
+}
+
+// Getgroups syscall
+func (k *LinuxKernel) Getgroups(size int, list co.Obuf) uint64 {
+	groups := k.U.Cred().Groups
+	if size == 0 {
+		return uint64(len(groups))
+	}
+	if size < len(groups) {
+		return Errno(EINVAL)
+	}
+	gids := make([]uint32, len(groups))
+	for i, g := range groups {
+		gids[i] = uint32(g)
+	}
+	if err := list.Pack(gids); err != nil {
+		return MinusOne
+	}
+	return uint64(len(gids))
+}
@@ -0,0 +1,78 @@
+package linux
+
+import (
+	"github.com/felberj/binemu/models"
+)
+
+// the guest is the only process and runs on a single thread
+const pid = 1
+
+// signals whose default action leaves the process running
+const (
+	SIGCHLD  = 17
+	SIGCONT  = 18
+	SIGSTOP  = 19
+	SIGTSTP  = 20
+	SIGTTIN  = 21
+	SIGTTOU  = 22
+	SIGURG   = 23
+	SIGWINCH = 28
+)
+
+// signals a guest is killed with for CPU traps no syscall handles
+const (
+	SIGILL  = 4
+	SIGTRAP = 5
+)
+
+// Getpid syscall
+func (k *LinuxKernel) Getpid() uint64 {
+	return pid
+}
+
+// Gettid syscall
+func (k *LinuxKernel) Gettid() uint64 {
+	return pid
+}
+
+// raise delivers sig to the guest. Handlers are not emulated, so every
+// signal takes its default action: the guest is killed, or nothing
+// happens for the signals that are ignored or would stop it.
+func (k *LinuxKernel) raise(sig int) uint64 {
+	switch {
+	case sig < 0 || sig > 64:
+		return Errno(EINVAL)
+	case sig == 0:
+		return 0
+	}
+	switch sig {
+	case SIGCHLD, SIGCONT, SIGSTOP, SIGTSTP, SIGTTIN, SIGTTOU, SIGURG, SIGWINCH:
+		return 0
+	}
+	k.U.Exit(models.Signal(sig))
+	return 0
+}
+
+// Kill syscall. The guest can only signal itself.
+func (k *LinuxKernel) Kill(p, sig int) uint64 {
+	if p != pid && p != 0 && p != -1 && p != -pid {
+		return Errno(ESRCH)
+	}
+	return k.raise(sig)
+}
+
+// Tkill syscall
+func (k *LinuxKernel) Tkill(tid, sig int) uint64 {
+	if tid != pid {
+		return Errno(ESRCH)
+	}
+	return k.raise(sig)
+}
+
+// Tgkill syscall
+func (k *LinuxKernel) Tgkill(tgid, tid, sig int) uint64 {
+	if tgid != pid || tid != pid {
+		return Errno(ESRCH)
+	}
+	return k.raise(sig)
+}
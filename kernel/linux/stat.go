@@ -11,6 +11,7 @@ func NewLinuxStat_generic(stat *LinuxStat64_x86, bits uint, large bool) interfac
 		Dev:       uint32(stat.Dev),
 		Ino:       uint64(stat.Ino),
 		Mode:      uint32(stat.Mode),
+		Nlink:     uint32(stat.Nlink),
 		Uid:       stat.Uid,
 		Gid:       stat.Gid,
 		Rdev:      uint32(stat.Rdev),
@@ -26,12 +27,34 @@ func NewLinuxStat_generic(stat *LinuxStat64_x86, bits uint, large bool) interfac
 	}
 }
 
+func NewLinuxStat_arm64(stat *LinuxStat64_x86, bits uint, large bool) interface{} {
+	return &LinuxStat_arm64{
+		Dev:       uint64(stat.Dev),
+		Ino:       uint64(stat.Ino),
+		Mode:      uint32(stat.Mode),
+		Nlink:     uint32(stat.Nlink),
+		Uid:       stat.Uid,
+		Gid:       stat.Gid,
+		Rdev:      uint64(stat.Rdev),
+		Size:      int64(stat.Size),
+		Blksize:   int32(stat.Blksize),
+		Blkcnt:    int64(stat.Blkcnt),
+		Atime:     int64(stat.Atime),
+		AtimeNsec: uint64(stat.AtimeNsec),
+		Mtime:     int64(stat.Mtime),
+		MtimeNsec: uint64(stat.MtimeNsec),
+		Ctime:     int64(stat.Ctime),
+		CtimeNsec: uint64(stat.CtimeNsec),
+	}
+}
+
 func NewLinuxStat_x86(stat *LinuxStat64_x86, bits uint, large bool) interface{} {
 	if bits == 64 {
 		return &LinuxStat64_x86{
 			Dev:       uint64(stat.Dev),
 			Ino:       uint64(stat.Ino),
 			Mode:      uint32(stat.Mode),
+			Nlink:     uint64(stat.Nlink),
 			Uid:       stat.Uid,
 			Gid:       stat.Gid,
 			Rdev:      uint64(stat.Rdev),
@@ -51,6 +74,7 @@ func NewLinuxStat_x86(stat *LinuxStat64_x86, bits uint, large bool) interface{}
 				Dev:       uint64(stat.Dev),
 				Ino:       uint32(stat.Ino),
 				Mode:      uint32(stat.Mode),
+				Nlink:     uint32(stat.Nlink),
 				Uid:       stat.Uid,
 				Gid:       stat.Gid,
 				Rdev:      uint64(stat.Rdev),
@@ -70,6 +94,7 @@ func NewLinuxStat_x86(stat *LinuxStat64_x86, bits uint, large bool) interface{}
 			Dev:       uint32(stat.Dev),
 			Ino:       uint32(stat.Ino),
 			Mode:      uint16(stat.Mode),
+			Nlink:     uint16(stat.Nlink),
 			Uid:       stat.Uid,
 			Gid:       stat.Gid,
 			Rdev:      uint32(stat.Rdev),
@@ -91,6 +116,7 @@ func NewDarwinStat(stat *LinuxStat64_x86, bits uint, large bool) interface{} {
 		return &DarwinStat64{
 			Dev:       int32(stat.Dev),
 			Mode:      uint16(stat.Mode),
+			Nlink:     uint16(stat.Nlink),
 			Ino:       uint64(stat.Ino),
 			Uid:       uint32(stat.Uid),
 			Gid:       uint32(stat.Gid),
@@ -110,6 +136,48 @@ func NewDarwinStat(stat *LinuxStat64_x86, bits uint, large bool) interface{} {
 	}
 }
 
+func NewFreebsdStat(stat *LinuxStat64_x86, bits uint, large bool) interface{} {
+	if bits == 64 {
+		return &FreebsdStat64{
+			Dev:       uint64(stat.Dev),
+			Ino:       uint64(stat.Ino),
+			Nlink:     uint64(stat.Nlink),
+			Mode:      uint16(stat.Mode),
+			Uid:       uint32(stat.Uid),
+			Gid:       uint32(stat.Gid),
+			Rdev:      uint64(stat.Rdev),
+			Atime:     int64(stat.Atime),
+			AtimeNsec: int64(stat.AtimeNsec),
+			Mtime:     int64(stat.Mtime),
+			MtimeNsec: int64(stat.MtimeNsec),
+			Ctime:     int64(stat.Ctime),
+			CtimeNsec: int64(stat.CtimeNsec),
+			Size:      int64(stat.Size),
+			Blkcnt:    int64(stat.Blkcnt),
+			Blksize:   int32(stat.Blksize),
+		}
+	} else {
+		return &FreebsdStat32{
+			Dev:       uint64(stat.Dev),
+			Ino:       uint64(stat.Ino),
+			Nlink:     uint64(stat.Nlink),
+			Mode:      uint16(stat.Mode),
+			Uid:       uint32(stat.Uid),
+			Gid:       uint32(stat.Gid),
+			Rdev:      uint64(stat.Rdev),
+			Atime:     int32(stat.Atime),
+			AtimeNsec: int32(stat.AtimeNsec),
+			Mtime:     int32(stat.Mtime),
+			MtimeNsec: int32(stat.MtimeNsec),
+			Ctime:     int32(stat.Ctime),
+			CtimeNsec: int32(stat.CtimeNsec),
+			Size:      int64(stat.Size),
+			Blkcnt:    int64(stat.Blkcnt),
+			Blksize:   int32(stat.Blksize),
+		}
+	}
+}
+
 func HandleStat(buf co.Obuf, stat *LinuxStat64_x86, u models.Usercorn, large bool) uint64 {
 	var pack interface{}
 	os, bits := u.OS(), u.Bits()
@@ -123,11 +191,15 @@ func HandleStat(buf co.Obuf, stat *LinuxStat64_x86, u models.Usercorn, large boo
 			fallthrough
 		case "x86_64":
 			pack = NewLinuxStat_x86(stat, bits, large)
+		case "arm64":
+			pack = NewLinuxStat_arm64(stat, bits, large)
 		default:
 			pack = NewLinuxStat_generic(stat, bits, large)
 		}
 	case "darwin":
 		pack = NewDarwinStat(stat, bits, large)
+	case "freebsd":
+		pack = NewFreebsdStat(stat, bits, large)
 	default:
 		panic("(currently) unsupported target OS for fstat: " + os)
 	}
@@ -162,6 +234,55 @@ type LinuxStat_generic struct {
 	Reserved [8]byte
 }
 
+// LinuxStat_arm64 is the asm-generic struct stat used by aarch64.
+type LinuxStat_arm64 struct {
+	Dev      uint64
+	Ino      uint64
+	Mode     uint32
+	Nlink    uint32
+	Uid, Gid uint32
+	Rdev     uint64
+	Pad1     uint64
+	Size     int64
+	Blksize  int32
+	Pad2     int32
+	Blkcnt   int64
+
+	Atime     int64
+	AtimeNsec uint64
+	Mtime     int64
+	MtimeNsec uint64
+	Ctime     int64
+	CtimeNsec uint64
+
+	Unused [2]uint32
+}
+
+// Sigcontext_arm64 is the aarch64 struct sigcontext embedded in the signal frame.
+// The reserved area holds the fpsimd_context and is 16 byte aligned.
+type Sigcontext_arm64 struct {
+	FaultAddress uint64
+	Regs         [31]uint64
+	Sp           uint64
+	Pc           uint64
+	Pstate       uint64
+	Pad          [8]byte
+	Reserved     [4096]byte
+}
+
+// FPSIMD_MAGIC tags the FpsimdContext_arm64 record in the reserved area.
+const FPSIMD_MAGIC = 0x46508001
+
+// FpsimdContext_arm64 is the aarch64 struct fpsimd_context, with every
+// vector register stored as its low and high half.
+type FpsimdContext_arm64 struct {
+	Magic uint32
+	Size  uint32
+	Fpsr  uint32
+	Fpcr  uint32
+	Vregs [32][2]uint64
+}
+
 type Linux32Stat_x86 struct {
 	Dev      uint32
 	Ino      uint32
@@ -261,3 +382,95 @@ type DarwinStat64 struct {
 	st_lspare int32    /* RESERVED: DO NOT USE! */
 	st_qspare [2]int64 /* RESERVED: DO NOT USE! */
 }
+
+// FreebsdStat64 is the FreeBSD 12 struct stat with 64-bit inodes.
+type FreebsdStat64 struct {
+	Dev   uint64
+	Ino   uint64
+	Nlink uint64
+	Mode  uint16
+	Pad0  int16
+	Uid   uint32
+	Gid   uint32
+	Pad1  int32
+	Rdev  uint64
+
+	Atime         int64
+	AtimeNsec     int64
+	Mtime         int64
+	MtimeNsec     int64
+	Ctime         int64
+	CtimeNsec     int64
+	Birthtime     int64
+	BirthtimeNsec int64
+
+	Size    int64
+	Blkcnt  int64
+	Blksize int32
+	Flags   uint32
+	Gen     uint64
+	Spare   [10]uint64
+}
+
+// FreebsdStat32 is the i386 layout of FreebsdStat64. time_t is 32 bits
+// wide there, every timestamp is preceded by room for its high half.
+type FreebsdStat32 struct {
+	Dev   uint64
+	Ino   uint64
+	Nlink uint64
+	Mode  uint16
+	Pad0  int16
+	Uid   uint32
+	Gid   uint32
+	Pad1  int32
+	Rdev  uint64
+
+	AtimeExt      int32
+	Atime         int32
+	AtimeNsec     int32
+	MtimeExt      int32
+	Mtime         int32
+	MtimeNsec     int32
+	CtimeExt      int32
+	Ctime         int32
+	CtimeNsec     int32
+	BirthtimeExt  int32
+	Birthtime     int32
+	BirthtimeNsec int32
+
+	Size    int64
+	Blkcnt  int64
+	Blksize int32
+	Flags   uint32
+	Gen     uint64
+	Spare   [10]uint64
+}
+
+// StatxTimestamp is a struct statx_timestamp.
+type StatxTimestamp struct {
+	Sec      int64
+	Nsec     uint32
+	Reserved int32
+}
+
+// Statx is a struct statx.
+type Statx struct {
+	Mask           uint32
+	Blksize        uint32
+	Attributes     uint64
+	Nlink          uint32
+	Uid, Gid       uint32
+	Mode           uint16
+	Spare0         uint16
+	Ino            uint64
+	Size           uint64
+	Blocks         uint64
+	AttributesMask uint64
+
+	Atime, Btime, Ctime, Mtime StatxTimestamp
+
+	RdevMajor, RdevMinor uint32
+	DevMajor, DevMinor   uint32
+
+	Spare2 [14]uint64
+}
@@ -0,0 +1,23 @@
+package linux
+
+import (
+	"testing"
+
+	"github.com/lunixbochs/struc"
+)
+
+func TestFreebsdStatSize(t *testing.T) {
+	stat := &LinuxStat64_x86{}
+	for _, s := range []struct {
+		bits uint
+		size int
+	}{{32, 208}, {64, 224}} {
+		size, err := struc.Sizeof(NewFreebsdStat(stat, s.bits, false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != s.size {
+			t.Errorf("%d-bit struct stat is %d bytes, want %d", s.bits, size, s.size)
+		}
+	}
+}
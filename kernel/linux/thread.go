@@ -26,11 +26,9 @@ const (
 	FUTEX_CMD_MASK       = ^(FUTEX_PRIVATE_FLAG | FUTEX_CLOCK_REALTIME)
 )
 
-var ENOSYS = 33
-
-// SetTidAddress syscall (not implemented)
+// SetTidAddress syscall (not implemented), returns the tid of the caller
 func (k *LinuxKernel) SetTidAddress(tidptr co.Buf) uint64 {
-	return 0
+	return pid
 }
 
 // SetRobustList syscall (not implemented)
@@ -0,0 +1,108 @@
+package linux
+
+import (
+	"time"
+
+	co "github.com/felberj/binemu/kernel/common"
+	"github.com/felberj/binemu/native"
+)
+
+const (
+	CLOCK_REALTIME         = 0
+	CLOCK_MONOTONIC        = 1
+	CLOCK_PROCESS_CPUTIME  = 2
+	CLOCK_THREAD_CPUTIME   = 3
+	CLOCK_MONOTONIC_RAW    = 4
+	CLOCK_REALTIME_COARSE  = 5
+	CLOCK_MONOTONIC_COARSE = 6
+	CLOCK_BOOTTIME         = 7
+)
+
+// Clock is the virtual clock seen by the guest. It only advances when the
+// guest reads it, so runs are reproducible.
+type Clock struct {
+	Epoch   time.Time
+	Step    time.Duration
+	elapsed time.Duration
+}
+
+// NewClock creates a clock starting at epoch that advances by one
+// microsecond on every read.
+func NewClock(epoch time.Time) *Clock {
+	return &Clock{Epoch: epoch, Step: time.Microsecond}
+}
+
+// Elapsed returns the time since the clock was started.
+func (c *Clock) Elapsed() time.Duration {
+	c.elapsed += c.Step
+	return c.elapsed
+}
+
+// Now returns the current wall clock time.
+func (c *Clock) Now() time.Time {
+	return c.Epoch.Add(c.Elapsed())
+}
+
+// ClockGettime syscall
+func (k *LinuxKernel) ClockGettime(clockid int, tp co.Obuf) uint64 {
+	var d time.Duration
+	switch clockid {
+	case CLOCK_REALTIME, CLOCK_REALTIME_COARSE:
+		d = time.Duration(k.Clock.Now().UnixNano())
+	case CLOCK_MONOTONIC, CLOCK_MONOTONIC_RAW, CLOCK_MONOTONIC_COARSE, CLOCK_BOOTTIME,
+		CLOCK_PROCESS_CPUTIME, CLOCK_THREAD_CPUTIME:
+		d = k.Clock.Elapsed()
+	default:
+		return MinusOne
+	}
+	ts := &native.Timespec{Sec: int64(d / time.Second), Nsec: int64(d % time.Second)}
+	if err := tp.Pack(ts); err != nil {
+		return MinusOne
+	}
+	return 0
+}
+
+// Gettimeofday syscall
+func (k *LinuxKernel) Gettimeofday(tv co.Obuf, tz co.Obuf) uint64 {
+	if tv.Addr != 0 {
+		now := k.Clock.Now().UnixNano()
+		if err := tv.Pack(&native.Timeval{Sec: now / 1e9, Usec: now % 1e9 / 1e3}); err != nil {
+			return MinusOne
+		}
+	}
+	if tz.Addr != 0 {
+		// struct timezone, always UTC
+		if err := tz.Pack([2]int32{}); err != nil {
+			return MinusOne
+		}
+	}
+	return 0
+}
+
+// Time syscall
+func (k *LinuxKernel) Time(tloc co.Obuf) uint64 {
+	now := uint64(k.Clock.Now().Unix())
+	if tloc.Addr != 0 {
+		var tmp [8]byte
+		buf, _ := k.U.PackAddr(tmp[:], now)
+		if err := tloc.Pack(buf); err != nil {
+			return MinusOne
+		}
+	}
+	return now
+}
+
+// Getcpu syscall
+func (k *LinuxKernel) Getcpu(cpu, node co.Obuf, cache uint64) uint64 {
+	if cpu.Addr != 0 {
+		if err := cpu.Pack(uint32(0)); err != nil {
+			return MinusOne
+		}
+	}
+	if node.Addr != 0 {
+		if err := node.Pack(uint32(0)); err != nil {
+			return MinusOne
+		}
+	}
+	return 0
+}
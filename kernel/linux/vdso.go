@@ -0,0 +1,184 @@
+package linux
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/felberj/binemu/cpu"
+	"github.com/felberj/binemu/models"
+)
+
+// VdsoDesc names the vDSO mapping, setupElfAuxv uses it to find the image.
+const VdsoDesc = "[vdso]"
+
+// VdsoFunc is a function exported by the vDSO. The code at its address
+// only returns, Call runs right before that and does the actual work.
+type VdsoFunc struct {
+	Name string
+	Call func()
+}
+
+const vdsoStubAlign = 16
+
+type vdsoImage struct {
+	order   binary.ByteOrder
+	bits    uint
+	machine elf.Machine
+	ret     []byte
+	funcs   []VdsoFunc
+}
+
+type vdsoLayout struct {
+	phdr, dyn, hash, sym, str, text, size int
+	symsize                               int
+	strtab                                []byte
+}
+
+// layout computes the file offsets of every part of the image.
+func (v *vdsoImage) layout() *vdsoLayout {
+	ehsize, phsize, dynsize, symsize := 52, 32, 8, 16
+	if v.bits == 64 {
+		ehsize, phsize, dynsize, symsize = 64, 56, 16, 24
+	}
+	l := &vdsoLayout{symsize: symsize, strtab: []byte{0}}
+	for _, f := range v.funcs {
+		l.strtab = append(l.strtab, []byte(f.Name+"\x00")...)
+	}
+	nsyms := len(v.funcs) + 1
+	l.phdr = ehsize
+	l.dyn = l.phdr + 2*phsize
+	l.hash = l.dyn + 6*dynsize
+	l.sym = (l.hash + (3+nsyms)*4 + 7) &^ 7
+	l.str = l.sym + nsyms*symsize
+	l.text = (l.str + len(l.strtab) + vdsoStubAlign - 1) &^ (vdsoStubAlign - 1)
+	l.size = l.text + len(v.funcs)*vdsoStubAlign
+	return l
+}
+
+// build assembles a minimal shared object linked at address 0 with a
+// dynamic symbol table and a SysV hash table, which is all glibc, musl and
+// the Go runtime need to resolve vDSO symbols. It returns the image and
+// the offset of every function.
+func (v *vdsoImage) build() ([]byte, []uint64) {
+	l := v.layout()
+	var buf bytes.Buffer
+	w := func(data interface{}) {
+		binary.Write(&buf, v.order, data)
+	}
+	pad := func(off int) {
+		buf.Write(make([]byte, off-buf.Len()))
+	}
+	ident := [elf.EI_NIDENT]byte{0x7f, 'E', 'L', 'F', byte(elf.ELFCLASS32), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)}
+	if v.bits == 64 {
+		ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	}
+	if v.order == binary.BigEndian {
+		ident[elf.EI_DATA] = byte(elf.ELFDATA2MSB)
+	}
+	dynamic := [][2]uint64{
+		{uint64(elf.DT_HASH), uint64(l.hash)},
+		{uint64(elf.DT_SYMTAB), uint64(l.sym)},
+		{uint64(elf.DT_STRTAB), uint64(l.str)},
+		{uint64(elf.DT_STRSZ), uint64(len(l.strtab))},
+		{uint64(elf.DT_SYMENT), uint64(l.symsize)},
+		{uint64(elf.DT_NULL), 0},
+	}
+	load := elf.PF_R | elf.PF_X
+	dynsz := l.hash - l.dyn
+	if v.bits == 64 {
+		w(elf.Header64{
+			Ident: ident, Type: uint16(elf.ET_DYN), Machine: uint16(v.machine), Version: uint32(elf.EV_CURRENT),
+			Phoff: uint64(l.phdr), Ehsize: 64, Phentsize: 56, Phnum: 2, Shentsize: 64,
+		})
+		w(elf.Prog64{Type: uint32(elf.PT_LOAD), Flags: uint32(load), Filesz: uint64(l.size), Memsz: uint64(l.size), Align: 0x1000})
+		w(elf.Prog64{Type: uint32(elf.PT_DYNAMIC), Flags: uint32(elf.PF_R), Off: uint64(l.dyn), Vaddr: uint64(l.dyn),
+			Paddr: uint64(l.dyn), Filesz: uint64(dynsz), Memsz: uint64(dynsz), Align: 8})
+		for _, d := range dynamic {
+			w(elf.Dyn64{Tag: int64(d[0]), Val: d[1]})
+		}
+	} else {
+		w(elf.Header32{
+			Ident: ident, Type: uint16(elf.ET_DYN), Machine: uint16(v.machine), Version: uint32(elf.EV_CURRENT),
+			Phoff: uint32(l.phdr), Ehsize: 52, Phentsize: 32, Phnum: 2, Shentsize: 40,
+		})
+		w(elf.Prog32{Type: uint32(elf.PT_LOAD), Flags: uint32(load), Filesz: uint32(l.size), Memsz: uint32(l.size), Align: 0x1000})
+		w(elf.Prog32{Type: uint32(elf.PT_DYNAMIC), Flags: uint32(elf.PF_R), Off: uint32(l.dyn), Vaddr: uint32(l.dyn),
+			Paddr: uint32(l.dyn), Filesz: uint32(dynsz), Memsz: uint32(dynsz), Align: 4})
+		for _, d := range dynamic {
+			w(elf.Dyn32{Tag: int32(d[0]), Val: uint32(d[1])})
+		}
+	}
+	// nbucket, nchain and a single bucket chaining all symbols in order
+	nsyms := uint32(len(v.funcs) + 1)
+	w([]uint32{1, nsyms, 1, 0})
+	for i := uint32(1); i < nsyms; i++ {
+		w((i + 1) % nsyms)
+	}
+	pad(l.sym)
+	addrs := make([]uint64, len(v.funcs))
+	info := elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC)
+	if v.bits == 64 {
+		w(elf.Sym64{})
+	} else {
+		w(elf.Sym32{})
+	}
+	name := 1
+	for i, f := range v.funcs {
+		addrs[i] = uint64(l.text + i*vdsoStubAlign)
+		// any section index but SHN_UNDEF and SHN_ABS is relative to the load address
+		if v.bits == 64 {
+			w(elf.Sym64{Name: uint32(name), Info: info, Shndx: 1, Value: addrs[i], Size: uint64(len(v.ret))})
+		} else {
+			w(elf.Sym32{Name: uint32(name), Info: info, Shndx: 1, Value: uint32(addrs[i]), Size: uint32(len(v.ret))})
+		}
+		name += len(f.Name) + 1
+	}
+	buf.Write(l.strtab)
+	for i := range v.funcs {
+		pad(int(addrs[i]))
+		buf.Write(v.ret)
+	}
+	pad(l.size)
+	return buf.Bytes(), addrs
+}
+
+// MapVdso builds a vDSO image exporting funcs, maps it and hooks every
+// function so calls land in the kernel instead. ret is the machine's
+// return instruction. The image base is returned.
+func MapVdso(u models.Usercorn, machine elf.Machine, ret []byte, funcs []VdsoFunc) (uint64, error) {
+	img := &vdsoImage{order: u.ByteOrder(), bits: u.Bits(), machine: machine, ret: ret, funcs: funcs}
+	data, addrs := img.build()
+	base, err := u.Mmap(0, uint64(len(data)), cpu.PROT_READ|cpu.PROT_EXEC, false, VdsoDesc, nil)
+	if err != nil {
+		return 0, err
+	}
+	mem := u.Mem()
+	mem.Seek(int64(base), io.SeekStart)
+	if _, err := mem.Write(data); err != nil {
+		return 0, err
+	}
+	calls := make(map[uint64]func(), len(funcs))
+	for i, f := range funcs {
+		calls[base+addrs[i]] = f.Call
+	}
+	_, err = u.GetCPU().HookCode(func(addr uint64, size uint32) {
+		if call, ok := calls[addr]; ok {
+			call()
+		}
+	}, base, base+uint64(len(data)))
+	return base, errors.Wrap(err, "u.HookAdd() failed")
+}
+
+// vdsoBase returns the address of the mapped vDSO image, if any.
+func vdsoBase(u models.Usercorn) (uint64, bool) {
+	for _, page := range u.Mappings() {
+		if page.Desc == VdsoDesc {
+			return page.Addr, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,125 @@
+package linux
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+// sysvHash is the ELF symbol hash function.
+func sysvHash(name string) uint32 {
+	var h uint32
+	for _, c := range []byte(name) {
+		h = h<<4 + uint32(c)
+		g := h & 0xf0000000
+		h ^= g >> 24
+		h &^= g
+	}
+	return h
+}
+
+// vdsoLookup resolves name in a vDSO image the way a dynamic linker does,
+// through PT_DYNAMIC and the hash table, since the image has no sections.
+func vdsoLookup(data []byte, name string) (uint64, error) {
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	tags := make(map[elf.DynTag]uint64)
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_DYNAMIC {
+			continue
+		}
+		r := p.Open()
+		for {
+			var tag elf.DynTag
+			var val uint64
+			if f.Class == elf.ELFCLASS64 {
+				var d elf.Dyn64
+				err = binary.Read(r, f.ByteOrder, &d)
+				tag, val = elf.DynTag(d.Tag), d.Val
+			} else {
+				var d elf.Dyn32
+				err = binary.Read(r, f.ByteOrder, &d)
+				tag, val = elf.DynTag(d.Tag), uint64(d.Val)
+			}
+			if err != nil {
+				return 0, err
+			}
+			if tag == elf.DT_NULL {
+				break
+			}
+			tags[tag] = val
+		}
+	}
+	for _, tag := range []elf.DynTag{elf.DT_HASH, elf.DT_SYMTAB, elf.DT_STRTAB, elf.DT_SYMENT} {
+		if _, ok := tags[tag]; !ok {
+			return 0, fmt.Errorf("no %v", tag)
+		}
+	}
+	word := func(off uint64) uint32 { return f.ByteOrder.Uint32(data[off:]) }
+	hash := tags[elf.DT_HASH]
+	nbucket := word(hash)
+	chain := hash + 8 + 4*uint64(nbucket)
+	for i := word(hash + 8 + 4*uint64(sysvHash(name)%nbucket)); i != 0; i = word(chain + 4*uint64(i)) {
+		var nameOff uint32
+		var value uint64
+		r := bytes.NewReader(data[tags[elf.DT_SYMTAB]+uint64(i)*tags[elf.DT_SYMENT]:])
+		if f.Class == elf.ELFCLASS64 {
+			var sym elf.Sym64
+			err = binary.Read(r, f.ByteOrder, &sym)
+			nameOff, value = sym.Name, sym.Value
+		} else {
+			var sym elf.Sym32
+			err = binary.Read(r, f.ByteOrder, &sym)
+			nameOff, value = sym.Name, uint64(sym.Value)
+		}
+		if err != nil {
+			return 0, err
+		}
+		str := data[tags[elf.DT_STRTAB]+uint64(nameOff):]
+		if end := bytes.IndexByte(str, 0); end >= 0 && string(str[:end]) == name {
+			return value, nil
+		}
+	}
+	return 0, fmt.Errorf("%s not found", name)
+}
+
+func TestVdsoImage(t *testing.T) {
+	funcs := []VdsoFunc{
+		{Name: "__vdso_clock_gettime"},
+		{Name: "__vdso_gettimeofday"},
+		{Name: "__vdso_time"},
+	}
+	for _, img := range []*vdsoImage{
+		{order: binary.LittleEndian, bits: 64, machine: elf.EM_X86_64, ret: []byte{0xc3}, funcs: funcs},
+		{order: binary.BigEndian, bits: 32, machine: elf.EM_MIPS, ret: []byte{0x03, 0xe0, 0x00, 0x08}, funcs: funcs},
+	} {
+		data, addrs := img.build()
+		f, err := elf.NewFile(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%v: %v", img.machine, err)
+		}
+		if f.Type != elf.ET_DYN || f.Machine != img.machine || f.ByteOrder != img.order {
+			t.Errorf("%v: header is %+v", img.machine, f.FileHeader)
+		}
+		for i, fn := range funcs {
+			addr, err := vdsoLookup(data, fn.Name)
+			if err != nil {
+				t.Errorf("%v: %v", img.machine, err)
+				continue
+			}
+			if addr != addrs[i] {
+				t.Errorf("%v: %s is at %#x, want %#x", img.machine, fn.Name, addr, addrs[i])
+			}
+			if got := data[addr : addr+uint64(len(img.ret))]; !bytes.Equal(got, img.ret) {
+				t.Errorf("%v: %s starts with %x, want %x", img.machine, fn.Name, got, img.ret)
+			}
+		}
+		if addr, err := vdsoLookup(data, "__vdso_getcpu"); err == nil {
+			t.Errorf("%v: __vdso_getcpu resolved to %#x", img.machine, addr)
+		}
+	}
+}
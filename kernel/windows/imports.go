@@ -0,0 +1,257 @@
+package windows
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/felberj/binemu/cpu"
+	"github.com/felberj/binemu/loader"
+	"github.com/felberj/binemu/models"
+
+	uc "github.com/felberj/binemu/cpu/unicorn"
+)
+
+// api is a function exported by one of the emulated DLLs. call names the
+// kernel method implementing it. On x86, stdcall functions pop args stack
+// slots when they return.
+type api struct {
+	call string
+	args int
+}
+
+type dll struct {
+	cdecl bool
+	funcs map[string]api
+	// data exports resolve to a variable instead of a stub
+	data map[string]uint64
+}
+
+var dlls = map[string]*dll{
+	"kernel32.dll": {funcs: kernel32},
+	"msvcrt.dll":   {cdecl: true, funcs: msvcrt, data: msvcrtData},
+	"ntdll.dll":    {funcs: ntdll},
+}
+
+// Fixed addresses of the emulation structures, out of the way of the
+// usual image bases.
+const (
+	stubBase    = 0x7ff00000
+	stubSize    = 0x10000
+	stubAlign   = 16
+	missingBase = stubBase + stubSize
+	dataBase    = 0x7ff20000
+	dataSize    = 0x1000
+	tebAddr     = 0x7ffde000
+	pebAddr     = 0x7ffdf000
+	stackBase   = 0x00100000
+	stackSize   = 0x00100000
+)
+
+// stub is the code a resolved import points to. The code only returns,
+// the hook on the stub calls the kernel first.
+type stub struct {
+	dll, name string
+	api       api
+	cdecl     bool
+}
+
+// internal stubs the process starts and returns through
+var internal = []stub{
+	{name: "process start", api: api{call: "process_start"}, cdecl: true},
+	{name: "process return", api: api{call: "process_return"}, cdecl: true},
+	{name: "call return", api: api{call: "call_return"}, cdecl: true},
+}
+
+const (
+	stubProcessStart = iota
+	stubProcessReturn
+	stubCallReturn
+)
+
+// stubs lists every stub in address order. The order is fixed, so the
+// address of any export is known up front.
+var stubs []stub
+
+func init() {
+	stubs = append(stubs, internal...)
+	var names []string
+	for name := range dlls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d := dlls[name]
+		var funcs []string
+		for f := range d.funcs {
+			funcs = append(funcs, f)
+		}
+		sort.Strings(funcs)
+		for _, f := range funcs {
+			stubs = append(stubs, stub{dll: name, name: f, api: d.funcs[f], cdecl: d.cdecl})
+		}
+	}
+	if len(stubs)*stubAlign > stubSize {
+		panic("too many windows api stubs")
+	}
+}
+
+func stubAddr(i int) uint64 {
+	return stubBase + uint64(i*stubAlign)
+}
+
+// dllName normalizes a module name the way the loader does.
+func dllName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.Contains(name, ".") {
+		name += ".dll"
+	}
+	return name
+}
+
+// resolve returns the address an import of dll!name resolves to.
+func resolve(dll, name string) (uint64, bool) {
+	dll = dllName(dll)
+	if d, ok := dlls[dll]; ok {
+		if addr, ok := d.data[name]; ok {
+			return addr, true
+		}
+	}
+	for i, s := range stubs {
+		if s.dll == dll && s.name == name {
+			return stubAddr(i), true
+		}
+	}
+	return 0, false
+}
+
+// code returns the return instruction of a stub.
+func (s *stub) code(bits uint) []byte {
+	if bits == 32 && !s.cdecl && s.api.args > 0 {
+		n := s.api.args * 4
+		return []byte{0xc2, byte(n), byte(n >> 8)}
+	}
+	return []byte{0xc3}
+}
+
+// Args reads the arguments of a call that just entered a stub, using the
+// Windows calling convention of the guest.
+func Args(u models.Usercorn) func(n int) ([]uint64, error) {
+	return func(n int) ([]uint64, error) {
+		args := make([]uint64, n)
+		for i := range args {
+			var err error
+			if args[i], err = arg(u, i); err != nil {
+				return nil, err
+			}
+		}
+		return args, nil
+	}
+}
+
+var x64ArgRegs = []int{uc.X86_REG_RCX, uc.X86_REG_RDX, uc.X86_REG_R8, uc.X86_REG_R9}
+
+// arg reads argument i right after a call. On x86_64 the first four are
+// passed in registers, but stack slots are reserved for them as well.
+func arg(u models.Usercorn, i int) (uint64, error) {
+	if u.Bits() == 64 && i < len(x64ArgRegs) {
+		return u.RegRead(x64ArgRegs[i])
+	}
+	sp, err := u.RegRead(u.Arch().SP)
+	if err != nil {
+		return 0, err
+	}
+	size := uint64(u.Bits() / 8)
+	buf := make([]byte, size)
+	if err := u.GetCPU().MemReadInto(buf, sp+size*uint64(i+1)); err != nil {
+		return 0, err
+	}
+	return u.UnpackAddr(buf), nil
+}
+
+func retReg(u models.Usercorn) int {
+	if u.Bits() == 64 {
+		return uc.X86_REG_RAX
+	}
+	return uc.X86_REG_EAX
+}
+
+// mapStubs maps the API stubs and routes calls to them into the kernel.
+func mapStubs(u models.Usercorn) error {
+	if _, err := u.Mmap(stubBase, stubSize, cpu.PROT_READ|cpu.PROT_EXEC, true, "[winapi]", nil); err != nil {
+		return err
+	}
+	mem := u.GetCPU()
+	for i := range stubs {
+		if err := mem.MemWrite(stubAddr(i), stubs[i].code(u.Bits())); err != nil {
+			return err
+		}
+	}
+	_, err := u.GetCPU().HookCode(func(addr uint64, size uint32) {
+		i := int(addr-stubBase) / stubAlign
+		if (addr-stubBase)%stubAlign != 0 || i >= len(stubs) {
+			return
+		}
+		ret, _ := u.Syscall(i, stubs[i].api.call, Args(u))
+		u.RegWrite(retReg(u), ret)
+	}, stubBase, stubBase+stubSize-1)
+	return errors.Wrap(err, "u.HookAdd() failed")
+}
+
+// mapMissing gives imports without an implementation a stub that stops
+// the process when it is called, so they only fail if they are used.
+func mapMissing(u models.Usercorn, missing []loader.PEImport) error {
+	if len(missing) == 0 {
+		return nil
+	}
+	size := (uint64(len(missing)*stubAlign) + 0xfff) &^ 0xfff
+	if _, err := u.Mmap(missingBase, size, cpu.PROT_READ|cpu.PROT_EXEC, true, "[winapi missing]", nil); err != nil {
+		return err
+	}
+	for i, imp := range missing {
+		addr := missingBase + uint64(i*stubAlign)
+		if err := u.GetCPU().MemWrite(addr, []byte{0xcc}); err != nil {
+			return err
+		}
+		if err := writePtr(u, imp.Addr, addr); err != nil {
+			return err
+		}
+	}
+	_, err := u.GetCPU().HookCode(func(addr uint64, size uint32) {
+		imp := missing[(addr-missingBase)/stubAlign]
+		name := imp.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", imp.Ordinal)
+		}
+		u.Exit(errors.Errorf("unimplemented import %s!%s", imp.DLL, name))
+	}, missingBase, missingBase+size-1)
+	return errors.Wrap(err, "u.HookAdd() failed")
+}
+
+func writePtr(u models.Usercorn, addr, val uint64) error {
+	var tmp [8]byte
+	buf, _ := u.PackAddr(tmp[:], val)
+	return u.GetCPU().MemWrite(addr, buf)
+}
+
+// resolveImports points every import address table slot at its stub.
+func resolveImports(u models.Usercorn, l *loader.PELoader) error {
+	imports, err := l.Imports()
+	if err != nil {
+		return errors.Wrap(err, "failed to read imports")
+	}
+	var missing []loader.PEImport
+	for _, imp := range imports {
+		addr, ok := resolve(imp.DLL, imp.Name)
+		if !ok || imp.Name == "" {
+			missing = append(missing, imp)
+			continue
+		}
+		if err := writePtr(u, imp.Addr, addr); err != nil {
+			return err
+		}
+	}
+	return mapMissing(u, missing)
+}
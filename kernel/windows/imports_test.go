@@ -0,0 +1,226 @@
+package windows
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"io"
+	"sort"
+	"testing"
+
+	"github.com/felberj/binemu/cpu"
+	"github.com/felberj/binemu/loader"
+	"github.com/felberj/binemu/models"
+
+	uc "github.com/felberj/binemu/cpu/unicorn"
+)
+
+// winUsercorn runs the kernel on a bare 32-bit CPU. It keeps the list of
+// mappings itself and records the API calls the stubs make.
+type winUsercorn struct {
+	models.Usercorn
+	c     *cpu.Cpu
+	pages cpu.Pages
+	brk   uint64
+	calls []string
+	args  [][]uint64
+}
+
+func newWinUsercorn(t *testing.T) *winUsercorn {
+	c, err := (&cpu.Builder{Arch: uc.ARCH_X86, Mode: uc.MODE_32}).New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &winUsercorn{c: c, brk: 0x10000000}
+}
+
+func (u *winUsercorn) RegRead(reg int) (uint64, error)    { return u.c.RegRead(reg) }
+func (u *winUsercorn) RegWrite(reg int, val uint64) error { return u.c.RegWrite(reg, val) }
+func (u *winUsercorn) Mem() io.ReadWriteSeeker            { return u.c.Mem() }
+func (u *winUsercorn) GetCPU() *cpu.Cpu                   { return u.c }
+func (u *winUsercorn) Bits() uint                         { return 32 }
+func (u *winUsercorn) ByteOrder() binary.ByteOrder        { return binary.LittleEndian }
+func (u *winUsercorn) Arch() *models.Arch                 { return &models.Arch{SP: uc.X86_REG_ESP} }
+func (u *winUsercorn) Mappings() cpu.Pages                { return u.pages }
+func (u *winUsercorn) UnpackAddr(buf []byte) uint64       { return uint64(binary.LittleEndian.Uint32(buf)) }
+
+func (u *winUsercorn) PackAddr(buf []byte, n uint64) ([]byte, error) {
+	binary.LittleEndian.PutUint32(buf, uint32(n))
+	return buf[:4], nil
+}
+
+func (u *winUsercorn) Mmap(addr, size uint64, prot int, fixed bool, desc string, file *cpu.FileDesc) (uint64, error) {
+	size = (size + 0xfff) &^ 0xfff
+	if err := u.c.MemMap(addr, size, prot); err != nil {
+		return 0, err
+	}
+	u.pages = append(u.pages, &cpu.Page{Addr: addr, Size: size, Prot: prot, Desc: desc})
+	sort.Slice(u.pages, func(i, j int) bool { return u.pages[i].Addr < u.pages[j].Addr })
+	return addr, nil
+}
+
+func (u *winUsercorn) Malloc(size uint64, desc string) (uint64, error) {
+	addr, err := u.Mmap(u.brk, size, cpu.PROT_READ|cpu.PROT_WRITE, true, desc, nil)
+	u.brk += (size + 0xfff) &^ 0xfff
+	return addr, err
+}
+
+func (u *winUsercorn) Syscall(num int, name string, getArgs models.SysGetArgs) (uint64, error) {
+	args, err := getArgs(stubs[num].api.args)
+	if err != nil {
+		return 0, err
+	}
+	u.calls = append(u.calls, name)
+	u.args = append(u.args, args)
+	return 0, nil
+}
+
+// importPE builds a PE32 image whose code pushes 7 and calls ExitProcess
+// through the import address table. Its base relocation fixes the address
+// of the table slot in the call, it also imports kernel32.dll!Beep, which
+// the kernel does not implement.
+func importPE() []byte {
+	var buf bytes.Buffer
+	dos := make([]byte, 0x40)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], 0x40)
+	buf.Write(dos)
+	buf.WriteString("PE\x00\x00")
+	binary.Write(&buf, binary.LittleEndian, pe.FileHeader{
+		Machine:              pe.IMAGE_FILE_MACHINE_I386,
+		NumberOfSections:     1,
+		SizeOfOptionalHeader: 0xe0,
+		Characteristics:      0x0102,
+	})
+	oh := pe.OptionalHeader32{
+		Magic:               0x10b,
+		AddressOfEntryPoint: 0x1000,
+		ImageBase:           0x400000,
+		SectionAlignment:    0x1000,
+		FileAlignment:       0x200,
+		SizeOfImage:         0x2000,
+		SizeOfHeaders:       0x200,
+		Subsystem:           3,
+		NumberOfRvaAndSizes: 16,
+	}
+	oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_IMPORT] = pe.DataDirectory{VirtualAddress: 0x1010, Size: 40}
+	oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_BASERELOC] = pe.DataDirectory{VirtualAddress: 0x1100, Size: 12}
+	binary.Write(&buf, binary.LittleEndian, oh)
+	sh := pe.SectionHeader32{
+		VirtualSize:      0x200,
+		VirtualAddress:   0x1000,
+		SizeOfRawData:    0x200,
+		PointerToRawData: 0x200,
+		Characteristics:  0xe0000020,
+	}
+	copy(sh.Name[:], ".text")
+	binary.Write(&buf, binary.LittleEndian, sh)
+	buf.Write(make([]byte, 0x200-buf.Len()))
+
+	text := make([]byte, 0x200)
+	copy(text, []byte{
+		0x6a, 0x07, // push 7
+		0xff, 0x15, 0x50, 0x10, 0x40, 0x00, // call [0x401050]
+	})
+	le := binary.LittleEndian
+	// import descriptor followed by the null descriptor
+	le.PutUint32(text[0x10:], 0x1040)
+	le.PutUint32(text[0x1c:], 0x1060)
+	le.PutUint32(text[0x20:], 0x1050)
+	// lookup table and import address table
+	for _, off := range []int{0x40, 0x50} {
+		le.PutUint32(text[off:], 0x1080)
+		le.PutUint32(text[off+4:], 0x1090)
+	}
+	copy(text[0x60:], "KERNEL32.dll\x00")
+	copy(text[0x82:], "ExitProcess\x00")
+	copy(text[0x92:], "Beep\x00")
+	// a HIGHLOW relocation of the call operand, padded by an absolute one
+	le.PutUint32(text[0x100:], 0x1000)
+	le.PutUint32(text[0x104:], 12)
+	le.PutUint16(text[0x108:], 3<<12|4)
+	buf.Write(text)
+	return buf.Bytes()
+}
+
+// loadPE maps the segments of l like the loader does.
+func loadPE(t *testing.T, u *winUsercorn, l *loader.PELoader) {
+	segments, err := l.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range segments {
+		data, err := s.Data()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := u.Mmap(s.Addr, s.Size, cpu.PROT_ALL, true, "image", nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := u.c.MemWrite(s.Addr, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	for _, name := range []string{"kernel32.dll", "KERNEL32.DLL", "kernel32"} {
+		addr, ok := resolve(name, "ExitProcess")
+		if !ok || addr < stubBase || addr >= stubBase+stubSize || addr%stubAlign != 0 {
+			t.Errorf("%s!ExitProcess resolved to %#x", name, addr)
+		}
+	}
+	if addr, ok := resolve("msvcrt.dll", "_iob"); !ok || addr != iobAddr {
+		t.Errorf("msvcrt.dll!_iob resolved to %#x", addr)
+	}
+	if _, ok := resolve("kernel32.dll", "Beep"); ok {
+		t.Error("resolved an import without an implementation")
+	}
+}
+
+func TestResolveImports(t *testing.T) {
+	l, err := loader.NewPELoader(bytes.NewReader(importPE()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Rebase(0x500000); err != nil {
+		t.Fatal(err)
+	}
+	u := newWinUsercorn(t)
+	loadPE(t, u, l)
+	if err := mapStubs(u); err != nil {
+		t.Fatal(err)
+	}
+	if err := resolveImports(u, l); err != nil {
+		t.Fatal(err)
+	}
+	exitProcess, _ := resolve("kernel32.dll", "ExitProcess")
+	for _, slot := range []struct {
+		addr, want uint64
+	}{{0x501050, exitProcess}, {0x501054, missingBase}} {
+		data, err := u.c.MemRead(slot.addr, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := uint64(binary.LittleEndian.Uint32(data)); got != slot.want {
+			t.Errorf("import address table slot %#x is %#x, want %#x", slot.addr, got, slot.want)
+		}
+	}
+
+	// the relocated call goes through the table into the kernel
+	const stack = 0x200000
+	if _, err := u.Mmap(stack, 0x1000, cpu.PROT_READ|cpu.PROT_WRITE, true, "stack", nil); err != nil {
+		t.Fatal(err)
+	}
+	u.c.RegWrite(uc.X86_REG_ESP, stack+0x800)
+	if err := u.c.Start(0x501000, 0x501008); err != nil {
+		t.Fatal(err)
+	}
+	if len(u.calls) != 1 || u.calls[0] != "exit_process" || len(u.args[0]) != 1 || u.args[0][0] != 7 {
+		t.Fatalf("wrong calls: %v %v", u.calls, u.args)
+	}
+	// ExitProcess is stdcall and pops its argument
+	if sp, _ := u.c.RegRead(uc.X86_REG_ESP); sp != stack+0x800 {
+		t.Errorf("esp is %#x after the call, want %#x", sp, stack+0x800)
+	}
+}
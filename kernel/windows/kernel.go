@@ -0,0 +1,281 @@
+// Package windows provides high-level emulation of the Windows API for PE
+// binaries. Imported functions from kernel32, msvcrt and ntdll resolve to
+// stubs that call into this kernel instead of real DLLs.
+package windows
+
+import (
+	"bufio"
+	"io"
+	"os"
+
+	co "github.com/felberj/binemu/kernel/common"
+	"github.com/felberj/binemu/models"
+	"github.com/felberj/binemu/vfs"
+)
+
+// Win32 error codes returned by GetLastError.
+const (
+	ERROR_SUCCESS           = 0
+	ERROR_FILE_NOT_FOUND    = 2
+	ERROR_ACCESS_DENIED     = 5
+	ERROR_INVALID_HANDLE    = 6
+	ERROR_NOT_ENOUGH_MEMORY = 8
+	ERROR_INVALID_PARAMETER = 87
+	ERROR_PROC_NOT_FOUND    = 127
+	ERROR_MOD_NOT_FOUND     = 126
+)
+
+const (
+	INVALID_HANDLE_VALUE = ^uint64(0)
+
+	// console handles, as handed out by Windows 7
+	stdinHandle  = 0x3
+	stdoutHandle = 0x7
+	stderrHandle = 0xb
+
+	pid = 0x1000
+	tid = 0x1004
+)
+
+// File is an open file handle.
+type File interface {
+	io.ReadWriter
+	io.Closer
+}
+
+// WindowsKernel implements the emulated DLL functions.
+type WindowsKernel struct {
+	*co.KernelBase
+	Fs      *vfs.Filesystem
+	Handles map[uint64]File
+	// Streams maps the FILE pointers returned by fopen to handles.
+	Streams    map[uint64]uint64
+	stdin      *bufio.Reader
+	nextHandle uint64
+	heap       heap
+	tls        map[uint64]uint64
+	nextTls    uint64
+	calls      []*guestCall
+	seed       uint32
+}
+
+// NewKernel creates a Windows kernel with the console attached to the host.
+func NewKernel(fs *vfs.Filesystem) *WindowsKernel {
+	return &WindowsKernel{
+		KernelBase: &co.KernelBase{},
+		Fs:         fs,
+		Handles: map[uint64]File{
+			stdinHandle:  os.Stdin,
+			stdoutHandle: os.Stdout,
+			stderrHandle: os.Stderr,
+		},
+		Streams:    make(map[uint64]uint64),
+		stdin:      bufio.NewReader(os.Stdin),
+		nextHandle: 0x100,
+		heap:       heap{sizes: make(map[uint64]uint64)},
+		tls:        make(map[uint64]uint64),
+		seed:       1,
+	}
+}
+
+// SetStdio replaces the host's console the guest starts with.
+func (k *WindowsKernel) SetStdio(stdin io.Reader, stdout, stderr io.Writer) {
+	if stdin != nil {
+		k.Handles[stdinHandle] = &co.Stream{R: stdin}
+		k.stdin = bufio.NewReader(stdin)
+	}
+	if stdout != nil {
+		k.Handles[stdoutHandle] = &co.Stream{W: stdout}
+	}
+	if stderr != nil {
+		k.Handles[stderrHandle] = &co.Stream{W: stderr}
+	}
+}
+
+// ptrSize is the size of a guest pointer in bytes.
+func (k *WindowsKernel) ptrSize() uint64 {
+	return uint64(k.U.Bits() / 8)
+}
+
+// mapped reports whether the n bytes at addr are all mapped. Sizes the guest
+// passes in are checked with it before they size a host buffer.
+func (k *WindowsKernel) mapped(addr, n uint64) bool {
+	end := addr + n
+	if end < addr {
+		return false
+	}
+	for addr < end {
+		m := k.U.Mappings().Find(addr)
+		if m == nil || m.Addr+m.Size <= addr {
+			return false
+		}
+		addr = m.Addr + m.Size
+	}
+	return true
+}
+
+func (k *WindowsKernel) readPtr(addr uint64) uint64 {
+	buf := make([]byte, k.ptrSize())
+	if err := k.U.GetCPU().MemReadInto(buf, addr); err != nil {
+		return 0
+	}
+	return k.U.UnpackAddr(buf)
+}
+
+func (k *WindowsKernel) writePtr(addr, val uint64) error {
+	var tmp [8]byte
+	buf, _ := k.U.PackAddr(tmp[:], val)
+	return k.U.GetCPU().MemWrite(addr, buf)
+}
+
+func (k *WindowsKernel) writeU32(addr uint64, val uint32) error {
+	var tmp [4]byte
+	k.U.ByteOrder().PutUint32(tmp[:], val)
+	return k.U.GetCPU().MemWrite(addr, tmp[:])
+}
+
+// putPtr stores val at ptr unless ptr is null.
+func (k *WindowsKernel) putPtr(ptr co.Obuf, val uint64) {
+	if ptr.Addr != 0 {
+		k.writePtr(ptr.Addr, val)
+	}
+}
+
+// putU32 stores a DWORD at ptr unless ptr is null.
+func (k *WindowsKernel) putU32(ptr co.Obuf, val uint32) {
+	if ptr.Addr != 0 {
+		k.writeU32(ptr.Addr, val)
+	}
+}
+
+// readString reads a NUL terminated string of any length.
+func (k *WindowsKernel) readString(addr uint64) string {
+	var s []byte
+	var tmp [1]byte
+	mem := k.U.Mem()
+	mem.Seek(int64(addr), io.SeekStart)
+	for {
+		if _, err := mem.Read(tmp[:]); err != nil || tmp[0] == 0 {
+			break
+		}
+		s = append(s, tmp[0])
+	}
+	return string(s)
+}
+
+// readWString reads a NUL terminated UTF-16 string, keeping the low byte
+// of every character.
+func (k *WindowsKernel) readWString(addr uint64) string {
+	var s []byte
+	var tmp [2]byte
+	mem := k.U.Mem()
+	mem.Seek(int64(addr), io.SeekStart)
+	for {
+		if _, err := mem.Read(tmp[:]); err != nil || tmp[0] == 0 && tmp[1] == 0 {
+			break
+		}
+		s = append(s, tmp[0])
+	}
+	return string(s)
+}
+
+func (k *WindowsKernel) writeString(addr uint64, s string) error {
+	return k.U.GetCPU().MemWrite(addr, []byte(s+"\x00"))
+}
+
+func (k *WindowsKernel) setLastError(code uint32) {
+	k.writeU32(tebAddr+tebOffset(k.U, tebLastError), code)
+}
+
+func (k *WindowsKernel) lastError() uint32 {
+	var tmp [4]byte
+	k.U.GetCPU().MemReadInto(tmp[:], tebAddr+tebOffset(k.U, tebLastError))
+	return k.U.ByteOrder().Uint32(tmp[:])
+}
+
+// fail sets the last error and returns 0, which is what most Win32
+// functions return on failure.
+func (k *WindowsKernel) fail(code uint32) uint64 {
+	k.setLastError(code)
+	return 0
+}
+
+func (k *WindowsKernel) addHandle(f File) uint64 {
+	h := k.nextHandle
+	k.nextHandle += 4
+	k.Handles[h] = f
+	return h
+}
+
+// heap is a bump allocator backing HeapAlloc and malloc. Freed memory is
+// never reused, which keeps use-after-free bugs observable.
+type heap struct {
+	next, end uint64
+	sizes     map[uint64]uint64
+}
+
+const heapChunk = 0x100000
+
+func (k *WindowsKernel) alloc(size uint64) uint64 {
+	h := &k.heap
+	// sizes near the top of the address space would wrap when rounded
+	if size > 1<<(uint(k.U.Bits())-1) {
+		return 0
+	}
+	size = (size + 15) &^ 15
+	if size == 0 {
+		size = 16
+	}
+	if h.next+size > h.end {
+		chunk := uint64(heapChunk)
+		if size > chunk {
+			chunk = (size + 0xfff) &^ 0xfff
+		}
+		addr, err := k.U.Malloc(chunk, "heap")
+		if err != nil {
+			return 0
+		}
+		h.next, h.end = addr, addr+chunk
+	}
+	addr := h.next
+	h.next += size
+	h.sizes[addr] = size
+	return addr
+}
+
+func (k *WindowsKernel) realloc(addr, size uint64) uint64 {
+	if addr == 0 {
+		return k.alloc(size)
+	}
+	old, ok := k.heap.sizes[addr]
+	if !ok {
+		return 0
+	}
+	if size <= old {
+		return addr
+	}
+	dst := k.alloc(size)
+	if dst == 0 {
+		return 0
+	}
+	data, err := k.U.GetCPU().MemRead(addr, old)
+	if err != nil {
+		return 0
+	}
+	k.U.GetCPU().MemWrite(dst, data)
+	delete(k.heap.sizes, addr)
+	return dst
+}
+
+func (k *WindowsKernel) free(addr uint64) bool {
+	if _, ok := k.heap.sizes[addr]; !ok {
+		return false
+	}
+	delete(k.heap.sizes, addr)
+	return true
+}
+
+// exit terminates the process.
+func (k *WindowsKernel) exit(code uint64) {
+	k.U.Exit(models.ExitStatus(int32(code)))
+}
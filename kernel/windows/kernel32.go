@@ -0,0 +1,611 @@
+package windows
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/felberj/binemu/cpu"
+	co "github.com/felberj/binemu/kernel/common"
+)
+
+var kernel32 = map[string]api{
+	"CloseHandle":                 {"close_handle", 1},
+	"CreateFileA":                 {"create_file_a", 7},
+	"DeleteCriticalSection":       {"critical_section", 1},
+	"DeleteFileA":                 {"delete_file_a", 1},
+	"EnterCriticalSection":        {"critical_section", 1},
+	"ExitProcess":                 {"exit_process", 1},
+	"FreeLibrary":                 {"free_library", 1},
+	"GetCommandLineA":             {"get_command_line_a", 0},
+	"GetConsoleMode":              {"get_console_mode", 2},
+	"GetCurrentProcess":           {"get_current_process", 0},
+	"GetCurrentProcessId":         {"get_current_process_id", 0},
+	"GetCurrentThreadId":          {"get_current_thread_id", 0},
+	"GetFileSize":                 {"get_file_size", 2},
+	"GetFileType":                 {"get_file_type", 1},
+	"GetLastError":                {"get_last_error", 0},
+	"GetModuleFileNameA":          {"get_module_file_name_a", 3},
+	"GetModuleHandleA":            {"get_module_handle_a", 1},
+	"GetModuleHandleW":            {"get_module_handle_w", 1},
+	"GetProcAddress":              {"get_proc_address", 2},
+	"GetProcessHeap":              {"get_process_heap", 0},
+	"GetStartupInfoA":             {"get_startup_info_a", 1},
+	"GetStdHandle":                {"get_std_handle", 1},
+	"GetSystemTimeAsFileTime":     {"get_system_time_as_file_time", 1},
+	"GetTickCount":                {"get_tick_count", 0},
+	"HeapAlloc":                   {"heap_alloc", 3},
+	"HeapFree":                    {"heap_free", 3},
+	"HeapReAlloc":                 {"heap_re_alloc", 4},
+	"HeapSize":                    {"heap_size", 3},
+	"InitializeCriticalSection":   {"critical_section", 1},
+	"IsDebuggerPresent":           {"is_debugger_present", 0},
+	"LeaveCriticalSection":        {"critical_section", 1},
+	"LoadLibraryA":                {"load_library_a", 1},
+	"QueryPerformanceCounter":     {"query_performance_counter", 1},
+	"QueryPerformanceFrequency":   {"query_performance_frequency", 1},
+	"ReadConsoleA":                {"read_file", 5},
+	"ReadFile":                    {"read_file", 5},
+	"SetFilePointer":              {"set_file_pointer", 4},
+	"SetLastError":                {"set_last_error", 1},
+	"SetUnhandledExceptionFilter": {"set_unhandled_exception_filter", 1},
+	"Sleep":                       {"sleep", 1},
+	"TerminateProcess":            {"terminate_process", 2},
+	"TlsAlloc":                    {"tls_alloc", 0},
+	"TlsFree":                     {"tls_free", 1},
+	"TlsGetValue":                 {"tls_get_value", 1},
+	"TlsSetValue":                 {"tls_set_value", 2},
+	"VirtualAlloc":                {"virtual_alloc", 4},
+	"VirtualFree":                 {"virtual_free", 3},
+	"VirtualProtect":              {"virtual_protect", 4},
+	"VirtualQuery":                {"virtual_query", 3},
+	"WriteConsoleA":               {"write_file", 5},
+	"WriteFile":                   {"write_file", 5},
+}
+
+// hostPath turns a Windows path into a path on the guest filesystem. Drive
+// letters are dropped, so C:\foo and \foo are the same file.
+func hostPath(p string) string {
+	if len(p) >= 2 && p[1] == ':' {
+		p = p[2:]
+	}
+	p = strings.Replace(p, "\\", "/", -1)
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return path.Clean(p)
+}
+
+func (k *WindowsKernel) ExitProcess(code uint64) {
+	k.exit(code)
+}
+
+func (k *WindowsKernel) TerminateProcess(process, code uint64) uint64 {
+	k.exit(code)
+	return 1
+}
+
+func (k *WindowsKernel) GetStdHandle(n uint32) uint64 {
+	// STD_INPUT_HANDLE is (DWORD)-10 and so on
+	switch int32(n) {
+	case -10:
+		return stdinHandle
+	case -11:
+		return stdoutHandle
+	case -12:
+		return stderrHandle
+	}
+	k.setLastError(ERROR_INVALID_HANDLE)
+	return INVALID_HANDLE_VALUE
+}
+
+// read reads from a handle. Console input shares its buffer with the C
+// runtime, so mixing ReadFile and getchar keeps the order.
+func (k *WindowsKernel) read(h uint64, p []byte) (int, error) {
+	if h == stdinHandle {
+		return k.stdin.Read(p)
+	}
+	f, ok := k.Handles[h]
+	if !ok {
+		return 0, os.ErrInvalid
+	}
+	return f.Read(p)
+}
+
+func (k *WindowsKernel) WriteFile(h uint64, buf co.Buf, size uint32, written co.Obuf, overlapped uint64) uint64 {
+	f, ok := k.Handles[h]
+	if !ok {
+		return k.fail(ERROR_INVALID_HANDLE)
+	}
+	if !k.mapped(buf.Addr, uint64(size)) {
+		return k.fail(ERROR_INVALID_PARAMETER)
+	}
+	data, err := k.U.GetCPU().MemRead(buf.Addr, uint64(size))
+	if err != nil {
+		return k.fail(ERROR_INVALID_PARAMETER)
+	}
+	n, err := f.Write(data)
+	k.putU32(written, uint32(n))
+	if err != nil {
+		return k.fail(ERROR_ACCESS_DENIED)
+	}
+	return 1
+}
+
+func (k *WindowsKernel) ReadFile(h uint64, buf co.Obuf, size uint32, read co.Obuf, overlapped uint64) uint64 {
+	if _, ok := k.Handles[h]; !ok {
+		return k.fail(ERROR_INVALID_HANDLE)
+	}
+	if !k.mapped(buf.Addr, uint64(size)) {
+		return k.fail(ERROR_INVALID_PARAMETER)
+	}
+	tmp := make([]byte, size)
+	n, err := k.read(h, tmp)
+	if err != nil && err != io.EOF {
+		k.putU32(read, 0)
+		return k.fail(ERROR_ACCESS_DENIED)
+	}
+	if err := k.U.GetCPU().MemWrite(buf.Addr, tmp[:n]); err != nil {
+		return k.fail(ERROR_INVALID_PARAMETER)
+	}
+	// end of file is a successful read of zero bytes
+	k.putU32(read, uint32(n))
+	return 1
+}
+
+// CreateFileA creation dispositions
+const (
+	CREATE_NEW        = 1
+	CREATE_ALWAYS     = 2
+	OPEN_EXISTING     = 3
+	OPEN_ALWAYS       = 4
+	TRUNCATE_EXISTING = 5
+
+	GENERIC_WRITE = 0x40000000
+	GENERIC_READ  = 0x80000000
+)
+
+func (k *WindowsKernel) CreateFileA(name uint64, access, share uint32, security uint64, disposition, attrs uint32, template uint64) uint64 {
+	var flags int
+	switch {
+	case access&GENERIC_READ != 0 && access&GENERIC_WRITE != 0:
+		flags = os.O_RDWR
+	case access&GENERIC_WRITE != 0:
+		flags = os.O_WRONLY
+	default:
+		flags = os.O_RDONLY
+	}
+	switch disposition {
+	case CREATE_NEW:
+		flags |= os.O_CREATE | os.O_EXCL
+	case CREATE_ALWAYS:
+		flags |= os.O_CREATE | os.O_TRUNC
+	case OPEN_ALWAYS:
+		flags |= os.O_CREATE
+	case TRUNCATE_EXISTING:
+		flags |= os.O_TRUNC
+	}
+	f, err := k.Fs.OpenFile(hostPath(k.readString(name)), flags, 0644)
+	if err != nil {
+		if os.IsNotExist(err) {
+			k.setLastError(ERROR_FILE_NOT_FOUND)
+		} else {
+			k.setLastError(ERROR_ACCESS_DENIED)
+		}
+		return INVALID_HANDLE_VALUE
+	}
+	return k.addHandle(f)
+}
+
+func (k *WindowsKernel) CloseHandle(h uint64) uint64 {
+	f, ok := k.Handles[h]
+	if !ok {
+		return k.fail(ERROR_INVALID_HANDLE)
+	}
+	// the console stays open
+	if h != stdinHandle && h != stdoutHandle && h != stderrHandle {
+		f.Close()
+		delete(k.Handles, h)
+	}
+	return 1
+}
+
+func (k *WindowsKernel) GetFileSize(h uint64, high co.Obuf) uint64 {
+	f, ok := k.Handles[h].(io.Seeker)
+	if !ok {
+		k.setLastError(ERROR_INVALID_HANDLE)
+		return 0xffffffff
+	}
+	pos, _ := f.Seek(0, io.SeekCurrent)
+	size, err := f.Seek(0, io.SeekEnd)
+	f.Seek(pos, io.SeekStart)
+	if err != nil {
+		k.setLastError(ERROR_INVALID_HANDLE)
+		return 0xffffffff
+	}
+	k.putU32(high, uint32(size>>32))
+	return uint64(uint32(size))
+}
+
+func (k *WindowsKernel) SetFilePointer(h uint64, dist uint32, high co.Buf, method uint32) uint64 {
+	f, ok := k.Handles[h].(io.Seeker)
+	if !ok {
+		k.setLastError(ERROR_INVALID_HANDLE)
+		return 0xffffffff
+	}
+	off := int64(int32(dist))
+	if high.Addr != 0 {
+		var hi int32
+		if err := high.Unpack(&hi); err != nil {
+			return k.fail(ERROR_INVALID_PARAMETER)
+		}
+		off = int64(hi)<<32 | int64(dist)
+	}
+	// FILE_BEGIN, FILE_CURRENT and FILE_END match io.Seek*
+	pos, err := f.Seek(off, int(method))
+	if err != nil {
+		k.setLastError(ERROR_INVALID_PARAMETER)
+		return 0xffffffff
+	}
+	k.putU32(co.Obuf{Buf: high}, uint32(pos>>32))
+	return uint64(uint32(pos))
+}
+
+func (k *WindowsKernel) DeleteFileA(name uint64) uint64 {
+	if err := k.Fs.Remove(hostPath(k.readString(name))); err != nil {
+		return k.fail(ERROR_FILE_NOT_FOUND)
+	}
+	return 1
+}
+
+const (
+	FILE_TYPE_DISK = 1
+	FILE_TYPE_CHAR = 2
+)
+
+func (k *WindowsKernel) GetFileType(h uint64) uint64 {
+	if _, ok := k.Handles[h]; !ok {
+		return k.fail(ERROR_INVALID_HANDLE)
+	}
+	if h == stdinHandle || h == stdoutHandle || h == stderrHandle {
+		return FILE_TYPE_CHAR
+	}
+	return FILE_TYPE_DISK
+}
+
+func (k *WindowsKernel) GetConsoleMode(h uint64, mode co.Obuf) uint64 {
+	if h != stdinHandle && h != stdoutHandle && h != stderrHandle {
+		return k.fail(ERROR_INVALID_HANDLE)
+	}
+	// ENABLE_PROCESSED_INPUT | ENABLE_LINE_INPUT | ENABLE_ECHO_INPUT
+	k.putU32(mode, 7)
+	return 1
+}
+
+func (k *WindowsKernel) GetLastError() uint64 {
+	return uint64(k.lastError())
+}
+
+func (k *WindowsKernel) SetLastError(code uint32) {
+	k.setLastError(code)
+}
+
+func (k *WindowsKernel) GetProcessHeap() uint64 {
+	return processHeap
+}
+
+const HEAP_ZERO_MEMORY = 8
+
+func (k *WindowsKernel) HeapAlloc(heap uint64, flags uint32, size uint64) uint64 {
+	// the heap is fresh memory, so it is always zeroed
+	return k.alloc(size)
+}
+
+func (k *WindowsKernel) HeapFree(heap uint64, flags uint32, addr uint64) uint64 {
+	if addr == 0 || k.free(addr) {
+		return 1
+	}
+	return k.fail(ERROR_INVALID_PARAMETER)
+}
+
+func (k *WindowsKernel) HeapReAlloc(heap uint64, flags uint32, addr, size uint64) uint64 {
+	if ret := k.realloc(addr, size); ret != 0 {
+		return ret
+	}
+	return k.fail(ERROR_NOT_ENOUGH_MEMORY)
+}
+
+func (k *WindowsKernel) HeapSize(heap uint64, flags uint32, addr uint64) uint64 {
+	if size, ok := k.heap.sizes[addr]; ok {
+		return size
+	}
+	return ^uint64(0)
+}
+
+// VirtualAlloc protections
+const (
+	PAGE_NOACCESS          = 0x01
+	PAGE_READONLY          = 0x02
+	PAGE_READWRITE         = 0x04
+	PAGE_WRITECOPY         = 0x08
+	PAGE_EXECUTE           = 0x10
+	PAGE_EXECUTE_READ      = 0x20
+	PAGE_EXECUTE_READWRITE = 0x40
+	PAGE_EXECUTE_WRITECOPY = 0x80
+
+	MEM_COMMIT = 0x1000
+	MEM_FREE   = 0x10000
+)
+
+func pageProt(p uint32) int {
+	switch p & 0xff {
+	case PAGE_READONLY:
+		return cpu.PROT_READ
+	case PAGE_READWRITE, PAGE_WRITECOPY:
+		return cpu.PROT_READ | cpu.PROT_WRITE
+	case PAGE_EXECUTE:
+		return cpu.PROT_EXEC
+	case PAGE_EXECUTE_READ:
+		return cpu.PROT_READ | cpu.PROT_EXEC
+	case PAGE_EXECUTE_READWRITE, PAGE_EXECUTE_WRITECOPY:
+		return cpu.PROT_ALL
+	}
+	return cpu.PROT_NONE
+}
+
+func winProt(p int) uint32 {
+	switch p {
+	case cpu.PROT_READ:
+		return PAGE_READONLY
+	case cpu.PROT_READ | cpu.PROT_WRITE:
+		return PAGE_READWRITE
+	case cpu.PROT_EXEC:
+		return PAGE_EXECUTE
+	case cpu.PROT_READ | cpu.PROT_EXEC:
+		return PAGE_EXECUTE_READ
+	case cpu.PROT_ALL:
+		return PAGE_EXECUTE_READWRITE
+	}
+	return PAGE_NOACCESS
+}
+
+func (k *WindowsKernel) VirtualAlloc(addr, size uint64, allocType, protect uint32) uint64 {
+	size = (size + 0xfff) &^ 0xfff
+	if addr != 0 {
+		// committing reserved memory that is already mapped
+		if k.U.Mappings().Find(addr) != nil {
+			return addr &^ 0xfff
+		}
+	}
+	ret, err := k.U.Mmap(addr&^0xfff, size, pageProt(protect), addr != 0, "VirtualAlloc", nil)
+	if err != nil {
+		return k.fail(ERROR_NOT_ENOUGH_MEMORY)
+	}
+	return ret
+}
+
+func (k *WindowsKernel) VirtualFree(addr, size uint64, freeType uint32) uint64 {
+	// like munmap, only without ever reusing the address
+	return 1
+}
+
+func (k *WindowsKernel) VirtualProtect(addr, size uint64, protect uint32, old co.Obuf) uint64 {
+	prev := uint32(PAGE_NOACCESS)
+	if m := k.U.Mappings().Find(addr); m != nil {
+		prev = winProt(m.Prot)
+	}
+	start := addr &^ 0xfff
+	end := (addr + size + 0xfff) &^ 0xfff
+	if err := k.U.MemProt(start, end-start, pageProt(protect)); err != nil {
+		return k.fail(ERROR_INVALID_PARAMETER)
+	}
+	k.putU32(old, prev)
+	return 1
+}
+
+func (k *WindowsKernel) VirtualQuery(addr uint64, buf co.Obuf, size uint64) uint64 {
+	var info struct {
+		BaseAddress, AllocationBase uint64
+		AllocationProtect           uint32
+		RegionSize                  uint64
+		State, Protect, Type        uint32
+	}
+	info.BaseAddress = addr &^ 0xfff
+	info.State = MEM_FREE
+	info.Protect = PAGE_NOACCESS
+	if m := k.U.Mappings().Find(addr); m != nil {
+		info.AllocationBase = m.Addr
+		info.AllocationProtect = winProt(m.Prot)
+		info.RegionSize = m.Addr + m.Size - info.BaseAddress
+		info.State = MEM_COMMIT
+		info.Protect = info.AllocationProtect
+		// MEM_PRIVATE
+		info.Type = 0x20000
+	}
+	// MEMORY_BASIC_INFORMATION uses pointer sized fields
+	fields := []uint64{info.BaseAddress, info.AllocationBase, uint64(info.AllocationProtect), info.RegionSize}
+	pos := buf.Addr
+	for _, v := range fields {
+		k.writePtr(pos, v)
+		pos += k.ptrSize()
+	}
+	k.writeU32(pos, info.State)
+	k.writeU32(pos+4, info.Protect)
+	k.writeU32(pos+8, info.Type)
+	return 7 * k.ptrSize()
+}
+
+// GetModuleHandleA returns the image base for the executable and known
+// DLLs, which have no image of their own and use their stub address.
+func (k *WindowsKernel) GetModuleHandleA(name uint64) uint64 {
+	if name == 0 {
+		return k.U.Base()
+	}
+	return k.module(k.readString(name))
+}
+
+func (k *WindowsKernel) GetModuleHandleW(name uint64) uint64 {
+	if name == 0 {
+		return k.U.Base()
+	}
+	return k.module(k.readWString(name))
+}
+
+// module returns a fake module handle for an emulated DLL.
+func (k *WindowsKernel) module(name string) uint64 {
+	name = dllName(path.Base(strings.Replace(name, "\\", "/", -1)))
+	for i, s := range stubs {
+		if s.dll == name {
+			return stubAddr(i)
+		}
+	}
+	return k.fail(ERROR_MOD_NOT_FOUND)
+}
+
+func (k *WindowsKernel) LoadLibraryA(name uint64) uint64 {
+	return k.GetModuleHandleA(name)
+}
+
+func (k *WindowsKernel) FreeLibrary(module uint64) uint64 {
+	return 1
+}
+
+// GetProcAddress only knows the emulated DLLs.
+func (k *WindowsKernel) GetProcAddress(module, name uint64) uint64 {
+	// lookups by ordinal pass a number instead of a string
+	if name < 0x10000 {
+		return k.fail(ERROR_PROC_NOT_FOUND)
+	}
+	fn := k.readString(name)
+	var dll string
+	for i, s := range stubs {
+		if stubAddr(i) == module {
+			dll = s.dll
+		}
+	}
+	if addr, ok := resolve(dll, fn); ok && dll != "" {
+		return addr
+	}
+	return k.fail(ERROR_PROC_NOT_FOUND)
+}
+
+func (k *WindowsKernel) GetModuleFileNameA(module uint64, buf co.Obuf, size uint32) uint64 {
+	name := "C:\\" + path.Base(k.U.Exe())
+	if uint32(len(name)) >= size {
+		name = name[:size-1]
+	}
+	if err := k.writeString(buf.Addr, name); err != nil {
+		return k.fail(ERROR_INVALID_PARAMETER)
+	}
+	return uint64(len(name))
+}
+
+func (k *WindowsKernel) GetCommandLineA() uint64 {
+	return k.readPtr(acmdlnAddr)
+}
+
+func (k *WindowsKernel) GetStartupInfoA(info co.Obuf) {
+	// STARTUPINFOA is 68 bytes on x86 and 104 on x86_64, cb comes first
+	size := 68
+	if k.U.Bits() == 64 {
+		size = 104
+	}
+	k.U.GetCPU().MemWrite(info.Addr, make([]byte, size))
+	k.writeU32(info.Addr, uint32(size))
+}
+
+func (k *WindowsKernel) GetCurrentProcess() uint64 {
+	// the pseudo handle (HANDLE)-1
+	return ^uint64(0)
+}
+
+func (k *WindowsKernel) GetCurrentProcessId() uint64 {
+	return pid
+}
+
+func (k *WindowsKernel) GetCurrentThreadId() uint64 {
+	return tid
+}
+
+func (k *WindowsKernel) IsDebuggerPresent() uint64 {
+	return 0
+}
+
+func (k *WindowsKernel) SetUnhandledExceptionFilter(filter uint64) uint64 {
+	return 0
+}
+
+// CriticalSection stands in for the critical section functions. There is
+// only one thread, so they do nothing.
+func (k *WindowsKernel) CriticalSection(cs uint64) {}
+
+// fileTimeEpoch is the difference between 1601-01-01 and the Unix epoch in
+// 100ns intervals.
+const fileTimeEpoch = 116444736000000000
+
+func (k *WindowsKernel) GetSystemTimeAsFileTime(ft co.Obuf) {
+	t := uint64(time.Now().UnixNano()/100) + fileTimeEpoch
+	k.writeU32(ft.Addr, uint32(t))
+	k.writeU32(ft.Addr+4, uint32(t>>32))
+}
+
+var startTime = time.Now()
+
+func (k *WindowsKernel) GetTickCount() uint64 {
+	return uint64(uint32(time.Since(startTime) / time.Millisecond))
+}
+
+func (k *WindowsKernel) QueryPerformanceCounter(count co.Obuf) uint64 {
+	if err := count.Pack(uint64(time.Since(startTime) / time.Microsecond)); err != nil {
+		return 0
+	}
+	return 1
+}
+
+func (k *WindowsKernel) QueryPerformanceFrequency(freq co.Obuf) uint64 {
+	if err := freq.Pack(uint64(1000000)); err != nil {
+		return 0
+	}
+	return 1
+}
+
+func (k *WindowsKernel) Sleep(ms uint32) {
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+}
+
+const TLS_OUT_OF_INDEXES = 0xffffffff
+
+// TlsAlloc hands out dynamic TLS indexes. Index 0 is the static TLS block
+// of the image, so dynamic ones start at 1.
+func (k *WindowsKernel) TlsAlloc() uint64 {
+	k.nextTls++
+	k.tls[k.nextTls] = 0
+	return k.nextTls
+}
+
+func (k *WindowsKernel) TlsFree(index uint64) uint64 {
+	if _, ok := k.tls[index]; !ok {
+		return k.fail(ERROR_INVALID_PARAMETER)
+	}
+	delete(k.tls, index)
+	return 1
+}
+
+func (k *WindowsKernel) TlsGetValue(index uint64) uint64 {
+	val, ok := k.tls[index]
+	if !ok {
+		return k.fail(ERROR_INVALID_PARAMETER)
+	}
+	k.setLastError(ERROR_SUCCESS)
+	return val
+}
+
+func (k *WindowsKernel) TlsSetValue(index, val uint64) uint64 {
+	if _, ok := k.tls[index]; !ok {
+		return k.fail(ERROR_INVALID_PARAMETER)
+	}
+	k.tls[index] = val
+	return 1
+}
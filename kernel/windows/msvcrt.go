@@ -0,0 +1,1027 @@
+package windows
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	co "github.com/felberj/binemu/kernel/common"
+)
+
+var msvcrt = map[string]api{
+	"__getmainargs":                  {call: "getmainargs"},
+	"__iob_func":                     {call: "iob_func"},
+	"__lconv_init":                   {call: "nop"},
+	"__p___argc":                     {call: "p_argc"},
+	"__p___argv":                     {call: "p_argv"},
+	"__p__acmdln":                    {call: "p_acmdln"},
+	"__p__commode":                   {call: "p_commode"},
+	"__p__environ":                   {call: "p_environ"},
+	"__p__fmode":                     {call: "p_fmode"},
+	"__set_app_type":                 {call: "nop"},
+	"__setusermatherr":               {call: "nop"},
+	"_amsg_exit":                     {call: "amsg_exit"},
+	"_cexit":                         {call: "nop"},
+	"_controlfp":                     {call: "controlfp"},
+	"_errno":                         {call: "errno"},
+	"_exit":                          {call: "exit"},
+	"_initterm":                      {call: "initterm"},
+	"_lock":                          {call: "nop"},
+	"_onexit":                        {call: "atexit"},
+	"_set_invalid_parameter_handler": {call: "nop"},
+	"_setmode":                       {call: "setmode"},
+	"_snprintf":                      {call: "snprintf"},
+	"_strdup":                        {call: "strdup"},
+	"_unlock":                        {call: "nop"},
+	"abort":                          {call: "abort"},
+	"atexit":                         {call: "atexit"},
+	"atoi":                           {call: "atoi"},
+	"atol":                           {call: "atoi"},
+	"calloc":                         {call: "calloc"},
+	"exit":                           {call: "exit"},
+	"fclose":                         {call: "fclose"},
+	"fflush":                         {call: "nop"},
+	"fgetc":                          {call: "fgetc"},
+	"fgets":                          {call: "fgets"},
+	"fopen":                          {call: "fopen"},
+	"fprintf":                        {call: "fprintf"},
+	"fputc":                          {call: "fputc"},
+	"fputs":                          {call: "fputs"},
+	"fread":                          {call: "fread"},
+	"free":                           {call: "free"},
+	"fseek":                          {call: "fseek"},
+	"ftell":                          {call: "ftell"},
+	"fwrite":                         {call: "fwrite"},
+	"getc":                           {call: "fgetc"},
+	"getchar":                        {call: "getchar"},
+	"gets":                           {call: "gets"},
+	"isalnum":                        {call: "isalnum"},
+	"isalpha":                        {call: "isalpha"},
+	"isdigit":                        {call: "isdigit"},
+	"isspace":                        {call: "isspace"},
+	"malloc":                         {call: "malloc"},
+	"memchr":                         {call: "memchr"},
+	"memcmp":                         {call: "memcmp"},
+	"memcpy":                         {call: "memmove"},
+	"memmove":                        {call: "memmove"},
+	"memset":                         {call: "memset"},
+	"printf":                         {call: "printf"},
+	"putc":                           {call: "fputc"},
+	"putchar":                        {call: "putchar"},
+	"puts":                           {call: "puts"},
+	"rand":                           {call: "rand"},
+	"realloc":                        {call: "realloc"},
+	"scanf":                          {call: "scanf"},
+	"signal":                         {call: "nop"},
+	"snprintf":                       {call: "snprintf"},
+	"sprintf":                        {call: "sprintf"},
+	"srand":                          {call: "srand"},
+	"sscanf":                         {call: "sscanf"},
+	"strcat":                         {call: "strcat"},
+	"strchr":                         {call: "strchr"},
+	"strcmp":                         {call: "strcmp"},
+	"strcpy":                         {call: "strcpy"},
+	"strlen":                         {call: "strlen"},
+	"strncmp":                        {call: "strncmp"},
+	"strncpy":                        {call: "strncpy"},
+	"strrchr":                        {call: "strrchr"},
+	"strstr":                         {call: "strstr"},
+	"strtol":                         {call: "strtol"},
+	"strtoul":                        {call: "strtol"},
+	"time":                           {call: "time"},
+	"tolower":                        {call: "tolower"},
+	"toupper":                        {call: "toupper"},
+	"vfprintf":                       {call: "vfprintf"},
+	"vprintf":                        {call: "vprintf"},
+	"vsprintf":                       {call: "vsprintf"},
+}
+
+var msvcrtData = map[string]uint64{
+	"_iob":      iobAddr,
+	"_fmode":    fmodeAddr,
+	"_commode":  commodeAddr,
+	"__argc":    argcAddr,
+	"__argv":    argvAddr,
+	"_environ":  environAddr,
+	"__initenv": initenvAddr,
+	"_acmdln":   acmdlnAddr,
+}
+
+const EOF = ^uint64(0)
+
+// Nop stands in for functions the emulation has nothing to do for.
+func (k *WindowsKernel) Nop() uint64 {
+	return 0
+}
+
+// varargs reads the variable arguments of a call, either straight from the
+// call or from a va_list.
+type varargs struct {
+	k    *WindowsKernel
+	next func() uint64
+}
+
+// callArgs returns the arguments of the current call starting at i.
+func (k *WindowsKernel) callArgs(i int) *varargs {
+	return &varargs{k: k, next: func() uint64 {
+		v, _ := arg(k.U, i)
+		i++
+		return v
+	}}
+}
+
+// vaList returns the arguments in a va_list, which on Windows is a
+// pointer to stack slots on both x86 and x86_64.
+func (k *WindowsKernel) vaList(addr uint64) *varargs {
+	return &varargs{k: k, next: func() uint64 {
+		v := k.readPtr(addr)
+		addr += k.ptrSize()
+		return v
+	}}
+}
+
+func (a *varargs) int64() uint64 {
+	lo := a.next()
+	if a.k.U.Bits() == 64 {
+		return lo
+	}
+	return uint64(uint32(lo)) | a.next()<<32
+}
+
+func (a *varargs) float() float64 {
+	return math.Float64frombits(a.int64())
+}
+
+// format implements the printf format language.
+func (k *WindowsKernel) format(f string, a *varargs) string {
+	var out bytes.Buffer
+	for i := 0; i < len(f); i++ {
+		if f[i] != '%' {
+			out.WriteByte(f[i])
+			continue
+		}
+		spec := "%"
+		for i++; i < len(f) && strings.IndexByte("-+ #0", f[i]) >= 0; i++ {
+			spec += f[i : i+1]
+		}
+		if i < len(f) && f[i] == '*' {
+			spec += strconv.Itoa(int(int32(a.next())))
+			i++
+		}
+		for ; i < len(f) && f[i] >= '0' && f[i] <= '9'; i++ {
+			spec += f[i : i+1]
+		}
+		prec := false
+		if i < len(f) && f[i] == '.' {
+			prec = true
+			spec += "."
+			i++
+			if i < len(f) && f[i] == '*' {
+				spec += strconv.Itoa(int(int32(a.next())))
+				i++
+			}
+			for ; i < len(f) && f[i] >= '0' && f[i] <= '9'; i++ {
+				spec += f[i : i+1]
+			}
+		}
+		length := ""
+		for _, l := range []string{"I64", "I32", "hh", "ll", "h", "l", "L", "I", "z", "j", "t", "w"} {
+			if strings.HasPrefix(f[i:], l) {
+				length = l
+				i += len(l)
+				break
+			}
+		}
+		if i >= len(f) {
+			break
+		}
+		var val uint64
+		if strings.IndexByte("diuxXoc", f[i]) >= 0 {
+			switch length {
+			case "I64", "ll", "j":
+				val = a.int64()
+			case "I", "z", "t":
+				val = a.next()
+			default:
+				val = uint64(uint32(a.next()))
+			}
+		}
+		switch c := f[i]; c {
+		case 'd', 'i':
+			var n int64
+			switch length {
+			case "I64", "ll", "j":
+				n = int64(val)
+			case "I", "z", "t":
+				n = int64(val)
+				if k.U.Bits() == 32 {
+					n = int64(int32(val))
+				}
+			case "hh":
+				n = int64(int8(val))
+			case "h":
+				n = int64(int16(val))
+			default:
+				n = int64(int32(val))
+			}
+			fmt.Fprintf(&out, spec+"d", n)
+		case 'u', 'x', 'X', 'o':
+			switch length {
+			case "hh":
+				val = uint64(uint8(val))
+			case "h":
+				val = uint64(uint16(val))
+			}
+			verb := string(c)
+			if c == 'u' {
+				verb = "d"
+			}
+			fmt.Fprintf(&out, spec+verb, val)
+		case 'c':
+			fmt.Fprintf(&out, spec+"c", rune(byte(val)))
+		case 's', 'S':
+			addr := a.next()
+			s := "(null)"
+			if addr != 0 {
+				if c == 'S' || length == "l" || length == "w" {
+					s = k.readWString(addr)
+				} else {
+					s = k.readString(addr)
+				}
+			}
+			fmt.Fprintf(&out, spec+"s", s)
+		case 'p':
+			fmt.Fprintf(&out, "%0*X", k.ptrSize()*2, a.next())
+		case 'f', 'F', 'e', 'E', 'g', 'G':
+			// C defaults to a precision of 6 where Go picks the shortest
+			if !prec && (c == 'g' || c == 'G') {
+				spec += ".6"
+			}
+			fmt.Fprintf(&out, spec+string(c), a.float())
+		case 'n':
+			k.writeU32(a.next(), uint32(out.Len()))
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.String()
+}
+
+func skipSpace(r io.ByteScanner) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		if !isSpace(b) {
+			r.UnreadByte()
+			return
+		}
+	}
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\v' || b == '\f'
+}
+
+// token reads up to width bytes accepted by ok.
+func token(r io.ByteScanner, width int, ok func(s []byte, b byte) bool) string {
+	var s []byte
+	for width <= 0 || len(s) < width {
+		b, err := r.ReadByte()
+		if err != nil {
+			break
+		}
+		if !ok(s, b) {
+			r.UnreadByte()
+			break
+		}
+		s = append(s, b)
+	}
+	return string(s)
+}
+
+// intChar accepts the characters of an integer in base, where base 0
+// picks the base from the prefix like strtol.
+func intChar(base int) func(s []byte, b byte) bool {
+	return func(s []byte, b byte) bool {
+		if len(s) == 0 && (b == '-' || b == '+') {
+			return true
+		}
+		digits := strings.TrimLeft(string(s), "+-")
+		if (base == 0 || base == 16) && digits == "0" && (b == 'x' || b == 'X') {
+			return true
+		}
+		digitBase := base
+		if base == 0 {
+			switch {
+			case strings.HasPrefix(digits, "0x") || strings.HasPrefix(digits, "0X"):
+				digitBase = 16
+			case strings.HasPrefix(digits, "0"):
+				digitBase = 8
+			default:
+				digitBase = 10
+			}
+		}
+		_, err := strconv.ParseUint(string(b), digitBase, 8)
+		return err == nil
+	}
+}
+
+// parseInt parses a token accepted by intChar.
+func parseInt(tok string, base, bits int) (int64, bool) {
+	neg := strings.HasPrefix(tok, "-")
+	digits := strings.TrimLeft(tok, "+-")
+	if base == 16 {
+		digits = strings.TrimPrefix(strings.TrimPrefix(digits, "0x"), "0X")
+	}
+	n, err := strconv.ParseUint(digits, base, bits)
+	if err != nil {
+		return 0, false
+	}
+	if neg {
+		return -int64(n), true
+	}
+	return int64(n), true
+}
+
+func floatChar(s []byte, b byte) bool {
+	return b >= '0' && b <= '9' || strings.IndexByte("+-.eE", b) >= 0
+}
+
+// scan implements the scanf format language and returns the number of
+// assigned fields, or EOF if the input ended first.
+func (k *WindowsKernel) scan(r io.ByteScanner, f string, a *varargs) uint64 {
+	count := 0
+	mem := k.U.GetCPU()
+	store := func(addr uint64, val uint64, size int) {
+		var tmp [8]byte
+		k.U.ByteOrder().PutUint64(tmp[:], val)
+		mem.MemWrite(addr, tmp[:size])
+	}
+	for i := 0; i < len(f); i++ {
+		if isSpace(f[i]) {
+			skipSpace(r)
+			continue
+		}
+		if f[i] != '%' || i+1 < len(f) && f[i+1] == '%' {
+			if f[i] == '%' {
+				i++
+			}
+			b, err := r.ReadByte()
+			if err != nil {
+				break
+			}
+			if b != f[i] {
+				r.UnreadByte()
+				break
+			}
+			continue
+		}
+		i++
+		skip := false
+		if i < len(f) && f[i] == '*' {
+			skip = true
+			i++
+		}
+		width := 0
+		for ; i < len(f) && f[i] >= '0' && f[i] <= '9'; i++ {
+			width = width*10 + int(f[i]-'0')
+		}
+		size := 4
+		for _, l := range []struct {
+			s    string
+			size int
+		}{{"I64", 8}, {"ll", 8}, {"hh", 1}, {"h", 2}, {"l", 8}, {"L", 8}} {
+			if strings.HasPrefix(f[i:], l.s) {
+				size = l.size
+				i += len(l.s)
+				break
+			}
+		}
+		if i >= len(f) {
+			break
+		}
+		var val string
+		switch c := f[i]; c {
+		case 'd', 'i', 'u', 'x', 'X', 'o':
+			if size == 8 && f[i-1] == 'l' && f[i-2] != 'l' {
+				// long is 32 bits on Windows
+				size = 4
+			}
+			base := map[byte]int{'d': 10, 'i': 0, 'u': 10, 'x': 16, 'X': 16, 'o': 8}[c]
+			skipSpace(r)
+			val = token(r, width, intChar(base))
+			n, ok := parseInt(val, base, 64)
+			if !ok {
+				val = ""
+				break
+			}
+			if !skip {
+				store(a.next(), uint64(n), size)
+			}
+		case 'f', 'e', 'g', 'E', 'G':
+			skipSpace(r)
+			val = token(r, width, floatChar)
+			n, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				val = ""
+				break
+			}
+			if !skip {
+				if size == 8 {
+					store(a.next(), math.Float64bits(n), 8)
+				} else {
+					store(a.next(), uint64(math.Float32bits(float32(n))), 4)
+				}
+			}
+		case 's':
+			skipSpace(r)
+			val = token(r, width, func(s []byte, b byte) bool { return !isSpace(b) })
+			if val != "" && !skip {
+				k.writeString(a.next(), val)
+			}
+		case 'c':
+			if width == 0 {
+				width = 1
+			}
+			val = token(r, width, func(s []byte, b byte) bool { return true })
+			if len(val) == width && !skip {
+				mem.MemWrite(a.next(), []byte(val))
+			}
+		default:
+			val = ""
+		}
+		if val == "" {
+			if count == 0 {
+				if _, err := r.ReadByte(); err != nil {
+					return EOF
+				}
+				r.UnreadByte()
+			}
+			break
+		}
+		if !skip {
+			count++
+		}
+	}
+	return uint64(count)
+}
+
+// stream returns the handle behind a FILE pointer.
+func (k *WindowsKernel) stream(fp uint64) (uint64, bool) {
+	size := iobSize(k.U)
+	if fp >= iobAddr && fp < iobAddr+iobCount*size {
+		return []uint64{stdinHandle, stdoutHandle, stderrHandle}[(fp-iobAddr)/size], true
+	}
+	h, ok := k.Streams[fp]
+	return h, ok
+}
+
+func (k *WindowsKernel) write(h uint64, s string) uint64 {
+	f, ok := k.Handles[h]
+	if !ok {
+		return EOF
+	}
+	n, err := io.WriteString(f, s)
+	if err != nil {
+		return EOF
+	}
+	return uint64(n)
+}
+
+func (k *WindowsKernel) fwrite(fp uint64, s string) uint64 {
+	h, ok := k.stream(fp)
+	if !ok {
+		return EOF
+	}
+	return k.write(h, s)
+}
+
+func (k *WindowsKernel) Printf(f uint64) uint64 {
+	return k.write(stdoutHandle, k.format(k.readString(f), k.callArgs(1)))
+}
+
+func (k *WindowsKernel) Vprintf(f, va uint64) uint64 {
+	return k.write(stdoutHandle, k.format(k.readString(f), k.vaList(va)))
+}
+
+func (k *WindowsKernel) Fprintf(fp, f uint64) uint64 {
+	return k.fwrite(fp, k.format(k.readString(f), k.callArgs(2)))
+}
+
+func (k *WindowsKernel) Vfprintf(fp, f, va uint64) uint64 {
+	return k.fwrite(fp, k.format(k.readString(f), k.vaList(va)))
+}
+
+func (k *WindowsKernel) Sprintf(buf, f uint64) uint64 {
+	s := k.format(k.readString(f), k.callArgs(2))
+	k.writeString(buf, s)
+	return uint64(len(s))
+}
+
+func (k *WindowsKernel) Vsprintf(buf, f, va uint64) uint64 {
+	s := k.format(k.readString(f), k.vaList(va))
+	k.writeString(buf, s)
+	return uint64(len(s))
+}
+
+// Snprintf follows _snprintf, which returns -1 and leaves the string
+// unterminated when it does not fit.
+func (k *WindowsKernel) Snprintf(buf, size, f uint64) uint64 {
+	s := k.format(k.readString(f), k.callArgs(3))
+	if uint64(len(s)) > size {
+		k.U.GetCPU().MemWrite(buf, []byte(s[:size]))
+		return EOF
+	}
+	if uint64(len(s)) == size {
+		k.U.GetCPU().MemWrite(buf, []byte(s))
+	} else {
+		k.writeString(buf, s)
+	}
+	return uint64(len(s))
+}
+
+func (k *WindowsKernel) Scanf(f uint64) uint64 {
+	return k.scan(k.stdin, k.readString(f), k.callArgs(1))
+}
+
+func (k *WindowsKernel) Sscanf(s, f uint64) uint64 {
+	return k.scan(strings.NewReader(k.readString(s)), k.readString(f), k.callArgs(2))
+}
+
+func (k *WindowsKernel) Puts(s uint64) uint64 {
+	if k.write(stdoutHandle, k.readString(s)+"\n") == EOF {
+		return EOF
+	}
+	return 0
+}
+
+func (k *WindowsKernel) Putchar(c uint64) uint64 {
+	if k.write(stdoutHandle, string([]byte{byte(c)})) == EOF {
+		return EOF
+	}
+	return uint64(byte(c))
+}
+
+func (k *WindowsKernel) Fputs(s, fp uint64) uint64 {
+	if k.fwrite(fp, k.readString(s)) == EOF {
+		return EOF
+	}
+	return 0
+}
+
+func (k *WindowsKernel) Fputc(c, fp uint64) uint64 {
+	if k.fwrite(fp, string([]byte{byte(c)})) == EOF {
+		return EOF
+	}
+	return uint64(byte(c))
+}
+
+func (k *WindowsKernel) getc(h uint64) uint64 {
+	var b [1]byte
+	if n, _ := k.read(h, b[:]); n == 0 {
+		return EOF
+	}
+	return uint64(b[0])
+}
+
+func (k *WindowsKernel) Getchar() uint64 {
+	return k.getc(stdinHandle)
+}
+
+func (k *WindowsKernel) Fgetc(fp uint64) uint64 {
+	h, ok := k.stream(fp)
+	if !ok {
+		return EOF
+	}
+	return k.getc(h)
+}
+
+// readLine reads up to max bytes, stopping after a newline.
+func (k *WindowsKernel) readLine(h uint64, max int) ([]byte, bool) {
+	var line []byte
+	for len(line) < max {
+		c := k.getc(h)
+		if c == EOF {
+			return line, len(line) > 0
+		}
+		line = append(line, byte(c))
+		if c == '\n' {
+			break
+		}
+	}
+	return line, true
+}
+
+func (k *WindowsKernel) Gets(buf uint64) uint64 {
+	line, ok := k.readLine(stdinHandle, math.MaxInt32)
+	if !ok {
+		return 0
+	}
+	k.writeString(buf, strings.TrimSuffix(string(line), "\n"))
+	return buf
+}
+
+func (k *WindowsKernel) Fgets(buf, size, fp uint64) uint64 {
+	h, ok := k.stream(fp)
+	if !ok || int32(size) <= 0 {
+		return 0
+	}
+	line, ok := k.readLine(h, int(int32(size))-1)
+	if !ok {
+		return 0
+	}
+	k.writeString(buf, string(line))
+	return buf
+}
+
+func (k *WindowsKernel) Fwrite(buf, size, n, fp uint64) uint64 {
+	h, ok := k.stream(fp)
+	if !ok || size == 0 {
+		return 0
+	}
+	total := size * n
+	if total/size != n || !k.mapped(buf, total) {
+		return 0
+	}
+	data, err := k.U.GetCPU().MemRead(buf, total)
+	if err != nil {
+		return 0
+	}
+	written := k.write(h, string(data))
+	if written == EOF {
+		return 0
+	}
+	return written / size
+}
+
+func (k *WindowsKernel) Fread(buf, size, n, fp uint64) uint64 {
+	h, ok := k.stream(fp)
+	if !ok || size == 0 {
+		return 0
+	}
+	total := size * n
+	if total/size != n || !k.mapped(buf, total) {
+		return 0
+	}
+	data := make([]byte, total)
+	var read int
+	for read < len(data) {
+		c, err := k.read(h, data[read:])
+		read += c
+		if err != nil || c == 0 {
+			break
+		}
+	}
+	k.U.GetCPU().MemWrite(buf, data[:read])
+	return uint64(read) / size
+}
+
+func (k *WindowsKernel) Fopen(name, mode uint64) uint64 {
+	m := strings.Replace(k.readString(mode), "b", "", -1)
+	m = strings.Replace(m, "t", "", -1)
+	flags, ok := map[string]int{
+		"r":  os.O_RDONLY,
+		"r+": os.O_RDWR,
+		"w":  os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+		"w+": os.O_RDWR | os.O_CREATE | os.O_TRUNC,
+		"a":  os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+		"a+": os.O_RDWR | os.O_CREATE | os.O_APPEND,
+	}[m]
+	if !ok {
+		return 0
+	}
+	f, err := k.Fs.OpenFile(hostPath(k.readString(name)), flags, 0644)
+	if err != nil {
+		return 0
+	}
+	fp := k.alloc(iobSize(k.U))
+	k.Streams[fp] = k.addHandle(f)
+	return fp
+}
+
+func (k *WindowsKernel) Fclose(fp uint64) uint64 {
+	h, ok := k.Streams[fp]
+	if !ok {
+		return EOF
+	}
+	delete(k.Streams, fp)
+	k.free(fp)
+	k.CloseHandle(h)
+	return 0
+}
+
+func (k *WindowsKernel) Fseek(fp, off, whence uint64) uint64 {
+	h, ok := k.stream(fp)
+	if !ok {
+		return EOF
+	}
+	f, ok := k.Handles[h].(io.Seeker)
+	if !ok {
+		return EOF
+	}
+	if _, err := f.Seek(int64(int32(off)), int(whence)); err != nil {
+		return EOF
+	}
+	return 0
+}
+
+func (k *WindowsKernel) Ftell(fp uint64) uint64 {
+	h, ok := k.stream(fp)
+	if !ok {
+		return EOF
+	}
+	f, ok := k.Handles[h].(io.Seeker)
+	if !ok {
+		return EOF
+	}
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return EOF
+	}
+	return uint64(pos)
+}
+
+func (k *WindowsKernel) IobFunc() uint64 {
+	return iobAddr
+}
+
+func (k *WindowsKernel) Setmode(fd, mode uint64) uint64 {
+	// _O_TEXT
+	return 0x4000
+}
+
+func (k *WindowsKernel) Malloc(size uint64) uint64 {
+	return k.alloc(size)
+}
+
+func (k *WindowsKernel) Calloc(n, size uint64) uint64 {
+	if size != 0 && n*size/size != n {
+		return 0
+	}
+	return k.alloc(n * size)
+}
+
+func (k *WindowsKernel) Realloc(addr, size uint64) uint64 {
+	return k.realloc(addr, size)
+}
+
+func (k *WindowsKernel) Free(addr uint64) {
+	k.free(addr)
+}
+
+// Exit does not run the functions registered with atexit.
+func (k *WindowsKernel) Exit(code uint64) {
+	k.exit(code)
+}
+
+func (k *WindowsKernel) Abort() {
+	k.write(stderrHandle, "\nabnormal program termination\n")
+	k.exit(3)
+}
+
+func (k *WindowsKernel) AmsgExit(code uint64) {
+	k.write(stderrHandle, fmt.Sprintf("runtime error R60%02d\n", code))
+	k.exit(255)
+}
+
+func (k *WindowsKernel) Atexit(fn uint64) uint64 {
+	return 0
+}
+
+// Initterm calls the function pointers in [start, end), which is how the
+// C runtime runs static initializers.
+func (k *WindowsKernel) Initterm(start, end uint64) uint64 {
+	ret, sp := k.callerFrame()
+	return k.callGuest(k.readPtrArray(start, end), nil, ret, sp)
+}
+
+// Getmainargs hands out the arguments set up by Init.
+func (k *WindowsKernel) Getmainargs(argc, argv, env co.Obuf) uint64 {
+	var tmp [4]byte
+	k.U.GetCPU().MemReadInto(tmp[:], argcAddr)
+	k.writeU32(argc.Addr, k.U.ByteOrder().Uint32(tmp[:]))
+	k.writePtr(argv.Addr, k.readPtr(argvAddr))
+	k.writePtr(env.Addr, k.readPtr(environAddr))
+	return 0
+}
+
+func (k *WindowsKernel) PArgc() uint64    { return argcAddr }
+func (k *WindowsKernel) PArgv() uint64    { return argvAddr }
+func (k *WindowsKernel) PAcmdln() uint64  { return acmdlnAddr }
+func (k *WindowsKernel) PCommode() uint64 { return commodeAddr }
+func (k *WindowsKernel) PEnviron() uint64 { return environAddr }
+func (k *WindowsKernel) PFmode() uint64   { return fmodeAddr }
+func (k *WindowsKernel) Errno() uint64    { return errnoAddr }
+
+func (k *WindowsKernel) Controlfp(val, mask uint64) uint64 {
+	// _PC_53 | _RC_NEAR | _MCW_EM, the default control word
+	return 0x9001f
+}
+
+func (k *WindowsKernel) Strlen(s uint64) uint64 {
+	return uint64(len(k.readString(s)))
+}
+
+func (k *WindowsKernel) Strcpy(dst, src uint64) uint64 {
+	k.writeString(dst, k.readString(src))
+	return dst
+}
+
+func (k *WindowsKernel) Strncpy(dst, src, n uint64) uint64 {
+	if !k.mapped(dst, n) {
+		return dst
+	}
+	s := []byte(k.readString(src))
+	buf := make([]byte, n)
+	copy(buf, s)
+	k.U.GetCPU().MemWrite(dst, buf)
+	return dst
+}
+
+func (k *WindowsKernel) Strcat(dst, src uint64) uint64 {
+	k.writeString(dst+uint64(len(k.readString(dst))), k.readString(src))
+	return dst
+}
+
+func (k *WindowsKernel) Strdup(s uint64) uint64 {
+	str := k.readString(s)
+	addr := k.alloc(uint64(len(str) + 1))
+	if addr != 0 {
+		k.writeString(addr, str)
+	}
+	return addr
+}
+
+func sign(n int) uint64 {
+	switch {
+	case n < 0:
+		return ^uint64(0)
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+func (k *WindowsKernel) Strcmp(a, b uint64) uint64 {
+	return sign(strings.Compare(k.readString(a), k.readString(b)))
+}
+
+func (k *WindowsKernel) Strncmp(a, b, n uint64) uint64 {
+	sa, sb := k.readString(a), k.readString(b)
+	if uint64(len(sa)) > n {
+		sa = sa[:n]
+	}
+	if uint64(len(sb)) > n {
+		sb = sb[:n]
+	}
+	return sign(strings.Compare(sa, sb))
+}
+
+func (k *WindowsKernel) Strchr(s, c uint64) uint64 {
+	str := k.readString(s)
+	if byte(c) == 0 {
+		return s + uint64(len(str))
+	}
+	if i := strings.IndexByte(str, byte(c)); i >= 0 {
+		return s + uint64(i)
+	}
+	return 0
+}
+
+func (k *WindowsKernel) Strrchr(s, c uint64) uint64 {
+	str := k.readString(s)
+	if byte(c) == 0 {
+		return s + uint64(len(str))
+	}
+	if i := strings.LastIndexByte(str, byte(c)); i >= 0 {
+		return s + uint64(i)
+	}
+	return 0
+}
+
+func (k *WindowsKernel) Strstr(s, sub uint64) uint64 {
+	if i := strings.Index(k.readString(s), k.readString(sub)); i >= 0 {
+		return s + uint64(i)
+	}
+	return 0
+}
+
+// Strtol parses a long, which is 32 bits on Windows.
+func (k *WindowsKernel) Strtol(s, end, base uint64) uint64 {
+	str := k.readString(s)
+	r := strings.NewReader(str)
+	skipSpace(r)
+	tok := token(r, 0, intChar(int(int32(base))))
+	n, _ := parseInt(tok, int(int32(base)), 32)
+	if end != 0 {
+		consumed := uint64(len(str) - r.Len())
+		if tok == "" {
+			consumed = 0
+		}
+		k.writePtr(end, s+consumed)
+	}
+	return uint64(n)
+}
+
+func (k *WindowsKernel) Atoi(s uint64) uint64 {
+	return k.Strtol(s, 0, 10)
+}
+
+func (k *WindowsKernel) Memmove(dst, src, n uint64) uint64 {
+	if n > 0 && k.mapped(src, n) {
+		data, err := k.U.GetCPU().MemRead(src, n)
+		if err == nil {
+			k.U.GetCPU().MemWrite(dst, data)
+		}
+	}
+	return dst
+}
+
+func (k *WindowsKernel) Memset(dst, c, n uint64) uint64 {
+	if k.mapped(dst, n) {
+		k.U.GetCPU().MemWrite(dst, bytes.Repeat([]byte{byte(c)}, int(n)))
+	}
+	return dst
+}
+
+func (k *WindowsKernel) Memcmp(a, b, n uint64) uint64 {
+	if !k.mapped(a, n) || !k.mapped(b, n) {
+		return 0
+	}
+	da, _ := k.U.GetCPU().MemRead(a, n)
+	db, _ := k.U.GetCPU().MemRead(b, n)
+	return sign(bytes.Compare(da, db))
+}
+
+func (k *WindowsKernel) Memchr(s, c, n uint64) uint64 {
+	if !k.mapped(s, n) {
+		return 0
+	}
+	data, _ := k.U.GetCPU().MemRead(s, n)
+	if i := bytes.IndexByte(data, byte(c)); i >= 0 {
+		return s + uint64(i)
+	}
+	return 0
+}
+
+func boolInt(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (k *WindowsKernel) Isdigit(c uint64) uint64 {
+	return boolInt(c >= '0' && c <= '9')
+}
+
+func (k *WindowsKernel) Isalpha(c uint64) uint64 {
+	return boolInt(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z')
+}
+
+func (k *WindowsKernel) Isalnum(c uint64) uint64 {
+	return k.Isalpha(c) | k.Isdigit(c)
+}
+
+func (k *WindowsKernel) Isspace(c uint64) uint64 {
+	return boolInt(c < 0x100 && isSpace(byte(c)))
+}
+
+func (k *WindowsKernel) Toupper(c uint64) uint64 {
+	if c >= 'a' && c <= 'z' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
+
+func (k *WindowsKernel) Tolower(c uint64) uint64 {
+	if c >= 'A' && c <= 'Z' {
+		return c - 'A' + 'a'
+	}
+	return c
+}
+
+// Srand and Rand use the msvcrt generator, so seeded sequences match.
+func (k *WindowsKernel) Srand(seed uint64) {
+	k.seed = uint32(seed)
+}
+
+func (k *WindowsKernel) Rand() uint64 {
+	k.seed = k.seed*214013 + 2531011
+	return uint64(k.seed>>16) & 0x7fff
+}
+
+func (k *WindowsKernel) Time(t uint64) uint64 {
+	now := uint64(time.Now().Unix())
+	if t != 0 {
+		k.writePtr(t, now)
+	}
+	return now
+}
@@ -0,0 +1,79 @@
+package windows
+
+import (
+	"testing"
+
+	"github.com/felberj/binemu/vfs"
+)
+
+// msvcrtKernel returns a kernel over an empty filesystem and a page of
+// guest memory for strings and buffers.
+func msvcrtKernel(t *testing.T) (*WindowsKernel, uint64) {
+	k := NewKernel(vfs.New())
+	k.U = newWinUsercorn(t)
+	mem, err := k.U.Malloc(0x1000, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k, mem
+}
+
+func TestFileRoundTrip(t *testing.T) {
+	k, mem := msvcrtKernel(t)
+	name, wb, rb, buf := mem, mem+0x100, mem+0x110, mem+0x200
+	k.writeString(name, `C:\out.txt`)
+	k.writeString(wb, "wb")
+	k.writeString(rb, "rb")
+	k.writeString(buf, "hello")
+
+	fp := k.Fopen(name, wb)
+	if fp == 0 {
+		t.Fatal("fopen for writing failed")
+	}
+	if n := k.Fwrite(buf, 1, 5, fp); n != 5 {
+		t.Fatalf("fwrite wrote %d items", n)
+	}
+	if k.Fclose(fp) != 0 {
+		t.Fatal("fclose failed")
+	}
+	k.Memset(buf, 0, 0x100)
+	if fp = k.Fopen(name, rb); fp == 0 {
+		t.Fatal("fopen for reading failed")
+	}
+	// the file holds two items of two bytes and one byte more
+	if n := k.Fread(buf, 2, 0x10, fp); n != 2 {
+		t.Fatalf("fread read %d items", n)
+	}
+	if got := k.readString(buf); got != "hello" {
+		t.Fatalf("read back %q", got)
+	}
+	if k.Fclose(fp) != 0 {
+		t.Fatal("fclose failed")
+	}
+}
+
+func TestGuestSizes(t *testing.T) {
+	k, mem := msvcrtKernel(t)
+	if err := k.Fs.WriteFile("/data", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	k.writeString(mem, "/data")
+	k.writeString(mem+0x10, "rb")
+	fp := k.Fopen(mem, mem+0x10)
+	if fp == 0 {
+		t.Fatal("fopen failed")
+	}
+	// size*n wraps around to 4
+	if n := k.Fread(mem, 1<<63+2, 2, fp); n != 0 || k.readString(mem) != "/data" {
+		t.Errorf("fread with an overflowing size read %d items", n)
+	}
+	if k.Memset(mem, 'x', 1<<30); k.readString(mem) != "/data" {
+		t.Error("memset past the end of the mapping wrote memory")
+	}
+	if addr := k.Malloc(^uint64(0)); addr != 0 {
+		t.Errorf("malloc(-1) returned %#x", addr)
+	}
+	if addr := k.Calloc(1<<33, 1<<33); addr != 0 {
+		t.Errorf("an overflowing calloc returned %#x", addr)
+	}
+}
@@ -0,0 +1,10 @@
+package windows
+
+var ntdll = map[string]api{
+	"NtTerminateProcess":   {"terminate_process", 2},
+	"RtlAllocateHeap":      {"heap_alloc", 3},
+	"RtlFreeHeap":          {"heap_free", 3},
+	"RtlGetLastWin32Error": {"get_last_error", 0},
+	"RtlReAllocateHeap":    {"heap_re_alloc", 4},
+	"RtlSizeHeap":          {"heap_size", 3},
+}
@@ -0,0 +1,376 @@
+package windows
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/felberj/binemu/cpu"
+	"github.com/felberj/binemu/loader"
+	"github.com/felberj/binemu/models"
+)
+
+// TEB and PEB fields, see tebOffset and pebOffset for their layout.
+const (
+	tebExceptionList = iota
+	tebStackBase
+	tebStackLimit
+	tebSelf
+	tebProcessId
+	tebThreadId
+	tebTlsPointer
+	tebPeb
+	tebLastError
+)
+
+const (
+	pebBeingDebugged = iota
+	pebImageBase
+	pebProcessHeap
+	pebNtGlobalFlag
+)
+
+var tebOffsets = map[uint][]uint64{
+	32: {0x00, 0x04, 0x08, 0x18, 0x20, 0x24, 0x2c, 0x30, 0x34},
+	64: {0x00, 0x08, 0x10, 0x30, 0x40, 0x48, 0x58, 0x60, 0x68},
+}
+
+var pebOffsets = map[uint][]uint64{
+	32: {0x02, 0x08, 0x18, 0x68},
+	64: {0x02, 0x10, 0x30, 0xbc},
+}
+
+func tebOffset(u models.Usercorn, field int) uint64 {
+	return tebOffsets[u.Bits()][field]
+}
+
+func pebOffset(u models.Usercorn, field int) uint64 {
+	return pebOffsets[u.Bits()][field]
+}
+
+// processHeap is the handle GetProcessHeap returns. There is only one heap.
+const processHeap = 0x150000
+
+// Variables exported by msvcrt, kept in the data page.
+const (
+	iobAddr     = dataBase
+	fmodeAddr   = dataBase + 0x100
+	commodeAddr = dataBase + 0x104
+	argcAddr    = dataBase + 0x108
+	argvAddr    = dataBase + 0x110
+	environAddr = dataBase + 0x118
+	acmdlnAddr  = dataBase + 0x120
+	initenvAddr = dataBase + 0x128
+	errnoAddr   = dataBase + 0x130
+
+	// stdin, stdout and stderr in _iob
+	iobCount = 3
+)
+
+// iobSize is the size of a FILE in _iob.
+func iobSize(u models.Usercorn) uint64 {
+	if u.Bits() == 64 {
+		return 48
+	}
+	return 32
+}
+
+// commandLine joins args, quoting the ones containing spaces.
+func commandLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		if a == "" || strings.ContainsAny(a, " \t") {
+			a = `"` + a + `"`
+		}
+		quoted[i] = a
+	}
+	return strings.Join(quoted, " ")
+}
+
+// setupArgs builds the command line and the argv and environ arrays the
+// C runtime picks up through msvcrt.
+func setupArgs(u models.Usercorn, args, env []string) error {
+	cmdline := commandLine(args)
+	size := uint64(len(cmdline)+1) + uint64(len(args)+len(env)+2)*8
+	for _, s := range append(args, env...) {
+		size += uint64(len(s) + 1)
+	}
+	block, err := u.Malloc((size+0xfff)&^0xfff, "process parameters")
+	if err != nil {
+		return err
+	}
+	mem := u.GetCPU()
+	ptrSize := uint64(u.Bits() / 8)
+	pos := block
+	putString := func(s string) (uint64, error) {
+		addr := pos
+		pos += uint64(len(s) + 1)
+		return addr, mem.MemWrite(addr, []byte(s+"\x00"))
+	}
+	putArray := func(strs []string) (uint64, error) {
+		addrs := make([]uint64, len(strs))
+		for i, s := range strs {
+			var err error
+			if addrs[i], err = putString(s); err != nil {
+				return 0, err
+			}
+		}
+		pos = (pos + ptrSize - 1) &^ (ptrSize - 1)
+		array := pos
+		for _, addr := range append(addrs, 0) {
+			if err := writePtr(u, pos, addr); err != nil {
+				return 0, err
+			}
+			pos += ptrSize
+		}
+		return array, nil
+	}
+	cmdAddr, err := putString(cmdline)
+	if err != nil {
+		return err
+	}
+	argv, err := putArray(args)
+	if err != nil {
+		return err
+	}
+	environ, err := putArray(env)
+	if err != nil {
+		return err
+	}
+	var argc [4]byte
+	u.ByteOrder().PutUint32(argc[:], uint32(len(args)))
+	if err := mem.MemWrite(argcAddr, argc[:]); err != nil {
+		return err
+	}
+	for addr, val := range map[uint64]uint64{argvAddr: argv, environAddr: environ, initenvAddr: environ, acmdlnAddr: cmdAddr} {
+		if err := writePtr(u, addr, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupTeb maps the TEB and PEB of the only thread.
+func setupTeb(u models.Usercorn, l *loader.PELoader) error {
+	if _, err := u.Mmap(tebAddr, 0x2000, cpu.PROT_READ|cpu.PROT_WRITE, true, "teb", nil); err != nil {
+		return err
+	}
+	teb := map[int]uint64{
+		// end of the SEH chain
+		tebExceptionList: ^uint64(0),
+		tebStackBase:     stackBase + stackSize,
+		tebStackLimit:    stackBase,
+		tebSelf:          tebAddr,
+		tebProcessId:     pid,
+		tebThreadId:      tid,
+		tebPeb:           pebAddr,
+	}
+	for field, val := range teb {
+		if err := writePtr(u, tebAddr+tebOffset(u, field), val); err != nil {
+			return err
+		}
+	}
+	// BeingDebugged and NtGlobalFlag stay zero
+	if err := writePtr(u, pebAddr+pebOffset(u, pebImageBase), l.ImageBase()); err != nil {
+		return err
+	}
+	return writePtr(u, pebAddr+pebOffset(u, pebProcessHeap), processHeap)
+}
+
+// setupTls allocates the static TLS block of the image as slot 0.
+func setupTls(u models.Usercorn, l *loader.PELoader) error {
+	tls, err := l.TLS()
+	if err != nil || tls == nil {
+		return err
+	}
+	size := tls.End - tls.Start
+	block, err := u.Malloc((size+uint64(tls.ZeroFill)+0xfff)&^0xfff, "tls")
+	if err != nil {
+		return err
+	}
+	mem := u.GetCPU()
+	if size > 0 {
+		data, err := mem.MemRead(tls.Start, size)
+		if err != nil {
+			return err
+		}
+		if err := mem.MemWrite(block, data); err != nil {
+			return err
+		}
+	}
+	if tls.Index != 0 {
+		if err := mem.MemWrite(tls.Index, []byte{0, 0, 0, 0}); err != nil {
+			return err
+		}
+	}
+	slots, err := u.Malloc(0x1000, "tls slots")
+	if err != nil {
+		return err
+	}
+	if err := writePtr(u, slots, block); err != nil {
+		return err
+	}
+	return writePtr(u, tebAddr+tebOffset(u, tebTlsPointer), slots)
+}
+
+// Init loads a PE image into a fresh process: it resolves the imports,
+// sets up the stack, the TEB and PEB and the static TLS block. The caller
+// points FS or GS at the returned TEB.
+func Init(u models.Usercorn, args, env []string) (uint64, error) {
+	l, ok := u.Loader().(*loader.PELoader)
+	if !ok {
+		return 0, errors.New("the windows OS can only run PE images")
+	}
+	if err := mapStubs(u); err != nil {
+		return 0, err
+	}
+	if _, err := u.Mmap(dataBase, dataSize, cpu.PROT_READ|cpu.PROT_WRITE, true, "[winapi data]", nil); err != nil {
+		return 0, err
+	}
+	if err := resolveImports(u, l); err != nil {
+		return 0, err
+	}
+	if err := setupArgs(u, args, env); err != nil {
+		return 0, err
+	}
+	if err := u.MapStack(stackBase, stackSize, false); err != nil {
+		return 0, err
+	}
+	if err := setupTeb(u, l); err != nil {
+		return 0, err
+	}
+	if err := setupTls(u, l); err != nil {
+		return 0, err
+	}
+	// the entry point returns into ExitProcess, with the stack aligned
+	// like after any other call
+	sp, _ := u.RegRead(u.Arch().SP)
+	sp &^= 15
+	if u.Bits() == 64 {
+		sp -= 32
+	}
+	if err := u.RegWrite(u.Arch().SP, sp); err != nil {
+		return 0, err
+	}
+	if _, err := u.Push(stubAddr(stubProcessReturn)); err != nil {
+		return 0, err
+	}
+	// TLS callbacks run before the entry point, see ProcessStart
+	u.SetEntry(stubAddr(stubProcessStart))
+	return tebAddr, nil
+}
+
+// guestCall is a list of guest functions the kernel calls one after the
+// other before resuming at ret with the stack pointer set to sp.
+type guestCall struct {
+	fns     []uint64
+	args    []uint64
+	ret, sp uint64
+}
+
+// callGuest calls fns from a stub and resumes at ret afterwards. Every
+// function returns into the call return stub, which starts the next one.
+func (k *WindowsKernel) callGuest(fns, args []uint64, ret, sp uint64) uint64 {
+	k.calls = append(k.calls, &guestCall{fns: fns, args: args, ret: ret, sp: sp})
+	return k.nextCall()
+}
+
+func (k *WindowsKernel) nextCall() uint64 {
+	u := k.U
+	c := k.calls[len(k.calls)-1]
+	if len(c.fns) == 0 {
+		k.calls = k.calls[:len(k.calls)-1]
+		u.RegWrite(u.Arch().SP, c.sp)
+		u.RegWrite(u.Arch().PC, c.ret)
+		return 0
+	}
+	fn := c.fns[0]
+	c.fns = c.fns[1:]
+	sp := c.sp &^ 15
+	if u.Bits() == 64 {
+		for i, a := range c.args {
+			u.RegWrite(x64ArgRegs[i], a)
+		}
+		sp -= 32
+	} else {
+		for i := len(c.args) - 1; i >= 0; i-- {
+			sp -= 4
+			writePtr(u, sp, c.args[i])
+		}
+	}
+	sp -= k.ptrSize()
+	writePtr(u, sp, stubAddr(stubCallReturn))
+	u.RegWrite(u.Arch().SP, sp)
+	u.RegWrite(u.Arch().PC, fn)
+	return 0
+}
+
+// readPtrArray reads pointers from [start, end) and skips the null ones.
+func (k *WindowsKernel) readPtrArray(start, end uint64) []uint64 {
+	var ptrs []uint64
+	for addr := start; addr < end; addr += k.ptrSize() {
+		if p := k.readPtr(addr); p != 0 {
+			ptrs = append(ptrs, p)
+		}
+	}
+	return ptrs
+}
+
+// callerFrame returns where a cdecl stub returns to and the stack pointer
+// after returning.
+func (k *WindowsKernel) callerFrame() (ret, sp uint64) {
+	sp, _ = k.U.RegRead(k.U.Arch().SP)
+	return k.readPtr(sp), sp + k.ptrSize()
+}
+
+const DLL_PROCESS_ATTACH = 1
+
+// ProcessStart runs the TLS callbacks of the image and then jumps to the
+// entry point.
+func (k *WindowsKernel) ProcessStart() uint64 {
+	var callbacks []uint64
+	l := k.U.Loader().(*loader.PELoader)
+	if tls, err := l.TLS(); err == nil && tls != nil && tls.Callbacks != 0 {
+		for addr := tls.Callbacks; ; addr += k.ptrSize() {
+			fn := k.readPtr(addr)
+			if fn == 0 {
+				break
+			}
+			callbacks = append(callbacks, fn)
+		}
+	}
+	sp, _ := k.U.RegRead(k.U.Arch().SP)
+	args := []uint64{l.ImageBase(), DLL_PROCESS_ATTACH, 0}
+	return k.callGuest(callbacks, args, k.U.BinEntry(), sp)
+}
+
+// ProcessReturn exits with the value returned from the entry point.
+func (k *WindowsKernel) ProcessReturn() {
+	code, _ := k.U.RegRead(retReg(k.U))
+	k.exit(code)
+}
+
+// CallReturn continues a callGuest.
+func (k *WindowsKernel) CallReturn() uint64 {
+	if len(k.calls) == 0 {
+		k.U.Exit(errors.New("returned into the call return stub without a pending call"))
+		return 0
+	}
+	return k.nextCall()
+}
+
+// STATUS_STACK_BUFFER_OVERRUN is the exit code of __fastfail.
+const STATUS_STACK_BUFFER_OVERRUN = 0xc0000409
+
+// Interrupt handles the software interrupts a Windows process can raise.
+// There is no exception dispatch, so every one of them ends the process.
+func Interrupt(u models.Usercorn, intno uint32) {
+	switch intno {
+	case 0x29:
+		u.Exit(models.ExitStatus(int32(STATUS_STACK_BUFFER_OVERRUN - 1<<32)))
+	case 0:
+		u.Exit(errors.New("division by zero"))
+	default:
+		u.Exit(errors.Errorf("unhandled interrupt %#x", intno))
+	}
+}
@@ -4,18 +4,30 @@ import (
 	"encoding/binary"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/pkg/errors"
 )
 
+// ComSegment is the segment the PSP and the program are loaded at.
+const ComSegment = 0x1000
+
 type ComLoader struct {
 	LoaderBase
 	Size int
 	r    io.ReaderAt
 }
 
-func (c *ComLoader) OS() string {
-	return "DOS"
+type namer interface {
+	Name() string
+}
+
+// MatchCom reports whether r is a DOS .COM file. COM files have no header,
+// so only the file extension can identify them.
+func MatchCom(r io.ReaderAt) bool {
+	f, ok := r.(namer)
+	return ok && strings.EqualFold(filepath.Ext(f.Name()), ".com")
 }
 
 func NewComLoader(filename string) (Loader, error) {
@@ -32,6 +44,9 @@ func NewComLoader(filename string) (Loader, error) {
 	if size == 0 {
 		return nil, errors.New("Cannot read from file")
 	}
+	if size > 0x10000-0x100 {
+		return nil, errors.New("COM file does not fit into a segment")
+	}
 	return &ComLoader{
 		LoaderBase: LoaderBase{
 			arch:      "x86_16",
@@ -48,11 +63,11 @@ func NewComLoader(filename string) (Loader, error) {
 func (r *ComLoader) Segments() ([]SegmentData, error) {
 	var segs []SegmentData
 
-	// Main segment
+	// Main segment, the PSP below it and the stack above it share the segment
 	segs = append(segs, SegmentData{
 		Off:  0,
-		Addr: 0x100,
-		Size: uint64(r.Size),
+		Addr: ComSegment<<4 + 0x100,
+		Size: 0x10000 - 0x100,
 		Prot: 7,
 		DataFunc: func() ([]byte, error) {
 			p := make([]byte, r.Size)
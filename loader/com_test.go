@@ -1,6 +1,7 @@
 package loader
 
 import (
+	"os"
 	"testing"
 )
 
@@ -26,3 +27,18 @@ func TestComSegments(t *testing.T) {
 		t.Fatal("No segments!")
 	}
 }
+
+func TestComMatch(t *testing.T) {
+	f, err := os.Open(comFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	l, err := LoaderFor(f, NoOSHint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Arch() != "x86_16" || l.OS() != "dos" {
+		t.Fatalf("wrong loader: %s/%s", l.Arch(), l.OS())
+	}
+}
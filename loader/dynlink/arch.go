@@ -0,0 +1,156 @@
+package dynlink
+
+import (
+	"debug/elf"
+
+	"github.com/felberj/binemu/models"
+
+	uc "github.com/felberj/binemu/cpu/unicorn"
+)
+
+// relocation kinds shared by the supported architectures
+const (
+	relNone      = iota
+	relAbs       // S + A
+	relSym       // S, REL GLOB_DAT and JUMP_SLOT ignore the implicit addend
+	relPC32      // S + A - P, 32 bit
+	relRelative  // B + A
+	relCopy      // copy the symbol from the library defining it
+	relIRelative // call the resolver at B + A
+	relDTPMod    // TLS module id
+	relDTPOff    // offset in the TLS block of the module
+	relTPOff     // offset from the thread pointer
+	relTPOffNeg  // negated offset from the thread pointer
+	relTLSDesc   // TLS descriptor, resolved statically
+)
+
+// archInfo describes how the linker calls into the guest and lays out TLS
+// on an architecture.
+type archInfo struct {
+	ret []byte // instruction returning from a stub
+
+	argRegs []int // nil if arguments are passed on the stack
+	retReg  int
+	lr      int // link register, 0 if calls push the return address
+	fini    int // register the entry point expects the fini function in
+
+	// TLS variant II puts the blocks below the thread pointer and the
+	// thread control block above it, variant I the other way around.
+	tlsVariant int
+	tcbSize    uint64 // room for the libc thread descriptor
+	canary     uint64 // offset of the stack protector canary from the thread pointer, 0 if none
+
+	relocs map[uint32]int
+	setTP  func(u models.Usercorn, scratch, tp uint64) error
+	// names and argument register of __tls_get_addr
+	getAddrs []string
+	getArg   int
+	// _dl_tlsdesc_return, which loads the offset of a static TLS
+	// variable from its descriptor
+	tlsdesc []byte
+}
+
+var arches = map[string]*archInfo{
+	"x86": {
+		ret:        []byte{0xc3},
+		retReg:     uc.X86_REG_EAX,
+		fini:       uc.X86_REG_EDX,
+		tlsVariant: 2,
+		tcbSize:    0x1000,
+		canary:     0x14,
+		relocs: map[uint32]int{
+			uint32(elf.R_386_NONE):         relNone,
+			uint32(elf.R_386_32):           relAbs,
+			uint32(elf.R_386_PC32):         relPC32,
+			uint32(elf.R_386_GLOB_DAT):     relSym,
+			uint32(elf.R_386_JMP_SLOT):     relSym,
+			uint32(elf.R_386_RELATIVE):     relRelative,
+			uint32(elf.R_386_COPY):         relCopy,
+			uint32(elf.R_386_IRELATIVE):    relIRelative,
+			uint32(elf.R_386_TLS_DTPMOD32): relDTPMod,
+			uint32(elf.R_386_TLS_DTPOFF32): relDTPOff,
+			uint32(elf.R_386_TLS_TPOFF):    relTPOff,
+			uint32(elf.R_386_TLS_TPOFF32):  relTPOffNeg,
+		},
+		setTP: func(u models.Usercorn, scratch, tp uint64) error {
+			// struct user_desc for set_thread_area, 32 bit segment
+			// with page granularity
+			s := u.StrucAt(scratch)
+			s.Pack(uint32(0xffffffff), uint32(tp), uint32(0xfffff), uint32(0x51))
+			if s.Error != nil {
+				return s.Error
+			}
+			_, err := u.Syscall(243, "set_thread_area", func(n int) ([]uint64, error) {
+				return []uint64{scratch}, nil
+			})
+			return err
+		},
+		// the GNU variant takes its argument in eax
+		getAddrs: []string{"___tls_get_addr"},
+		getArg:   uc.X86_REG_EAX,
+	},
+	"x86_64": {
+		ret:        []byte{0xc3},
+		argRegs:    []int{uc.X86_REG_RDI, uc.X86_REG_RSI, uc.X86_REG_RDX},
+		retReg:     uc.X86_REG_RAX,
+		fini:       uc.X86_REG_RDX,
+		tlsVariant: 2,
+		tcbSize:    0x1000,
+		canary:     0x28,
+		relocs: map[uint32]int{
+			uint32(elf.R_X86_64_NONE):      relNone,
+			uint32(elf.R_X86_64_64):        relAbs,
+			uint32(elf.R_X86_64_PC32):      relPC32,
+			uint32(elf.R_X86_64_GLOB_DAT):  relAbs,
+			uint32(elf.R_X86_64_JMP_SLOT):  relAbs,
+			uint32(elf.R_X86_64_RELATIVE):  relRelative,
+			uint32(elf.R_X86_64_COPY):      relCopy,
+			uint32(elf.R_X86_64_IRELATIVE): relIRelative,
+			uint32(elf.R_X86_64_DTPMOD64):  relDTPMod,
+			uint32(elf.R_X86_64_DTPOFF64):  relDTPOff,
+			uint32(elf.R_X86_64_TPOFF64):   relTPOff,
+			uint32(elf.R_X86_64_TLSDESC):   relTLSDesc,
+		},
+		setTP: func(u models.Usercorn, scratch, tp uint64) error {
+			const ARCH_SET_FS = 0x1002
+			_, err := u.Syscall(158, "arch_prctl", func(n int) ([]uint64, error) {
+				return []uint64{ARCH_SET_FS, tp}, nil
+			})
+			return err
+		},
+		getAddrs: []string{"__tls_get_addr"},
+		getArg:   uc.X86_REG_RDI,
+		// mov rax, [rax+8]; ret
+		tlsdesc: []byte{0x48, 0x8b, 0x40, 0x08, 0xc3},
+	},
+	"arm64": {
+		ret:        []byte{0xc0, 0x03, 0x5f, 0xd6},
+		argRegs:    []int{uc.ARM64_REG_X0, uc.ARM64_REG_X1, uc.ARM64_REG_X2},
+		retReg:     uc.ARM64_REG_X0,
+		lr:         uc.ARM64_REG_LR,
+		fini:       uc.ARM64_REG_X0,
+		tlsVariant: 1,
+		tcbSize:    0x1000,
+		relocs: map[uint32]int{
+			uint32(elf.R_AARCH64_NONE):         relNone,
+			uint32(elf.R_AARCH64_ABS64):        relAbs,
+			uint32(elf.R_AARCH64_GLOB_DAT):     relAbs,
+			uint32(elf.R_AARCH64_JUMP_SLOT):    relAbs,
+			uint32(elf.R_AARCH64_RELATIVE):     relRelative,
+			uint32(elf.R_AARCH64_COPY):         relCopy,
+			uint32(elf.R_AARCH64_IRELATIVE):    relIRelative,
+			uint32(elf.R_AARCH64_TLS_DTPMOD64): relDTPMod,
+			uint32(elf.R_AARCH64_TLS_DTPREL64): relDTPOff,
+			uint32(elf.R_AARCH64_TLS_TPREL64):  relTPOff,
+			uint32(elf.R_AARCH64_TLSDESC):      relTLSDesc,
+		},
+		// ldr x0, [x0, #8]; ret
+		tlsdesc: []byte{0x00, 0x04, 0x40, 0xf9, 0xc0, 0x03, 0x5f, 0xd6},
+		setTP: func(u models.Usercorn, scratch, tp uint64) error {
+			_, err := u.Syscall(0, "set_tls", func(n int) ([]uint64, error) {
+				return []uint64{tp}, nil
+			})
+			return err
+		},
+	},
+}
@@ -0,0 +1,419 @@
+// Package dynlink links dynamically linked ELF binaries inside the
+// emulator, in place of the guest's ld.so.
+//
+// Link loads the DT_NEEDED libraries of a mapped executable from the guest
+// filesystem, applies their relocations, lays out the static TLS block and
+// points the entry at a stub that runs ifunc resolvers and initializers in
+// the guest before jumping to the executable.
+//
+// The linker provides __tls_get_addr and the few variables libraries
+// expect from ld.so, but none of its private interfaces. glibc's libc
+// reaches into ld.so internals (_rtld_global and the _dl_* functions), so
+// glibc binaries need glibc's ld.so instead.
+package dynlink
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/felberj/binemu/cpu"
+	"github.com/felberj/binemu/loader"
+	"github.com/felberj/binemu/loader/ldcache"
+	"github.com/felberj/binemu/models"
+	"github.com/felberj/binemu/vfs"
+)
+
+// DefaultPaths are searched for libraries after DT_RPATH, DT_RUNPATH, the
+// configured paths and /etc/ld.so.cache.
+var DefaultPaths = []string{"/lib", "/usr/lib", "/lib64", "/usr/lib64", "/usr/local/lib"}
+
+// DefaultDirs returns the directories searched for libraries of arch if
+// nothing else names them.
+func DefaultDirs(arch string) []string {
+	return append(append([]string(nil), DefaultPaths...), archDirs[arch]...)
+}
+
+// archDirs are the multiarch directories searched after DefaultPaths.
+var archDirs = map[string][]string{
+	"x86":    {"/lib/i386-linux-gnu", "/usr/lib/i386-linux-gnu", "/lib32", "/usr/lib32"},
+	"x86_64": {"/lib/x86_64-linux-gnu", "/usr/lib/x86_64-linux-gnu"},
+	"arm64":  {"/lib/aarch64-linux-gnu", "/usr/lib/aarch64-linux-gnu"},
+}
+
+// Object is an executable or library the linker mapped.
+type Object struct {
+	Name string // DT_NEEDED name, or the path of the executable
+	Path string // path the object was loaded from
+	Base uint64 // load bias
+
+	file    *elf.File
+	dyn     map[elf.DynTag]uint64
+	needed  []string
+	deps    []*Object
+	syms    []elf.Symbol
+	exports map[string]int
+
+	// static TLS block of the object, if it has a PT_TLS segment
+	tls       *elf.Prog
+	tlsModule uint64
+	tlsOffset uint64
+	tlsAddr   uint64
+}
+
+// Linker holds the state of a linked process.
+type Linker struct {
+	Objects []*Object
+
+	u        models.Usercorn
+	arch     *archInfo
+	order    binary.ByteOrder
+	ptr      uint64
+	paths    []string
+	defaults []string
+	cache    []ldcache.Entry
+
+	builtins map[string]uint64
+	stub     uint64
+	data     uint64
+	missing  []string
+	canary   uint64
+
+	tlsMods []*Object
+	tp      uint64
+
+	// guest calls made before the entry point, and the process state
+	// they run on
+	calls    []guestCall
+	pending  func(ret uint64) error
+	started  bool
+	sp       uint64
+	initArgs []uint64
+	entry    uint64
+}
+
+// Link links the executable that was loaded from exe and makes the
+// process start through the linker. Libraries are searched in paths
+// before the default directories of the guest filesystem.
+func Link(u models.Usercorn, exe io.ReaderAt, paths []string) (*Linker, error) {
+	arch, ok := arches[u.Arch().Name]
+	if !ok {
+		return nil, errors.Errorf("built-in linker does not support %s", u.Arch().Name)
+	}
+	l := &Linker{
+		u:        u,
+		arch:     arch,
+		order:    u.ByteOrder(),
+		ptr:      uint64(u.Bits() / 8),
+		paths:    paths,
+		defaults: DefaultDirs(u.Arch().Name),
+		builtins: make(map[string]uint64),
+		entry:    u.Entry(),
+	}
+	if data, err := readFile(u.Fs(), ldcache.CachePath); err == nil {
+		// a broken cache only makes the search slower
+		l.cache, _ = ldcache.Parse(data, l.order)
+	}
+	file, err := elf.NewFile(exe)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse executable")
+	}
+	// the guest path, $ORIGIN names a guest directory
+	main, err := l.newObject(u.Exe(), u.Exe(), file)
+	if err != nil {
+		return nil, err
+	}
+	main.Base = u.Base()
+	l.Objects = append(l.Objects, main)
+	if err := l.loadNeeded(); err != nil {
+		return nil, err
+	}
+	if err := l.mapStubs(); err != nil {
+		return nil, err
+	}
+	if err := l.setupTLS(); err != nil {
+		return nil, err
+	}
+	// relocate dependencies first, so copy relocations in the
+	// executable see relocated data
+	for i := len(l.Objects) - 1; i >= 0; i-- {
+		if err := l.relocate(l.Objects[i]); err != nil {
+			return nil, errors.Wrapf(err, "failed to relocate %s", l.Objects[i].Name)
+		}
+	}
+	if err := l.queueInit(); err != nil {
+		return nil, err
+	}
+	u.SetEntry(l.stubAddr(stubStart))
+	return l, nil
+}
+
+// Lookup returns the address a symbol resolves to in the global scope.
+func (l *Linker) Lookup(name string) (uint64, bool) {
+	for _, o := range l.Objects {
+		if i, ok := o.exports[name]; ok {
+			return o.Base + o.syms[i].Value, true
+		}
+	}
+	addr, ok := l.builtins[name]
+	return addr, ok
+}
+
+// Symbols returns the dynamic symbols of every object at their load
+// address.
+func (l *Linker) Symbols() []loader.Symbol {
+	var symbols []loader.Symbol
+	for _, o := range l.Objects {
+		for _, s := range o.syms {
+			if s.Section == elf.SHN_UNDEF || elf.ST_TYPE(s.Info) == elf.STT_TLS {
+				continue
+			}
+			symbols = append(symbols, loader.Symbol{
+				Name:    s.Name,
+				Start:   o.Base + s.Value,
+				End:     o.Base + s.Value + s.Size,
+				Dynamic: true,
+			})
+		}
+	}
+	return symbols
+}
+
+func (l *Linker) newObject(name, p string, file *elf.File) (*Object, error) {
+	o := &Object{Name: name, Path: p, file: file, dyn: make(map[elf.DynTag]uint64), exports: make(map[string]int)}
+	for _, prog := range file.Progs {
+		switch prog.Type {
+		case elf.PT_DYNAMIC:
+			data, err := ioutil.ReadAll(prog.Open())
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read dynamic section of %s", name)
+			}
+			o.parseDynamic(data, file.Class, file.ByteOrder)
+		case elf.PT_TLS:
+			o.tls = prog
+		}
+	}
+	// a binary without dynamic symbols has nothing to link
+	o.syms, _ = file.DynamicSymbols()
+	o.needed, _ = file.ImportedLibraries()
+	for i, s := range o.syms {
+		bind := elf.ST_BIND(s.Info)
+		vis := elf.ST_VISIBILITY(s.Other)
+		if s.Section == elf.SHN_UNDEF || bind == elf.STB_LOCAL || vis == elf.STV_HIDDEN || vis == elf.STV_INTERNAL {
+			continue
+		}
+		if _, ok := o.exports[s.Name]; !ok {
+			o.exports[s.Name] = i
+		}
+	}
+	return o, nil
+}
+
+// parseDynamic keeps the first value of every tag in the dynamic section.
+func (o *Object) parseDynamic(data []byte, class elf.Class, order binary.ByteOrder) {
+	size := 8
+	if class == elf.ELFCLASS64 {
+		size = 16
+	}
+	for ; len(data) >= size; data = data[size:] {
+		var tag elf.DynTag
+		var val uint64
+		if size == 16 {
+			tag, val = elf.DynTag(order.Uint64(data)), order.Uint64(data[8:])
+		} else {
+			tag, val = elf.DynTag(int32(order.Uint32(data))), uint64(order.Uint32(data[4:]))
+		}
+		if tag == elf.DT_NULL {
+			break
+		}
+		if _, ok := o.dyn[tag]; !ok {
+			o.dyn[tag] = val
+		}
+	}
+}
+
+// candidates returns the paths to look for a dependency of o at, in the
+// order ld.so tries them.
+func (l *Linker) candidates(o *Object, name string) []string {
+	if strings.Contains(name, "/") {
+		return []string{name}
+	}
+	var dirs []string
+	origin := path.Dir(o.Path)
+	// DT_RPATH is ignored if there is a DT_RUNPATH
+	tag := elf.DT_RUNPATH
+	if _, ok := o.dyn[tag]; !ok {
+		tag = elf.DT_RPATH
+	}
+	if list, err := o.file.DynString(tag); err == nil {
+		for _, entry := range list {
+			for _, dir := range strings.Split(entry, ":") {
+				if dir != "" {
+					dirs = append(dirs, loader.ExpandOrigin(dir, origin))
+				}
+			}
+		}
+	}
+	var paths []string
+	for _, dir := range append(dirs, l.paths...) {
+		paths = append(paths, path.Join(dir, name))
+	}
+	for _, e := range l.cache {
+		if e.Soname == name {
+			paths = append(paths, e.Path)
+		}
+	}
+	for _, dir := range l.defaults {
+		paths = append(paths, path.Join(dir, name))
+	}
+	return paths
+}
+
+// loadNeeded loads the dependencies of every object breadth first, which
+// is the symbol lookup order ld.so uses as well.
+func (l *Linker) loadNeeded() error {
+	loaded := make(map[string]*Object)
+	for i := 0; i < len(l.Objects); i++ {
+		o := l.Objects[i]
+		for _, name := range o.needed {
+			dep, ok := loaded[name]
+			if !ok {
+				var err error
+				if dep, err = l.load(name, l.candidates(o, name)); err != nil {
+					return errors.Wrapf(err, "%s needed by %s", name, o.Name)
+				}
+				loaded[name] = dep
+				l.Objects = append(l.Objects, dep)
+			}
+			o.deps = append(o.deps, dep)
+		}
+	}
+	return nil
+}
+
+func readFile(fs *vfs.Filesystem, name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// load maps the first library among candidates that fits the process.
+func (l *Linker) load(name string, candidates []string) (*Object, error) {
+	for _, p := range candidates {
+		data, err := readFile(l.u.Fs(), p)
+		if err != nil {
+			continue
+		}
+		r := bytes.NewReader(data)
+		file, err := elf.NewFile(r)
+		if err != nil || file.Type != elf.ET_DYN || loader.MachineName(file.Machine) != l.u.Arch().Name {
+			// wrong architecture, keep looking like ld.so does
+			continue
+		}
+		o, err := l.newObject(name, p, file)
+		if err != nil {
+			return nil, err
+		}
+		return o, l.mapObject(o, r)
+	}
+	return nil, errors.New("library not found")
+}
+
+// progProt converts segment flags to memory protection.
+func progProt(flags elf.ProgFlag) int {
+	var prot int
+	if flags&elf.PF_R != 0 {
+		prot |= cpu.PROT_READ
+	}
+	if flags&elf.PF_W != 0 {
+		prot |= cpu.PROT_WRITE
+	}
+	if flags&elf.PF_X != 0 {
+		prot |= cpu.PROT_EXEC
+	}
+	return prot
+}
+
+// mapObject maps the loadable segments of a library at a free address.
+func (l *Linker) mapObject(o *Object, r io.ReaderAt) error {
+	low, high := ^uint64(0), uint64(0)
+	var loads []*elf.Prog
+	for _, prog := range o.file.Progs {
+		if prog.Type != elf.PT_LOAD || prog.Memsz == 0 {
+			continue
+		}
+		loads = append(loads, prog)
+		if prog.Vaddr < low {
+			low = prog.Vaddr
+		}
+		if end := prog.Vaddr + prog.Memsz; end > high {
+			high = end
+		}
+	}
+	if len(loads) == 0 {
+		return errors.New("no loadable segments")
+	}
+	low &^= pageSize - 1
+	page, err := l.u.MemReserve(0, high-low, false)
+	if err != nil {
+		return err
+	}
+	o.Base = page.Addr - low
+	// map every segment before writing any, neighbours can share a page
+	for _, prog := range loads {
+		desc := &cpu.FileDesc{Name: o.Path, Off: prog.Off, Len: prog.Filesz}
+		if _, err := l.u.Mmap(o.Base+prog.Vaddr, prog.Memsz, progProt(prog.Flags), true, path.Base(o.Path), desc); err != nil {
+			return err
+		}
+	}
+	for _, prog := range loads {
+		data := make([]byte, prog.Filesz)
+		if _, err := r.ReadAt(data, int64(prog.Off)); err != nil {
+			return errors.Wrap(err, "failed to read segment")
+		}
+		if err := l.u.GetCPU().MemWrite(o.Base+prog.Vaddr, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const pageSize = 0x1000
+
+func (l *Linker) readWord(addr uint64, size uint64) (uint64, error) {
+	buf := make([]byte, size)
+	if err := l.u.GetCPU().MemReadInto(buf, addr); err != nil {
+		return 0, err
+	}
+	if size == 4 {
+		return uint64(l.order.Uint32(buf)), nil
+	}
+	return l.order.Uint64(buf), nil
+}
+
+func (l *Linker) writeWord(addr uint64, size uint64, val uint64) error {
+	buf := make([]byte, size)
+	if size == 4 {
+		l.order.PutUint32(buf, uint32(val))
+	} else {
+		l.order.PutUint64(buf, val)
+	}
+	return l.u.GetCPU().MemWrite(addr, buf)
+}
+
+func (l *Linker) readPtr(addr uint64) (uint64, error) {
+	return l.readWord(addr, l.ptr)
+}
+
+func (l *Linker) writePtr(addr, val uint64) error {
+	return l.writeWord(addr, l.ptr, val)
+}
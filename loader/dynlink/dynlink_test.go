@@ -0,0 +1,63 @@
+package dynlink
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"testing"
+)
+
+func TestDecodeRela64(t *testing.T) {
+	le := binary.LittleEndian
+	data := make([]byte, 48)
+	le.PutUint64(data, 0x1000)
+	le.PutUint64(data[8:], 3<<32|uint64(elf.R_X86_64_GLOB_DAT))
+	le.PutUint64(data[16:], 8)
+	le.PutUint64(data[24:], 0x2000)
+	le.PutUint64(data[32:], uint64(elf.R_X86_64_RELATIVE))
+	le.PutUint64(data[40:], ^uint64(0))
+	relocs := decodeRelocs(data, elf.ELFCLASS64, le, true)
+	want := []reloc{
+		{off: 0x1000, typ: uint32(elf.R_X86_64_GLOB_DAT), sym: 3, addend: 8, rela: true},
+		{off: 0x2000, typ: uint32(elf.R_X86_64_RELATIVE), addend: ^uint64(0), rela: true},
+	}
+	if len(relocs) != len(want) || relocs[0] != want[0] || relocs[1] != want[1] {
+		t.Fatalf("wrong relocations: %+v", relocs)
+	}
+}
+
+func TestDecodeRel32(t *testing.T) {
+	le := binary.LittleEndian
+	data := make([]byte, 8)
+	le.PutUint32(data, 0x804a00c)
+	le.PutUint32(data[4:], 5<<8|uint32(elf.R_386_JMP_SLOT))
+	relocs := decodeRelocs(data, elf.ELFCLASS32, le, false)
+	want := reloc{off: 0x804a00c, typ: uint32(elf.R_386_JMP_SLOT), sym: 5}
+	if len(relocs) != 1 || relocs[0] != want {
+		t.Fatalf("wrong relocations: %+v", relocs)
+	}
+}
+
+func TestParseDynamic(t *testing.T) {
+	le := binary.LittleEndian
+	var data []byte
+	for _, d := range [][2]uint64{
+		{uint64(elf.DT_NEEDED), 1},
+		{uint64(elf.DT_NEEDED), 9},
+		{uint64(elf.DT_INIT_ARRAY), 0x3000},
+		{uint64(elf.DT_NULL), 0},
+		{uint64(elf.DT_INIT), 0x4000},
+	} {
+		var buf [16]byte
+		le.PutUint64(buf[:], d[0])
+		le.PutUint64(buf[8:], d[1])
+		data = append(data, buf[:]...)
+	}
+	o := &Object{dyn: make(map[elf.DynTag]uint64)}
+	o.parseDynamic(data, elf.ELFCLASS64, le)
+	if o.dyn[elf.DT_NEEDED] != 1 || o.dyn[elf.DT_INIT_ARRAY] != 0x3000 {
+		t.Fatalf("wrong dynamic tags: %v", o.dyn)
+	}
+	if _, ok := o.dyn[elf.DT_INIT]; ok {
+		t.Fatal("read past DT_NULL")
+	}
+}
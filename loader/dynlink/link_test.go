@@ -0,0 +1,68 @@
+package dynlink
+
+import (
+	"os"
+	"testing"
+
+	"github.com/felberj/binemu/arch"
+	"github.com/felberj/binemu/loader"
+	"github.com/felberj/binemu/vfs"
+
+	usercorn "github.com/felberj/binemu"
+)
+
+// TestLink runs bins/dynlink/hello, which calls a function of a library it
+// finds through $ORIGIN and exits with a variable the library's
+// constructor sets, through a copy relocation.
+func TestLink(t *testing.T) {
+	const dir = "../../bins/dynlink/"
+	fs := vfs.New()
+	for host, guest := range map[string]string{"hello": "/app/hello", "lib/libgreet.so": "/app/lib/libgreet.so"} {
+		if err := fs.MapFile(dir+host, guest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := os.Open(dir + "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	l, err := loader.LoaderFor(f, "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, o, err := arch.GetArch(l.Arch(), "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := a.Cpu.NewWithOrder(l.ByteOrder())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := &usercorn.Capture{}
+	ex := &usercorn.ExecConfig{
+		Args:     []string{"/app/hello"},
+		Exe:      "/app/hello",
+		NoInterp: true,
+		Stdout:   stdout,
+	}
+	u := usercorn.NewUsercornWrapper(dir+"hello", usercorn.NewTask(c, a, o, l.ByteOrder()), fs, l, o, ex)
+	defer u.Close()
+	if err := u.LoadBinary(f); err != nil {
+		t.Fatal(err)
+	}
+	linker, err := Link(u, f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := linker.Objects[1].Path; got != "/app/lib/libgreet.so" {
+		t.Errorf("libgreet.so loaded from %q", got)
+	}
+	term := usercorn.Terminated(u.Run())
+	if term.Reason != usercorn.ReasonExit || term.Code != 42 {
+		t.Errorf("terminated with %+v, want exit 42", term)
+	}
+	if got := stdout.String(); got != "hello from libgreet\n" {
+		t.Errorf("stdout is %q", got)
+	}
+}
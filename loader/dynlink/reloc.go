@@ -0,0 +1,225 @@
+package dynlink
+
+import (
+	"debug/elf"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+type reloc struct {
+	off    uint64
+	typ    uint32
+	sym    uint32
+	addend uint64
+	rela   bool
+}
+
+// decodeRelocs decodes a REL or RELA table.
+func decodeRelocs(data []byte, class elf.Class, order binary.ByteOrder, rela bool) []reloc {
+	size := 8
+	if class == elf.ELFCLASS64 {
+		size = 16
+	}
+	if rela {
+		size += size / 2
+	}
+	var relocs []reloc
+	for ; len(data) >= size; data = data[size:] {
+		r := reloc{rela: rela}
+		if class == elf.ELFCLASS64 {
+			info := order.Uint64(data[8:])
+			r.off, r.sym, r.typ = order.Uint64(data), uint32(info>>32), uint32(info)
+			if rela {
+				r.addend = order.Uint64(data[16:])
+			}
+		} else {
+			info := order.Uint32(data[4:])
+			r.off, r.sym, r.typ = uint64(order.Uint32(data)), info>>8, info&0xff
+			if rela {
+				r.addend = uint64(int64(int32(order.Uint32(data[8:]))))
+			}
+		}
+		relocs = append(relocs, r)
+	}
+	return relocs
+}
+
+// relocs reads the relocation tables of a mapped object.
+func (l *Linker) relocs(o *Object) ([]reloc, error) {
+	tables := []struct {
+		addr, size elf.DynTag
+		rela       bool
+	}{
+		{elf.DT_RELA, elf.DT_RELASZ, true},
+		{elf.DT_REL, elf.DT_RELSZ, false},
+		{elf.DT_JMPREL, elf.DT_PLTRELSZ, o.dyn[elf.DT_PLTREL] == uint64(elf.DT_RELA)},
+	}
+	var relocs []reloc
+	for _, t := range tables {
+		addr, ok := o.dyn[t.addr]
+		if !ok || o.dyn[t.size] == 0 {
+			continue
+		}
+		data, err := l.u.GetCPU().MemRead(o.Base+addr, o.dyn[t.size])
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read relocations")
+		}
+		relocs = append(relocs, decodeRelocs(data, o.file.Class, l.order, t.rela)...)
+	}
+	return relocs, nil
+}
+
+// binding is what a symbol reference resolved to.
+type binding struct {
+	obj   *Object // nil for builtins and missing weak symbols
+	value uint64  // address, or offset in the TLS block for TLS symbols
+	size  uint64
+	ifunc bool
+}
+
+func bind(o *Object, s elf.Symbol) binding {
+	b := binding{obj: o, value: o.Base + s.Value, size: s.Size}
+	switch {
+	case elf.ST_TYPE(s.Info) == elf.STT_TLS:
+		b.value = s.Value
+	case s.Section == elf.SHN_ABS:
+		b.value = s.Value
+	}
+	// STT_GNU_IFUNC
+	b.ifunc = elf.ST_TYPE(s.Info) == elf.STT_LOOS
+	return b
+}
+
+// lookup resolves symbol idx of o in the global scope. Copy relocations
+// skip the executable, which holds the copy.
+func (l *Linker) lookup(o *Object, idx uint32, kind int) (binding, error) {
+	if idx == 0 {
+		return binding{obj: o}, nil
+	}
+	if int(idx) > len(o.syms) {
+		return binding{}, errors.Errorf("bad symbol index %d", idx)
+	}
+	s := o.syms[idx-1]
+	if s.Section != elf.SHN_UNDEF && elf.ST_BIND(s.Info) == elf.STB_LOCAL {
+		return bind(o, s), nil
+	}
+	for _, def := range l.Objects {
+		if kind == relCopy && def == o {
+			continue
+		}
+		if i, ok := def.exports[s.Name]; ok {
+			return bind(def, def.syms[i]), nil
+		}
+	}
+	if addr, ok := l.builtins[s.Name]; ok {
+		return binding{value: addr}, nil
+	}
+	switch {
+	case elf.ST_BIND(s.Info) == elf.STB_WEAK:
+		return binding{}, nil
+	case elf.ST_TYPE(s.Info) == elf.STT_FUNC && kind != relCopy:
+		// calls to missing functions only fail once they are made
+		addr, err := l.missingStub(s.Name)
+		return binding{value: addr}, err
+	}
+	return binding{}, errors.Errorf("undefined symbol %s", s.Name)
+}
+
+// relocate applies the relocations of a mapped object. Relocations that
+// need a resolver to run in the guest are queued.
+func (l *Linker) relocate(o *Object) error {
+	relocs, err := l.relocs(o)
+	if err != nil {
+		return err
+	}
+	for _, r := range relocs {
+		kind, ok := l.arch.relocs[r.typ]
+		if !ok {
+			return errors.Errorf("unsupported relocation type %d", r.typ)
+		}
+		if kind == relNone {
+			continue
+		}
+		target := o.Base + r.off
+		size := l.ptr
+		if kind == relPC32 {
+			size = 4
+		}
+		addend := r.addend
+		if !r.rela && kind != relCopy && kind != relTLSDesc {
+			if addend, err = l.readWord(target, size); err != nil {
+				return err
+			}
+			if size == 4 {
+				addend = uint64(int64(int32(addend)))
+			}
+		}
+		var b binding
+		if kind != relRelative && kind != relIRelative {
+			if b, err = l.lookup(o, r.sym, kind); err != nil {
+				return err
+			}
+		}
+		var val uint64
+		switch kind {
+		case relAbs, relSym:
+			if kind == relSym {
+				addend = 0
+			}
+			if b.ifunc {
+				l.queueResolver(target, size, b.value, addend)
+				continue
+			}
+			val = b.value + addend
+		case relPC32:
+			val = b.value + addend - target
+		case relRelative:
+			val = o.Base + addend
+		case relIRelative:
+			l.queueResolver(target, size, o.Base+addend, 0)
+			continue
+		case relCopy:
+			if b.obj == nil {
+				return errors.Errorf("copy relocation of undefined symbol %d", r.sym)
+			}
+			data, err := l.u.GetCPU().MemRead(b.value, o.syms[r.sym-1].Size)
+			if err != nil {
+				return err
+			}
+			if err := l.u.GetCPU().MemWrite(target, data); err != nil {
+				return err
+			}
+			continue
+		case relDTPMod, relDTPOff, relTPOff, relTPOffNeg, relTLSDesc:
+			if b.obj == nil || b.obj.tls == nil {
+				return errors.Errorf("TLS relocation of symbol %d without TLS segment", r.sym)
+			}
+			tpoff := b.value + addend + b.obj.tlsOffset
+			if l.arch.tlsVariant == 2 {
+				tpoff = b.value + addend - b.obj.tlsOffset
+			}
+			switch kind {
+			case relDTPMod:
+				val = b.obj.tlsModule
+			case relDTPOff:
+				val = b.value + addend
+			case relTPOff:
+				val = tpoff
+			case relTPOffNeg:
+				val = -tpoff
+			case relTLSDesc:
+				// the descriptor is a function and its argument
+				if err := l.writePtr(target, l.stubAddr(stubTLSDesc)); err != nil {
+					return err
+				}
+				target += l.ptr
+				val = tpoff
+			}
+		}
+		if err := l.writeWord(target, size, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package dynlink
+
+import (
+	"debug/elf"
+
+	"github.com/pkg/errors"
+
+	"github.com/felberj/binemu/cpu"
+)
+
+// The stub page holds the code the linker routes guest control flow
+// through. Every slot is stubAlign bytes.
+const (
+	stubSize  = 0x10000
+	stubAlign = 16
+)
+
+const (
+	// the process starts here and guest calls made by the linker
+	// return here
+	stubStart = iota
+	stubTLSGetAddr
+	stubTLSDesc
+	// functions no library defines
+	stubMissing
+)
+
+// offsets in the data page of the variables the linker defines
+const (
+	dataCanary  = 0x0
+	dataSecure  = 0x8
+	dataScratch = 0x100
+)
+
+// guestCall is a function the linker calls before the entry point.
+type guestCall struct {
+	fn   uint64
+	init bool // called with argc, argv and envp
+	done func(ret uint64) error
+}
+
+func (l *Linker) stubAddr(i int) uint64 {
+	return l.stub + uint64(i*stubAlign)
+}
+
+// mapStubs maps the stub page and the variables the linker defines.
+func (l *Linker) mapStubs() error {
+	u := l.u
+	var err error
+	if l.stub, err = u.Mmap(0, stubSize, cpu.PROT_READ|cpu.PROT_EXEC, false, "[ld]", nil); err != nil {
+		return err
+	}
+	if l.data, err = u.Malloc(pageSize, "[ld data]"); err != nil {
+		return err
+	}
+	mem := u.GetCPU()
+	for i := 0; i < stubMissing; i++ {
+		code := l.arch.ret
+		if i == stubTLSDesc && l.arch.tlsdesc != nil {
+			code = l.arch.tlsdesc
+		}
+		if err := mem.MemWrite(l.stubAddr(i), code); err != nil {
+			return err
+		}
+	}
+	// glibc keeps a zero byte in the canary to stop string overflows
+	l.canary = uint64(u.Rand().Int63()) &^ 0xff
+	if err := l.writePtr(l.data+dataCanary, l.canary); err != nil {
+		return err
+	}
+	for _, name := range l.arch.getAddrs {
+		l.builtins[name] = l.stubAddr(stubTLSGetAddr)
+	}
+	l.builtins["__stack_chk_guard"] = l.data + dataCanary
+	l.builtins["__libc_enable_secure"] = l.data + dataSecure
+
+	_, err = mem.HookCode(func(addr uint64, size uint32) {
+		if (addr-l.stub)%stubAlign != 0 {
+			return
+		}
+		var err error
+		switch i := int(addr-l.stub) / stubAlign; {
+		case i == stubStart:
+			err = l.next()
+		case i == stubTLSGetAddr:
+			err = l.tlsGetAddr()
+		case i >= stubMissing && i-stubMissing < len(l.missing):
+			err = errors.Errorf("call to undefined function %s", l.missing[i-stubMissing])
+		}
+		if err != nil {
+			u.Exit(err)
+		}
+	}, l.stub, l.stub+stubSize-1)
+	return errors.Wrap(err, "u.HookAdd() failed")
+}
+
+// missingStub returns a stub that stops the process when it is called.
+func (l *Linker) missingStub(name string) (uint64, error) {
+	for i, n := range l.missing {
+		if n == name {
+			return l.stubAddr(stubMissing + i), nil
+		}
+	}
+	i := stubMissing + len(l.missing)
+	if i >= stubSize/stubAlign {
+		return 0, errors.New("too many undefined functions")
+	}
+	l.missing = append(l.missing, name)
+	return l.stubAddr(i), l.u.GetCPU().MemWrite(l.stubAddr(i), l.arch.ret)
+}
+
+// queueResolver calls an ifunc resolver in the guest and stores the
+// function it returns, plus addend, at target.
+func (l *Linker) queueResolver(target, size, resolver, addend uint64) {
+	l.calls = append(l.calls, guestCall{fn: resolver, done: func(ret uint64) error {
+		return l.writeWord(target, size, ret+addend)
+	}})
+}
+
+// queueInit queues the initializers of the libraries, dependencies first.
+// The executable runs its own initializers from its libc start code, only
+// its preinit array is up to the linker.
+func (l *Linker) queueInit() error {
+	main := l.Objects[0]
+	if err := l.queueArray(main, elf.DT_PREINIT_ARRAY, elf.DT_PREINIT_ARRAYSZ); err != nil {
+		return err
+	}
+	seen := map[*Object]bool{main: true}
+	var visit func(o *Object) error
+	visit = func(o *Object) error {
+		for _, dep := range o.deps {
+			if seen[dep] {
+				continue
+			}
+			seen[dep] = true
+			if err := visit(dep); err != nil {
+				return err
+			}
+			if init, ok := dep.dyn[elf.DT_INIT]; ok && init != 0 {
+				l.calls = append(l.calls, guestCall{fn: dep.Base + init, init: true})
+			}
+			if err := l.queueArray(dep, elf.DT_INIT_ARRAY, elf.DT_INIT_ARRAYSZ); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return visit(main)
+}
+
+// queueArray queues the functions of an init array, which hold relocated
+// addresses by now.
+func (l *Linker) queueArray(o *Object, tag, sizeTag elf.DynTag) error {
+	addr, ok := o.dyn[tag]
+	if !ok {
+		return nil
+	}
+	for off := uint64(0); off+l.ptr <= o.dyn[sizeTag]; off += l.ptr {
+		fn, err := l.readPtr(o.Base + addr + off)
+		if err != nil {
+			return err
+		}
+		// 0 and -1 are placeholders some toolchains leave behind
+		if fn != 0 && fn != ^uint64(0)>>(64-8*l.ptr) {
+			l.calls = append(l.calls, guestCall{fn: fn, init: true})
+		}
+	}
+	return nil
+}
+
+// next runs when the process starts and whenever a guest call returns.
+// It makes the next queued call, or jumps to the executable's entry point
+// with the initial stack once all of them returned.
+func (l *Linker) next() error {
+	u := l.u
+	sp := u.Arch().SP
+	if !l.started {
+		l.started = true
+		var err error
+		if l.sp, err = u.RegRead(sp); err != nil {
+			return err
+		}
+		if err := l.arch.setTP(u, l.data+dataScratch, l.tp); err != nil {
+			return errors.Wrap(err, "failed to set the thread pointer")
+		}
+		argc, err := l.readPtr(l.sp)
+		if err != nil {
+			return err
+		}
+		argv := l.sp + l.ptr
+		l.initArgs = []uint64{argc, argv, argv + (argc+1)*l.ptr}
+	} else if l.pending != nil {
+		ret, err := u.RegRead(l.arch.retReg)
+		if err != nil {
+			return err
+		}
+		if err := l.pending(ret); err != nil {
+			return err
+		}
+	}
+	if len(l.calls) == 0 {
+		l.pending = nil
+		u.RegWrite(sp, l.sp)
+		// no fini function to register with atexit
+		u.RegWrite(l.arch.fini, 0)
+		return u.RegWrite(u.Arch().PC, l.entry)
+	}
+	c := l.calls[0]
+	l.calls = l.calls[1:]
+	l.pending = c.done
+	var args []uint64
+	if c.init {
+		args = l.initArgs
+	}
+	return l.call(c.fn, args)
+}
+
+// call enters fn below the initial stack, returning to the start stub.
+func (l *Linker) call(fn uint64, args []uint64) error {
+	u := l.u
+	sp := (l.sp - 0x100) &^ 15
+	if l.arch.argRegs != nil {
+		for i, arg := range args {
+			if err := u.RegWrite(l.arch.argRegs[i], arg); err != nil {
+				return err
+			}
+		}
+	} else {
+		// keep the stack aligned at the call
+		n := uint64(len(args)) * l.ptr
+		sp -= n + (16-n%16)%16
+		for i, arg := range args {
+			if err := l.writePtr(sp+uint64(i)*l.ptr, arg); err != nil {
+				return err
+			}
+		}
+	}
+	ret := l.stubAddr(stubStart)
+	if l.arch.lr != 0 {
+		if err := u.RegWrite(l.arch.lr, ret); err != nil {
+			return err
+		}
+	} else {
+		sp -= l.ptr
+		if err := l.writePtr(sp, ret); err != nil {
+			return err
+		}
+	}
+	if err := u.RegWrite(u.Arch().SP, sp); err != nil {
+		return err
+	}
+	return u.RegWrite(u.Arch().PC, fn)
+}
+
+// tlsGetAddr implements __tls_get_addr, whose argument points to a module
+// id and an offset in its TLS block.
+func (l *Linker) tlsGetAddr() error {
+	ti, err := l.u.RegRead(l.arch.getArg)
+	if err != nil {
+		return err
+	}
+	module, err := l.readPtr(ti)
+	if err != nil {
+		return err
+	}
+	off, err := l.readPtr(ti + l.ptr)
+	if err != nil {
+		return err
+	}
+	if module == 0 || module > uint64(len(l.tlsMods)) {
+		return errors.Errorf("__tls_get_addr: bad TLS module %d", module)
+	}
+	return l.u.RegWrite(l.arch.retReg, l.tlsMods[module-1].tlsAddr+off)
+}
@@ -0,0 +1,100 @@
+package dynlink
+
+import (
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+func alignUp(n, align uint64) uint64 {
+	if align == 0 {
+		return n
+	}
+	return (n + align - 1) / align * align
+}
+
+// setupTLS lays out the TLS blocks of every object next to the thread
+// control block and copies their initialization images. The thread
+// pointer is set when the process starts.
+func (l *Linker) setupTLS() error {
+	for _, o := range l.Objects {
+		if o.tls != nil {
+			l.tlsMods = append(l.tlsMods, o)
+			o.tlsModule = uint64(len(l.tlsMods))
+		}
+	}
+	maxAlign := uint64(16)
+	for _, o := range l.tlsMods {
+		if o.tls.Align > maxAlign {
+			maxAlign = o.tls.Align
+		}
+	}
+	tcb := l.arch.tcbSize
+	if l.arch.tlsVariant == 2 {
+		// blocks sit below the thread pointer, the first one closest
+		var off uint64
+		for _, o := range l.tlsMods {
+			off = alignUp(off+o.tls.Memsz, o.tls.Align)
+			o.tlsOffset = off
+		}
+		mem, err := l.u.Malloc(off+maxAlign+tcb, "tls")
+		if err != nil {
+			return err
+		}
+		l.tp = alignUp(mem+off, maxAlign)
+		for _, o := range l.tlsMods {
+			o.tlsAddr = l.tp - o.tlsOffset
+		}
+	} else {
+		// blocks follow the two word thread control block, the libc
+		// thread descriptor sits below the thread pointer
+		off := 2 * l.ptr
+		for _, o := range l.tlsMods {
+			off = alignUp(off, o.tls.Align)
+			o.tlsOffset = off
+			off += o.tls.Memsz
+		}
+		mem, err := l.u.Malloc(tcb+off+maxAlign, "tls")
+		if err != nil {
+			return err
+		}
+		l.tp = alignUp(mem+tcb, maxAlign)
+		for _, o := range l.tlsMods {
+			o.tlsAddr = l.tp + o.tlsOffset
+		}
+	}
+	// the dtv starts with its generation, followed by a block per module
+	dtv, err := l.u.Malloc(uint64(len(l.tlsMods)+1)*l.ptr, "dtv")
+	if err != nil {
+		return err
+	}
+	if err := l.writePtr(dtv, 1); err != nil {
+		return err
+	}
+	for i, o := range l.tlsMods {
+		if err := l.writePtr(dtv+uint64(i+1)*l.ptr, o.tlsAddr); err != nil {
+			return err
+		}
+		image, err := ioutil.ReadAll(o.tls.Open())
+		if err != nil {
+			return errors.Wrapf(err, "failed to read TLS image of %s", o.Name)
+		}
+		if err := l.u.GetCPU().MemWrite(o.tlsAddr, image); err != nil {
+			return err
+		}
+	}
+	if l.arch.tlsVariant == 2 {
+		// tcbhead_t starts with pointers to itself and the dtv
+		for i, val := range []uint64{l.tp, dtv, l.tp} {
+			if err := l.writePtr(l.tp+uint64(i)*l.ptr, val); err != nil {
+				return err
+			}
+		}
+	} else if err := l.writePtr(l.tp, dtv); err != nil {
+		return err
+	}
+	if l.arch.canary != 0 {
+		return l.writePtr(l.tp+l.arch.canary, l.canary)
+	}
+	return nil
+}
@@ -23,6 +23,12 @@ var machineMap = map[elf.Machine]string{
 	elf.EM_X86_64:  "x86_64",
 }
 
+// MachineName returns the arch name of an ELF machine, or "" if it is
+// not supported.
+func MachineName(m elf.Machine) string {
+	return machineMap[m]
+}
+
 type ElfLoader struct {
 	LoaderBase
 	file *elf.File
@@ -50,9 +56,12 @@ func NewElfLoader(r io.ReaderAt, arch string, osHint string) (Loader, error) {
 	if !ok {
 		return nil, errors.Errorf("Unsupported machine: %s", file.Machine)
 	}
-	os := "linux"
-	if osHint != NoOSHint {
-		os = osHint
+	os := elfOS(file)
+	if os == "" {
+		os = "linux"
+		if osHint != NoOSHint {
+			os = osHint
+		}
 	}
 	l := &ElfLoader{
 		LoaderBase: LoaderBase{
@@ -90,6 +99,40 @@ func NewElfLoader(r io.ReaderAt, arch string, osHint string) (Loader, error) {
 	return l, nil
 }
 
+// elfOS returns the OS the binary identifies itself as, if any. Most
+// toolchains leave EI_OSABI alone, FreeBSD also marks binaries with a
+// .note.tag section.
+func elfOS(file *elf.File) string {
+	if file.OSABI == elf.ELFOSABI_FREEBSD {
+		return "freebsd"
+	}
+	if sec := file.Section(".note.tag"); sec != nil {
+		data, err := sec.Data()
+		if err == nil && elfNoteOwner(data, file.ByteOrder, "FreeBSD") {
+			return "freebsd"
+		}
+	}
+	return ""
+}
+
+// elfNoteOwner reports whether any note in data has the given owner name.
+func elfNoteOwner(data []byte, order binary.ByteOrder, owner string) bool {
+	// in uint64, sizes near 4G cannot wrap around
+	align := func(n uint32) uint64 { return (uint64(n) + 3) &^ 3 }
+	for len(data) >= 12 {
+		namesz, descsz := order.Uint32(data), order.Uint32(data[4:])
+		data = data[12:]
+		if align(namesz)+align(descsz) > uint64(len(data)) {
+			break
+		}
+		if strings.TrimRight(string(data[:namesz]), "\x00") == owner {
+			return true
+		}
+		data = data[align(namesz)+align(descsz):]
+	}
+	return false
+}
+
 func (e *ElfLoader) Interp() string {
 	for _, prog := range e.file.Progs {
 		if prog.Type == elf.PT_INTERP {
@@ -100,6 +143,36 @@ func (e *ElfLoader) Interp() string {
 	return ""
 }
 
+// Needed returns the libraries the binary names in DT_NEEDED.
+func (e *ElfLoader) Needed() ([]string, error) {
+	return e.file.ImportedLibraries()
+}
+
+// SearchPath returns the directories in DT_RUNPATH, or in DT_RPATH if
+// there is no DT_RUNPATH. $ORIGIN is left for the caller to expand.
+func (e *ElfLoader) SearchPath() []string {
+	list, err := e.file.DynString(elf.DT_RUNPATH)
+	if err != nil || len(list) == 0 {
+		list, _ = e.file.DynString(elf.DT_RPATH)
+	}
+	var dirs []string
+	for _, entry := range list {
+		for _, dir := range strings.Split(entry, ":") {
+			if dir != "" {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	return dirs
+}
+
+// ExpandOrigin substitutes the directory of the object for $ORIGIN in a
+// search path entry.
+func ExpandOrigin(dir, origin string) string {
+	dir = strings.Replace(dir, "${ORIGIN}", origin, -1)
+	return strings.Replace(dir, "$ORIGIN", origin, -1)
+}
+
 func (e *ElfLoader) Header() (uint64, []byte, int) {
 	return e.phoff, e.phdr, e.phnum
 }
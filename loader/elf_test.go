@@ -2,6 +2,7 @@ package loader
 
 import (
 	"bytes"
+	"encoding/binary"
 	"io"
 	"io/ioutil"
 	"testing"
@@ -48,3 +49,43 @@ func TestElfSegments(t *testing.T) {
 		t.Fatal("No segments found.")
 	}
 }
+
+func TestElfOS(t *testing.T) {
+	elf, err := NewElfLoader(elfFile, "any", NoOSHint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elf.OS() != "linux" {
+		t.Fatalf("wrong os: %s", elf.OS())
+	}
+	elf, err = NewElfLoader(elfFile, "any", "darwin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elf.OS() != "darwin" {
+		t.Fatalf("os hint ignored: %s", elf.OS())
+	}
+}
+
+func TestElfNoteOwner(t *testing.T) {
+	// the NT_FREEBSD_ABI_TAG note of a FreeBSD 12 binary
+	note := []byte{
+		8, 0, 0, 0, 4, 0, 0, 0, 1, 0, 0, 0,
+		'F', 'r', 'e', 'e', 'B', 'S', 'D', 0,
+		0x50, 0x57, 0x12, 0,
+	}
+	if !elfNoteOwner(note, binary.LittleEndian, "FreeBSD") {
+		t.Fatal("FreeBSD note not found")
+	}
+	if elfNoteOwner(note, binary.LittleEndian, "GNU") {
+		t.Fatal("found wrong note owner")
+	}
+	if elfNoteOwner(note[:20], binary.LittleEndian, "FreeBSD") {
+		t.Fatal("truncated note accepted")
+	}
+	// a name size whose alignment wraps around in 32 bits
+	huge := append([]byte{0xfd, 0xff, 0xff, 0xff, 4, 0, 0, 0, 1, 0, 0, 0}, note[12:]...)
+	if elfNoteOwner(huge, binary.LittleEndian, "FreeBSD") {
+		t.Fatal("oversized note accepted")
+	}
+}
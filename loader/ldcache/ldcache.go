@@ -0,0 +1,266 @@
+// Package ldcache builds the /etc/ld.so.cache and /etc/ld.so.conf files
+// ldconfig would generate for a set of libraries, so the guest's ld.so
+// finds them by SONAME.
+package ldcache
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/felberj/binemu/vfs"
+	"github.com/pkg/errors"
+)
+
+// Paths of the generated files
+const (
+	CachePath = "/etc/ld.so.cache"
+	ConfPath  = "/etc/ld.so.conf"
+)
+
+// glibc's format since 2.32, older versions read it as well
+const (
+	magic      = "glibc-ld.so.cache1.1"
+	headerSize = 48
+	entrySize  = 24
+)
+
+// entry flags, from glibc's ldconfig.h
+const (
+	flagElfLibc6     = 0x0003
+	flagX8664Lib64   = 0x0300
+	flagPowerPCLib64 = 0x0500
+	flagArmLibHF     = 0x0900
+	flagAarch64Lib64 = 0x0a00
+	flagArmLibSF     = 0x0b00
+
+	efArmABIFloatHard = 0x400
+)
+
+// header flags telling the byte order of the cache
+const (
+	endianLittle = 2
+	endianBig    = 3
+)
+
+// Entry maps a SONAME to the path of a library.
+type Entry struct {
+	Soname string
+	Path   string
+	Flags  int32
+}
+
+// entryFlags returns the cache flags of a library, which ld.so checks
+// against its own ABI.
+func entryFlags(f *elf.File, data []byte) int32 {
+	flags := int32(flagElfLibc6)
+	switch f.Machine {
+	case elf.EM_X86_64:
+		if f.Class == elf.ELFCLASS64 {
+			flags |= flagX8664Lib64
+		}
+	case elf.EM_AARCH64:
+		flags |= flagAarch64Lib64
+	case elf.EM_PPC64:
+		flags |= flagPowerPCLib64
+	case elf.EM_ARM:
+		// e_flags of a 32 bit header
+		if len(data) >= 40 && f.ByteOrder.Uint32(data[36:])&efArmABIFloatHard != 0 {
+			flags |= flagArmLibHF
+		} else {
+			flags |= flagArmLibSF
+		}
+	}
+	return flags
+}
+
+// Scan reads the SONAME of every shared object among paths. Other files
+// are skipped.
+func Scan(fs *vfs.Filesystem, paths []string) ([]Entry, error) {
+	var entries []Entry
+	for _, p := range paths {
+		f, err := fs.Open(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to open %q", p)
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read %q", p)
+		}
+		file, err := elf.NewFile(bytes.NewReader(data))
+		if err != nil || file.Type != elf.ET_DYN {
+			continue
+		}
+		soname, err := file.DynString(elf.DT_SONAME)
+		if err != nil || len(soname) == 0 {
+			continue
+		}
+		entries = append(entries, Entry{Soname: soname[0], Path: p, Flags: entryFlags(file, data)})
+	}
+	return entries, nil
+}
+
+// libcmp orders names like ld.so does, comparing runs of digits by value.
+func libcmp(a, b string) int {
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+	i, j := 0, 0
+	for i < len(a) {
+		switch {
+		case isDigit(a[i]) && j < len(b) && isDigit(b[j]):
+			var v1, v2 int
+			for ; i < len(a) && isDigit(a[i]); i++ {
+				v1 = v1*10 + int(a[i]-'0')
+			}
+			for ; j < len(b) && isDigit(b[j]); j++ {
+				v2 = v2*10 + int(b[j]-'0')
+			}
+			if v1 != v2 {
+				return v1 - v2
+			}
+		case isDigit(a[i]):
+			return 1
+		case j < len(b) && isDigit(b[j]):
+			return -1
+		case j >= len(b):
+			return int(a[i])
+		case a[i] != b[j]:
+			return int(a[i]) - int(b[j])
+		default:
+			i++
+			j++
+		}
+	}
+	if j < len(b) {
+		return -int(b[j])
+	}
+	return 0
+}
+
+// Cache encodes entries as an ld.so.cache. ld.so binary searches the
+// entries, which ldconfig sorts in descending order.
+func Cache(entries []Entry, order binary.ByteOrder) []byte {
+	sorted := append([]Entry(nil), entries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return libcmp(sorted[i].Soname, sorted[j].Soname) > 0
+	})
+	// string offsets are relative to the start of the file
+	var strtab bytes.Buffer
+	strOff := uint32(headerSize + entrySize*len(sorted))
+	addString := func(s string) uint32 {
+		off := strOff + uint32(strtab.Len())
+		strtab.WriteString(s)
+		strtab.WriteByte(0)
+		return off
+	}
+	var libs bytes.Buffer
+	for _, e := range sorted {
+		var buf [entrySize]byte
+		order.PutUint32(buf[0:], uint32(e.Flags))
+		order.PutUint32(buf[4:], addString(e.Soname))
+		order.PutUint32(buf[8:], addString(e.Path))
+		// osversion and hwcap stay 0
+		libs.Write(buf[:])
+	}
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	order.PutUint32(header[20:], uint32(len(sorted)))
+	order.PutUint32(header[24:], uint32(strtab.Len()))
+	header[28] = endianLittle
+	if order == binary.BigEndian {
+		header[28] = endianBig
+	}
+	return append(append(header, libs.Bytes()...), strtab.Bytes()...)
+}
+
+// Parse decodes an ld.so.cache written by Cache or ldconfig.
+func Parse(data []byte, order binary.ByteOrder) ([]Entry, error) {
+	if len(data) < headerSize || string(data[:len(magic)]) != magic {
+		return nil, errors.New("not a new format ld.so.cache")
+	}
+	n := int(order.Uint32(data[20:]))
+	if n < 0 || headerSize+n*entrySize > len(data) {
+		return nil, errors.New("truncated ld.so.cache")
+	}
+	str := func(off uint32) (string, error) {
+		if int(off) >= len(data) {
+			return "", errors.New("bad string offset in ld.so.cache")
+		}
+		s := data[off:]
+		if i := bytes.IndexByte(s, 0); i >= 0 {
+			s = s[:i]
+		}
+		return string(s), nil
+	}
+	entries := make([]Entry, n)
+	for i := range entries {
+		e := data[headerSize+i*entrySize:]
+		var err error
+		entries[i].Flags = int32(order.Uint32(e))
+		if entries[i].Soname, err = str(order.Uint32(e[4:])); err != nil {
+			return nil, err
+		}
+		if entries[i].Path, err = str(order.Uint32(e[8:])); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// Conf lists the directories of entries, in the order they first appear.
+func Conf(entries []Entry) []byte {
+	var buf bytes.Buffer
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		dir := path.Dir(e.Path)
+		if !seen[dir] {
+			seen[dir] = true
+			buf.WriteString(dir + "\n")
+		}
+	}
+	return buf.Bytes()
+}
+
+// Generate writes ld.so.cache and ld.so.conf for the shared objects among
+// paths, unless the filesystem already has them.
+func Generate(fs *vfs.Filesystem, paths []string, order binary.ByteOrder) error {
+	entries, err := Scan(fs, paths)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	fs.Mkdir(path.Dir(CachePath), 0755)
+	for _, out := range []struct {
+		name string
+		data []byte
+	}{
+		{CachePath, Cache(entries, order)},
+		{ConfPath, Conf(entries)},
+	} {
+		if _, err := fs.Stat(out.name); err == nil {
+			continue
+		}
+		if err := writeFile(fs, out.name, out.data); err != nil {
+			return errors.Wrapf(err, "unable to write %q", out.name)
+		}
+	}
+	return nil
+}
+
+func writeFile(fs *vfs.Filesystem, name string, data []byte) error {
+	f, err := fs.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return fs.Chmod(name, os.FileMode(0644))
+}
@@ -0,0 +1,57 @@
+package ldcache
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestLibcmp(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		sign int
+	}{
+		{"libc.so.6", "libc.so.6", 0},
+		{"libfoo.so.10", "libfoo.so.9", 1},
+		{"liba.so", "libb.so", -1},
+		{"libc.so", "libc.so.6", -1},
+	} {
+		got := libcmp(c.a, c.b)
+		if (got > 0) != (c.sign > 0) || (got < 0) != (c.sign < 0) {
+			t.Errorf("libcmp(%q, %q) = %d", c.a, c.b, got)
+		}
+	}
+}
+
+func TestCacheRoundTrip(t *testing.T) {
+	entries := []Entry{
+		{"libc.so.6", "/lib/x86_64-linux-gnu/libc.so.6", flagElfLibc6 | flagX8664Lib64},
+		{"libm.so.6", "/lib/x86_64-linux-gnu/libm.so.6", flagElfLibc6 | flagX8664Lib64},
+		{"libz.so.1", "/usr/lib/libz.so.1", flagElfLibc6},
+	}
+	data := Cache(entries, binary.LittleEndian)
+	got, err := Parse(data, binary.LittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ld.so expects descending order
+	want := []Entry{entries[2], entries[1], entries[0]}
+	if len(got) != len(want) {
+		t.Fatalf("wrong entries: %+v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("entry %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestConf(t *testing.T) {
+	conf := Conf([]Entry{
+		{Path: "/lib/x86_64-linux-gnu/libc.so.6"},
+		{Path: "/usr/lib/libz.so.1"},
+		{Path: "/lib/x86_64-linux-gnu/libm.so.6"},
+	})
+	if want := "/lib/x86_64-linux-gnu\n/usr/lib\n"; string(conf) != want {
+		t.Fatalf("wrong ld.so.conf: %q", conf)
+	}
+}
@@ -8,14 +8,19 @@ import (
 	"github.com/pkg/errors"
 )
 
-// LoaderFor returns a loader for the file.
-func LoaderFor(r io.ReaderAt) (Loader, error) {
+// LoaderFor returns a loader for the file. osHint picks the OS of binaries
+// that don't say which one they are for, NoOSHint means linux.
+func LoaderFor(r io.ReaderAt, osHint string) (Loader, error) {
 	if MatchElf(r) {
-		return NewElfLoader(r, "REMOVE", "REMOVE")
+		return NewElfLoader(r, "REMOVE", osHint)
 	} else if MatchMachO(r) {
 		return NewMachOLoader(r, "REMOVE")
 	} else if MatchCgc(r) {
 		return NewCgcLoader(r, "REMOVE")
+	} else if MatchPE(r) {
+		return NewPELoader(r)
+	} else if MatchCom(r) {
+		return NewComLoader(r.(namer).Name())
 	} else {
 		return nil, errors.WithStack(UnknownMagic)
 	}
@@ -49,6 +54,8 @@ func LoadArch(r io.ReaderAt, arch string, osHint string) (Loader, error) {
 		return NewMachOLoader(r, arch)
 	} else if MatchCgc(r) {
 		return NewCgcLoader(r, arch)
+	} else if MatchPE(r) {
+		return NewPELoader(r)
 	} else {
 		return nil, errors.WithStack(UnknownMagic)
 	}
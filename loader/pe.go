@@ -0,0 +1,511 @@
+package loader
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var peMachineMap = map[uint16]string{
+	pe.IMAGE_FILE_MACHINE_I386:  "x86",
+	pe.IMAGE_FILE_MACHINE_AMD64: "x86_64",
+}
+
+// PE data directory indices
+const (
+	peDirExport    = 0
+	peDirImport    = 1
+	peDirBaseReloc = 5
+	peDirTLS       = 9
+)
+
+const (
+	peRelocsStripped   = 0x0001
+	peRelBasedAbsolute = 0
+	peRelBasedHighLow  = 3
+	peRelBasedDir64    = 10
+)
+
+// PEImport is a function or variable imported by name or ordinal. Addr is
+// the address of its import address table slot.
+type PEImport struct {
+	DLL     string
+	Name    string
+	Ordinal uint16
+	Addr    uint64
+}
+
+// PETLS is the TLS directory. All fields are virtual addresses.
+type PETLS struct {
+	Start, End uint64
+	Index      uint64
+	Callbacks  uint64
+	ZeroFill   uint32
+}
+
+type PELoader struct {
+	LoaderBase
+	file      *pe.File
+	r         io.ReaderAt
+	imageBase uint64
+	base      uint64
+	dirs      []pe.DataDirectory
+	hdrSize   uint32
+	imageSize uint32
+}
+
+var peMagic = []byte("PE\x00\x00")
+
+// MatchPE returns true if the file has a MZ header pointing to a PE header
+func MatchPE(r io.ReaderAt) bool {
+	var dos [0x40]byte
+	if _, err := r.ReadAt(dos[:], 0); err != nil || dos[0] != 'M' || dos[1] != 'Z' {
+		return false
+	}
+	var sig [4]byte
+	off := binary.LittleEndian.Uint32(dos[0x3c:])
+	if _, err := r.ReadAt(sig[:], int64(off)); err != nil {
+		return false
+	}
+	return bytes.Equal(sig[:], peMagic)
+}
+
+func NewPELoader(r io.ReaderAt) (*PELoader, error) {
+	file, err := pe.NewFile(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open PE file")
+	}
+	machineName, ok := peMachineMap[file.Machine]
+	if !ok {
+		return nil, errors.Errorf("Unsupported machine: %#x", file.Machine)
+	}
+	p := &PELoader{
+		LoaderBase: LoaderBase{
+			arch:      machineName,
+			os:        "windows",
+			byteOrder: binary.LittleEndian,
+		},
+		file: file,
+		r:    r,
+	}
+	var entry uint32
+	switch oh := file.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		p.bits = 32
+		p.imageBase = uint64(oh.ImageBase)
+		p.dirs = dataDirs(oh.DataDirectory[:], oh.NumberOfRvaAndSizes)
+		p.hdrSize, p.imageSize, entry = oh.SizeOfHeaders, oh.SizeOfImage, oh.AddressOfEntryPoint
+	case *pe.OptionalHeader64:
+		p.bits = 64
+		p.imageBase = oh.ImageBase
+		p.dirs = dataDirs(oh.DataDirectory[:], oh.NumberOfRvaAndSizes)
+		p.hdrSize, p.imageSize, entry = oh.SizeOfHeaders, oh.SizeOfImage, oh.AddressOfEntryPoint
+	default:
+		return nil, errors.New("missing optional header")
+	}
+	p.base = p.imageBase
+	p.entry = p.base + uint64(entry)
+	return p, nil
+}
+
+// dataDirs returns the n data directories the optional header declares,
+// of the 16 there is room for.
+func dataDirs(dirs []pe.DataDirectory, n uint32) []pe.DataDirectory {
+	if n < uint32(len(dirs)) {
+		return dirs[:n]
+	}
+	return dirs
+}
+
+// sectionSize returns the size of s in memory. Some linkers leave
+// VirtualSize zero, the section then takes the size of its data.
+func sectionSize(s *pe.Section) uint32 {
+	if s.VirtualSize == 0 {
+		return s.Size
+	}
+	return s.VirtualSize
+}
+
+// Rebase moves the image to base, applying the base relocations.
+func (p *PELoader) Rebase(base uint64) error {
+	if base != p.imageBase && p.file.Characteristics&peRelocsStripped != 0 {
+		return errors.New("relocations were stripped from the image")
+	}
+	p.entry = p.entry - p.base + base
+	p.base = base
+	p.symCache = nil
+	return nil
+}
+
+// ImageBase returns the address the image is loaded at.
+func (p *PELoader) ImageBase() uint64 {
+	return p.base
+}
+
+func (p *PELoader) dir(i int) (rva, size uint32) {
+	if i >= len(p.dirs) {
+		return 0, 0
+	}
+	return p.dirs[i].VirtualAddress, p.dirs[i].Size
+}
+
+// rvaSection returns the section rva is part of in memory, nil for the
+// headers, and how many bytes of it are left from rva on.
+func (p *PELoader) rvaSection(rva uint32) (*pe.Section, uint32, error) {
+	if rva < p.hdrSize {
+		return nil, p.hdrSize - rva, nil
+	}
+	for _, s := range p.file.Sections {
+		if rva >= s.VirtualAddress && rva-s.VirtualAddress < sectionSize(s) {
+			return s, sectionSize(s) - (rva - s.VirtualAddress), nil
+		}
+	}
+	return nil, 0, errors.Errorf("RVA %#x is not part of any section", rva)
+}
+
+// fileHas reports whether r holds n bytes at off, without reading them.
+func fileHas(r io.ReaderAt, off int64, n uint32) bool {
+	var last [1]byte
+	if n == 0 {
+		return true
+	}
+	_, err := r.ReadAt(last[:], off+int64(n)-1)
+	return err == nil
+}
+
+// readRVA reads size bytes at rva from the file. Bytes that are only
+// present in memory, like the tail of .bss, read as zero. They can't run
+// past the headers or the section rva is part of, or past the end of the
+// file.
+func (p *PELoader) readRVA(rva, size uint32) ([]byte, error) {
+	s, left, err := p.rvaSection(rva)
+	if err != nil {
+		return nil, err
+	}
+	if size > left {
+		return nil, errors.Errorf("%d bytes at RVA %#x run past the end of their section", size, rva)
+	}
+	var r io.ReaderAt = p.r
+	off, n := rva, size
+	if s != nil {
+		r, off = s, rva-s.VirtualAddress
+		if off >= s.Size {
+			n = 0
+		} else if n > s.Size-off {
+			n = s.Size - off
+		}
+	}
+	if !fileHas(r, int64(off), n) {
+		return nil, errors.Errorf("%d bytes at RVA %#x are past the end of the file", n, rva)
+	}
+	buf := make([]byte, size)
+	if _, err := r.ReadAt(buf[:n], int64(off)); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (p *PELoader) readStringRVA(rva uint32) (string, error) {
+	var out []byte
+	for {
+		_, left, err := p.rvaSection(rva)
+		if err != nil {
+			return "", err
+		}
+		if left > 64 {
+			left = 64
+		}
+		chunk, err := p.readRVA(rva, left)
+		if err != nil {
+			return "", err
+		}
+		if i := bytes.IndexByte(chunk, 0); i >= 0 {
+			return string(append(out, chunk[:i]...)), nil
+		}
+		out = append(out, chunk...)
+		rva += left
+	}
+}
+
+func (p *PELoader) Type() int {
+	return EXEC
+}
+
+func (p *PELoader) Header() (uint64, []byte, int) {
+	return p.base, nil, 0
+}
+
+func (p *PELoader) DataSegment() (start, end uint64) {
+	if s := p.file.Section(".data"); s != nil {
+		start = p.base + uint64(s.VirtualAddress)
+		return start, start + uint64(sectionSize(s))
+	}
+	return 0, 0
+}
+
+func peProt(c uint32) int {
+	prot := 0
+	if c&pe.IMAGE_SCN_MEM_READ != 0 {
+		prot |= 1
+	}
+	if c&pe.IMAGE_SCN_MEM_WRITE != 0 {
+		prot |= 2
+	}
+	if c&pe.IMAGE_SCN_MEM_EXECUTE != 0 {
+		prot |= 4
+	}
+	return prot
+}
+
+// peReloc is a base relocation of type typ at rva.
+type peReloc struct {
+	rva uint32
+	typ int
+}
+
+// relocations returns every base relocation but the padding ones.
+func (p *PELoader) relocations() ([]peReloc, error) {
+	rva, size := p.dir(peDirBaseReloc)
+	if size == 0 {
+		return nil, nil
+	}
+	data, err := p.readRVA(rva, size)
+	if err != nil {
+		return nil, err
+	}
+	var relocs []peReloc
+	for len(data) >= 8 {
+		page := binary.LittleEndian.Uint32(data)
+		blockSize := binary.LittleEndian.Uint32(data[4:])
+		if blockSize < 8 || int(blockSize) > len(data) {
+			break
+		}
+		for i := uint32(8); i+2 <= blockSize; i += 2 {
+			entry := binary.LittleEndian.Uint16(data[i:])
+			// absolute entries pad blocks to a multiple of 4 bytes
+			if typ := int(entry >> 12); typ != peRelBasedAbsolute {
+				relocs = append(relocs, peReloc{page + uint32(entry&0xfff), typ})
+			}
+		}
+		data = data[blockSize:]
+	}
+	return relocs, nil
+}
+
+// relocate applies the base relocations inside [rva, rva+len(data)).
+func (p *PELoader) relocate(data []byte, rva uint32, relocs []peReloc) {
+	delta := p.base - p.imageBase
+	for _, r := range relocs {
+		if r.rva < rva || r.rva-rva >= uint32(len(data)) {
+			continue
+		}
+		off := r.rva - rva
+		switch r.typ {
+		case peRelBasedHighLow:
+			if int(off)+4 <= len(data) {
+				v := binary.LittleEndian.Uint32(data[off:])
+				binary.LittleEndian.PutUint32(data[off:], v+uint32(delta))
+			}
+		case peRelBasedDir64:
+			if int(off)+8 <= len(data) {
+				v := binary.LittleEndian.Uint64(data[off:])
+				binary.LittleEndian.PutUint64(data[off:], v+delta)
+			}
+		}
+	}
+}
+
+func (p *PELoader) Segments() ([]SegmentData, error) {
+	var relocs []peReloc
+	if p.base != p.imageBase {
+		var err error
+		if relocs, err = p.relocations(); err != nil {
+			return nil, errors.Wrap(err, "failed to read base relocations")
+		}
+	}
+	segment := func(rva, vsize, fsize uint32, prot int) SegmentData {
+		return SegmentData{
+			Off:  uint64(rva),
+			Addr: p.base + uint64(rva),
+			Size: uint64(vsize),
+			Prot: prot,
+			DataFunc: func() ([]byte, error) {
+				if fsize > vsize {
+					fsize = vsize
+				}
+				data, err := p.readRVA(rva, fsize)
+				if err != nil {
+					return nil, err
+				}
+				p.relocate(data, rva, relocs)
+				return data, nil
+			},
+		}
+	}
+	ret := []SegmentData{segment(0, p.hdrSize, p.hdrSize, 1)}
+	for _, s := range p.file.Sections {
+		ret = append(ret, segment(s.VirtualAddress, sectionSize(s), s.Size, peProt(s.Characteristics)))
+	}
+	return ret, nil
+}
+
+// Imports returns every entry of the import directory.
+func (p *PELoader) Imports() ([]PEImport, error) {
+	rva, size := p.dir(peDirImport)
+	if size == 0 {
+		return nil, nil
+	}
+	ptrSize := uint32(p.bits / 8)
+	ordinalFlag := uint64(1) << uint(p.bits-1)
+	var imports []PEImport
+	for desc := rva; ; desc += 20 {
+		raw, err := p.readRVA(desc, 20)
+		if err != nil {
+			return nil, err
+		}
+		lookup := binary.LittleEndian.Uint32(raw[0:])
+		nameRVA := binary.LittleEndian.Uint32(raw[12:])
+		iat := binary.LittleEndian.Uint32(raw[16:])
+		if nameRVA == 0 && iat == 0 {
+			break
+		}
+		dll, err := p.readStringRVA(nameRVA)
+		if err != nil {
+			return nil, err
+		}
+		if lookup == 0 {
+			lookup = iat
+		}
+		for i := uint32(0); ; i++ {
+			thunk, err := p.readRVA(lookup+i*ptrSize, ptrSize)
+			if err != nil {
+				return nil, err
+			}
+			var v uint64
+			if ptrSize == 8 {
+				v = binary.LittleEndian.Uint64(thunk)
+			} else {
+				v = uint64(binary.LittleEndian.Uint32(thunk))
+			}
+			if v == 0 {
+				break
+			}
+			imp := PEImport{DLL: strings.ToLower(dll), Addr: p.base + uint64(iat+i*ptrSize)}
+			if v&ordinalFlag != 0 {
+				imp.Ordinal = uint16(v)
+			} else if imp.Name, err = p.readStringRVA(uint32(v) + 2); err != nil {
+				return nil, err
+			}
+			imports = append(imports, imp)
+		}
+	}
+	return imports, nil
+}
+
+// TLS returns the TLS directory, or nil if the image has none.
+func (p *PELoader) TLS() (*PETLS, error) {
+	rva, size := p.dir(peDirTLS)
+	if size == 0 {
+		return nil, nil
+	}
+	raw, err := p.readRVA(rva, 40)
+	if err != nil {
+		return nil, err
+	}
+	tls := &PETLS{}
+	if p.bits == 64 {
+		tls.Start = binary.LittleEndian.Uint64(raw[0:])
+		tls.End = binary.LittleEndian.Uint64(raw[8:])
+		tls.Index = binary.LittleEndian.Uint64(raw[16:])
+		tls.Callbacks = binary.LittleEndian.Uint64(raw[24:])
+		tls.ZeroFill = binary.LittleEndian.Uint32(raw[32:])
+	} else {
+		tls.Start = uint64(binary.LittleEndian.Uint32(raw[0:]))
+		tls.End = uint64(binary.LittleEndian.Uint32(raw[4:]))
+		tls.Index = uint64(binary.LittleEndian.Uint32(raw[8:]))
+		tls.Callbacks = uint64(binary.LittleEndian.Uint32(raw[12:]))
+		tls.ZeroFill = binary.LittleEndian.Uint32(raw[16:])
+	}
+	// the directory holds absolute addresses for the preferred base
+	delta := p.base - p.imageBase
+	for _, v := range []*uint64{&tls.Start, &tls.End, &tls.Index, &tls.Callbacks} {
+		if *v != 0 {
+			*v += delta
+		}
+	}
+	return tls, nil
+}
+
+func (p *PELoader) exports() ([]Symbol, error) {
+	rva, size := p.dir(peDirExport)
+	if size == 0 {
+		return nil, nil
+	}
+	raw, err := p.readRVA(rva, 40)
+	if err != nil {
+		return nil, err
+	}
+	numNames := binary.LittleEndian.Uint32(raw[24:])
+	funcs := binary.LittleEndian.Uint32(raw[28:])
+	names := binary.LittleEndian.Uint32(raw[32:])
+	ordinals := binary.LittleEndian.Uint32(raw[36:])
+	var syms []Symbol
+	for i := uint32(0); i < numNames; i++ {
+		nameRaw, err := p.readRVA(names+i*4, 4)
+		if err != nil {
+			return nil, err
+		}
+		name, err := p.readStringRVA(binary.LittleEndian.Uint32(nameRaw))
+		if err != nil {
+			return nil, err
+		}
+		ordRaw, err := p.readRVA(ordinals+i*2, 2)
+		if err != nil {
+			return nil, err
+		}
+		funcRaw, err := p.readRVA(funcs+uint32(binary.LittleEndian.Uint16(ordRaw))*4, 4)
+		if err != nil {
+			return nil, err
+		}
+		addr := binary.LittleEndian.Uint32(funcRaw)
+		// forwarders point into the export directory
+		if addr >= rva && addr < rva+size {
+			continue
+		}
+		syms = append(syms, Symbol{Name: name, Start: p.base + uint64(addr), Dynamic: true})
+	}
+	return syms, nil
+}
+
+func (p *PELoader) getSymbols() ([]Symbol, error) {
+	syms, err := p.exports()
+	if err != nil {
+		return nil, err
+	}
+	// COFF symbols are only left in by mingw
+	for _, s := range p.file.Symbols {
+		if s.SectionNumber <= 0 || int(s.SectionNumber) > len(p.file.Sections) {
+			continue
+		}
+		sec := p.file.Sections[s.SectionNumber-1]
+		syms = append(syms, Symbol{Name: s.Name, Start: p.base + uint64(sec.VirtualAddress) + uint64(s.Value)})
+	}
+	sort.Slice(syms, func(i, j int) bool { return syms[i].Start < syms[j].Start })
+	for i := 0; i+1 < len(syms); i++ {
+		syms[i].End = syms[i+1].Start
+	}
+	return syms, nil
+}
+
+func (p *PELoader) Symbols() ([]Symbol, error) {
+	var err error
+	if p.symCache == nil {
+		p.symCache, err = p.getSymbols()
+	}
+	return p.symCache, err
+}
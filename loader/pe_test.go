@@ -0,0 +1,196 @@
+package loader
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"testing"
+)
+
+// minimalPE builds a PE32 image with a single section holding a ret and an
+// import of kernel32.dll!ExitProcess.
+func minimalPE() []byte {
+	return buildPE(0, 0x200)
+}
+
+// buildPE builds the image of minimalPE with extraDirs data directories
+// past the 16 of the optional header and the section's VirtualSize set to
+// virtualSize.
+func buildPE(extraDirs int, virtualSize uint32) []byte {
+	var buf bytes.Buffer
+	dos := make([]byte, 0x40)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], 0x40)
+	buf.Write(dos)
+	buf.Write(peMagic)
+	binary.Write(&buf, binary.LittleEndian, pe.FileHeader{
+		Machine:              pe.IMAGE_FILE_MACHINE_I386,
+		NumberOfSections:     1,
+		SizeOfOptionalHeader: uint16(0xe0 + 8*extraDirs),
+		Characteristics:      0x0102,
+	})
+	oh := pe.OptionalHeader32{
+		Magic:               0x10b,
+		AddressOfEntryPoint: 0x1000,
+		ImageBase:           0x400000,
+		SectionAlignment:    0x1000,
+		FileAlignment:       0x200,
+		SizeOfImage:         0x2000,
+		SizeOfHeaders:       0x200,
+		Subsystem:           3,
+		NumberOfRvaAndSizes: uint32(16 + extraDirs),
+	}
+	oh.DataDirectory[peDirImport] = pe.DataDirectory{VirtualAddress: 0x1010, Size: 40}
+	binary.Write(&buf, binary.LittleEndian, oh)
+	buf.Write(make([]byte, 8*extraDirs))
+	sh := pe.SectionHeader32{
+		VirtualSize:      virtualSize,
+		VirtualAddress:   0x1000,
+		SizeOfRawData:    0x200,
+		PointerToRawData: 0x200,
+		Characteristics:  0xe0000020,
+	}
+	copy(sh.Name[:], ".text")
+	binary.Write(&buf, binary.LittleEndian, sh)
+	buf.Write(make([]byte, 0x200-buf.Len()))
+
+	text := make([]byte, 0x200)
+	text[0] = 0xc3
+	le := binary.LittleEndian
+	// import descriptor followed by the null descriptor
+	le.PutUint32(text[0x10:], 0x1040)
+	le.PutUint32(text[0x1c:], 0x1060)
+	le.PutUint32(text[0x20:], 0x1048)
+	// lookup table and import address table
+	le.PutUint32(text[0x40:], 0x1050)
+	le.PutUint32(text[0x48:], 0x1050)
+	copy(text[0x52:], "ExitProcess\x00")
+	copy(text[0x60:], "KERNEL32.dll\x00")
+	buf.Write(text)
+	return buf.Bytes()
+}
+
+func TestPEMatch(t *testing.T) {
+	l, err := LoaderFor(bytes.NewReader(minimalPE()), NoOSHint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Arch() != "x86" || l.OS() != "windows" {
+		t.Fatalf("wrong loader: %s/%s", l.Arch(), l.OS())
+	}
+	if l.Entry() != 0x401000 {
+		t.Fatalf("wrong entry point: %#x", l.Entry())
+	}
+}
+
+func TestPESegments(t *testing.T) {
+	l, err := NewPELoader(bytes.NewReader(minimalPE()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments, err := l.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 || segments[1].Addr != 0x401000 {
+		t.Fatalf("wrong segments: %+v", segments)
+	}
+	data, err := segments[1].Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != 0xc3 {
+		t.Fatalf("wrong section data: %x", data[:4])
+	}
+}
+
+func TestPEImports(t *testing.T) {
+	l, err := NewPELoader(bytes.NewReader(minimalPE()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imports, err := l.Imports()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PEImport{DLL: "kernel32.dll", Name: "ExitProcess", Addr: 0x401048}
+	if len(imports) != 1 || imports[0] != want {
+		t.Fatalf("wrong imports: %+v", imports)
+	}
+}
+
+func TestPEOddHeaders(t *testing.T) {
+	// more data directories than the optional header has room for, and a
+	// section that only has a raw size
+	l, err := NewPELoader(bytes.NewReader(buildPE(2, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.dirs) != 16 {
+		t.Fatalf("%d data directories", len(l.dirs))
+	}
+	imports, err := l.Imports()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imports) != 1 || imports[0].Name != "ExitProcess" {
+		t.Fatalf("wrong imports: %+v", imports)
+	}
+	segments, err := l.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 || segments[1].Size != 0x200 {
+		t.Fatalf("wrong segments: %+v", segments)
+	}
+}
+
+func TestPERebase(t *testing.T) {
+	img := minimalPE()
+	le := binary.LittleEndian
+	// the base relocation directory follows the imports
+	le.PutUint32(img[0xe0:], 0x1100)
+	le.PutUint32(img[0xe4:], 12)
+	text := img[0x200:]
+	le.PutUint32(text[0x80:], 0x401000)
+	// a HIGHLOW relocation padded by an absolute one for the same address
+	le.PutUint32(text[0x100:], 0x1080)
+	le.PutUint32(text[0x104:], 12)
+	le.PutUint16(text[0x108:], peRelBasedHighLow<<12)
+	l, err := NewPELoader(bytes.NewReader(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Rebase(0x500000); err != nil {
+		t.Fatal(err)
+	}
+	segments, err := l.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := segments[1].Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := le.Uint32(data[0x80:]); got != 0x501000 {
+		t.Fatalf("relocated pointer is %#x, want 0x501000", got)
+	}
+}
+
+func TestPETruncated(t *testing.T) {
+	// the section claims more of the file than there is
+	l, err := NewPELoader(bytes.NewReader(minimalPE()[:0x300]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments, err := l.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := segments[1].Data(); err == nil {
+		t.Fatal("read a section past the end of the file")
+	}
+	if _, err := l.readRVA(0x1000, 0x1000); err == nil {
+		t.Fatal("read past the end of a section")
+	}
+}
@@ -0,0 +1,295 @@
+package loader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// RawLoader maps a headerless image at a fixed base. Flat binaries and
+// shellcode are mapped as a single blob, Intel HEX and Motorola S-record
+// files at the addresses of their records.
+type RawLoader struct {
+	LoaderBase
+	Format string
+	chunks []rawChunk
+}
+
+// rawChunk is a contiguous run of bytes at an address relative to the base.
+type rawChunk struct {
+	addr uint64
+	data []byte
+}
+
+// Raw image formats
+const (
+	RawBinary = "binary"
+	RawIHex   = "ihex"
+	RawSrec   = "srec"
+)
+
+// NewRawLoader loads r for the given arch and OS. The image is mapped at
+// base and entry is relative to base. Intel HEX and S-record files carry
+// their own addresses, which are relative to base as well, and their own
+// entry point, which is used unless entry is given.
+func NewRawLoader(r io.ReaderAt, arch, os string, order binary.ByteOrder, base uint64, entry *uint64) (*RawLoader, error) {
+	data, err := ioutil.ReadAll(io.NewSectionReader(r, 0, 1<<62))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read image")
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty image")
+	}
+	l := &RawLoader{
+		LoaderBase: LoaderBase{
+			arch:      arch,
+			os:        os,
+			byteOrder: order,
+		},
+		Format: RawBinary,
+	}
+	var start uint64
+	var hasStart bool
+	switch {
+	case MatchIHex(data):
+		l.Format = RawIHex
+		l.chunks, start, hasStart, err = parseIHex(data)
+	case MatchSrec(data):
+		l.Format = RawSrec
+		l.chunks, start, hasStart, err = parseSrec(data)
+	default:
+		l.chunks = []rawChunk{{0, data}}
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s image", l.Format)
+	}
+	if len(l.chunks) == 0 {
+		return nil, errors.Errorf("%s image has no data", l.Format)
+	}
+	for i := range l.chunks {
+		l.chunks[i].addr += base
+	}
+	switch {
+	case entry != nil:
+		l.entry = base + *entry
+	case hasStart:
+		l.entry = base + start
+	default:
+		l.entry = l.chunks[0].addr
+	}
+	return l, nil
+}
+
+func (r *RawLoader) Segments() ([]SegmentData, error) {
+	segs := make([]SegmentData, len(r.chunks))
+	for i, c := range r.chunks {
+		data := c.data
+		segs[i] = SegmentData{
+			Addr:     c.addr,
+			Size:     uint64(len(data)),
+			Prot:     7,
+			DataFunc: func() ([]byte, error) { return data, nil },
+		}
+	}
+	return segs, nil
+}
+
+// mergeChunks sorts records by address and joins the adjacent ones.
+func mergeChunks(chunks []rawChunk) []rawChunk {
+	sort.SliceStable(chunks, func(i, j int) bool { return chunks[i].addr < chunks[j].addr })
+	var merged []rawChunk
+	for _, c := range chunks {
+		if len(c.data) == 0 {
+			continue
+		}
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			end := last.addr + uint64(len(last.data))
+			if c.addr <= end {
+				// later records overwrite overlapping bytes
+				if tail := c.addr + uint64(len(c.data)); tail > end {
+					last.data = append(last.data, make([]byte, tail-end)...)
+				}
+				copy(last.data[c.addr-last.addr:], c.data)
+				continue
+			}
+		}
+		merged = append(merged, rawChunk{c.addr, append([]byte(nil), c.data...)})
+	}
+	return merged
+}
+
+// hexLines returns the non-empty lines of a text image.
+func hexLines(data []byte) [][]byte {
+	var lines [][]byte
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// decodeRecord decodes the hex digits of a record and verifies that it is
+// extra bytes longer than its leading length byte says.
+func decodeRecord(digits []byte, extra int) ([]byte, error) {
+	if len(digits)%2 != 0 {
+		return nil, errors.New("odd number of hex digits")
+	}
+	rec := make([]byte, len(digits)/2)
+	for i := range rec {
+		hi, ok1 := hexDigit(digits[2*i])
+		lo, ok2 := hexDigit(digits[2*i+1])
+		if !ok1 || !ok2 {
+			return nil, errors.Errorf("invalid hex digit in %q", digits)
+		}
+		rec[i] = hi<<4 | lo
+	}
+	if len(rec) == 0 || len(rec) != int(rec[0])+extra {
+		return nil, errors.Errorf("bad record length in %q", digits)
+	}
+	return rec, nil
+}
+
+func hexDigit(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10, true
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// MatchIHex returns true if data starts with an Intel HEX record.
+func MatchIHex(data []byte) bool {
+	lines := hexLines(data)
+	if len(lines) == 0 || lines[0][0] != ':' {
+		return false
+	}
+	_, err := decodeRecord(lines[0][1:], 5)
+	return err == nil
+}
+
+// MatchSrec returns true if data starts with a Motorola S-record.
+func MatchSrec(data []byte) bool {
+	lines := hexLines(data)
+	if len(lines) == 0 || len(lines[0]) < 2 || lines[0][0] != 'S' || lines[0][1] < '0' || lines[0][1] > '9' {
+		return false
+	}
+	_, err := decodeRecord(lines[0][2:], 1)
+	return err == nil
+}
+
+// Intel HEX record types
+const (
+	ihexData = iota
+	ihexEOF
+	ihexExtSegment
+	ihexStartSegment
+	ihexExtLinear
+	ihexStartLinear
+)
+
+func parseIHex(data []byte) (chunks []rawChunk, start uint64, hasStart bool, err error) {
+	var offset uint64
+	for n, line := range hexLines(data) {
+		if line[0] != ':' {
+			return nil, 0, false, errors.Errorf("line %d: missing record mark", n+1)
+		}
+		rec, err := decodeRecord(line[1:], 5)
+		if err != nil {
+			return nil, 0, false, errors.Wrapf(err, "line %d", n+1)
+		}
+		var sum byte
+		for _, b := range rec {
+			sum += b
+		}
+		if sum != 0 {
+			return nil, 0, false, errors.Errorf("line %d: bad checksum", n+1)
+		}
+		payload := rec[4 : len(rec)-1]
+		addr := uint64(binary.BigEndian.Uint16(rec[1:]))
+		switch rec[3] {
+		case ihexData:
+			chunks = append(chunks, rawChunk{offset + addr, payload})
+		case ihexEOF:
+			return mergeChunks(chunks), start, hasStart, nil
+		case ihexExtSegment, ihexExtLinear:
+			if len(payload) != 2 {
+				return nil, 0, false, errors.Errorf("line %d: bad address record", n+1)
+			}
+			offset = uint64(binary.BigEndian.Uint16(payload))
+			if rec[3] == ihexExtSegment {
+				offset <<= 4
+			} else {
+				offset <<= 16
+			}
+		case ihexStartSegment, ihexStartLinear:
+			if len(payload) != 4 {
+				return nil, 0, false, errors.Errorf("line %d: bad start record", n+1)
+			}
+			if rec[3] == ihexStartSegment {
+				// CS:IP
+				start = uint64(binary.BigEndian.Uint16(payload))<<4 + uint64(binary.BigEndian.Uint16(payload[2:]))
+			} else {
+				start = uint64(binary.BigEndian.Uint32(payload))
+			}
+			hasStart = true
+		default:
+			return nil, 0, false, errors.Errorf("line %d: unknown record type %d", n+1, rec[3])
+		}
+	}
+	return nil, 0, false, errors.New("missing end of file record")
+}
+
+// srecAddrSize maps S-record types to the size of their address field.
+var srecAddrSize = map[byte]int{
+	'0': 2, '1': 2, '2': 3, '3': 4,
+	'5': 2, '6': 3,
+	'7': 4, '8': 3, '9': 2,
+}
+
+func parseSrec(data []byte) (chunks []rawChunk, start uint64, hasStart bool, err error) {
+	for n, line := range hexLines(data) {
+		if len(line) < 2 || line[0] != 'S' {
+			return nil, 0, false, errors.Errorf("line %d: missing record mark", n+1)
+		}
+		typ := line[1]
+		size, ok := srecAddrSize[typ]
+		if !ok {
+			return nil, 0, false, errors.Errorf("line %d: unknown record type S%c", n+1, typ)
+		}
+		rec, err := decodeRecord(line[2:], 1)
+		if err != nil {
+			return nil, 0, false, errors.Wrapf(err, "line %d", n+1)
+		}
+		if len(rec) < size+2 {
+			return nil, 0, false, errors.Errorf("line %d: record too short", n+1)
+		}
+		var sum byte
+		for _, b := range rec {
+			sum += b
+		}
+		if sum != 0xff {
+			return nil, 0, false, errors.Errorf("line %d: bad checksum", n+1)
+		}
+		var addr uint64
+		for _, b := range rec[1 : 1+size] {
+			addr = addr<<8 | uint64(b)
+		}
+		switch typ {
+		case '1', '2', '3':
+			chunks = append(chunks, rawChunk{addr, rec[1+size : len(rec)-1]})
+		case '7', '8', '9':
+			start, hasStart = addr, true
+		}
+	}
+	return mergeChunks(chunks), start, hasStart, nil
+}
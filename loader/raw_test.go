@@ -0,0 +1,82 @@
+package loader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func rawSegments(t *testing.T, l *RawLoader) []SegmentData {
+	segments, err := l.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return segments
+}
+
+func TestRawBinary(t *testing.T) {
+	code := []byte{0x90, 0x90, 0xcc}
+	entry := uint64(1)
+	l, err := NewRawLoader(bytes.NewReader(code), "x86_64", "linux", binary.LittleEndian, 0x400000, &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Format != RawBinary || l.Entry() != 0x400001 {
+		t.Fatalf("wrong format or entry: %s %#x", l.Format, l.Entry())
+	}
+	segments := rawSegments(t, l)
+	if len(segments) != 1 || segments[0].Addr != 0x400000 || segments[0].Size != 3 {
+		t.Fatalf("wrong segments: %+v", segments)
+	}
+}
+
+func TestRawIHex(t *testing.T) {
+	image := ":0400000090909090BC\n" +
+		// extended linear address 0xa0000
+		":02000004000AF0\n" +
+		":0200100090CC92\n" +
+		// start linear address 0x1000
+		":0400000500001000E7\n" +
+		":00000001FF\n"
+	l, err := NewRawLoader(bytes.NewReader([]byte(image)), "x86", "linux", binary.LittleEndian, 0x1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Format != RawIHex || l.Entry() != 0x2000 {
+		t.Fatalf("wrong format or entry: %s %#x", l.Format, l.Entry())
+	}
+	segments := rawSegments(t, l)
+	if len(segments) != 2 || segments[0].Addr != 0x1000 || segments[1].Addr != 0xa1010 {
+		t.Fatalf("wrong segments: %+v", segments)
+	}
+	data, _ := segments[1].Data()
+	if !bytes.Equal(data, []byte{0x90, 0xcc}) {
+		t.Fatalf("wrong data: %x", data)
+	}
+}
+
+func TestRawIHexChecksum(t *testing.T) {
+	image := ":0400000090909090BD\n:00000001FF\n"
+	if _, err := NewRawLoader(bytes.NewReader([]byte(image)), "x86", "linux", binary.LittleEndian, 0, nil); err == nil {
+		t.Fatal("accepted a bad checksum")
+	}
+}
+
+func TestRawSrec(t *testing.T) {
+	image := "S00600004844521B\nS1071000909090CC6C\nS1051004C3C360\nS9031000EC\n"
+	l, err := NewRawLoader(bytes.NewReader([]byte(image)), "m68k", "linux", binary.BigEndian, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Format != RawSrec || l.Entry() != 0x1000 {
+		t.Fatalf("wrong format or entry: %s %#x", l.Format, l.Entry())
+	}
+	segments := rawSegments(t, l)
+	if len(segments) != 1 || segments[0].Addr != 0x1000 {
+		t.Fatalf("wrong segments: %+v", segments)
+	}
+	data, _ := segments[0].Data()
+	if !bytes.Equal(data, []byte{0x90, 0x90, 0x90, 0xcc, 0xc3, 0xc3}) {
+		t.Fatalf("wrong data: %x", data)
+	}
+}
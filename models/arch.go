@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/binary"
 	"fmt"
 
 	"github.com/felberj/binemu/cpu"
@@ -10,6 +11,7 @@ import (
 
 type CpuBuilder interface {
 	New() (*cpu.Cpu, error)
+	NewWithOrder(order binary.ByteOrder) (*cpu.Cpu, error)
 }
 
 type Reg struct {
@@ -0,0 +1,109 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/felberj/binemu/cpu"
+)
+
+// testBase is where TestExec and BenchExec load their code.
+const testBase = 0x1000
+
+// smokeSkip are registers that can't hold an arbitrary value. Flags
+// registers keep some bits fixed and writing a segment register loads a
+// descriptor.
+var smokeSkip = map[string]bool{
+	"flags": true, "eflags": true, "rflags": true, "nzcv": true,
+	"cs": true, "ds": true, "es": true, "fs": true, "gs": true, "ss": true,
+}
+
+// SmokeTest writes and reads back every register of the arch.
+func (a *Arch) SmokeTest(t *testing.T) {
+	c, err := a.Cpu.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testReg := func(name string, enum int) {
+		if err := c.RegWrite(enum, 0x1000); err != nil {
+			t.Fatal(err)
+		}
+		val, err := c.RegRead(enum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != 0x1000 {
+			t.Fatalf("%s failed to read/write register %s: got %#x", a.Name, name, val)
+		}
+		// clear the register in case registers are aliased
+		if err := c.RegWrite(enum, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, r := range a.getRegList() {
+		if !smokeSkip[r.Name] {
+			testReg(r.Name, r.Enum)
+		}
+	}
+	testReg("PC", a.PC)
+	testReg("SP", a.SP)
+}
+
+// execCpu returns a CPU with code mapped at testBase.
+func (a *Arch) execCpu(code []byte) (*cpu.Cpu, error) {
+	c, err := a.Cpu.New()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.MemMap(testBase, 0x1000, cpu.PROT_ALL); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := c.MemWrite(testBase, code); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// TestExec runs machine code until it falls off its end.
+func (a *Arch) TestExec(t *testing.T, code []byte) {
+	c, err := a.execCpu(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Start(testBase, testBase+uint64(len(code))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchRegs measures a dump of every register.
+func (a *Arch) BenchRegs(b *testing.B) {
+	c, err := a.Cpu.New()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := a.RegDumpFast(c); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchExec measures runs of machine code.
+func (a *Arch) BenchExec(b *testing.B, code []byte) {
+	c, err := a.execCpu(code)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.Start(testBase, testBase+uint64(len(code))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
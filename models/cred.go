@@ -0,0 +1,22 @@
+package models
+
+// Cred holds the user and group ids the guest runs as.
+type Cred struct {
+	Uid, Euid int
+	Gid, Egid int
+	// Groups are the supplementary groups.
+	Groups []int
+}
+
+// InGroup tells whether gid is the effective or a supplementary group.
+func (c *Cred) InGroup(gid int) bool {
+	if gid == c.Egid {
+		return true
+	}
+	for _, g := range c.Groups {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
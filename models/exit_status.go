@@ -7,3 +7,10 @@ type ExitStatus int
 func (e ExitStatus) Error() string {
 	return fmt.Sprintf("exit %d", e)
 }
+
+// Signal is the error a guest that was killed by a signal stops with.
+type Signal int
+
+func (s Signal) Error() string {
+	return fmt.Sprintf("killed by signal %d", s)
+}
@@ -3,10 +3,11 @@ package models
 import (
 	"encoding/binary"
 	"io"
+	"math/rand"
 
 	"github.com/felberj/binemu/cpu"
 	"github.com/felberj/binemu/loader"
-	"github.com/felberj/ramfs"
+	"github.com/felberj/binemu/vfs"
 
 	uc "github.com/felberj/binemu/cpu/unicorn"
 )
@@ -51,6 +52,7 @@ type Usercorn interface {
 	Push(n uint64) (uint64, error)
 	OS() string
 
+	Mappings() cpu.Pages
 	MemReserve(addr, size uint64, force bool) (*cpu.Page, error)
 	Mmap(addr, size uint64, prot int, fixed bool, desc string, file *cpu.FileDesc) (uint64, error)
 	Malloc(size uint64, desc string) (uint64, error)
@@ -65,6 +67,7 @@ type Usercorn interface {
 	Exe() string
 	Loader() loader.Loader
 	Base() uint64
+	InterpBase() uint64
 	Entry() uint64
 	BinEntry() uint64
 	SetEntry(entry uint64)
@@ -77,5 +80,8 @@ type Usercorn interface {
 
 	Exit(err error)
 
-	Fs() *ramfs.Filesystem
+	Fs() *vfs.Filesystem
+	Seed() int64
+	Rand() *rand.Rand
+	Cred() *Cred
 }
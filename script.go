@@ -0,0 +1,261 @@
+package binemu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// Step is one exchange of a Script.
+type Step struct {
+	// Expect is a regexp the guest's stdout has to match before Send is
+	// written to its stdin. Its named groups capture values for later
+	// sends. An empty Expect sends right away.
+	Expect string
+	// Send is a text/template of the reply. The captures so far are its
+	// fields, and p16, p32, p64, u16, u32, u64, int, hex, add and sub help
+	// with leaked addresses: {{p64 (add (int .leak) 0x1234)}}, or
+	// {{p64 (add (u64 .raw) 0x1234)}} for a leak of raw bytes.
+	Send string
+}
+
+// maxUnread bounds the output a Script keeps for its steps.
+const maxUnread = 64 << 10
+
+type step struct {
+	expect *regexp.Regexp
+	send   *template.Template
+	// sends is false for steps that only check the output
+	sends bool
+}
+
+// Script drives the guest like expect: the guest's stdout is matched
+// against a step's pattern and the step's reply is fed to its stdin.
+// As the guest runs on a single thread there is nothing to wait for. If
+// the guest reads stdin while a step with a reply is still waiting for
+// its output, the script fails. Use it as ExecConfig.Stdin and Stdout.
+//
+// Only the last maxUnread bytes of output no step matched yet are kept,
+// a pattern has to match within them.
+type Script struct {
+	// Order packs the p16, p32 and p64 values and unpacks the u16, u32 and
+	// u64 ones, little endian if nil.
+	Order binary.ByteOrder
+	// Transcript logs every exchange if set.
+	Transcript io.Writer
+	// Stop is called when the script fails, to stop the guest. Set it to
+	// the Usercorn's Exit.
+	Stop func(error)
+
+	steps    []step
+	next     int
+	out      io.Writer
+	unread   bytes.Buffer
+	reply    bytes.Buffer
+	captures map[string]string
+	err      error
+}
+
+// NewScript compiles steps. The guest's stdout is passed on to out if it
+// is not nil.
+func NewScript(steps []Step, out io.Writer) (*Script, error) {
+	s := &Script{out: out, captures: make(map[string]string)}
+	funcs := template.FuncMap{
+		"p16": func(v uint64) string { return s.pack(2, v) },
+		"p32": func(v uint64) string { return s.pack(4, v) },
+		"p64": func(v uint64) string { return s.pack(8, v) },
+		"u16": func(v string) (uint64, error) { return s.unpack(2, v) },
+		"u32": func(v string) (uint64, error) { return s.unpack(4, v) },
+		"u64": func(v string) (uint64, error) { return s.unpack(8, v) },
+		"int": func(v string) (uint64, error) { return strconv.ParseUint(strings.TrimSpace(v), 0, 64) },
+		"hex": func(v uint64) string { return fmt.Sprintf("%#x", v) },
+		"add": func(a, b uint64) uint64 { return a + b },
+		"sub": func(a, b uint64) uint64 { return a - b },
+	}
+	for i, st := range steps {
+		var c step
+		if st.Expect != "" {
+			re, err := regexp.Compile(st.Expect)
+			if err != nil {
+				return nil, errors.Wrapf(err, "step %d", i+1)
+			}
+			c.expect = re
+		}
+		t, err := template.New(fmt.Sprintf("step %d", i+1)).Funcs(funcs).Option("missingkey=error").Parse(st.Send)
+		if err != nil {
+			return nil, err
+		}
+		c.send = t
+		c.sends = st.Send != ""
+		s.steps = append(s.steps, c)
+	}
+	return s, nil
+}
+
+func (s *Script) order() binary.ByteOrder {
+	if s.Order == nil {
+		return binary.LittleEndian
+	}
+	return s.Order
+}
+
+func (s *Script) pack(size int, v uint64) string {
+	order := s.order()
+	b := make([]byte, 8)
+	switch size {
+	case 2:
+		order.PutUint16(b, uint16(v))
+	case 4:
+		order.PutUint32(b, uint32(v))
+	default:
+		order.PutUint64(b, v)
+	}
+	return string(b[:size])
+}
+
+// unpack decodes up to size raw bytes. Shorter values, like a pointer
+// whose leak stopped at its first NUL byte, miss their most significant
+// bytes.
+func (s *Script) unpack(size int, v string) (uint64, error) {
+	if len(v) > size {
+		return 0, errors.Errorf("%d bytes don't fit in %d", len(v), size)
+	}
+	order := s.order()
+	b := make([]byte, 8)
+	pad := strings.Repeat("\x00", size-len(v))
+	if order == binary.BigEndian {
+		copy(b, pad+v)
+	} else {
+		copy(b, v+pad)
+	}
+	switch size {
+	case 2:
+		return uint64(order.Uint16(b)), nil
+	case 4:
+		return uint64(order.Uint32(b)), nil
+	}
+	return order.Uint64(b), nil
+}
+
+func (s *Script) logf(format string, args ...interface{}) {
+	if s.Transcript != nil {
+		fmt.Fprintf(s.Transcript, format+"\n", args...)
+	}
+}
+
+// fail stops the script and the guest with err.
+func (s *Script) fail(err error) {
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	s.logf("fail %v", err)
+	if s.Stop != nil {
+		s.Stop(err)
+	}
+}
+
+// advance runs the steps the output read so far matches.
+func (s *Script) advance() {
+	for s.err == nil && s.next < len(s.steps) {
+		st := s.steps[s.next]
+		if st.expect != nil {
+			m := st.expect.FindSubmatchIndex(s.unread.Bytes())
+			if m == nil {
+				return
+			}
+			out := s.unread.Bytes()
+			var caps []string
+			for i, name := range st.expect.SubexpNames() {
+				if name == "" || m[2*i] < 0 {
+					continue
+				}
+				v := string(out[m[2*i]:m[2*i+1]])
+				s.captures[name] = v
+				caps = append(caps, fmt.Sprintf("%s=%q", name, v))
+			}
+			s.logf("match %d %q %s", s.next+1, st.expect.String(), strings.Join(caps, " "))
+			s.unread.Next(m[1])
+		}
+		var reply bytes.Buffer
+		if err := st.send.Execute(&reply, s.captures); err != nil {
+			s.fail(err)
+			return
+		}
+		if reply.Len() > 0 {
+			s.logf("send %q", reply.Bytes())
+			s.reply.Write(reply.Bytes())
+		}
+		s.next++
+	}
+}
+
+// Write takes the guest's stdout.
+func (s *Script) Write(p []byte) (int, error) {
+	s.logf("recv %q", p)
+	s.unread.Write(p)
+	s.advance()
+	if s.err != nil || s.next == len(s.steps) {
+		s.unread.Reset()
+	} else if n := s.unread.Len() - maxUnread; n > 0 {
+		s.unread.Next(n)
+	}
+	if s.out != nil {
+		return s.out.Write(p)
+	}
+	return len(p), nil
+}
+
+// Read feeds the replies to the guest's stdin. Once no step is left to
+// reply, the guest reads EOF.
+func (s *Script) Read(p []byte) (int, error) {
+	s.advance()
+	if s.reply.Len() > 0 {
+		return s.reply.Read(p)
+	}
+	if s.err == nil && s.sending() {
+		s.fail(errors.Errorf("step %d: the guest reads stdin, but its output %q does not match %q",
+			s.next+1, s.unread.String(), s.steps[s.next].expect))
+	}
+	if s.err == nil {
+		s.logf("eof")
+	}
+	return 0, io.EOF
+}
+
+// sending reports whether a step that did not run yet has a reply.
+func (s *Script) sending() bool {
+	for _, st := range s.steps[s.next:] {
+		if st.sends {
+			return true
+		}
+	}
+	return false
+}
+
+// Captures returns the values the steps captured so far, by group name.
+func (s *Script) Captures() map[string]string {
+	return s.captures
+}
+
+// Done returns why the script failed, or an error if the guest exited
+// before all steps ran.
+func (s *Script) Done() error {
+	if s.err != nil {
+		return s.err
+	}
+	if s.next < len(s.steps) {
+		err := errors.Errorf("step %d: the guest exited, but its output %q does not match %q",
+			s.next+1, s.unread.String(), s.steps[s.next].expect)
+		s.logf("fail %v", err)
+		return err
+	}
+	return nil
+}
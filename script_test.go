@@ -0,0 +1,136 @@
+package binemu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func newTestScript(t *testing.T, steps ...Step) (*Script, *[]error) {
+	t.Helper()
+	s, err := NewScript(steps, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stops []error
+	s.Stop = func(err error) { stops = append(stops, err) }
+	return s, &stops
+}
+
+func TestScriptExchange(t *testing.T) {
+	s, stops := newTestScript(t,
+		Step{Expect: `leak: (?P<leak>0x[0-9a-f]+)\n`, Send: `{{p64 (add (int .leak) 0x10)}}`},
+		Step{Expect: `name\? `, Send: "{{hex (sub (int .leak) 1)}}\n"},
+		Step{Expect: "bye"},
+	)
+	var transcript bytes.Buffer
+	s.Transcript = &transcript
+	// output arrives in pieces that only match together
+	s.Write([]byte("hello\nleak: 0x10"))
+	s.Write([]byte("00\nname? "))
+	if got := s.Captures()["leak"]; got != "0x1000" {
+		t.Fatalf("captured %q", got)
+	}
+	reply, err := ioutil.ReadAll(io.LimitReader(s, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := binary.LittleEndian.Uint64(reply); got != 0x1010 {
+		t.Fatalf("first reply is %#x", got)
+	}
+	buf := make([]byte, 64)
+	n, err := s.Read(buf)
+	if err != nil || string(buf[:n]) != "0xfff\n" {
+		t.Fatalf("second reply is %q, %v", buf[:n], err)
+	}
+	// no step is left to reply
+	if n, err := s.Read(buf); n != 0 || err != io.EOF {
+		t.Fatalf("read %d, %v after the replies", n, err)
+	}
+	s.Write([]byte("bye\n"))
+	if err := s.Done(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*stops) != 0 {
+		t.Fatalf("stopped the guest: %v", *stops)
+	}
+	if !strings.Contains(transcript.String(), `match 1 "leak: (?P<leak>0x[0-9a-f]+)\\n" leak="0x1000"`) {
+		t.Fatalf("transcript:\n%s", transcript.String())
+	}
+}
+
+func TestScriptReadsFirst(t *testing.T) {
+	s, stops := newTestScript(t, Step{Expect: "name?", Send: "bob\n"})
+	s.Write([]byte("hello\n"))
+	if n, err := s.Read(make([]byte, 16)); n != 0 || err != io.EOF {
+		t.Fatalf("read %d, %v", n, err)
+	}
+	if len(*stops) != 1 {
+		t.Fatalf("stopped the guest %d times", len(*stops))
+	}
+	if err := s.Done(); err != (*stops)[0] {
+		t.Fatalf("Done returned %v", err)
+	}
+}
+
+func TestScriptLeftover(t *testing.T) {
+	s, stops := newTestScript(t, Step{Expect: "a"}, Step{Expect: "b"})
+	s.Write([]byte("a"))
+	err := s.Done()
+	if err == nil || !strings.HasPrefix(err.Error(), "step 2:") {
+		t.Fatalf("Done returned %v", err)
+	}
+	if len(*stops) != 0 {
+		t.Fatalf("stopped the guest: %v", *stops)
+	}
+}
+
+func TestScriptUnread(t *testing.T) {
+	s, _ := newTestScript(t, Step{Expect: "end"}, Step{Expect: "more"})
+	chunk := bytes.Repeat([]byte("x"), 4096)
+	for i := 0; i < 64; i++ {
+		s.Write(chunk)
+		if s.unread.Len() > maxUnread {
+			t.Fatalf("keeps %d bytes of output", s.unread.Len())
+		}
+	}
+	s.Write([]byte("end"))
+	if s.next != 1 {
+		t.Fatal("the end of the output does not match")
+	}
+	s.Write([]byte("more"))
+	s.Write(chunk)
+	if s.unread.Len() != 0 {
+		t.Fatalf("keeps %d bytes of output after the last step", s.unread.Len())
+	}
+}
+
+func TestScriptUnpack(t *testing.T) {
+	for _, order := range []binary.ByteOrder{nil, binary.BigEndian} {
+		s, _ := newTestScript(t,
+			Step{Expect: `leak: (?P<raw>[^\n]*)\n`, Send: "{{hex (u64 .raw)}} {{hex (u32 .raw)}} {{hex (u16 .two)}}\n"},
+		)
+		s.Order = order
+		raw, two := "\x10\x32\x54", "\x01\x02"
+		want := "0x543210 0x543210 0x201\n"
+		if order != nil {
+			want = "0x103254 0x103254 0x102\n"
+		}
+		s.captures["two"] = two
+		s.Write([]byte("leak: " + raw + "\n"))
+		buf := make([]byte, 64)
+		n, err := s.Read(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Errorf("order %v: reply is %q, %v, want %q", order, buf[:n], err, want)
+		}
+	}
+	s, stops := newTestScript(t, Step{Send: "{{u16 .long}}"})
+	s.captures["long"] = "abc"
+	s.Read(make([]byte, 8))
+	if len(*stops) != 1 {
+		t.Fatalf("unpacked 3 bytes into 2: %v", *stops)
+	}
+}
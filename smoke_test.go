@@ -0,0 +1,64 @@
+package binemu
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/felberj/binemu/arch"
+	"github.com/felberj/binemu/loader"
+	"github.com/felberj/binemu/vfs"
+)
+
+// runBinary runs one of the example binaries on an empty filesystem and
+// returns what it wrote to stdout.
+func runBinary(t *testing.T, path string, args ...string) (*Termination, string) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	l, err := loader.LoaderFor(f, loader.NoOSHint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, guestOS, err := arch.GetArch(l.Arch(), l.OS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := a.Cpu.NewWithOrder(l.ByteOrder())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	ex := &ExecConfig{
+		Args:   append([]string{path}, args...),
+		Seed:   1,
+		Stdin:  strings.NewReader(""),
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	u := NewUsercornWrapper(path, NewTask(c, a, guestOS, l.ByteOrder()), vfs.New(), l, guestOS, ex)
+	defer u.Close()
+	if err := u.LoadBinary(f); err != nil {
+		t.Fatal(err)
+	}
+	term := Terminated(u.Run())
+	if stderr.Len() > 0 {
+		t.Logf("stderr: %s", stderr.String())
+	}
+	return term, stdout.String()
+}
+
+func TestDarwinMachO(t *testing.T) {
+	term, out := runBinary(t, "bins/x86_64.darwin.macho", "arg")
+	if term.Reason != ReasonExit || term.Status != 0 {
+		t.Fatalf("the binary stopped with %v, output:\n%s", term, out)
+	}
+	for _, want := range []string{"hello with printf", `"arg"`, "file test 1: success"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package binemu
+
+import (
+	"fmt"
+
+	"github.com/felberj/binemu/models"
+	"github.com/pkg/errors"
+
+	uc "github.com/felberj/binemu/cpu/unicorn"
+)
+
+// UnsupportedSyscallError stops a guest that made a syscall no kernel
+// implements. Name is empty if the number is unknown as well.
+type UnsupportedSyscallError struct {
+	Num  int
+	Name string
+}
+
+func (e *UnsupportedSyscallError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("unsupported syscall %d", e.Num)
+	}
+	return fmt.Sprintf("unsupported syscall %s (%d)", e.Name, e.Num)
+}
+
+// Reasons a run ends with.
+const (
+	ReasonExit        = "exit"
+	ReasonSignal      = "signal"
+	ReasonTimeout     = "timeout"
+	ReasonInsnLimit   = "insn_limit"
+	ReasonUnsupported = "unsupported_syscall"
+	ReasonFault       = "fault"
+	// ReasonError is for errors outside the guest, such as a config or
+	// binary that can't be loaded or a failed script.
+	ReasonError = "error"
+)
+
+// Exit codes of a run that did not end with the guest's own exit status.
+// A guest killed by a signal exits with 128 plus its number, like in a
+// shell.
+const (
+	ExitTimeout     = 124 // the guest ran out of time or instructions
+	ExitError       = 125 // binemu could not run the guest
+	ExitUnsupported = 126 // the guest made an unsupported syscall
+	ExitFault       = 127 // the emulator failed
+)
+
+// Termination describes how a run ended.
+type Termination struct {
+	Reason string `json:"reason"`
+	// Code is what a process running the guest exits with.
+	Code int `json:"code"`
+	// Status is the exit status the guest passed, for ReasonExit.
+	Status  int    `json:"status,omitempty"`
+	Signal  int    `json:"signal,omitempty"`
+	Syscall string `json:"syscall,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// faultSignals are the signals Linux kills a process with for the CPU
+// errors Unicorn stops with.
+var faultSignals = map[uc.UcError]int{
+	uc.ERR_READ_UNMAPPED:   11, // SIGSEGV
+	uc.ERR_WRITE_UNMAPPED:  11,
+	uc.ERR_FETCH_UNMAPPED:  11,
+	uc.ERR_READ_PROT:       11,
+	uc.ERR_WRITE_PROT:      11,
+	uc.ERR_FETCH_PROT:      11,
+	uc.ERR_READ_UNALIGNED:  7, // SIGBUS
+	uc.ERR_WRITE_UNALIGNED: 7,
+	uc.ERR_FETCH_UNALIGNED: 7,
+	uc.ERR_INSN_INVALID:    4, // SIGILL
+}
+
+// Terminated describes how a run that returned err ended.
+func Terminated(err error) *Termination {
+	cause := errors.Cause(err)
+	switch cause {
+	case nil:
+		return &Termination{Reason: ReasonExit}
+	case ErrTimeout:
+		return &Termination{Reason: ReasonTimeout, Code: ExitTimeout, Error: err.Error()}
+	case ErrInsnLimit:
+		return &Termination{Reason: ReasonInsnLimit, Code: ExitTimeout, Error: err.Error()}
+	}
+	switch e := cause.(type) {
+	case models.ExitStatus:
+		// only the low byte reaches the parent
+		return &Termination{Reason: ReasonExit, Code: int(e) & 0xff, Status: int(e)}
+	case models.Signal:
+		return &Termination{Reason: ReasonSignal, Code: 128 + int(e), Signal: int(e)}
+	case *UnsupportedSyscallError:
+		t := &Termination{Reason: ReasonUnsupported, Code: ExitUnsupported, Syscall: e.Name, Error: e.Error()}
+		if e.Name == "" {
+			t.Syscall = fmt.Sprint(e.Num)
+		}
+		return t
+	case uc.UcError:
+		if sig, ok := faultSignals[e]; ok {
+			return &Termination{Reason: ReasonSignal, Code: 128 + sig, Signal: sig, Error: e.Error()}
+		}
+	}
+	return &Termination{Reason: ReasonFault, Code: ExitFault, Error: err.Error()}
+}
+
+func (t *Termination) String() string {
+	switch t.Reason {
+	case ReasonExit:
+		return fmt.Sprintf("exit %d", t.Status)
+	case ReasonSignal:
+		if t.Error != "" {
+			return fmt.Sprintf("killed by signal %d: %s", t.Signal, t.Error)
+		}
+		return fmt.Sprintf("killed by signal %d", t.Signal)
+	}
+	return t.Error
+}
@@ -0,0 +1,48 @@
+package binemu
+
+import (
+	"testing"
+
+	"github.com/felberj/binemu/models"
+	"github.com/pkg/errors"
+
+	uc "github.com/felberj/binemu/cpu/unicorn"
+)
+
+func TestTerminated(t *testing.T) {
+	tests := []struct {
+		err  error
+		want Termination
+	}{
+		{nil, Termination{Reason: ReasonExit}},
+		{models.ExitStatus(3), Termination{Reason: ReasonExit, Code: 3, Status: 3}},
+		// only the low byte of the status reaches the parent
+		{models.ExitStatus(256 + 7), Termination{Reason: ReasonExit, Code: 7, Status: 263}},
+		{models.Signal(9), Termination{Reason: ReasonSignal, Code: 137, Signal: 9}},
+		{&UnsupportedSyscallError{Num: 56, Name: "clone"}, Termination{Reason: ReasonUnsupported, Code: ExitUnsupported, Syscall: "clone"}},
+		{&UnsupportedSyscallError{Num: 999}, Termination{Reason: ReasonUnsupported, Code: ExitUnsupported, Syscall: "999"}},
+		{ErrTimeout, Termination{Reason: ReasonTimeout, Code: ExitTimeout}},
+		{ErrInsnLimit, Termination{Reason: ReasonInsnLimit, Code: ExitTimeout}},
+		{errors.New("boom"), Termination{Reason: ReasonFault, Code: ExitFault}},
+		{uc.UcError(uc.ERR_NOMEM), Termination{Reason: ReasonFault, Code: ExitFault}},
+		// wrapping does not change how the run ended
+		{errors.Wrap(models.ExitStatus(1), "run"), Termination{Reason: ReasonExit, Code: 1, Status: 1}},
+		{errors.Wrap(ErrTimeout, "run"), Termination{Reason: ReasonTimeout, Code: ExitTimeout}},
+		{errors.Wrap(&UnsupportedSyscallError{Num: 5}, "run"), Termination{Reason: ReasonUnsupported, Code: ExitUnsupported, Syscall: "5"}},
+		{errors.Wrap(uc.UcError(uc.ERR_FETCH_UNMAPPED), "run"), Termination{Reason: ReasonSignal, Code: 139, Signal: 11}},
+	}
+	for fault, sig := range faultSignals {
+		tests = append(tests, struct {
+			err  error
+			want Termination
+		}{fault, Termination{Reason: ReasonSignal, Code: 128 + sig, Signal: sig}})
+	}
+	for _, test := range tests {
+		got := Terminated(test.err)
+		// the message is only for humans
+		got.Error = ""
+		if *got != test.want {
+			t.Errorf("Terminated(%v) = %+v, want %+v", test.err, *got, test.want)
+		}
+	}
+}
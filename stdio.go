@@ -0,0 +1,66 @@
+package binemu
+
+import (
+	"bytes"
+	"io"
+)
+
+// limitWriter passes the first n bytes on to w and drops the rest.
+type limitWriter struct {
+	w io.Writer
+	n int64
+}
+
+// LimitWriter returns a writer that writes at most n bytes to w and
+// silently drops the rest, so the guest never sees a failed write. n <= 0
+// means no limit.
+func LimitWriter(w io.Writer, n int64) io.Writer {
+	if n <= 0 {
+		return w
+	}
+	return &limitWriter{w, n}
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	keep := p
+	if int64(len(keep)) > l.n {
+		keep = keep[:l.n]
+	}
+	if len(keep) > 0 {
+		n, err := l.w.Write(keep)
+		l.n -= int64(n)
+		if err != nil {
+			return n, err
+		}
+	}
+	return len(p), nil
+}
+
+// Capture keeps the output of the guest in memory, up to Limit bytes if
+// Limit is positive. Use it as ExecConfig.Stdout or Stderr.
+type Capture struct {
+	Limit int64
+	// Truncated is set once output was dropped.
+	Truncated bool
+	buf       bytes.Buffer
+}
+
+func (c *Capture) Write(p []byte) (int, error) {
+	keep := p
+	if c.Limit > 0 && int64(c.buf.Len()+len(keep)) > c.Limit {
+		keep = keep[:c.Limit-int64(c.buf.Len())]
+		c.Truncated = true
+	}
+	c.buf.Write(keep)
+	return len(p), nil
+}
+
+// Bytes returns the output captured so far.
+func (c *Capture) Bytes() []byte {
+	return c.buf.Bytes()
+}
+
+// String returns the output captured so far.
+func (c *Capture) String() string {
+	return c.buf.String()
+}
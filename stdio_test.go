@@ -0,0 +1,44 @@
+package binemu
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLimitWriter(t *testing.T) {
+	var buf bytes.Buffer
+	if w := LimitWriter(&buf, 0); w != &buf {
+		t.Fatal("a limit of 0 wraps the writer")
+	}
+	w := LimitWriter(&buf, 5)
+	for _, s := range []string{"abc", "defg", "h"} {
+		// the guest never sees its writes fail
+		if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", s, n, err)
+		}
+	}
+	if buf.String() != "abcde" {
+		t.Fatalf("kept %q", buf.String())
+	}
+}
+
+func TestCapture(t *testing.T) {
+	c := &Capture{Limit: 4}
+	c.Write([]byte("ab"))
+	if c.Truncated {
+		t.Fatal("truncated below the limit")
+	}
+	if n, err := c.Write([]byte("cdef")); n != 4 || err != nil {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	c.Write([]byte("g"))
+	if c.String() != "abcd" || !c.Truncated {
+		t.Fatalf("kept %q, truncated %v", c.String(), c.Truncated)
+	}
+
+	c = &Capture{}
+	c.Write(bytes.Repeat([]byte("x"), 1<<16))
+	if len(c.Bytes()) != 1<<16 || c.Truncated {
+		t.Fatal("an unlimited capture dropped output")
+	}
+}
@@ -1,21 +1,26 @@
 package binemu
 
 import (
+	crand "crypto/rand"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"runtime"
 	"runtime/debug"
 	"sync"
+	"time"
 
 	"github.com/felberj/binemu/cpu"
 	"github.com/felberj/binemu/loader"
 	"github.com/felberj/binemu/models"
-	"github.com/felberj/ramfs"
+	"github.com/felberj/binemu/vfs"
 	"github.com/lunixbochs/struc"
 	"github.com/pkg/errors"
 
+	uc "github.com/felberj/binemu/cpu/unicorn"
 	co "github.com/felberj/binemu/kernel/common"
 )
 
@@ -52,20 +57,35 @@ type Usercorn struct {
 
 	restart func(models.Usercorn, error) error
 
-	fs *ramfs.Filesystem
+	fs   *vfs.Filesystem
+	seed int64
+	rand *rand.Rand
 }
 
 // NewUsercornWrapper is just a hacky woraround that usercorn has privat fields.
 // TODO(felberj) remove
-func NewUsercornWrapper(exe string, t *Task, fs *ramfs.Filesystem, l loader.Loader, os *models.OS, c *ExecConfig) *Usercorn {
+func NewUsercornWrapper(exe string, t *Task, fs *vfs.Filesystem, l loader.Loader, os *models.OS, c *ExecConfig) *Usercorn {
 	u := &Usercorn{
 		Task:   t,
 		config: c,
 		loader: l,
 		exit:   0xffffffffffffffff,
 		fs:     fs,
+		seed:   c.Seed,
+	}
+	if u.seed == 0 {
+		// without a seed every run must differ, so draw one
+		var b [8]byte
+		crand.Read(b[:])
+		u.seed = int64(binary.LittleEndian.Uint64(b[:]))
+	}
+	u.rand = rand.New(rand.NewSource(u.seed))
+	u.exe = c.Exe
+	if u.exe == "" {
+		// without a guest path the host path is all there is, which has to
+		// be absolute like the paths the kernel hands out
+		u.exe, _ = filepath.Abs(exe)
 	}
-	u.exe, _ = filepath.Abs(exe)
 
 	var kernels []co.Kernel
 	if os.Kernels != nil {
@@ -74,6 +94,14 @@ func NewUsercornWrapper(exe string, t *Task, fs *ramfs.Filesystem, l loader.Load
 			kernels = append(kernels, k.(co.Kernel))
 		}
 	}
+	for _, k := range kernels {
+		if k, ok := k.(co.StdioKernel); ok {
+			k.SetStdio(c.Stdin, c.Stdout, c.Stderr)
+		}
+		if k, ok := k.(co.CwdKernel); ok && c.Cwd != "" {
+			k.SetCwd(c.Cwd)
+		}
+	}
 	u.kernels = kernels
 	return u
 }
@@ -85,6 +113,11 @@ func (u *Usercorn) LoadBinary(f *os.File) error {
 	if err != nil {
 		return err
 	}
+	if interp := u.loader.Interp(); interp != "" && !u.config.NoInterp {
+		if err := u.mapInterp(interp); err != nil {
+			return errors.Wrapf(err, "failed to load interpreter %q", interp)
+		}
+	}
 	// find data segment for brk
 	u.brk = 0
 	segments, err := u.loader.Segments()
@@ -111,10 +144,27 @@ func (u *Usercorn) LoadBinary(f *os.File) error {
 }
 
 // Fs returns the filesystem
-func (u *Usercorn) Fs() *ramfs.Filesystem {
+func (u *Usercorn) Fs() *vfs.Filesystem {
 	return u.fs
 }
 
+// Seed returns the seed for guest visible randomness, the configured one
+// or, if there is none, the one drawn for this run.
+func (u *Usercorn) Seed() int64 {
+	return u.seed
+}
+
+// Rand returns the stream guest visible randomness is taken from, which
+// starts at Seed.
+func (u *Usercorn) Rand() *rand.Rand {
+	return u.rand
+}
+
+// Cred returns the ids the guest runs as, which its kernels share.
+func (u *Usercorn) Cred() *models.Cred {
+	return &u.config.Cred
+}
+
 // GetCPU returns the CPU
 func (u *Usercorn) GetCPU() *cpu.Cpu {
 	return u.Cpu
@@ -145,9 +195,28 @@ func (u *Usercorn) Run() error {
 	// loop to restart Cpu if we need to call a trampoline function
 	u.RegWrite(u.arch.PC, u.entry)
 	var err error
+	budget := newBudget(u.config.InsnLimit, u.config.Timeout, time.Now())
+	if u.config.InsnLimit > 0 {
+		hook, err := u.HookCode(func(addr uint64, size uint32) {
+			if !budget.step() {
+				u.Stop()
+			}
+		}, 1, 0)
+		if err != nil {
+			return err
+		}
+		defer u.HookDel(hook)
+	}
 	for err == nil && u.exitStatus == nil {
-		pc, _ := u.RegRead(u.arch.PC)
-		err = u.Start(pc, u.exit)
+		var opts *uc.UcOptions
+		if opts, err = budget.options(time.Now()); err != nil {
+			break
+		}
+		err = u.start(u.startPC(), u.exit, opts)
+		if err == nil && u.exitStatus == nil && u.restart == nil && len(u.trampolines) == 0 {
+			// nothing stopped the CPU, so it ran out of budget
+			err = budget.spent(time.Now())
+		}
 
 		if u.restart != nil {
 			err = u.restart(u, err)
@@ -156,7 +225,7 @@ func (u *Usercorn) Run() error {
 				break
 			}
 		}
-		pc, _ = u.RegRead(u.arch.PC)
+		pc := u.startPC()
 		if len(u.trampolines) > 0 {
 			sp, _ := u.RegRead(u.arch.SP)
 			trampolines := u.trampolines
@@ -175,24 +244,41 @@ func (u *Usercorn) Run() error {
 			u.RegWrite(u.arch.SP, sp)
 		}
 	}
-	if _, ok := err.(models.ExitStatus); !ok && err != nil {
-		if err != nil {
-			fmt.Printf("got error: %v", err)
-		}
-	}
 	if err == nil && u.exitStatus != nil {
 		err = u.exitStatus
 	}
 	return err
 }
 
+// startPC returns the address execution should resume at.
+// ARM keeps the Thumb state in the low bit of the start address and
+// real mode x86 starts at a linear address relative to CS.
+func (u *Usercorn) startPC() uint64 {
+	pc, _ := u.RegRead(u.arch.PC)
+	switch u.arch.Name {
+	case "arm":
+		if cpsr, _ := u.RegRead(uc.ARM_REG_CPSR); cpsr&(1<<5) != 0 {
+			pc |= 1
+		}
+	case "x86_16":
+		cs, _ := u.RegRead(uc.X86_REG_CS)
+		pc = cs<<4 + pc&0xffff
+	}
+	return pc
+}
+
 func (u *Usercorn) Start(pc, end uint64) error {
+	return u.start(pc, end, &uc.UcOptions{})
+}
+
+func (u *Usercorn) start(pc, end uint64, opts *uc.UcOptions) error {
 	u.running = true
-	err := u.Cpu.Start(pc, end)
+	err := u.Cpu.StartWithOptions(pc, end, opts)
 	u.running = false
 	return err
 }
 
+// Exe returns the guest path the program was executed as.
 func (u *Usercorn) Exe() string {
 	return u.exe
 }
@@ -206,6 +292,11 @@ func (u *Usercorn) Base() uint64 {
 	return u.base
 }
 
+func (u *Usercorn) InterpBase() uint64 {
+	// points to the interpreter base, 0 without one
+	return u.interpBase
+}
+
 func (u *Usercorn) Entry() uint64 {
 	// points to effective program entry: either an interpreter or the binary
 	return u.entry
@@ -270,7 +361,18 @@ func (u *Usercorn) addHooks() error {
 }
 
 func (u *Usercorn) mapBinary(f *os.File) (entry, base, realEntry uint64, err error) {
-	l := u.loader
+	loadBias, err := u.mapImage(u.loader, f.Name(), "exe", 0x1000000)
+	if err != nil {
+		return
+	}
+	entry = loadBias + u.loader.Entry()
+	return entry, loadBias, entry, nil
+}
+
+// mapImage maps the segments of l and returns its load bias. Position
+// independent images go at the first free address from dynBase, or
+// anywhere if dynBase is 0.
+func (u *Usercorn) mapImage(l loader.Loader, name, desc string, dynBase uint64) (loadBias uint64, err error) {
 	var dynamic bool
 	switch l.Type() {
 	case loader.EXEC:
@@ -304,13 +406,10 @@ func (u *Usercorn) mapBinary(f *os.File) (entry, base, realEntry uint64, err err
 		low = high
 	}
 	// map contiguous binary
-	loadBias := uint64(0)
 	if dynamic {
 		mapLow := low
-		if loadBias > 0 {
-			mapLow = loadBias
-		} else if mapLow == 0 {
-			mapLow = 0x1000000
+		if mapLow == 0 {
+			mapLow = dynBase
 		}
 		// TODO: is allocating the whole lib width remotely sane?
 		var page *cpu.Page
@@ -320,7 +419,6 @@ func (u *Usercorn) mapBinary(f *os.File) (entry, base, realEntry uint64, err err
 		}
 		loadBias = page.Addr - low
 	}
-	desc := "exe"
 
 	// initial forced segment mappings
 	for _, seg := range segments {
@@ -329,7 +427,7 @@ func (u *Usercorn) mapBinary(f *os.File) (entry, base, realEntry uint64, err err
 			// TODO: confirm why darwin needs this
 			prot = cpu.PROT_ALL
 		}
-		fileDesc := &cpu.FileDesc{Name: f.Name(), Off: seg.Off, Len: seg.Size}
+		fileDesc := &cpu.FileDesc{Name: name, Off: seg.Off, Len: seg.Size}
 		_, err = u.Mmap(loadBias+seg.Addr, seg.Size, prot, true, desc, fileDesc)
 		if err != nil {
 			return
@@ -364,9 +462,30 @@ outer:
 			return
 		}
 	}
-	entry = loadBias + l.Entry()
-	// load interpreter if present
-	return entry, loadBias, entry, nil
+	return loadBias, nil
+}
+
+// mapInterp maps the interpreter the binary names from the guest
+// filesystem and starts the process there.
+func (u *Usercorn) mapInterp(interp string) error {
+	f, err := u.fs.Open(interp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	l, err := loader.LoaderFor(f, u.loader.OS())
+	if err != nil {
+		return err
+	}
+	if l.Arch() != u.loader.Arch() {
+		return errors.Errorf("interpreter is %s, binary is %s", l.Arch(), u.loader.Arch())
+	}
+	u.interpBase, err = u.mapImage(l, interp, "interp", 0)
+	if err != nil {
+		return err
+	}
+	u.entry = u.interpBase + l.Entry()
+	return nil
 }
 
 func (u *Usercorn) MapStack(base, size uint64, guard bool) error {
@@ -388,10 +507,14 @@ func (u *Usercorn) MapStack(base, size uint64, guard bool) error {
 	return nil
 }
 
+// Syscall calls the syscall name of the first kernel that implements it.
+// A syscall no kernel implements stops the guest with an
+// *UnsupportedSyscallError.
 func (u *Usercorn) Syscall(num int, name string, getArgs models.SysGetArgs) (uint64, error) {
 	if name == "" {
-		msg := fmt.Sprintf("Syscall missing: %d", num)
-		panic(msg)
+		err := &UnsupportedSyscallError{Num: num}
+		u.Exit(err)
+		return 0, err
 	}
 	for _, k := range u.kernels {
 		if sys := co.Lookup(u, k, name); sys != nil {
@@ -403,8 +526,9 @@ func (u *Usercorn) Syscall(num int, name string, getArgs models.SysGetArgs) (uin
 			return ret, nil
 		}
 	}
-	msg := errors.Errorf("Kernel not found for syscall '%s'", name)
-	panic(msg)
+	err := &UnsupportedSyscallError{Num: num, Name: name}
+	u.Exit(err)
+	return 0, err
 }
 
 func (u *Usercorn) Exit(err error) {
@@ -0,0 +1,375 @@
+package vfs
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Kind tells how a file changed.
+type Kind int
+
+// Kinds of changes
+const (
+	Created Kind = iota
+	Modified
+	Deleted
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Created:
+		return "created"
+	case Modified:
+		return "modified"
+	case Deleted:
+		return "deleted"
+	}
+	return "unknown"
+}
+
+// Change is a file that differs from a snapshot.
+type Change struct {
+	Path string
+	Kind Kind
+}
+
+// ChangeRecord is the PAX record of exported archives that holds the
+// kind of each change.
+const ChangeRecord = "BINEMU.change"
+
+// fileState is what a snapshot remembers of a file.
+type fileState struct {
+	mode     os.FileMode
+	uid, gid int
+	link     string
+	sum      [sha256.Size]byte
+	// lower is the host file of a file only the lower layers have. They
+	// are read-only, so its contents change only once it is copied up.
+	lower string
+}
+
+// Snapshot is the state of every file of a filesystem, keyed by path.
+type Snapshot map[string]fileState
+
+// walk calls fn for every file below root, parents first and in order.
+func (fs *Filesystem) walk(root string, fn func(name string, fi os.FileInfo) error) error {
+	fi, err := fs.Lstat(root)
+	if err != nil {
+		return err
+	}
+	if err := fn(root, fi); err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return nil
+	}
+	children, err := fs.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Name() < children[j].Name() })
+	for _, c := range children {
+		if err := fs.walk(path.Join(root, c.Name()), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFile returns the contents of name.
+func (fs *Filesystem) readFile(name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// Snapshot records the state of every file, reading the contents of
+// those in the ramfs.
+func (fs *Filesystem) Snapshot() (Snapshot, error) {
+	s := make(Snapshot)
+	err := fs.walk("/", func(name string, fi os.FileInfo) error {
+		st := fileState{mode: fi.Mode()}
+		if a := fs.Attr(name); a != nil {
+			st.uid, st.gid, st.link = a.Uid, a.Gid, a.Link
+		}
+		switch {
+		case !fi.Mode().IsRegular() || st.link != "":
+		case !fs.inUpper(name):
+			st.lower, _, _ = fs.lowerLookup(name)
+		default:
+			data, err := fs.readFile(name)
+			if err != nil {
+				return errors.Wrapf(err, "unable to read %q", name)
+			}
+			st.sum = sha256.Sum256(data)
+		}
+		s[name] = st
+		return nil
+	})
+	return s, err
+}
+
+// Diff lists how cur differs from base, sorted by path. A deleted
+// directory, or one replaced by another kind of file, is listed without
+// its contents. Everything is created if base is nil.
+func Diff(base, cur Snapshot) []Change {
+	var changes []Change
+	for name, st := range cur {
+		if old, ok := base[name]; !ok {
+			changes = append(changes, Change{name, Created})
+		} else if old != st {
+			changes = append(changes, Change{name, Modified})
+		}
+	}
+	for name := range base {
+		if _, ok := cur[name]; ok {
+			continue
+		}
+		if dir, ok := cur[path.Dir(name)]; ok && dir.mode.IsDir() || name == "/" {
+			changes = append(changes, Change{name, Deleted})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+// whiteoutName is the OCI whiteout that deletes name, so an exported diff
+// can be imported as a layer.
+func whiteoutName(name string) string {
+	dir, base := path.Split(name)
+	return path.Join(dir, whiteoutPrefix+base)
+}
+
+// ExportTar writes the files that changed since base to w, or all of them
+// if base is nil, and returns the changes. Each entry holds its kind in a
+// ChangeRecord, deleted files are whiteouts.
+func (fs *Filesystem) ExportTar(w io.Writer, base Snapshot) ([]Change, error) {
+	cur, err := fs.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	changes := Diff(base, cur)
+	tw := tar.NewWriter(w)
+	for _, c := range changes {
+		if c.Path == "/" {
+			continue
+		}
+		records := map[string]string{ChangeRecord: c.Kind.String()}
+		if c.Kind == Deleted {
+			hdr := &tar.Header{
+				Name:       whiteoutName(c.Path)[1:],
+				Typeflag:   tar.TypeReg,
+				Mode:       0644,
+				PAXRecords: records,
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := fs.writeMember(tw, c.Path, records); err != nil {
+			return nil, errors.Wrapf(err, "unable to export %q", c.Path)
+		}
+	}
+	return changes, tw.Close()
+}
+
+func (fs *Filesystem) writeMember(tw *tar.Writer, name string, records map[string]string) error {
+	fi, err := fs.Lstat(name)
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:       name[1:],
+		Mode:       int64(fi.Mode().Perm()),
+		ModTime:    fi.ModTime(),
+		PAXRecords: records,
+	}
+	if fi.Mode()&os.ModeSetuid != 0 {
+		hdr.Mode |= 04000
+	}
+	if fi.Mode()&os.ModeSetgid != 0 {
+		hdr.Mode |= 02000
+	}
+	if fi.Mode()&os.ModeSticky != 0 {
+		hdr.Mode |= 01000
+	}
+	a := fs.Attr(name)
+	if a != nil {
+		hdr.Uid, hdr.Gid = a.Uid, a.Gid
+		if !a.ModTime.IsZero() {
+			hdr.ModTime = a.ModTime
+		}
+	}
+	var data []byte
+	switch {
+	case a != nil && a.Link != "":
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = a.Link
+	case fi.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case a != nil && a.Type&os.ModeCharDevice != 0:
+		hdr.Typeflag = tar.TypeChar
+		hdr.Devmajor, hdr.Devminor = int64(Major(a.Rdev)), int64(Minor(a.Rdev))
+	case a != nil && a.Type&os.ModeDevice != 0:
+		hdr.Typeflag = tar.TypeBlock
+		hdr.Devmajor, hdr.Devminor = int64(Major(a.Rdev)), int64(Minor(a.Rdev))
+	case a != nil && a.Type&os.ModeNamedPipe != 0:
+		hdr.Typeflag = tar.TypeFifo
+	default:
+		hdr.Typeflag = tar.TypeReg
+		if data, err = fs.readFile(name); err != nil {
+			return err
+		}
+		hdr.Size = int64(len(data))
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// ExportDir writes the files that changed since base below the host
+// directory dir, or all of them if base is nil, and returns the changes.
+// Deleted files are whiteouts. Owners are not kept, as the host would
+// need privileges to set them.
+//
+// Symlinks hold guest paths, so they are written last and never followed:
+// a guest could point them anywhere on the host.
+func (fs *Filesystem) ExportDir(dir string, base Snapshot) ([]Change, error) {
+	cur, err := fs.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	changes := Diff(base, cur)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// the contents of directories are written after them, so their modes
+	// and times are set at the end
+	var dirs, links []string
+	for _, c := range changes {
+		if c.Path == "/" {
+			continue
+		}
+		if c.Kind == Deleted {
+			wh, err := hostPath(dir, whiteoutName(c.Path))
+			if err != nil {
+				return nil, err
+			}
+			if err := ioutil.WriteFile(wh, nil, 0644); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		host, err := hostPath(dir, c.Path)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := fs.Lstat(c.Path)
+		if err != nil {
+			return nil, err
+		}
+		a := fs.Attr(c.Path)
+		if hfi, err := os.Lstat(host); err == nil && (!hfi.IsDir() || !fi.IsDir()) {
+			if err := os.RemoveAll(host); err != nil {
+				return nil, err
+			}
+		}
+		switch {
+		case a != nil && a.Link != "":
+			links = append(links, c.Path)
+			continue
+		case fi.IsDir():
+			if err := os.Mkdir(host, 0755); err != nil && !os.IsExist(err) {
+				return nil, err
+			}
+			dirs = append(dirs, c.Path)
+			continue
+		default:
+			data, err := fs.readFile(c.Path)
+			if err != nil {
+				return nil, err
+			}
+			if err := ioutil.WriteFile(host, data, 0600); err != nil {
+				return nil, err
+			}
+		}
+		if err := fs.exportAttrs(c.Path, host); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range links {
+		host, err := hostPath(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Symlink(fs.Attr(name).Link, host); err != nil {
+			return nil, err
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := fs.exportAttrs(dirs[i], filepath.Join(dir, filepath.FromSlash(dirs[i]))); err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+// hostPath returns the host path of the guest file name below dir,
+// creating its parents. A parent that is not a directory is refused
+// rather than followed, a symlink could point anywhere on the host.
+func hostPath(dir, name string) (string, error) {
+	parts := strings.Split(name, "/")
+	host := dir
+	for _, part := range parts[:len(parts)-1] {
+		if part == "" {
+			continue
+		}
+		host = filepath.Join(host, part)
+		fi, err := os.Lstat(host)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(host, 0755); err != nil {
+				return "", err
+			}
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if !fi.IsDir() {
+			return "", errors.Errorf("unable to export %q: %q is not a directory", name, host)
+		}
+	}
+	return filepath.Join(host, parts[len(parts)-1]), nil
+}
+
+// exportAttrs sets the mode and mtime of the host copy of name.
+func (fs *Filesystem) exportAttrs(name, host string) error {
+	fi, err := fs.Lstat(name)
+	if err != nil {
+		return err
+	}
+	mtime := fi.ModTime()
+	if a := fs.Attr(name); a != nil && !a.ModTime.IsZero() {
+		mtime = a.ModTime
+	}
+	if err := os.Chmod(host, fi.Mode()&modeMask); err != nil {
+		return err
+	}
+	return os.Chtimes(host, time.Now(), mtime)
+}
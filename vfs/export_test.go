@@ -0,0 +1,224 @@
+package vfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	base := Snapshot{
+		"/":         {mode: os.ModeDir | 0755},
+		"/etc":      {mode: os.ModeDir | 0755},
+		"/etc/motd": {mode: 0644, sum: [32]byte{1}},
+		"/tmp":      {mode: os.ModeDir | 01777},
+		"/tmp/a":    {mode: os.ModeDir | 0755},
+		"/tmp/a/b":  {mode: 0644},
+		"/bin/sh":   {mode: 0755},
+	}
+	cur := Snapshot{
+		"/":          {mode: os.ModeDir | 0755},
+		"/etc":       {mode: os.ModeDir | 0755},
+		"/etc/motd":  {mode: 0644, sum: [32]byte{2}},
+		"/tmp":       {mode: os.ModeDir | 01777},
+		"/tmp/stage": {mode: 0755},
+		"/bin/sh":    {mode: 0755, uid: 1000},
+	}
+	want := []Change{
+		{"/bin/sh", Modified},
+		{"/etc/motd", Modified},
+		{"/tmp/a", Deleted},
+		{"/tmp/stage", Created},
+	}
+	got := Diff(base, cur)
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+	if all := Diff(nil, cur); len(all) != len(cur) {
+		t.Fatalf("full export lists %d of %d files", len(all), len(cur))
+	}
+}
+
+func TestWhiteoutName(t *testing.T) {
+	if got := whiteoutName("/tmp/a"); got != "/tmp/.wh.a" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+// exportFs returns a filesystem with a file of a lower layer, the
+// directory /tmp/a holding b and a symlink /lib.
+func exportFs(t *testing.T) *Filesystem {
+	t.Helper()
+	lower := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(lower, "motd"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := New()
+	if err := fs.Mount(lower, "/etc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.MkdirAll("/tmp/a", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/tmp/a/b", []byte("b"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Symlink("usr/lib", "/lib"); err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestSnapshotLower(t *testing.T) {
+	fs := exportFs(t)
+	base, err := fs.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := base["/etc/motd"]; st.lower == "" || st.sum != ([32]byte{}) {
+		t.Fatalf("lower file was read: %+v", st)
+	}
+	if err := fs.WriteFile("/etc/motd", []byte("bye"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cur, err := fs.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := Diff(base, cur); len(got) != 1 || got[0] != (Change{"/etc/motd", Modified}) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestExportTarRoundTrip(t *testing.T) {
+	fs := exportFs(t)
+	base, err := fs.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/tmp/c", []byte("c"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("/tmp/a/b"); err != nil {
+		t.Fatal(err)
+	}
+	var full, diff bytes.Buffer
+	if _, err := fs.ExportTar(&full, nil); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := fs.ExportTar(&diff, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || changes[0] != (Change{"/tmp/a/b", Deleted}) || changes[1] != (Change{"/tmp/c", Created}) {
+		t.Fatalf("got %v", changes)
+	}
+
+	// the full export alone, and the diff applied as a layer on the
+	// state it was taken from, both give the guest's files
+	imported := New()
+	if err := imported.ImportTar(&full, "/", true); err != nil {
+		t.Fatal(err)
+	}
+	layered := exportFs(t)
+	if err := layered.ImportTar(&diff, "/", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, got := range []*Filesystem{imported, layered} {
+		if data, err := got.readFile("/tmp/c"); err != nil || string(data) != "c" {
+			t.Errorf("/tmp/c holds %q, %v", data, err)
+		}
+		if fi, err := got.Lstat("/tmp/c"); err != nil || fi.Mode().Perm() != 0755 {
+			t.Errorf("/tmp/c: %v, %v", fi, err)
+		}
+		if data, err := got.readFile("/etc/motd"); err != nil || string(data) != "hello" {
+			t.Errorf("/etc/motd holds %q, %v", data, err)
+		}
+		if link, err := got.Readlink("/lib"); err != nil || link != "usr/lib" {
+			t.Errorf("/lib links to %q, %v", link, err)
+		}
+		if _, err := got.Lstat("/tmp/a/b"); !os.IsNotExist(err) {
+			t.Errorf("deleted file: %v", err)
+		}
+	}
+}
+
+func TestExportDir(t *testing.T) {
+	fs := exportFs(t)
+	dir := t.TempDir()
+	base, err := fs.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.ExportDir(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "tmp", "a", "b")); err != nil || string(data) != "b" {
+		t.Fatalf("/tmp/a/b holds %q, %v", data, err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "tmp", "a", "b")); err != nil || fi.Mode().Perm() != 0640 {
+		t.Fatalf("/tmp/a/b: %v, %v", fi, err)
+	}
+	if link, err := os.Readlink(filepath.Join(dir, "lib")); err != nil || link != "usr/lib" {
+		t.Fatalf("/lib links to %q, %v", link, err)
+	}
+
+	if err := fs.Remove("/tmp/a/b"); err != nil {
+		t.Fatal(err)
+	}
+	diff := t.TempDir()
+	if _, err := fs.ExportDir(diff, base); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(diff, "tmp", "a", ".wh.b")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportDirSymlinkEscape(t *testing.T) {
+	fs := exportFs(t)
+	outside := t.TempDir()
+	base, err := fs.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the whiteout of /tmp/a/b must not be written through the symlink
+	// that replaced its directory
+	if err := fs.RemoveAll("/tmp/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Symlink(outside, "/tmp/a"); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if _, err := fs.ExportDir(dir, base); err != nil {
+		t.Fatal(err)
+	}
+	if link, err := os.Readlink(filepath.Join(dir, "tmp", "a")); err != nil || link != outside {
+		t.Fatalf("/tmp/a links to %q, %v", link, err)
+	}
+
+	// nor the files of a directory a symlink replaced on the host
+	if err := fs.RemoveAll("/tmp/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.MkdirAll("/tmp/a", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/tmp/a/x", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.ExportDir(dir, base); err == nil {
+		t.Fatal("exported through a host symlink")
+	}
+	if files, _ := ioutil.ReadDir(outside); len(files) != 0 {
+		t.Fatalf("wrote %d files outside of the export", len(files))
+	}
+}
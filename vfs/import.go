@@ -0,0 +1,294 @@
+package vfs
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// whiteout prefixes of OCI layers, see the image spec's layer.md
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+const (
+	mediaTypeIndex = "application/vnd.oci.image.index.v1+json"
+	ociLayoutFile  = "oci-layout"
+)
+
+// modeMask keeps the bits of a mode the ramfs stores.
+const modeMask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// Import adds the tree at host below prefix. host is a tar archive,
+// optionally gzipped, an OCI image layout or a directory, which is
+// mounted as a lower layer. Archives have to be read up front.
+func (fs *Filesystem) Import(host, prefix string) error {
+	fi, err := os.Stat(host)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		if _, err := os.Stat(filepath.Join(host, ociLayoutFile)); err == nil {
+			return fs.ImportOCI(host, prefix)
+		}
+		return fs.Mount(host, prefix)
+	}
+	f, err := os.Open(host)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fs.ImportTar(f, prefix, false)
+}
+
+// guestPath returns where an archive or directory member name goes.
+func guestPath(prefix, name string) string {
+	return path.Join("/", prefix, path.Clean("/"+name))
+}
+
+// replace removes whatever is at name unless both it and the new file
+// are directories, which later layers merge into.
+func (fs *Filesystem) replace(name string, dir bool) error {
+	fi, err := fs.Lstat(name)
+	if err != nil || fi.IsDir() && dir {
+		return nil
+	}
+	return fs.RemoveAll(name)
+}
+
+// ImportTar adds the members of a tar archive below prefix. Gzipped
+// archives are detected by their magic. With whiteouts, the archive is an
+// OCI layer, whose whiteout files delete what earlier layers added instead
+// of being imported.
+func (fs *Filesystem) ImportTar(r io.Reader, prefix string, whiteouts bool) error {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return errors.New("zstd compressed archives are not supported")
+	default:
+		r = br
+	}
+	l := &layer{fs: fs, written: make(map[string]bool)}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		name := guestPath(prefix, hdr.Name)
+		if whiteouts && strings.HasPrefix(path.Base(name), whiteoutPrefix) {
+			l.whiteouts = append(l.whiteouts, name)
+			continue
+		}
+		if err := fs.importMember(tr, hdr, name, prefix); err != nil {
+			return errors.Wrapf(err, "unable to import %q", hdr.Name)
+		}
+		l.wrote(name)
+	}
+	for _, wh := range l.whiteouts {
+		if err := l.whiteout(wh); err != nil {
+			return errors.Wrapf(err, "whiteout %q", wh)
+		}
+	}
+	return nil
+}
+
+// layer tracks what an OCI layer wrote. Its whiteouts can come anywhere in
+// the archive, but only hide what lower layers added, so they are applied
+// at the end and spare what the layer wrote itself.
+type layer struct {
+	fs        *Filesystem
+	whiteouts []string
+	// written holds the members of the layer and their directories
+	written map[string]bool
+}
+
+func (l *layer) wrote(name string) {
+	for ; !l.written[name]; name = path.Dir(name) {
+		l.written[name] = true
+		if name == "/" {
+			break
+		}
+	}
+}
+
+// whiteout deletes the file the OCI whiteout name stands for, or
+// everything in its directory for an opaque whiteout.
+func (l *layer) whiteout(name string) error {
+	dir, base := path.Split(name)
+	if base != whiteoutOpaque {
+		return l.hide(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+	}
+	children, err := l.fs.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	for _, c := range children {
+		if err := l.hide(path.Join(dir, c.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hide removes name and what is below it, except what the layer wrote.
+func (l *layer) hide(name string) error {
+	if !l.written[name] {
+		return l.fs.RemoveAll(name)
+	}
+	fi, err := l.fs.Lstat(name)
+	if err != nil || !fi.IsDir() {
+		return nil
+	}
+	children, err := l.fs.ReadDir(name)
+	if err != nil {
+		return err
+	}
+	for _, c := range children {
+		if err := l.hide(path.Join(name, c.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *Filesystem) importMember(tr *tar.Reader, hdr *tar.Header, name, prefix string) error {
+	mode := hdr.FileInfo().Mode() & modeMask
+	if err := fs.replace(name, hdr.Typeflag == tar.TypeDir); err != nil {
+		return err
+	}
+	if err := fs.MkdirAll(path.Dir(name), 0755); err != nil {
+		return err
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := fs.MkdirAll(name, mode); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if err := fs.WriteFile(name, data, mode); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := fs.Symlink(hdr.Linkname, name); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		// the link shares its target's mode, owner and times
+		return fs.Link(guestPath(prefix, hdr.Linkname), name)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		typ := hdr.FileInfo().Mode() & os.ModeType
+		rdev := Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		if err := fs.Mknod(name, typ|mode, rdev); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	if hdr.Typeflag != tar.TypeSymlink {
+		if err := fs.Chmod(name, mode); err != nil {
+			return err
+		}
+	}
+	if err := fs.Lchown(name, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	return fs.Lchtimes(name, hdr.AccessTime, hdr.ModTime)
+}
+
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+}
+
+type ociIndex struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	Layers []ociDescriptor `json:"layers"`
+}
+
+// ImportOCI applies the layers of the first image in an OCI image layout
+// below prefix, in order.
+func (fs *Filesystem) ImportOCI(dir, prefix string) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return err
+	}
+	// nested indexes point to the manifest of each platform
+	for {
+		var index ociIndex
+		if err := json.Unmarshal(data, &index); err != nil {
+			return errors.Wrap(err, "invalid image index")
+		}
+		if len(index.Manifests) == 0 {
+			return errors.New("image index has no manifests")
+		}
+		desc := index.Manifests[0]
+		blob, err := blobPath(dir, desc.Digest)
+		if err != nil {
+			return err
+		}
+		if data, err = ioutil.ReadFile(blob); err != nil {
+			return err
+		}
+		if desc.MediaType != mediaTypeIndex {
+			break
+		}
+	}
+	var manifest ociManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return errors.Wrap(err, "invalid image manifest")
+	}
+	for _, layer := range manifest.Layers {
+		blob, err := blobPath(dir, layer.Digest)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(blob)
+		if err != nil {
+			return err
+		}
+		err = fs.ImportTar(f, prefix, true)
+		f.Close()
+		if err != nil {
+			return errors.Wrapf(err, "layer %s", layer.Digest)
+		}
+	}
+	return nil
+}
+
+// blobPath returns the file of a blob, given its digest.
+func blobPath(dir, digest string) (string, error) {
+	i := strings.Index(digest, ":")
+	if i < 0 || strings.ContainsAny(digest, "/\\") || strings.Contains(digest, "..") {
+		return "", errors.Errorf("invalid digest %q", digest)
+	}
+	return filepath.Join(dir, "blobs", digest[:i], digest[i+1:]), nil
+}
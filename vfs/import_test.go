@@ -0,0 +1,171 @@
+package vfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tarOf returns an archive of hdrs, regular files hold their names.
+func tarOf(t *testing.T, hdrs ...*tar.Header) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range hdrs {
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(hdr.Name))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write([]byte(hdr.Name))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func reg(name string) *tar.Header {
+	return &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644}
+}
+
+func TestGuestPath(t *testing.T) {
+	for _, c := range []struct {
+		prefix, name, want string
+	}{
+		{"", "./etc/passwd", "/etc/passwd"},
+		{"/", "bin/", "/bin"},
+		{"/opt/root", "usr/lib/libc.so.6", "/opt/root/usr/lib/libc.so.6"},
+		{"/opt/root", "../../etc/shadow", "/opt/root/etc/shadow"},
+	} {
+		if got := guestPath(c.prefix, c.name); got != c.want {
+			t.Errorf("guestPath(%q, %q) = %q, want %q", c.prefix, c.name, got, c.want)
+		}
+	}
+}
+
+func TestBlobPath(t *testing.T) {
+	got, err := blobPath("img", "sha256:abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join("img", "blobs", "sha256", "abcd"); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for _, digest := range []string{"abcd", "sha256:../../etc/passwd", "sha256:a/b"} {
+		if _, err := blobPath("img", digest); err == nil {
+			t.Errorf("accepted digest %q", digest)
+		}
+	}
+}
+
+func TestImportTar(t *testing.T) {
+	archive := tarOf(t,
+		&tar.Header{Typeflag: tar.TypeDir, Name: "bin/", Mode: 0755},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "bin/su", Mode: 04755, Uid: 0, Gid: 0},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "home/user/notes", Mode: 0600, Uid: 1000, Gid: 100},
+		&tar.Header{Typeflag: tar.TypeSymlink, Name: "bin/sh", Linkname: "su"},
+		&tar.Header{Typeflag: tar.TypeLink, Name: "home/user/notes2", Linkname: "home/user/notes"},
+		&tar.Header{Typeflag: tar.TypeChar, Name: "dev/tty", Mode: 0620, Devmajor: 5, Devminor: 0},
+		&tar.Header{Typeflag: tar.TypeFifo, Name: "run/fifo", Mode: 0600},
+		reg(".wh.kept"),
+	)
+	fs := New()
+	if err := fs.ImportTar(bytes.NewReader(archive), "/root", false); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name     string
+		mode     os.FileMode
+		uid, gid int
+	}{
+		{"/root/bin", os.ModeDir | 0755, 0, 0},
+		{"/root/bin/su", os.ModeSetuid | 0755, 0, 0},
+		{"/root/home/user/notes", 0600, 1000, 100},
+		{"/root/dev/tty", os.ModeDevice | os.ModeCharDevice | 0620, 0, 0},
+		{"/root/run/fifo", os.ModeNamedPipe | 0600, 0, 0},
+		// without whiteouts, whiteout files are plain files
+		{"/root/.wh.kept", 0644, 0, 0},
+	} {
+		info, err := fs.Info(c.name, false)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if info.Mode != c.mode || info.Uid != c.uid || info.Gid != c.gid {
+			t.Errorf("%s is %v %d:%d, want %v %d:%d", c.name, info.Mode, info.Uid, info.Gid, c.mode, c.uid, c.gid)
+		}
+	}
+	if target, err := fs.Readlink("/root/bin/sh"); err != nil || target != "su" {
+		t.Errorf("/root/bin/sh links to %q, %v", target, err)
+	}
+	notes, _ := fs.Info("/root/home/user/notes", false)
+	notes2, err := fs.Info("/root/home/user/notes2", false)
+	if err != nil || notes2.Ino != notes.Ino || notes2.Nlink != 2 {
+		t.Errorf("notes2 is not a hard link of notes: %+v, %v", notes2, err)
+	}
+	if info, _ := fs.Info("/root/dev/tty", false); info.Rdev != Mkdev(5, 0) {
+		t.Errorf("/root/dev/tty is device %#x", info.Rdev)
+	}
+}
+
+func TestImportOCI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	blob := func(data []byte) ociDescriptor {
+		sum := sha256.Sum256(data)
+		digest := hex.EncodeToString(sum[:])
+		if err := ioutil.WriteFile(filepath.Join(dir, "blobs", "sha256", digest), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return ociDescriptor{Digest: "sha256:" + digest}
+	}
+	marshal := func(v interface{}) []byte {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	lower := tarOf(t, reg("etc/passwd"), reg("etc/shadow"), reg("var/lib/a"), reg("var/lib/b/c"))
+	// the whiteouts come after what the layer adds next to them, but
+	// only hide the lower layer
+	upper := tarOf(t, reg("var/lib/new"), reg("var/lib/b/new"), reg(".wh.missing"), reg("etc/.wh.shadow"), reg("var/lib/.wh..wh..opq"))
+	manifest := blob(marshal(ociManifest{Layers: []ociDescriptor{blob(lower), blob(upper)}}))
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.json"), marshal(ociIndex{Manifests: []ociDescriptor{manifest}}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := New()
+	if err := fs.ImportOCI(dir, "/"); err != nil {
+		t.Fatal(err)
+	}
+	for name, exists := range map[string]bool{
+		"/etc/passwd":           true,
+		"/etc/shadow":           false,
+		"/etc/.wh.shadow":       false,
+		"/var/lib/a":            false,
+		"/var/lib/b/c":          false,
+		"/var/lib/new":          true,
+		"/var/lib/b/new":        true,
+		"/var/lib/.wh..wh..opq": false,
+	} {
+		if _, err := fs.Lstat(name); (err == nil) != exists {
+			t.Errorf("%s exists: %v, want %v", name, err == nil, exists)
+		}
+	}
+}
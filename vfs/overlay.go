@@ -0,0 +1,474 @@
+package vfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// The functions in this file work on the layers and take paths as they
+// are: symlinks and hard links are resolved by their callers.
+
+// lower is a read-only host directory mounted at prefix.
+type lower struct {
+	dir, prefix string
+}
+
+// lookup finds name in the host directory. Host symlinks are not
+// followed, as they could point outside of it.
+func (l lower) lookup(name string) (string, os.FileInfo, bool) {
+	host := l.dir
+	fi, err := os.Lstat(host)
+	if err != nil {
+		return "", nil, false
+	}
+	for _, part := range strings.Split(strings.TrimPrefix(name, l.prefix), "/") {
+		if part == "" {
+			continue
+		}
+		if !fi.IsDir() {
+			return "", nil, false
+		}
+		host = filepath.Join(host, part)
+		if fi, err = os.Lstat(host); err != nil {
+			return "", nil, false
+		}
+	}
+	return host, fi, true
+}
+
+// below reports whether name is dir or inside of it.
+func below(name, dir string) bool {
+	return dir == "/" || name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+// hidden reports whether a whiteout or an opaque directory hides name in
+// the lower layers.
+func (fs *Filesystem) hidden(name string) bool {
+	for p := name; ; p = path.Dir(p) {
+		if fs.whiteouts[p] || p != name && fs.opaque[p] {
+			return true
+		}
+		if p == "/" {
+			return false
+		}
+	}
+}
+
+// lowerLookup returns the host file of name in the topmost lower layer
+// that has it.
+func (fs *Filesystem) lowerLookup(name string) (string, os.FileInfo, bool) {
+	if fs.hidden(name) {
+		return "", nil, false
+	}
+	for i := len(fs.lowers) - 1; i >= 0; i-- {
+		if l := fs.lowers[i]; below(name, l.prefix) {
+			if host, fi, ok := l.lookup(name); ok {
+				return host, fi, true
+			}
+		}
+	}
+	return "", nil, false
+}
+
+func (fs *Filesystem) inUpper(name string) bool {
+	_, err := fs.upper.Stat(name)
+	return err == nil
+}
+
+// linkInfo describes a symlink the ramfs stores as an empty file.
+type linkInfo struct {
+	os.FileInfo
+	target string
+}
+
+func (fi linkInfo) Mode() os.FileMode { return os.ModeSymlink | 0777 }
+func (fi linkInfo) Size() int64       { return int64(len(fi.target)) }
+func (fi linkInfo) IsDir() bool       { return false }
+
+// namedInfo describes a hard link by the file it links to.
+type namedInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi namedInfo) Name() string { return fi.name }
+
+// typeInfo describes a device node, fifo or socket the ramfs stores as an
+// empty file.
+type typeInfo struct {
+	os.FileInfo
+	typ os.FileMode
+}
+
+func (fi typeInfo) Mode() os.FileMode { return fi.typ | fi.FileInfo.Mode()&modeMask }
+
+// upperInfo describes name in the ramfs the way the guest sees it.
+func (fs *Filesystem) upperInfo(name string, fi os.FileInfo) os.FileInfo {
+	if a := fs.attrs[name]; a != nil && a.Link != "" {
+		return linkInfo{fi, a.Link}
+	} else if a != nil && a.Type != 0 {
+		return typeInfo{fi, a.Type}
+	}
+	if inode, ok := fs.hardlinks[name]; ok {
+		if ifi, err := fs.upper.Stat(inode); err == nil {
+			return namedInfo{ifi, path.Base(name)}
+		}
+	}
+	return fi
+}
+
+// lstat returns the file info of name.
+func (fs *Filesystem) lstat(name string) (os.FileInfo, error) {
+	if fi, err := fs.upper.Stat(name); err == nil {
+		return fs.upperInfo(name, fi), nil
+	}
+	if _, fi, ok := fs.lowerLookup(name); ok {
+		return fi, nil
+	}
+	return nil, pathError("stat", name, os.ErrNotExist)
+}
+
+// rawAttr returns the attributes of name, or nil if none were recorded.
+func (fs *Filesystem) rawAttr(name string) *Attr {
+	if a, ok := fs.attrs[name]; ok {
+		return a
+	}
+	if fs.inUpper(name) {
+		return nil
+	}
+	host, fi, ok := fs.lowerLookup(name)
+	if !ok {
+		return nil
+	}
+	a := &Attr{ModTime: fi.ModTime()}
+	a.Uid, a.Gid, _ = owner(fi)
+	if fi.Mode()&os.ModeSymlink != 0 {
+		a.Link, _ = os.Readlink(host)
+	}
+	if fi.Mode()&os.ModeDevice != 0 {
+		a.Rdev = rdev(fi)
+	}
+	return a
+}
+
+// attr returns the attributes of name to change them.
+func (fs *Filesystem) attr(name string) *Attr {
+	a, ok := fs.attrs[name]
+	if !ok {
+		if a = fs.rawAttr(name); a == nil {
+			a = &Attr{}
+		}
+		fs.attrs[name] = a
+	}
+	return a
+}
+
+// copyUp copies name and its parents from the lower layers into the
+// ramfs, unless they are there already.
+func (fs *Filesystem) copyUp(name string) error {
+	if fs.inUpper(name) {
+		return nil
+	}
+	host, fi, ok := fs.lowerLookup(name)
+	if !ok {
+		return pathError("open", name, os.ErrNotExist)
+	}
+	if err := fs.copyUp(path.Dir(name)); err != nil {
+		return err
+	}
+	// the attributes of the host file, unless the guest changed them
+	attr := fs.rawAttr(name)
+	mode := fi.Mode() & modeMask
+	switch {
+	case fi.IsDir():
+		if err := fs.upper.Mkdir(name, mode); err != nil {
+			return err
+		}
+	case fi.Mode().IsRegular():
+		data, err := ioutil.ReadFile(host)
+		if err != nil {
+			return err
+		}
+		if err := fs.writeUpper(name, data); err != nil {
+			return err
+		}
+	case fi.Mode()&os.ModeSymlink != 0:
+		if err := fs.writeUpper(name, nil); err != nil {
+			return err
+		}
+		mode = 0777
+	default:
+		return pathError("open", name, errors.New("unsupported file type"))
+	}
+	if err := fs.upper.Chmod(name, mode); err != nil {
+		return err
+	}
+	fs.attrs[name] = attr
+	return nil
+}
+
+func (fs *Filesystem) writeUpper(name string, data []byte) error {
+	f, err := fs.upper.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
+
+// copyUpTree copies name and everything below it into the ramfs.
+func (fs *Filesystem) copyUpTree(name string) error {
+	if err := fs.copyUp(name); err != nil {
+		return err
+	}
+	fi, err := fs.lstat(name)
+	if err != nil || !fi.IsDir() {
+		return err
+	}
+	children, err := fs.readDir(name)
+	if err != nil {
+		return err
+	}
+	for _, c := range children {
+		if err := fs.copyUpTree(path.Join(name, c.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepare makes sure the directory name is created in is in the ramfs.
+func (fs *Filesystem) prepare(name string) error {
+	dir := path.Dir(name)
+	fi, err := fs.lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return pathError("open", name, syscall.ENOTDIR)
+	}
+	if err := fs.copyUp(dir); err != nil {
+		return err
+	}
+	delete(fs.whiteouts, name)
+	return nil
+}
+
+// readDir lists the directory name across the layers, sorted by name.
+func (fs *Filesystem) readDir(name string) ([]os.FileInfo, error) {
+	fi, err := fs.lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, pathError("readdir", name, syscall.ENOTDIR)
+	}
+	seen := make(map[string]bool)
+	var infos []os.FileInfo
+	if fs.inUpper(name) {
+		list, err := fs.upper.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range list {
+			seen[fi.Name()] = true
+			infos = append(infos, fs.upperInfo(path.Join(name, fi.Name()), fi))
+		}
+	}
+	for i := len(fs.lowers) - 1; i >= 0; i-- {
+		l := fs.lowers[i]
+		if !below(name, l.prefix) {
+			continue
+		}
+		host, fi, ok := l.lookup(name)
+		if !ok || !fi.IsDir() {
+			continue
+		}
+		list, err := ioutil.ReadDir(host)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range list {
+			if seen[fi.Name()] || fs.hidden(path.Join(name, fi.Name())) {
+				continue
+			}
+			seen[fi.Name()] = true
+			infos = append(infos, fi)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// openFile opens name like os.OpenFile. Files of the lower layers are
+// copied into the ramfs before they are opened for writing.
+func (fs *Filesystem) openFile(name string, flag int, perm os.FileMode) (File, error) {
+	write := flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0
+	if !fs.inUpper(name) {
+		host, fi, ok := fs.lowerLookup(name)
+		switch {
+		case ok && fi.Mode()&os.ModeSymlink != 0:
+			return nil, pathError("open", name, syscall.ELOOP)
+		case ok && !write:
+			return os.Open(host)
+		case ok && fi.IsDir():
+			return nil, pathError("open", name, syscall.EISDIR)
+		case ok:
+			if err := fs.copyUp(name); err != nil {
+				return nil, err
+			}
+		case flag&os.O_CREATE != 0:
+			if err := fs.prepare(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	f, err := fs.upper.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// mkdir creates the directory name.
+func (fs *Filesystem) mkdir(name string, perm os.FileMode) error {
+	if _, err := fs.lstat(name); err == nil {
+		return pathError("mkdir", name, os.ErrExist)
+	}
+	// a directory replacing a deleted one starts out empty
+	opaque := fs.whiteouts[name]
+	if err := fs.prepare(name); err != nil {
+		return err
+	}
+	if err := fs.upper.Mkdir(name, perm); err != nil {
+		return err
+	}
+	if opaque {
+		fs.opaque[name] = true
+	}
+	return nil
+}
+
+// remove removes name, which must be a file or an empty directory. Files
+// of the lower layers are hidden by a whiteout.
+func (fs *Filesystem) remove(name string) error {
+	fi, err := fs.lstat(name)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		if children, err := fs.readDir(name); err != nil {
+			return err
+		} else if len(children) > 0 {
+			return pathError("remove", name, syscall.ENOTEMPTY)
+		}
+	}
+	heir := fs.heir(name)
+	fs.unlinked(name, heir)
+	if heir != "" {
+		// another name of the file takes over its contents
+		if err := fs.upper.Remove(heir); err != nil {
+			return err
+		}
+		delete(fs.hardlinks, heir)
+		if err := fs.upper.Rename(name, heir); err != nil {
+			return err
+		}
+		for link, inode := range fs.hardlinks {
+			if inode == name {
+				fs.hardlinks[link] = heir
+			}
+		}
+		if a, ok := fs.attrs[name]; ok {
+			fs.attrs[heir] = a
+		}
+	} else if fs.inUpper(name) {
+		if err := fs.upper.Remove(name); err != nil {
+			return err
+		}
+	}
+	if _, _, ok := fs.lowerLookup(name); ok {
+		fs.whiteouts[name] = true
+	}
+	delete(fs.attrs, name)
+	delete(fs.opaque, name)
+	delete(fs.hardlinks, name)
+	return nil
+}
+
+// heir returns the first other name of a file with hard links.
+func (fs *Filesystem) heir(name string) string {
+	heir := ""
+	for link, inode := range fs.hardlinks {
+		if inode == name && (heir == "" || link < heir) {
+			heir = link
+		}
+	}
+	return heir
+}
+
+// rename moves oldname to newname, replacing what is there.
+func (fs *Filesystem) rename(oldname, newname string) error {
+	fi, err := fs.lstat(oldname)
+	if err != nil {
+		return err
+	}
+	if oldname == newname {
+		return nil
+	}
+	if below(newname, oldname) {
+		return pathError("rename", newname, syscall.EINVAL)
+	}
+	if _, err := fs.lstat(newname); err == nil {
+		if err := fs.remove(newname); err != nil {
+			return err
+		}
+	}
+	if err := fs.copyUpTree(oldname); err != nil {
+		return err
+	}
+	if err := fs.prepare(newname); err != nil {
+		return err
+	}
+	_, _, lowerOld := fs.lowerLookup(oldname)
+	if err := fs.upper.Rename(oldname, newname); err != nil {
+		return err
+	}
+	if lowerOld {
+		fs.whiteouts[oldname] = true
+	}
+	if fi.IsDir() {
+		// all of it was copied, whatever the lower layers have there is gone
+		fs.opaque[newname] = true
+	}
+	move := func(name string) string {
+		if below(name, oldname) {
+			return newname + strings.TrimPrefix(name, oldname)
+		}
+		return name
+	}
+	attrs := make(map[string]*Attr)
+	for name, a := range fs.attrs {
+		attrs[move(name)] = a
+	}
+	fs.attrs = attrs
+	hardlinks := make(map[string]string)
+	for link, inode := range fs.hardlinks {
+		hardlinks[move(link)] = move(inode)
+	}
+	fs.hardlinks = hardlinks
+	for f := range fs.files {
+		if f.gone == nil {
+			f.path = move(f.path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+// +build linux darwin freebsd
+
+package vfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// owner returns the uid and gid of a host file.
+func owner(fi os.FileInfo) (int, int, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
+
+// rdev returns the device number of a host device node, in the host's
+// encoding.
+func rdev(fi os.FileInfo) uint64 {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return uint64(st.Rdev)
+}
@@ -0,0 +1,299 @@
+package vfs
+
+import (
+	"os"
+	"path"
+	"time"
+)
+
+// Dev is the device number every file of the filesystem reports.
+const Dev = 0x801
+
+// Info is what the stat syscalls report about a file.
+type Info struct {
+	Name     string
+	Mode     os.FileMode
+	Size     int64
+	Ino      uint64
+	Nlink    int
+	Uid, Gid int
+	// Rdev is the device number of a device node, as Mkdev encodes it.
+	Rdev                uint64
+	Atime, Mtime, Ctime time.Time
+}
+
+// Mkdev encodes a device number like glibc's makedev.
+func Mkdev(major, minor uint32) uint64 {
+	ma, mi := uint64(major), uint64(minor)
+	return mi&0xff | (ma&0xfff)<<8 | (mi&^0xff)<<12 | (ma&^0xfff)<<32
+}
+
+// Major returns the major number of a device number.
+func Major(dev uint64) uint32 {
+	return uint32(dev>>8&0xfff | dev>>32&^0xfff)
+}
+
+// Minor returns the minor number of a device number.
+func Minor(dev uint64) uint32 {
+	return uint32(dev&0xff | dev>>12&^0xff)
+}
+
+// file type bits of st_mode
+const (
+	sIFIFO  = 0010000
+	sIFCHR  = 0020000
+	sIFDIR  = 0040000
+	sIFBLK  = 0060000
+	sIFREG  = 0100000
+	sIFLNK  = 0120000
+	sIFSOCK = 0140000
+)
+
+// UnixMode converts a mode to the st_mode bits.
+func UnixMode(m os.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	switch {
+	case m&os.ModeDir != 0:
+		mode |= sIFDIR
+	case m&os.ModeSymlink != 0:
+		mode |= sIFLNK
+	case m&os.ModeNamedPipe != 0:
+		mode |= sIFIFO
+	case m&os.ModeSocket != 0:
+		mode |= sIFSOCK
+	case m&os.ModeCharDevice != 0:
+		mode |= sIFCHR
+	case m&os.ModeDevice != 0:
+		mode |= sIFBLK
+	default:
+		mode |= sIFREG
+	}
+	if m&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	return mode
+}
+
+// FileMode converts the permission bits of st_mode to a mode.
+func FileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// InfoOf describes a file outside of the filesystem, such as the host's
+// stdin.
+func InfoOf(fi os.FileInfo) *Info {
+	return &Info{
+		Name:  fi.Name(),
+		Mode:  fi.Mode(),
+		Size:  fi.Size(),
+		Nlink: 1,
+		Atime: fi.ModTime(),
+		Mtime: fi.ModTime(),
+		Ctime: fi.ModTime(),
+	}
+}
+
+// now returns the time of the filesystem's clock.
+func (fs *Filesystem) now() time.Time {
+	if fs.Clock == nil {
+		return time.Now()
+	}
+	return fs.Clock()
+}
+
+// ino returns the inode number of the file at p, which it keeps until it
+// is deleted.
+func (fs *Filesystem) ino(p string) uint64 {
+	a := fs.attr(p)
+	if a.Ino == 0 {
+		fs.nextIno++
+		a.Ino = fs.nextIno
+	}
+	return a.Ino
+}
+
+// created sets the times of the new file at p and its directory.
+func (fs *Filesystem) created(p string) {
+	now := fs.now()
+	a := fs.attr(p)
+	a.Atime, a.ModTime, a.Ctime = now, now, now
+	fs.changed(path.Dir(p), true)
+}
+
+// changed updates the times of the file at p after its attributes, or
+// with data also its contents, changed.
+func (fs *Filesystem) changed(p string, data bool) {
+	now := fs.now()
+	a := fs.attr(p)
+	a.Ctime = now
+	if data {
+		a.ModTime = now
+	}
+}
+
+// info describes the file at p.
+func (fs *Filesystem) info(p string) (*Info, error) {
+	fi, err := fs.lstat(p)
+	if err != nil {
+		return nil, err
+	}
+	a := fs.attr(p)
+	info := &Info{
+		Name:  path.Base(p),
+		Mode:  fi.Mode(),
+		Size:  fi.Size(),
+		Ino:   fs.ino(p),
+		Nlink: fs.nlink(p),
+		Uid:   a.Uid,
+		Gid:   a.Gid,
+		Rdev:  a.Rdev,
+		Mtime: a.ModTime,
+		Atime: a.Atime,
+		Ctime: a.Ctime,
+	}
+	if info.Mtime.IsZero() {
+		info.Mtime = fi.ModTime()
+	}
+	if info.Atime.IsZero() {
+		info.Atime = info.Mtime
+	}
+	if info.Ctime.IsZero() {
+		info.Ctime = info.Mtime
+	}
+	if fi.IsDir() {
+		// . and the .. of every subdirectory
+		info.Nlink = 2
+		children, _ := fs.readDir(p)
+		for _, c := range children {
+			if c.IsDir() {
+				info.Nlink++
+			}
+		}
+	}
+	return info, nil
+}
+
+// nlink returns the number of names of the file at p.
+func (fs *Filesystem) nlink(p string) int {
+	n := 1
+	for _, inode := range fs.hardlinks {
+		if inode == p {
+			n++
+		}
+	}
+	return n
+}
+
+// Info describes name. A symlink at its end is only followed with
+// follow set.
+func (fs *Filesystem) Info(name string, follow bool) (*Info, error) {
+	p, err := fs.lookup(name, follow)
+	if err != nil {
+		return nil, err
+	}
+	return fs.info(p)
+}
+
+// file is an open file of the filesystem, which knows its path to
+// describe itself and to update its times. The filesystem keeps the path
+// current when the file is renamed.
+type file struct {
+	File
+	fs   *Filesystem
+	path string
+	// gone describes the file once its last name was removed
+	gone *Info
+}
+
+// unlinked updates the open files at p, which is being removed. They move
+// to heir, or keep what they were without a name if it is empty.
+func (fs *Filesystem) unlinked(p, heir string) {
+	for f := range fs.files {
+		if f.gone != nil || f.path != p {
+			continue
+		}
+		if heir != "" {
+			f.path = heir
+			continue
+		}
+		info, err := fs.info(p)
+		if err != nil {
+			continue
+		}
+		info.Nlink = 0
+		f.gone = info
+	}
+}
+
+// Name returns the path of the file in the guest.
+func (f *file) Name() string {
+	return f.path
+}
+
+// Info describes the file.
+func (f *file) Info() (*Info, error) {
+	if f.gone != nil {
+		info := *f.gone
+		return &info, nil
+	}
+	return f.fs.info(f.path)
+}
+
+// Chmod sets the mode of the file.
+func (f *file) Chmod(mode os.FileMode) error {
+	if f.gone != nil {
+		f.gone.Mode = f.gone.Mode&os.ModeType | mode&^os.ModeType
+		f.gone.Ctime = f.fs.now()
+		return nil
+	}
+	return f.fs.chmod(f.path, mode)
+}
+
+// Chown sets the owner of the file.
+func (f *file) Chown(uid, gid int) error {
+	if f.gone != nil {
+		f.gone.Uid, f.gone.Gid = uid, gid
+		f.gone.Ctime = f.fs.now()
+		return nil
+	}
+	return f.fs.chown(f.path, uid, gid)
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	if n > 0 && f.gone == nil {
+		f.fs.changed(f.path, true)
+	}
+	return n, err
+}
+
+func (f *file) Truncate(size int64) error {
+	if err := f.File.Truncate(size); err != nil {
+		return err
+	}
+	if f.gone == nil {
+		f.fs.changed(f.path, true)
+	}
+	return nil
+}
+
+func (f *file) Close() error {
+	delete(f.fs.files, f)
+	return f.File.Close()
+}
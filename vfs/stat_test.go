@@ -0,0 +1,96 @@
+package vfs
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMkdev(t *testing.T) {
+	tests := []struct {
+		major, minor uint32
+		dev          uint64
+	}{
+		{1, 3, 0x103},
+		{8, 1, Dev},
+		{136, 0, 0x8800},
+		{259, 300, 0x11032c},
+	}
+	for _, test := range tests {
+		if dev := Mkdev(test.major, test.minor); dev != test.dev {
+			t.Errorf("Mkdev(%d, %d) = %#x, want %#x", test.major, test.minor, dev, test.dev)
+		}
+		if Major(test.dev) != test.major || Minor(test.dev) != test.minor {
+			t.Errorf("%#x is %d:%d, want %d:%d", test.dev, Major(test.dev), Minor(test.dev), test.major, test.minor)
+		}
+	}
+}
+
+func TestUnixMode(t *testing.T) {
+	tests := []struct {
+		mode os.FileMode
+		want uint32
+	}{
+		{0644, 0100644},
+		{os.ModeDir | os.ModeSticky | 0777, 041777},
+		{os.ModeSymlink | 0777, 0120777},
+		{os.ModeNamedPipe | 0600, 010600},
+		{os.ModeSocket | 0755, 0140755},
+		{os.ModeDevice | os.ModeCharDevice | 0666, 020666},
+		{os.ModeDevice | 0660, 060660},
+		{os.ModeSetuid | 0755, 0104755},
+	}
+	for _, test := range tests {
+		if got := UnixMode(test.mode); got != test.want {
+			t.Errorf("UnixMode(%v) = %o, want %o", test.mode, got, test.want)
+		}
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	for _, mode := range []uint32{0644, 04755, 02750, 01777, 0} {
+		if got := UnixMode(FileMode(mode)) &^ sIFREG; got != mode {
+			t.Errorf("FileMode(%o) converts back to %o", mode, got)
+		}
+	}
+}
+
+func TestOpenFileFollows(t *testing.T) {
+	fs := New()
+	if err := fs.WriteFile("/a", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	of := f.(*file)
+	if err := fs.Rename("/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+	if of.Name() != "/b" {
+		t.Fatalf("renamed file is at %q", of.Name())
+	}
+	if err := fs.Link("/b", "/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("/b"); err != nil {
+		t.Fatal(err)
+	}
+	if of.Name() != "/c" {
+		t.Fatalf("file is at %q after its first name was removed", of.Name())
+	}
+	if err := fs.Remove("/c"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := of.Info()
+	if err != nil || info.Nlink != 0 || info.Size != 1 {
+		t.Fatalf("unlinked file: %+v, %v", info, err)
+	}
+	if err := of.Chmod(0600); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := of.Info(); info.Mode != 0600 {
+		t.Fatalf("unlinked file has mode %v", info.Mode)
+	}
+}
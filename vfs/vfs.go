@@ -0,0 +1,570 @@
+// Package vfs is the guest filesystem. It layers a ramfs, which takes
+// every change, over read-only host directories, and keeps what a ramfs
+// can't hold (owners, times, symlinks and hard links) next to it.
+package vfs
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/felberj/ramfs"
+	"github.com/pkg/errors"
+)
+
+// MaxSymlinks is how many symlinks a path may go through, as on Linux.
+const MaxSymlinks = 40
+
+// File is an open guest file.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Truncate(int64) error
+	Readdir(n int) ([]os.FileInfo, error)
+}
+
+// Attr holds the attributes of a guest file the ramfs doesn't store.
+type Attr struct {
+	Uid, Gid int
+	ModTime  time.Time
+	// Atime and Ctime default to ModTime while they are zero.
+	Atime, Ctime time.Time
+	// Ino is the inode number, assigned on the first stat.
+	Ino uint64
+	// Link is the target of a symlink, empty for other files.
+	Link string
+	// Type holds the type bits of device nodes, fifos and sockets, which
+	// the ramfs stores as empty files, and Rdev the device number.
+	Type os.FileMode
+	Rdev uint64
+}
+
+// Filesystem is a copy-on-write overlay. Files of the lower layers are
+// looked up when the guest uses them and copied into the ramfs before
+// they change; deleting them leaves a whiteout.
+//
+// The ramfs stores symlinks and the extra names of hard linked files as
+// empty files, the link targets are kept here.
+type Filesystem struct {
+	upper     *ramfs.Filesystem
+	lowers    []lower
+	whiteouts map[string]bool
+	// directories that hide the lower layers below them
+	opaque map[string]bool
+	attrs  map[string]*Attr
+	// extra names of files, to the path that holds their contents
+	hardlinks map[string]string
+	nextIno   uint64
+	// open files, which follow their file when it is renamed or removed
+	files map[*file]bool
+
+	// Clock returns the time files are created and changed at. It
+	// defaults to the host's time.
+	Clock func() time.Time
+}
+
+// New returns an empty filesystem.
+func New() *Filesystem {
+	fs := &Filesystem{
+		upper:     ramfs.New(),
+		whiteouts: make(map[string]bool),
+		opaque:    make(map[string]bool),
+		attrs:     make(map[string]*Attr),
+		hardlinks: make(map[string]string),
+		files:     make(map[*file]bool),
+	}
+	// everyone may look up files, whatever the ramfs defaults to
+	fs.upper.Chmod("/", 0755)
+	return fs
+}
+
+// clean makes name absolute, which is how the layers are keyed.
+func clean(name string) string {
+	return path.Clean("/" + name)
+}
+
+func pathError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// Mount adds the host directory dir as a read-only layer at prefix,
+// above the layers mounted before. dir is never written.
+func (fs *Filesystem) Mount(dir, prefix string) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(abs); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return errors.Errorf("%q is not a directory", dir)
+	}
+	prefix = clean(prefix)
+	if err := fs.MkdirAll(prefix, 0755); err != nil {
+		return err
+	}
+	fs.lowers = append(fs.lowers, lower{abs, prefix})
+	return nil
+}
+
+// Resolve returns the path name refers to once its symlinks are
+// followed. The last element is only followed with follow set.
+func (fs *Filesystem) Resolve(name string, follow bool) (string, error) {
+	return fs.Walk(name, follow, nil)
+}
+
+// Walk is Resolve, calling search with every directory a name is looked
+// up in, the ones inside symlink targets included. An error of search
+// ends the walk.
+func (fs *Filesystem) Walk(name string, follow bool, search func(dir string) error) (string, error) {
+	// ".." is resolved after the symlink before it, so don't clean name
+	parts := strings.Split(name, "/")
+	resolved := "/"
+	for links := 0; len(parts) > 0; {
+		part := parts[0]
+		parts = parts[1:]
+		if part == "" {
+			continue
+		}
+		if search != nil {
+			if err := search(resolved); err != nil {
+				return "", err
+			}
+		}
+		switch part {
+		case ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+		next := path.Join(resolved, part)
+		a := fs.rawAttr(next)
+		if a == nil || a.Link == "" || len(parts) == 0 && !follow {
+			resolved = next
+			continue
+		}
+		if links++; links > MaxSymlinks {
+			return "", pathError("open", name, syscall.ELOOP)
+		}
+		if path.IsAbs(a.Link) {
+			resolved = "/"
+		}
+		parts = append(strings.Split(a.Link, "/"), parts...)
+	}
+	return resolved, nil
+}
+
+// inode returns the path that holds the contents of a resolved name.
+func (fs *Filesystem) inode(name string) string {
+	if inode, ok := fs.hardlinks[name]; ok {
+		return inode
+	}
+	return name
+}
+
+// lookup resolves name to the path holding its contents.
+func (fs *Filesystem) lookup(name string, follow bool) (string, error) {
+	p, err := fs.Resolve(name, follow)
+	if err != nil {
+		return "", err
+	}
+	return fs.inode(p), nil
+}
+
+// Attr returns the attributes of name, without following a symlink at
+// its end, or nil if none were recorded.
+func (fs *Filesystem) Attr(name string) *Attr {
+	p, err := fs.lookup(name, false)
+	if err != nil {
+		return nil
+	}
+	return fs.rawAttr(p)
+}
+
+// Stat returns the file info of name.
+func (fs *Filesystem) Stat(name string) (os.FileInfo, error) {
+	p, err := fs.lookup(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return fs.lstat(p)
+}
+
+// Lstat returns the file info of name without following a symlink at its
+// end.
+func (fs *Filesystem) Lstat(name string) (os.FileInfo, error) {
+	p, err := fs.Resolve(name, false)
+	if err != nil {
+		return nil, err
+	}
+	return fs.lstat(p)
+}
+
+// Nlink returns the number of names of the file name.
+func (fs *Filesystem) Nlink(name string) int {
+	p, err := fs.lookup(name, false)
+	if err != nil {
+		return 0
+	}
+	return fs.nlink(p)
+}
+
+// ReadDir lists the directory name across the layers, sorted by name.
+func (fs *Filesystem) ReadDir(name string) ([]os.FileInfo, error) {
+	p, err := fs.Resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return fs.readDir(p)
+}
+
+// Open opens name for reading.
+func (fs *Filesystem) Open(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates name.
+func (fs *Filesystem) Create(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// OpenFile opens name like os.OpenFile. With syscall.O_NOFOLLOW, a
+// symlink at the end of name is an error.
+func (fs *Filesystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	follow := flag&syscall.O_NOFOLLOW == 0
+	p, err := fs.lookup(name, follow)
+	if err != nil {
+		return nil, err
+	}
+	if !follow {
+		if a := fs.rawAttr(p); a != nil && a.Link != "" {
+			return nil, pathError("open", name, syscall.ELOOP)
+		}
+	}
+	_, err = fs.lstat(p)
+	exists := err == nil
+	f, err := fs.openFile(p, flag&^syscall.O_NOFOLLOW, perm)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		fs.created(p)
+	} else if flag&os.O_TRUNC != 0 {
+		fs.changed(p, true)
+	}
+	of := &file{File: f, fs: fs, path: p}
+	fs.files[of] = true
+	return of, nil
+}
+
+// MapFile maps the host file host to guest, creating its directory.
+func (fs *Filesystem) MapFile(host, guest string) error {
+	guest = clean(guest)
+	if err := fs.MkdirAll(path.Dir(guest), 0755); err != nil {
+		return err
+	}
+	p, err := fs.Resolve(guest, false)
+	if err != nil {
+		return err
+	}
+	if _, err := fs.lstat(p); err == nil {
+		if err := fs.remove(p); err != nil {
+			return err
+		}
+	}
+	if err := fs.prepare(p); err != nil {
+		return err
+	}
+	if err := fs.upper.MapFile(host, p); err != nil {
+		return err
+	}
+	fs.created(p)
+	return nil
+}
+
+// Mkdir creates the directory name.
+func (fs *Filesystem) Mkdir(name string, perm os.FileMode) error {
+	p, err := fs.Resolve(name, false)
+	if err != nil {
+		return err
+	}
+	if err := fs.mkdir(p, perm); err != nil {
+		return err
+	}
+	fs.created(p)
+	return nil
+}
+
+// MkdirAll creates a directory and the parents it is missing.
+func (fs *Filesystem) MkdirAll(name string, perm os.FileMode) error {
+	dir := "/"
+	for _, part := range strings.Split(clean(name), "/") {
+		if part == "" {
+			continue
+		}
+		dir = path.Join(dir, part)
+		if fi, err := fs.Stat(dir); err == nil {
+			if !fi.IsDir() {
+				return errors.Errorf("%q is not a directory", dir)
+			}
+			continue
+		}
+		if err := fs.Mkdir(dir, perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteFile creates name with data and mode perm.
+func (fs *Filesystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	f, err := fs.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return fs.Chmod(name, perm)
+}
+
+// Chmod sets the mode of name.
+func (fs *Filesystem) Chmod(name string, mode os.FileMode) error {
+	p, err := fs.lookup(name, true)
+	if err != nil {
+		return err
+	}
+	return fs.chmod(p, mode)
+}
+
+// chmod sets the mode of the file at p.
+func (fs *Filesystem) chmod(p string, mode os.FileMode) error {
+	if err := fs.copyUp(p); err != nil {
+		return err
+	}
+	if err := fs.upper.Chmod(p, mode); err != nil {
+		return err
+	}
+	fs.changed(p, false)
+	return nil
+}
+
+// chown sets the owner of the file at p.
+func (fs *Filesystem) chown(p string, uid, gid int) error {
+	if _, err := fs.lstat(p); err != nil {
+		return err
+	}
+	a := fs.attr(p)
+	a.Uid, a.Gid = uid, gid
+	fs.changed(p, false)
+	return nil
+}
+
+// Chown sets the owner of name.
+func (fs *Filesystem) Chown(name string, uid, gid int) error {
+	p, err := fs.lookup(name, true)
+	if err != nil {
+		return err
+	}
+	return fs.chown(p, uid, gid)
+}
+
+// Lchown sets the owner of name without following a symlink at its end.
+func (fs *Filesystem) Lchown(name string, uid, gid int) error {
+	p, err := fs.lookup(name, false)
+	if err != nil {
+		return err
+	}
+	return fs.chown(p, uid, gid)
+}
+
+func (fs *Filesystem) chtimes(p string, atime, mtime time.Time) error {
+	if _, err := fs.lstat(p); err != nil {
+		return err
+	}
+	a := fs.attr(p)
+	if !atime.IsZero() {
+		a.Atime = atime
+	}
+	if !mtime.IsZero() {
+		a.ModTime = mtime
+	}
+	a.Ctime = fs.now()
+	return nil
+}
+
+// Chtimes sets the access and modification times of name, like
+// os.Chtimes. A zero time is left as it is.
+func (fs *Filesystem) Chtimes(name string, atime, mtime time.Time) error {
+	p, err := fs.lookup(name, true)
+	if err != nil {
+		return err
+	}
+	return fs.chtimes(p, atime, mtime)
+}
+
+// Lchtimes is Chtimes without following a symlink at the end of name.
+func (fs *Filesystem) Lchtimes(name string, atime, mtime time.Time) error {
+	p, err := fs.lookup(name, false)
+	if err != nil {
+		return err
+	}
+	return fs.chtimes(p, atime, mtime)
+}
+
+// Symlink creates name as a symlink to target.
+func (fs *Filesystem) Symlink(target, name string) error {
+	p, err := fs.Resolve(name, false)
+	if err != nil {
+		return err
+	}
+	if _, err := fs.lstat(p); err == nil {
+		return pathError("symlink", name, os.ErrExist)
+	}
+	f, err := fs.openFile(p, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0777)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	fs.created(p)
+	fs.attr(p).Link = target
+	return nil
+}
+
+// Mknod creates name as a device node, fifo or socket, as the type bits
+// of mode tell. rdev is the device number of a device.
+func (fs *Filesystem) Mknod(name string, mode os.FileMode, rdev uint64) error {
+	p, err := fs.Resolve(name, false)
+	if err != nil {
+		return err
+	}
+	if _, err := fs.lstat(p); err == nil {
+		return pathError("mknod", name, os.ErrExist)
+	}
+	f, err := fs.openFile(p, os.O_RDWR|os.O_CREATE|os.O_EXCL, mode.Perm())
+	if err != nil {
+		return err
+	}
+	f.Close()
+	fs.created(p)
+	a := fs.attr(p)
+	a.Type = mode & os.ModeType
+	a.Rdev = rdev
+	return nil
+}
+
+// Readlink returns the target of the symlink name.
+func (fs *Filesystem) Readlink(name string) (string, error) {
+	if a := fs.Attr(name); a != nil && a.Link != "" {
+		return a.Link, nil
+	}
+	return "", pathError("readlink", name, syscall.EINVAL)
+}
+
+// Link makes newname another name of the file oldname, which must not be
+// a directory. A symlink at the end of oldname is not followed.
+func (fs *Filesystem) Link(oldname, newname string) error {
+	inode, err := fs.lookup(oldname, false)
+	if err != nil {
+		return err
+	}
+	fi, err := fs.lstat(inode)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return pathError("link", oldname, syscall.EPERM)
+	}
+	p, err := fs.Resolve(newname, false)
+	if err != nil {
+		return err
+	}
+	if _, err := fs.lstat(p); err == nil {
+		return pathError("link", newname, os.ErrExist)
+	}
+	// the contents have to be in the ramfs to be shared
+	if err := fs.copyUp(inode); err != nil {
+		return err
+	}
+	f, err := fs.openFile(p, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	fs.hardlinks[p] = inode
+	fs.changed(inode, false)
+	fs.changed(path.Dir(p), true)
+	return nil
+}
+
+// Remove removes name, which must be a file or an empty directory. A
+// symlink at its end is removed itself.
+func (fs *Filesystem) Remove(name string) error {
+	p, err := fs.Resolve(name, false)
+	if err != nil {
+		return err
+	}
+	inode := fs.inode(p)
+	if err := fs.remove(p); err != nil {
+		return err
+	}
+	if inode != p {
+		fs.changed(inode, false)
+	}
+	fs.changed(path.Dir(p), true)
+	return nil
+}
+
+// RemoveAll removes name and everything below it. A missing name is not
+// an error.
+func (fs *Filesystem) RemoveAll(name string) error {
+	fi, err := fs.Lstat(name)
+	if err != nil {
+		return nil
+	}
+	if fi.IsDir() {
+		children, err := fs.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		for _, c := range children {
+			if err := fs.RemoveAll(path.Join(name, c.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return fs.Remove(name)
+}
+
+// Rename moves oldname to newname, along with everything below it.
+// Symlinks at their ends are moved or replaced themselves.
+func (fs *Filesystem) Rename(oldname, newname string) error {
+	oldp, err := fs.Resolve(oldname, false)
+	if err != nil {
+		return err
+	}
+	newp, err := fs.Resolve(newname, false)
+	if err != nil {
+		return err
+	}
+	if err := fs.rename(oldp, newp); err != nil {
+		return err
+	}
+	if oldp != newp {
+		fs.changed(fs.inode(newp), false)
+		fs.changed(path.Dir(oldp), true)
+		fs.changed(path.Dir(newp), true)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package vfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLowerLookup(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "etc", "passwd"), []byte("root:x:0:0::/root:/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// a link out of the lower layer must not be followed on the host
+	if err := os.Symlink("/", filepath.Join(dir, "host")); err != nil {
+		t.Fatal(err)
+	}
+	l := lower{dir, "/opt/root"}
+	if host, fi, ok := l.lookup("/opt/root/etc/passwd"); !ok || host != filepath.Join(dir, "etc", "passwd") || !fi.Mode().IsRegular() {
+		t.Fatalf("lookup of a file: %q, %v", host, ok)
+	}
+	if _, fi, ok := l.lookup("/opt/root/host"); !ok || fi.Mode()&os.ModeSymlink == 0 {
+		t.Fatal("symlink not reported as such")
+	}
+	if _, _, ok := l.lookup("/opt/root/host/etc"); ok {
+		t.Fatal("followed a host symlink")
+	}
+	if _, _, ok := l.lookup("/opt/root/missing"); ok {
+		t.Fatal("found a missing file")
+	}
+}
+
+func TestHidden(t *testing.T) {
+	fs := &Filesystem{
+		whiteouts: map[string]bool{"/etc/shadow": true, "/var": true},
+		opaque:    map[string]bool{"/tmp": true},
+	}
+	for name, want := range map[string]bool{
+		"/etc":            false,
+		"/etc/passwd":     false,
+		"/etc/shadow":     true,
+		"/var/log/syslog": true,
+		"/tmp":            false,
+		"/tmp/x":          true,
+	} {
+		if got := fs.hidden(name); got != want {
+			t.Errorf("hidden(%q) = %v", name, got)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	fs := New()
+	fs.attrs["/lib"] = &Attr{Link: "usr/lib"}
+	fs.attrs["/usr/lib/libc.so.6"] = &Attr{Link: "libc-2.27.so"}
+	fs.attrs["/usr/bin/python"] = &Attr{Link: "/usr/bin/python3"}
+	fs.attrs["/loop/a"] = &Attr{Link: "b"}
+	fs.attrs["/loop/b"] = &Attr{Link: "a"}
+	for _, c := range []struct {
+		name   string
+		follow bool
+		want   string
+	}{
+		{"/lib/libc.so.6", true, "/usr/lib/libc-2.27.so"},
+		{"/lib/libc.so.6", false, "/usr/lib/libc.so.6"},
+		{"/lib", false, "/lib"},
+		{"/lib/../bin", true, "/usr/bin"},
+		{"/usr/bin/python", true, "/usr/bin/python3"},
+		{"etc//passwd", true, "/etc/passwd"},
+	} {
+		got, err := fs.Resolve(c.name, c.follow)
+		if err != nil || got != c.want {
+			t.Errorf("Resolve(%q, %v) = %q, %v; want %q", c.name, c.follow, got, err, c.want)
+		}
+	}
+	if _, err := fs.Resolve("/loop/a", true); err == nil {
+		t.Error("resolved a symlink loop")
+	}
+	if got, err := fs.Resolve("/loop/a", false); err != nil || got != "/loop/a" {
+		t.Errorf("Resolve of a loop without following = %q, %v", got, err)
+	}
+}
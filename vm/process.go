@@ -11,6 +11,8 @@ type Process struct {
 	Executable  string
 	Args        []string
 	Environment []string
+	// Seed starts the guest's random stream, see binemu.ExecConfig.
+	Seed int64
 
 	vm   *VM
 	cpu  cpu.Cpu
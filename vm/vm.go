@@ -1,13 +1,12 @@
 package vm
 
 import (
-	"io"
 	"os"
 	"path"
 
 	"github.com/felberj/binemu/arch"
 	"github.com/felberj/binemu/loader"
-	"github.com/felberj/ramfs"
+	"github.com/felberj/binemu/vfs"
 	"github.com/pkg/errors"
 
 	pb "github.com/felberj/binemu/proto_gen"
@@ -15,18 +14,36 @@ import (
 
 // VM is the environment the binary should be emulated in.
 type VM struct {
-	Fs         *ramfs.Filesystem
+	Fs         *vfs.Filesystem
 	currentPid int
 }
 
 // LoadFiles loads the files from the config into the filesytem of the environment.
 func (v *VM) LoadFiles(c *pb.Config) error {
+	for _, r := range c.Rootfs {
+		f := path.Join(c.ConfigDir, r.HostPath)
+		if err := v.Fs.Import(f, r.GuestPath); err != nil {
+			return errors.Wrapf(err, "unable to import %q into the guest at %q", f, r.GuestPath)
+		}
+	}
+	for _, l := range c.Symlinks {
+		if err := v.Fs.MkdirAll(path.Dir(l.GuestPath), 0755); err != nil {
+			return errors.Wrapf(err, "unable to create the directory of %q", l.GuestPath)
+		}
+		// like files, links replace what the rootfs has there
+		if fi, err := v.Fs.Lstat(l.GuestPath); err == nil && !fi.IsDir() {
+			v.Fs.Remove(l.GuestPath)
+		}
+		if err := v.Fs.Symlink(l.Target, l.GuestPath); err != nil {
+			return errors.Wrapf(err, "unable to create symlink %q to %q", l.GuestPath, l.Target)
+		}
+	}
 	for _, p := range c.Files {
 		f := path.Join(c.ConfigDir, p.HostPath)
 		if err := v.Fs.MapFile(f, p.GuestPath); err != nil {
-			return errors.Wrapf(err, "unable to load file %q into ramfs to %q", f, p.GuestPath)
+			return errors.Wrapf(err, "unable to load file %q into the guest at %q", f, p.GuestPath)
 		}
-		if err := v.Fs.Chmod(p.GuestPath, os.FileMode(p.Mode)); err != nil {
+		if err := v.Fs.Chmod(p.GuestPath, vfs.FileMode(uint32(p.Mode))); err != nil {
 			return errors.Wrapf(err, "unable to chmod %q", p.GuestPath)
 		}
 	}
@@ -36,9 +53,9 @@ func (v *VM) LoadFiles(c *pb.Config) error {
 // Process creates a new process for the provided executable.
 // - create unicorn instance
 // - prepare memory and kernel for the process
-// - load loader into virtual machine (if required)
-// If a loader is required, the binary is written to the filesystem and the entry point
-// it set to the loader.
+// - copy the loader into the virtual machine (if required)
+// If a loader is required and the filesystem lacks the interpreter the binary names,
+// the loader from the config is put there.
 func (v *VM) Process(c *pb.Config, exec string, args, envornment []string) (*Process, error) {
 	exe, err := os.Open(exec)
 	if err != nil {
@@ -49,40 +66,23 @@ func (v *VM) Process(c *pb.Config, exec string, args, envornment []string) (*Pro
 	if err != nil {
 		return nil, err
 	}
-	if l.Interp() != "" {
-		if c.Loader == "" {
-			return nil, errors.New("the binary is interp, but no loader in config")
-		}
-		// copy the binary into the virual machine
-		vpath := path.Join("/bin", path.Base(exec))
-		vexe, err := v.Fs.Create(vpath)
-		if err != nil {
-			return nil, errors.Wrapf(err, "unable to open virtual file")
-		}
-		defer vexe.Close()
-		exe.Seek(0, 0)
-		if _, err := io.Copy(vexe, exe); err != nil {
-			return nil, err
-		}
-		ldargs := []string{"ld", vpath}
-		ldargs = append(ldargs, args...)
-		args = ldargs
-		exec = path.Join(c.ConfigDir, c.Loader)
-		exe, err = os.Open(exec)
-		if err != nil {
-			return nil, errors.Wrapf(err, "unable to open loader")
-		}
-		defer exe.Close()
-		l, err = loader.Loader(exe)
-		if err != nil {
-			return nil, err
+	// the kernel maps the interpreter from the guest filesystem
+	if interp := l.Interp(); interp != "" && !c.BuiltinLinker {
+		if _, err := v.Fs.Stat(interp); err != nil {
+			if c.Loader == "" {
+				return nil, errors.Errorf("the binary needs %q, but it is not in the filesystem and no loader in config", interp)
+			}
+			f := path.Join(c.ConfigDir, c.Loader)
+			if err := v.Fs.MapFile(f, interp); err != nil {
+				return nil, errors.Wrapf(err, "unable to load loader %q into the guest at %q", f, interp)
+			}
 		}
 	}
 	a, os, err := arch.GetArch(l.Arch(), c.Kernel)
 	if err != nil {
 		return nil, err
 	}
-	cpu, err := a.Cpu.New()
+	cpu, err := a.Cpu.NewWithOrder(l.ByteOrder())
 	if err != nil {
 		return nil, err
 	}
@@ -100,6 +100,7 @@ func (v *VM) Process(c *pb.Config, exec string, args, envornment []string) (*Pro
 		Executable:  exec,
 		Args:        args,
 		Environment: envornment,
+		Seed:        c.Seed,
 		cpu:         cpu,
 		vm:          v,
 		os:          os,
@@ -111,6 +112,6 @@ func (v *VM) Process(c *pb.Config, exec string, args, envornment []string) (*Pro
 // NewVM creates a new virtual environment to run binaries in.
 func NewVM() *VM {
 	return &VM{
-		Fs: ramfs.New(),
+		Fs: vfs.New(),
 	}
 }